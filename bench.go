@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/router"
+	"github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+)
+
+var benchCommand = &cli.Command{
+	Name:  "bench",
+	Usage: "Generates a find workload against a target and reports latency percentiles",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "target",
+			Usage:    "Base URL of the target to load test, e.g. a backend or another indexstar",
+			Required: true,
+		},
+		&cli.Float64Flag{
+			Name:  "rate",
+			Usage: "Requests per second",
+			Value: 10,
+		},
+		&cli.DurationFlag{
+			Name:  "duration",
+			Usage: "Duration of the load test",
+			Value: 30 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "Maximum number of concurrent in-flight requests",
+			Value: 16,
+		},
+		&cli.StringSliceFlag{
+			Name:  "hit",
+			Usage: "CID or multihash known to be resolvable by the target. Lookups of random multihashes are used as misses.",
+		},
+		&cli.Float64Flag{
+			Name:  "missRatio",
+			Usage: "Fraction of lookups for random multihashes that are not expected to resolve. Ignored if no hits are specified.",
+			Value: 0.5,
+		},
+		&cli.Float64Flag{
+			Name:  "ndjsonRatio",
+			Usage: "Fraction of lookups that request streaming NDJSON responses instead of JSON",
+			Value: 0.5,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		target, err := url.Parse(cctx.String("target"))
+		if err != nil {
+			return fmt.Errorf("invalid target: %w", err)
+		}
+		if cctx.Float64("rate") <= 0 {
+			return fmt.Errorf("rate must be positive")
+		}
+		var hits []string
+		for _, hit := range cctx.StringSlice("hit") {
+			if c, err := cid.Decode(hit); err == nil {
+				hits = append(hits, path.Join("/cid", c.String()))
+				continue
+			}
+			mh, err := multihash.FromB58String(hit)
+			if err != nil {
+				return fmt.Errorf("invalid hit %q: must be a cid or multihash", hit)
+			}
+			hits = append(hits, path.Join("/multihash", mh.B58String()))
+		}
+		client, err := router.NewBackendClient(router.BackendConfig{URL: target.String()})
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(cctx.Context, cctx.Duration("duration"))
+		defer cancel()
+		w := benchWorkload{
+			hits:        hits,
+			missRatio:   cctx.Float64("missRatio"),
+			ndjsonRatio: cctx.Float64("ndjsonRatio"),
+		}
+		reports := bench(ctx, client, target, w, cctx.Float64("rate"), cctx.Int("concurrency"))
+		printBenchReports(cctx.App.Writer, reports)
+		return nil
+	},
+}
+
+// benchWorkload generates a mix of find requests.
+type benchWorkload struct {
+	hits        []string
+	missRatio   float64
+	ndjsonRatio float64
+}
+
+// next generates the next request of the workload, along with the class of
+// request it belongs to, e.g. "hit/json".
+func (bw benchWorkload) next() (router.CapturedRequest, string) {
+	cr := router.CapturedRequest{
+		Time:   time.Now(),
+		Method: http.MethodGet,
+		Accept: router.MediaTypeJson,
+	}
+	encoding := "json"
+	if rand.Float64() < bw.ndjsonRatio {
+		cr.Accept = router.MediaTypeNDJson
+		encoding = "ndjson"
+	}
+	if len(bw.hits) > 0 && rand.Float64() >= bw.missRatio {
+		cr.Path = bw.hits[rand.IntN(len(bw.hits))]
+		return cr, "hit/" + encoding
+	}
+	cr.Path = path.Join("/multihash", randomMultihash().B58String())
+	return cr, "miss/" + encoding
+}
+
+func randomMultihash() multihash.Multihash {
+	buf := make([]byte, 32)
+	_, _ = crand.Read(buf)
+	mh, _ := multihash.Sum(buf, multihash.SHA2_256, -1)
+	return mh
+}
+
+// bench sends requests generated by the given workload to the target at the
+// given rate until the context is done, and returns a report per class of
+// request.
+func bench(ctx context.Context, client *http.Client, target *url.URL, w benchWorkload, rate float64, concurrency int) map[string]*replayReport {
+	reports := make(map[string]*replayReport)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return reports
+		case <-ticker.C:
+		}
+		select {
+		case <-ctx.Done():
+			return reports
+		case sem <- struct{}{}:
+		}
+		cr, class := w.next()
+		report, ok := reports[class]
+		if !ok {
+			report = &replayReport{statuses: make(map[int]int)}
+			reports[class] = report
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Requests still in flight when the load test ends are not counted.
+			status, latency, err := replayRequest(context.WithoutCancel(ctx), client, target, cr)
+			report.record(status, latency, err)
+		}()
+	}
+}
+
+func printBenchReports(w io.Writer, reports map[string]*replayReport) {
+	classes := make([]string, 0, len(reports))
+	for class := range reports {
+		classes = append(classes, class)
+	}
+	slices.Sort(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "== %s\n", class)
+		reports[class].print(w)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/router"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchWorkload_Next(t *testing.T) {
+	subject := benchWorkload{
+		hits:        []string{"/cid/fish"},
+		missRatio:   0,
+		ndjsonRatio: 1,
+	}
+	cr, class := subject.next()
+	require.Equal(t, "hit/ndjson", class)
+	require.Equal(t, "/cid/fish", cr.Path)
+	require.Equal(t, router.MediaTypeNDJson, cr.Accept)
+
+	subject = benchWorkload{ndjsonRatio: 0}
+	cr, class = subject.next()
+	require.Equal(t, "miss/json", class)
+	require.True(t, strings.HasPrefix(cr.Path, "/multihash/"))
+	require.Equal(t, router.MediaTypeJson, cr.Accept)
+	_, err := multihash.FromB58String(strings.TrimPrefix(cr.Path, "/multihash/"))
+	require.NoError(t, err)
+}
+
+func TestBench(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/multihash/") {
+			http.Error(w, "", http.StatusNotFound)
+		}
+	}))
+	defer target.Close()
+	targetURL, err := url.Parse(target.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	w := benchWorkload{hits: []string{"/cid/fish"}, missRatio: 0.5}
+	reports := bench(ctx, http.DefaultClient, targetURL, w, 100, 4)
+
+	require.NotEmpty(t, reports)
+	for class, report := range reports {
+		require.Zero(t, report.errors)
+		switch class {
+		case "hit/json":
+			require.Equal(t, []int{http.StatusOK}, keys(report.statuses))
+		case "miss/json":
+			require.Equal(t, []int{http.StatusNotFound}, keys(report.statuses))
+		default:
+			t.Fatalf("unexpected class %s", class)
+		}
+	}
+}
+
+func keys(m map[int]int) []int {
+	var ks []int
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/ipni/indexstar/mockbackend"
+)
+
+// startDevBackend serves an in-memory mock backend pre-loaded with sample
+// records on a random local port until the given context is done, and returns
+// its URL.
+func startDevBackend(ctx context.Context) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	srv := &http.Server{Handler: mockbackend.NewWithSampleData()}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorw("Dev backend stopped", "err", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	u := "http://" + l.Addr().String()
+	log.Infow("Serving from dev mock backend", "url", u, "cids", mockbackend.SampleCids, "providers", mockbackend.SampleProviders)
+	return u, nil
+}
@@ -3,404 +3,164 @@ package main
 import (
 	"bytes"
 	"context"
-	"errors"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"path"
-	"sync/atomic"
-	"time"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipni/go-libipni/find/model"
-	"github.com/ipni/indexstar/metrics"
-	"github.com/mercari/go-circuitbreaker"
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/ipni/indexstar/router"
 	"github.com/multiformats/go-multihash"
-	"go.opencensus.io/stats"
-	"go.opencensus.io/tag"
+	"github.com/urfave/cli/v2"
 )
 
 const (
-	findMethodOrig      = "http-v0"
-	findMethodDelegated = "delegated-v1"
+	findFormatJson  = "json"
+	findFormatTable = "table"
 )
 
-func (s *server) findCid(w http.ResponseWriter, r *http.Request, encrypted bool) {
-	switch r.Method {
-	case http.MethodOptions:
-		handleIPNIOptions(w, false)
-	case http.MethodGet:
-		sc := path.Base(r.URL.Path)
-		c, err := cid.Decode(sc)
+var findCommand = &cli.Command{
+	Name:      "find",
+	Usage:     "Looks up a CID or multihash across backends the same way the server would, and prints the merged results",
+	ArgsUsage: "<cid|multihash>",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  backendsArg,
+			Usage: "Backends to look up regular and providers requests on.",
+			Value: cli.NewStringSlice("https://cid.contact/"),
+		},
+		&cli.StringSliceFlag{
+			Name:  cascadeBackendsArg,
+			Usage: "Backends to cascade the lookup to, if a cascade label is specified.",
+		},
+		&cli.StringFlag{
+			Name:  "cascade",
+			Usage: "Cascade label to look up with, e.g. ipfs-dht",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Output format, either json or table",
+			Value: findFormatTable,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 1 {
+			return fmt.Errorf("exactly one cid or multihash must be specified")
+		}
+		format := cctx.String("format")
+		if format != findFormatJson && format != findFormatTable {
+			return fmt.Errorf("unknown format: %s", format)
+		}
+		regular := cctx.StringSlice(backendsArg)
+		backends := backendConfigs(router.BackendTypeRegular, regular)
+		backends = append(backends, backendConfigs(router.BackendTypeProviders, regular)...)
+		backends = append(backends, backendConfigs(router.BackendTypeCascade, cctx.StringSlice(cascadeBackendsArg))...)
+
+		resp, err := find(cctx.Context, backends, cctx.Args().First(), cctx.String("cascade"))
 		if err != nil {
-			http.Error(w, "invalid cid: "+err.Error(), http.StatusBadRequest)
-			return
+			return err
 		}
-		s.find(w, r, c.Hash(), encrypted)
-	default:
-		w.Header().Set("Allow", http.MethodGet)
-		w.Header().Add("Allow", http.MethodOptions)
-		http.Error(w, "", http.StatusMethodNotAllowed)
-		return
-	}
-}
-
-func (s *server) findMultihashSubtree(w http.ResponseWriter, r *http.Request, encrypted bool) {
-	switch r.Method {
-	case http.MethodOptions:
-		handleIPNIOptions(w, false)
-	case http.MethodGet:
-		smh := path.Base(r.URL.Path)
-		mh, err := multihash.FromB58String(smh)
-		if err != nil {
-			var hexErr error
-			mh, hexErr = multihash.FromHexString(smh)
-			if hexErr != nil {
-				http.Error(w, "invalid multihash: "+err.Error(), http.StatusBadRequest)
-				return
+		if format == findFormatJson {
+			data, err := json.MarshalIndent(resp, "", "  ")
+			if err != nil {
+				return err
 			}
+			_, err = fmt.Fprintln(cctx.App.Writer, string(data))
+			return err
 		}
-		s.find(w, r, mh, encrypted)
-	default:
-		w.Header().Set("Allow", http.MethodGet)
-		w.Header().Add("Allow", http.MethodOptions)
-		http.Error(w, "", http.StatusMethodNotAllowed)
-		return
-	}
+		return printFindTable(cctx.App.Writer, resp)
+	},
 }
 
-func (s *server) findMetadataSubtree(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", http.MethodGet)
-		http.Error(w, "", http.StatusMethodNotAllowed)
-		return
+// find looks up the given CID or multihash by routing it through an
+// in-process router over the given backends, and returns the merged response.
+func find(ctx context.Context, backends []router.BackendConfig, key, cascade string) (*model.FindResponse, error) {
+	reqURL := url.URL{Path: path.Join("/multihash", key)}
+	if _, err := cid.Decode(key); err == nil {
+		reqURL.Path = path.Join("/cid", key)
+	} else if _, err := multihash.FromB58String(key); err != nil {
+		return nil, fmt.Errorf("%s is neither a cid nor a multihash", key)
 	}
-
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
-	method := r.Method
-	reqURL := r.URL
-
-	sg := &scatterGather[Backend, []byte]{
-		backends: s.backends,
-		maxWait:  config.Server.ResultMaxWait,
+	if cascade != "" {
+		reqURL.RawQuery = url.Values{"cascade": []string{cascade}}.Encode()
 	}
 
-	// TODO: wait for the first successful response instead
-	err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*[]byte, error) {
-		// send metadata requests only to dh backends
-		if _, isDhBackend := b.(dhBackend); !isDhBackend {
-			return nil, nil
-		}
-
-		// Copy the URL from original request and override host/schema to point
-		// to the server.
-		endpoint := *reqURL
-		endpoint.Host = b.URL().Host
-		endpoint.Scheme = b.URL().Scheme
-		log := log.With("backend", endpoint.Host)
-
-		req, err := http.NewRequestWithContext(cctx, method, endpoint.String(), nil)
-		if err != nil {
-			log.Warnw("Failed to construct find-metadata backend query", "err", err)
-			return nil, err
-		}
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("Accept", mediaTypeJson)
-		if !b.Matches(req) {
-			return nil, nil
-		}
-		resp, err := s.Client.Do(req)
-		if err != nil {
-			log.Warnw("Failed to query backend for metadata", "err", err)
-			return nil, err
-		}
-		defer resp.Body.Close()
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Warnw("Failed to read find-metadata backend response", "err", err)
-			return nil, err
-		}
-
-		switch resp.StatusCode {
-		case http.StatusOK:
-			return &data, nil
-		case http.StatusNotFound:
-			return nil, nil
-		default:
-			body := string(data)
-			log := log.With("status", resp.StatusCode, "body", body)
-			log.Warn("Request processing was not successful")
-			err := fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
-			if resp.StatusCode < http.StatusInternalServerError {
-				err = circuitbreaker.MarkAsSuccess(err)
-			}
-			return nil, err
-		}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	handler, err := router.New(router.Options{
+		Context:  ctx,
+		Backends: backends,
 	})
 	if err != nil {
-		log.Errorw("Failed to scatter HTTP find metadata request", "err", err)
-		http.Error(w, "", http.StatusInternalServerError)
-		return
-	}
-
-	for md := range sg.gather(ctx) {
-		// It is ok to return the first encountered metadata. This is because
-		// metadata is uniquely identified by ValueKey (peerID + contextID).
-		// I.e. it is not possible to have different metadata records for the
-		// same ValueKey.
-		//
-		// Whereas in regular find requests it is perfectly normal to have
-		// different results returned by different IPNI instances and hence
-		// they need to be aggregated.
-		if len(md) > 0 {
-			writeJsonResponse(w, http.StatusOK, md)
-			return
-		}
-	}
-	http.Error(w, "", http.StatusNotFound)
-}
-
-func (s *server) find(w http.ResponseWriter, r *http.Request, mh multihash.Multihash, encrypted bool) {
-	decoded, err := multihash.Decode(mh)
-	if err != nil {
-		http.Error(w, "bad multihash: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-	if len(decoded.Digest) == 0 {
-		http.Error(w, "bad multihash: zero-length digest", http.StatusBadRequest)
-		return
+		return nil, err
 	}
+	req := httptest.NewRequest(http.MethodGet, reqURL.String(), nil).WithContext(ctx)
+	req.Header.Set("Accept", router.MediaTypeJson)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
 
-	acc, err := getAccepts(r)
+	body, err := io.ReadAll(rec.Body)
 	if err != nil {
-		http.Error(w, "invalid Accept header", http.StatusBadRequest)
-		return
+		return nil, err
 	}
-
-	// Use NDJSON response only when the request explicitly accepts it. Otherwise, fallback on
-	// JSON unless only unsupported media types are specified.
-	switch {
-	case acc.ndjson:
-		s.doFindNDJson(r.Context(), w, findMethodOrig, r.URL, false, mh, encrypted)
-	case acc.json || acc.any || !acc.acceptHeaderFound:
-		if s.translateNonStreaming {
-			s.doFindNDJson(r.Context(), w, findMethodOrig, r.URL, true, mh, encrypted)
-			return
-		}
-		// In a case where the request has no `Accept` header at all, be forgiving and respond with
-		// JSON.
-		rcode, resp := s.doFind(r.Context(), r.Method, findMethodOrig, r.URL, encrypted)
-		if rcode != http.StatusOK {
-			http.Error(w, "", rcode)
-			return
-		}
-		writeJsonResponse(w, http.StatusOK, resp)
+	switch rec.Code {
+	case http.StatusOK:
+		return model.UnmarshalFindResponse(body)
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("no providers found for %s", key)
 	default:
-		// The request must have  specified an explicit media type that we do not support.
-		http.Error(w, "unsupported media type", http.StatusBadRequest)
-		return
+		return nil, fmt.Errorf("lookup failed with status %d: %s", rec.Code, strings.TrimSpace(string(body)))
 	}
 }
 
-func (s *server) doFind(ctx context.Context, method, source string, reqURL *url.URL, encrypted bool) (int, []byte) {
-	start := time.Now()
-	latencyTags := []tag.Mutator{tag.Insert(metrics.Method, method)}
-	loadTags := []tag.Mutator{tag.Insert(metrics.Method, source)}
-	defer func() {
-		_ = stats.RecordWithOptions(context.Background(),
-			stats.WithTags(latencyTags...),
-			stats.WithMeasurements(metrics.FindLatency.M(float64(time.Since(start).Milliseconds()))))
-		_ = stats.RecordWithOptions(context.Background(),
-			stats.WithTags(loadTags...),
-			stats.WithMeasurements(metrics.FindLoad.M(1)))
-	}()
-
-	// sgResponse is a struct that exists to capture the backend that the response has been received from
-	type sgResponse struct {
-		rsp  *model.FindResponse
-		bknd Backend
-	}
-
-	sg := &scatterGather[Backend, sgResponse]{
-		backends: s.backends,
-		maxWait:  config.Server.ResultMaxWait,
-	}
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	var count int32
-	if err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*sgResponse, error) {
-		// forward double hashed requests to double hashed backends only and regular requests to regular backends
-		_, isDhBackend := b.(dhBackend)
-		_, isProvidersBackend := b.(providersBackend)
-		if (encrypted != isDhBackend) || isProvidersBackend {
-			return nil, nil
-		}
-
-		// Copy the URL from original request and override host/schema to point
-		// to the server.
-		endpoint := *reqURL
-		endpoint.Host = b.URL().Host
-		endpoint.Scheme = b.URL().Scheme
-		log := log.With("backend", endpoint.Host)
-
-		req, err := http.NewRequestWithContext(cctx, method, endpoint.String(), nil)
-		if err != nil {
-			log.Warnw("Failed to construct backend query", "err", err)
-			return nil, err
-		}
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("Accept", mediaTypeJson)
-
-		if !b.Matches(req) {
-			return nil, nil
-		}
-
-		resp, err := s.Client.Do(req)
-		if err != nil {
-			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				log.Debugw("Backend query ended", "err", err)
-			} else {
-				log.Warnw("Failed to query backend", "err", err)
-			}
-			return nil, err
-		}
-		defer resp.Body.Close()
-		data, err := io.ReadAll(resp.Body)
-
-		if err != nil {
-			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				log.Debugw("Reading backend response ended", "err", err)
-			} else {
-				log.Warnw("Failed to read backend response", "err", err)
-			}
-			return nil, err
-		}
-
-		switch resp.StatusCode {
-		case http.StatusOK:
-			atomic.AddInt32(&count, 1)
-			providers, err := model.UnmarshalFindResponse(data)
-			if err != nil {
-				return nil, circuitbreaker.MarkAsSuccess(err)
-			}
-			return &sgResponse{bknd: b, rsp: providers}, nil
-		case http.StatusNotFound:
-			atomic.AddInt32(&count, 1)
-			return nil, nil
-		default:
-			body := string(data)
-			log := log.With("status", resp.StatusCode, "body", body)
-			log.Warn("Request processing was not successful")
-			err := fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
-			if resp.StatusCode < http.StatusInternalServerError {
-				err = circuitbreaker.MarkAsSuccess(err)
-			}
-			return nil, err
-		}
-	}); err != nil {
-		log.Errorw("Failed to scatter HTTP find request", "err", err)
-		return http.StatusInternalServerError, nil
-	}
-
-	// TODO: stream out partial response as they come in.
-	var resp model.FindResponse
-	var rs resultStats
-	var foundRegular, foundCaskade bool
-	updateFoundFlags := func(b Backend) {
-		_, isCaskade := b.(caskadeBackend)
-		foundCaskade = foundCaskade || isCaskade
-		foundRegular = foundRegular || !isCaskade
-	}
-
-outer:
-	for r := range sg.gather(ctx) {
-		if len(r.rsp.MultihashResults) > 0 {
-			if resp.MultihashResults == nil {
-				resp.MultihashResults = r.rsp.MultihashResults
-				updateFoundFlags(r.bknd)
-			} else {
-				if !bytes.Equal(resp.MultihashResults[0].Multihash, r.rsp.MultihashResults[0].Multihash) {
-					// weird / invalid.
-					log.Warnw("conflicting results", "q", reqURL, "first", resp.MultihashResults[0].Multihash, "second", r.rsp.MultihashResults[0].Multihash)
-					return http.StatusInternalServerError, nil
-				}
-				for _, pr := range r.rsp.MultihashResults[0].ProviderResults {
-					for _, rr := range resp.MultihashResults[0].ProviderResults {
-						if bytes.Equal(rr.ContextID, pr.ContextID) && bytes.Equal([]byte(rr.Provider.ID), []byte(pr.Provider.ID)) {
-							continue outer
-						}
-					}
-					updateFoundFlags(r.bknd)
-					resp.MultihashResults[0].ProviderResults = append(resp.MultihashResults[0].ProviderResults, pr)
+// printFindTable prints the provider results of the given response as a
+// human-readable table.
+func printFindTable(w io.Writer, resp *model.FindResponse) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MULTIHASH\tPROVIDER\tPROTOCOLS\tCONTEXT ID\tADDRS")
+	for _, mhr := range resp.MultihashResults {
+		for _, pr := range mhr.ProviderResults {
+			var provider, addrs string
+			if pr.Provider != nil {
+				provider = pr.Provider.ID.String()
+				addrStrs := make([]string, 0, len(pr.Provider.Addrs))
+				for _, a := range pr.Provider.Addrs {
+					addrStrs = append(addrStrs, a.String())
 				}
+				addrs = strings.Join(addrStrs, ",")
 			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				mhr.Multihash.B58String(),
+				provider,
+				findProtocols(pr.Metadata),
+				base64.StdEncoding.EncodeToString(pr.ContextID),
+				addrs)
 		}
-
-		if len(r.rsp.EncryptedMultihashResults) > 0 {
-			if resp.EncryptedMultihashResults == nil {
-				resp.EncryptedMultihashResults = r.rsp.EncryptedMultihashResults
-				updateFoundFlags(r.bknd)
-			} else {
-				if !bytes.Equal(resp.EncryptedMultihashResults[0].Multihash, r.rsp.EncryptedMultihashResults[0].Multihash) {
-					log.Warnw("conflicting encrypted results", "q", reqURL, "first", resp.EncryptedMultihashResults[0].Multihash, "second", r.rsp.EncryptedMultihashResults[0].Multihash)
-					return http.StatusInternalServerError, nil
-				}
-				updateFoundFlags(r.bknd)
-				resp.EncryptedMultihashResults[0].EncryptedValueKeys = append(resp.EncryptedMultihashResults[0].EncryptedValueKeys, r.rsp.EncryptedMultihashResults[0].EncryptedValueKeys...)
-			}
-		}
-	}
-
-	_ = stats.RecordWithOptions(context.Background(),
-		stats.WithMeasurements(metrics.FindBackends.M(float64(atomic.LoadInt32(&count)))))
-
-	if len(resp.MultihashResults) == 0 && len(resp.EncryptedMultihashResults) == 0 {
-		latencyTags = append(latencyTags, tag.Insert(metrics.Found, "no"))
-		return http.StatusNotFound, nil
 	}
-
-	latencyTags = append(latencyTags, tag.Insert(metrics.Found, "yes"))
-	yesno := func(yn bool) string {
-		if yn {
-			return "yes"
-		}
-		return "no"
-	}
-
-	latencyTags = append(latencyTags, tag.Insert(metrics.FoundCaskade, yesno(foundCaskade)))
-	latencyTags = append(latencyTags, tag.Insert(metrics.FoundRegular, yesno(foundRegular)))
-
-	rs.observeFindResponse(&resp)
-	rs.reportMetrics(source)
-
-	// write out combined.
-	outData, err := model.MarshalFindResponse(&resp)
-	if err != nil {
-		log.Warnw("failed marshal response", "err", err)
-		return http.StatusInternalServerError, nil
-	}
-	return http.StatusOK, outData
+	return tw.Flush()
 }
 
-func handleIPNIOptions(w http.ResponseWriter, post bool) {
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	var methods string
-	if post {
-		methods = "GET, POST, OPTIONS"
-	} else {
-		methods = "GET, OPTIONS"
-	}
-	w.Header().Add("Access-Control-Allow-Methods", methods)
-	w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Accept")
-	if config.Server.CascadeLabels != "" {
-		// TODO Eventually we might want to propagate OPTIONS queries to backends,
-		//      and dynamically populate cascade labels with some caching config.
-		//      For now this is good enough.
-		w.Header().Add("X-IPNI-Allow-Cascade", config.Server.CascadeLabels)
-	}
-	w.WriteHeader(http.StatusAccepted)
+// findProtocols returns the comma-separated names of the retrieval protocols
+// in the given metadata.
+func findProtocols(md []byte) string {
+	m := metadata.Default.New()
+	// Known protocols are still populated when unmarshalling fails on unknown
+	// ones.
+	_ = m.UnmarshalBinary(md)
+	var buf bytes.Buffer
+	for i, p := range m.Protocols() {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(p.String())
+	}
+	return buf.String()
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/ipni/indexstar/router"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind(t *testing.T) {
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	backends := []router.BackendConfig{
+		{URL: backend.URL, Type: router.BackendTypeRegular},
+		{URL: backend.URL, Type: router.BackendTypeRegular},
+		{URL: backend.URL, Type: router.BackendTypeProviders},
+	}
+
+	for _, key := range []string{
+		mockbackend.SampleCids[0],
+		cid.MustParse(mockbackend.SampleCids[0]).Hash().B58String(),
+	} {
+		resp, err := find(context.Background(), backends, key, "")
+		require.NoError(t, err)
+		require.Len(t, resp.MultihashResults, 1)
+		require.Len(t, resp.MultihashResults[0].ProviderResults, 2)
+
+		var out bytes.Buffer
+		require.NoError(t, printFindTable(&out, resp))
+		for _, p := range mockbackend.SampleProviders {
+			require.Contains(t, out.String(), p)
+		}
+		require.Contains(t, out.String(), "transport-bitswap")
+	}
+
+	_, err := find(context.Background(), backends, "fish", "")
+	require.ErrorContains(t, err, "neither a cid nor a multihash")
+	unknown, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	_, err = find(context.Background(), backends, unknown.B58String(), "")
+	require.ErrorContains(t, err, "no providers found")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// listenFdsStart is the first file descriptor of inherited listeners, as
+	// per the systemd socket activation protocol.
+	listenFdsStart = 3
+
+	// upgradeFdsEnv names the listeners passed by a parent process that is
+	// upgrading to a new binary, in the order of their file descriptors.
+	upgradeFdsEnv = "INDEXSTAR_LISTEN_FDNAMES"
+	// upgradeReadyFdEnv is the file descriptor that a child process started by
+	// an upgrade writes to once it serves.
+	upgradeReadyFdEnv = "INDEXSTAR_READY_FD"
+
+	// listenName and metricsListenName are the names of the inherited HTTP
+	// and metrics server listeners.
+	listenName        = "listen"
+	metricsListenName = "metrics"
+
+	// upgradeTimeout bounds how long an upgrade waits for the new process to
+	// serve before giving up on it.
+	upgradeTimeout = time.Minute
+	// upgradeDrainTimeout bounds how long in-flight requests are drained once
+	// the new process serves.
+	upgradeDrainTimeout = 30 * time.Second
+)
+
+// inheritedListeners returns the listeners inherited by name, either via
+// systemd socket activation or from a parent process upgrading to a new
+// binary.
+func inheritedListeners() (map[string]net.Listener, error) {
+	var names []string
+	if v, ok := os.LookupEnv(upgradeFdsEnv); ok {
+		names = strings.Split(v, ":")
+		_ = os.Unsetenv(upgradeFdsEnv)
+	} else {
+		pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+		fdNames := os.Getenv("LISTEN_FDNAMES")
+		// Unset so that the activation is not mistaken for that of processes
+		// started by this one.
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+		if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+			return nil, nil
+		}
+		n, err := strconv.Atoi(fds)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+		}
+		names = activatedNames(n, fdNames)
+	}
+
+	listeners := make(map[string]net.Listener)
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// The listener holds a duplicate of the file descriptor, which is not
+		// inherited by processes started by this one.
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot inherit %s listener from fd %d: %w", name, fd, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// activatedNames returns the names of the listeners of the given number of
+// sockets activated by systemd with the given LISTEN_FDNAMES. Sockets named
+// neither listen nor metrics are taken in order for the listeners not named,
+// and the empty string is returned for any left over.
+func activatedNames(n int, fdNames string) []string {
+	names := make([]string, n)
+	for i, name := range strings.Split(fdNames, ":") {
+		if i < n && (name == listenName || name == metricsListenName) && !slices.Contains(names, name) {
+			names[i] = name
+		}
+	}
+	var unnamed []string
+	for _, name := range []string{listenName, metricsListenName} {
+		if !slices.Contains(names, name) {
+			unnamed = append(unnamed, name)
+		}
+	}
+	for i := range names {
+		if names[i] == "" && len(unnamed) > 0 {
+			names[i], unnamed = unnamed[0], unnamed[1:]
+		}
+	}
+	return names
+}
+
+// listen returns the inherited listener of the given name if any, and binds
+// the given address otherwise.
+func listen(inherited map[string]net.Listener, name, addr string) (net.Listener, error) {
+	if l, ok := inherited[name]; ok {
+		log.Infow("Inherited listener", "name", name, "listen_addr", l.Addr())
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// notifyReady tells the parent process upgrading to this one that it serves,
+// if started by an upgrade.
+func notifyReady() {
+	v, ok := os.LookupEnv(upgradeReadyFdEnv)
+	if !ok {
+		return
+	}
+	_ = os.Unsetenv(upgradeReadyFdEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		log.Errorw("Invalid upgrade ready fd", "fd", v)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Errorw("Failed to notify upgrading process of readiness", "err", err)
+	}
+}
+
+// upgrade starts the current binary with the same arguments as a new process
+// that inherits the listeners, and waits until it serves. Connections are not
+// dropped, since the listening sockets are shared with the new process until
+// this one stops accepting.
+func (s *server) upgrade() error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, l := range []net.Listener{s.Listener, s.metricsListener} {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("cannot pass listener of type %T", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		upgradeFdsEnv+"="+listenName+":"+metricsListenName,
+		upgradeReadyFdEnv+"="+strconv.Itoa(listenFdsStart+len(files)-1))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start new process: %w", err)
+	}
+	// Close the write end so that reads fail once the new process exits.
+	_ = readyW.Close()
+	files = files[:len(files)-1]
+
+	_ = ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		// Stop the new process, lest both serve once it does.
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return errors.New("new process did not serve in time")
+		}
+		return errors.New("new process exited before serving")
+	}
+	log.Infow("Upgraded to new process", "pid", cmd.Process.Pid)
+	// The new process is reaped by init once this one exits.
+	_ = cmd.Process.Release()
+	return nil
+}
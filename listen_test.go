@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivatedNames(t *testing.T) {
+	tests := []struct {
+		n       int
+		fdNames string
+		want    []string
+	}{
+		{n: 1, want: []string{listenName}},
+		{n: 2, fdNames: "indexstar.socket:indexstar.socket", want: []string{listenName, metricsListenName}},
+		{n: 2, fdNames: "metrics:listen", want: []string{metricsListenName, listenName}},
+		{n: 2, fdNames: "metrics:other", want: []string{metricsListenName, listenName}},
+		{n: 3, fdNames: "other:listen:other", want: []string{metricsListenName, listenName, ""}},
+		{n: 2, fdNames: "listen:listen", want: []string{listenName, metricsListenName}},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.want, activatedNames(test.n, test.fdNames), "%d sockets named %q", test.n, test.fdNames)
+	}
+}
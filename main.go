@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -8,9 +9,13 @@ import (
 	"syscall"
 	"time"
 
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/indexstar/router"
 	cli "github.com/urfave/cli/v2"
 )
 
+var log = logging.Logger("indexstar")
+
 // configCheckInterval determines how frequently the config file is checked for
 // changes, to see if it needs to be reloaded. Set this to 0 to disable
 // checking the config file.
@@ -20,6 +25,11 @@ func main() {
 	app := &cli.App{
 		Name:  "indexstar",
 		Usage: "indexstar is a point in the content routing galaxy - routes requests in a star topology",
+		Commands: []*cli.Command{
+			replayCommand,
+			benchCommand,
+			findCommand,
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:      "config",
@@ -36,6 +46,41 @@ func main() {
 				Usage: "Metrics server listen address",
 				Value: ":8081",
 			},
+			&cli.StringFlag{
+				Name:    metricsBasicAuthArg,
+				Usage:   "Basic auth credentials formatted as user:password required to access the metrics server. Disabled if empty.",
+				EnvVars: []string{"METRICS_BASIC_AUTH"},
+			},
+			&cli.StringSliceFlag{
+				Name:  metricsAllowArg,
+				Usage: "IPs or CIDRs allowed to access the metrics server. All are allowed if empty.",
+			},
+			&cli.StringFlag{
+				Name:    metricsOTLPEndpointArg,
+				Usage:   "URL of the OTLP/HTTP endpoint to push metrics to, e.g. http://collector:4318/v1/metrics. Disabled if empty.",
+				EnvVars: []string{"METRICS_OTLP_ENDPOINT"},
+			},
+			&cli.StringSliceFlag{
+				Name:    metricsOTLPHeadersArg,
+				Usage:   "Headers formatted as key=value to set on requests pushing metrics over OTLP, e.g. for authentication.",
+				EnvVars: []string{"METRICS_OTLP_HEADERS"},
+			},
+			&cli.StringFlag{
+				Name:    metricsStatsDArg,
+				Usage:   "Address formatted as host:port to send metrics to over StatsD via UDP. Disabled if empty.",
+				EnvVars: []string{"METRICS_STATSD_ADDR"},
+			},
+			&cli.BoolFlag{
+				Name:    metricsStatsDTagsArg,
+				Usage:   "Whether to send metric tags over StatsD in the DogStatsD format understood by the Datadog agent.",
+				EnvVars: []string{"METRICS_STATSD_TAGS"},
+			},
+			&cli.DurationFlag{
+				Name:    metricsPushIntervalArg,
+				Usage:   "Interval at which metrics are pushed over OTLP or StatsD.",
+				Value:   10 * time.Second,
+				EnvVars: []string{"METRICS_PUSH_INTERVAL"},
+			},
 			&cli.StringSliceFlag{
 				Name:  backendsArg,
 				Usage: "Backends to propagate regular requests to.",
@@ -57,6 +102,27 @@ func main() {
 				Name:  "translateNonStreaming",
 				Usage: "Whether to translate non-streaming JSON requests to streaming NDJSON requests before scattering to backends.",
 			},
+			&cli.StringFlag{
+				Name:  fallbackBackendArg,
+				Usage: "Backend to reverse proxy requests to for any path not handled by indexstar, e.g. /ingest/*",
+			},
+			&cli.BoolFlag{
+				Name:  chaosArg,
+				Usage: "Test-only: inject faults toward backends as configured by CHAOS_* env vars. Never enable in production.",
+			},
+			&cli.BoolFlag{
+				Name:    selfCheckArg,
+				Aliases: []string{"self-check"},
+				Usage:   "Probe each backend on startup, before listening, and log the routes each responds on.",
+			},
+			&cli.IntFlag{
+				Name:  selfCheckMinArg,
+				Usage: "Strict self-check: refuse to start if fewer backends than this are usable. Not enforced if zero.",
+			},
+			&cli.BoolFlag{
+				Name:  devArg,
+				Usage: "Serve from an embedded in-memory mock backend pre-loaded with sample provider records instead of the configured backends, for offline client development.",
+			},
 			&cli.StringFlag{
 				Name:  "homepageURL",
 				Usage: "The actual webUI backend to be rendered via iframe.",
@@ -74,8 +140,11 @@ func main() {
 
 			sighup := make(chan os.Signal, 1)
 			signal.Notify(sighup, syscall.SIGHUP)
+			upgradeSig := make(chan os.Signal, 1)
+			notifyUpgrade(upgradeSig)
 
 			done := s.Serve()
+			notifyReady()
 
 			var (
 				cfgPath  string
@@ -86,7 +155,7 @@ func main() {
 			if configCheckInterval != 0 {
 				cfgPath = s.cfgBase
 				if cfgPath == "" {
-					cfgPath, err = Path("", "")
+					cfgPath, err = router.Path("", "")
 					if err != nil {
 						return err
 					}
@@ -113,14 +182,32 @@ func main() {
 					default:
 					}
 				case <-exit:
+					s.snapshot()
+					return nil
+				case <-upgradeSig:
+					// Counters are snapshotted ahead of starting the new
+					// process, which restores them on startup.
+					s.snapshot()
+					if err := s.upgrade(); err != nil {
+						log.Errorw("Failed to upgrade", "err", err)
+						continue
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), upgradeDrainTimeout)
+					err := s.drain(ctx)
+					cancel()
+					if err != nil {
+						log.Warnw("Failed to drain requests before upgrade", "err", err)
+					}
 					return nil
 				case err := <-done:
 					return err
 				case <-reloadSig:
-					err := s.Reload(c)
+					report, err := s.Reload(c)
 					if err != nil {
 						log.Warnf("couldn't reload servers: %s", err)
+						continue
 					}
+					log.Infow("Reloaded config", "report", report)
 				case <-timeChan:
 					var changed bool
 					modTime, changed, err = fileChanged(s.cfgBase, modTime)
@@ -131,7 +218,19 @@ func main() {
 						timeChan = nil // reading from nil channel blocks forever
 						continue
 					}
-					if changed {
+					if !changed {
+						continue
+					}
+					// Changed config files are validated first, so that a bad
+					// edit does not degrade serving until it is fixed. SIGHUP still
+					// reloads them regardless.
+					report, err := s.ValidateReload(c)
+					switch {
+					case err != nil:
+						log.Warnw("Not reloading changed config file since it is invalid", "err", err)
+					case len(report.Unreachable) > 0:
+						log.Warnw("Not reloading changed config file since backends are unreachable", "unreachable", report.Unreachable)
+					default:
 						reloadSig <- struct{}{}
 					}
 				}
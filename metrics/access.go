@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// AccessControl restricts access to the metrics and pprof handlers by client
+// IP and/or HTTP basic auth credentials.
+type AccessControl struct {
+	user     string
+	password string
+	allow    []netip.Prefix
+}
+
+// NewAccessControl instantiates an AccessControl that requires the given
+// basic auth credentials, formatted as user:password, and only admits clients
+// with an IP within the given list of IPs or CIDRs. Either restriction is
+// disabled if empty.
+func NewAccessControl(basicAuth string, allow []string) (*AccessControl, error) {
+	var ac AccessControl
+	if basicAuth != "" {
+		user, password, ok := strings.Cut(basicAuth, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("basic auth credentials must be formatted as user:password")
+		}
+		ac.user, ac.password = user, password
+	}
+	for _, a := range allow {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if strings.Contains(a, "/") {
+			prefix, err := netip.ParsePrefix(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed CIDR %q: %w", a, err)
+			}
+			ac.allow = append(ac.allow, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed IP %q: %w", a, err)
+		}
+		ac.allow = append(ac.allow, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return &ac, nil
+}
+
+// Handler wraps the given handler to reject requests from clients that are not
+// allowed with 403, and requests without valid credentials with 401.
+func (ac *AccessControl) Handler(next http.Handler) http.Handler {
+	if ac == nil || (ac.user == "" && len(ac.allow) == 0) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(ac.allow) > 0 && !ac.allowed(r.RemoteAddr) {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		if ac.user != "" {
+			user, password, ok := r.BasicAuth()
+			userOk := subtle.ConstantTimeCompare([]byte(user), []byte(ac.user)) == 1
+			passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(ac.password)) == 1
+			if !ok || !userOk || !passwordOk {
+				w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+				http.Error(w, "", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ac *AccessControl) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range ac.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessControl(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		basicAuth  string
+		allow      []string
+		remoteAddr string
+		user, pass string
+		wantStatus int
+	}{
+		{name: "unrestricted", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusOK},
+		{name: "allowed ip", allow: []string{"192.0.2.1"}, remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusOK},
+		{name: "allowed cidr", allow: []string{"10.0.0.0/8"}, remoteAddr: "10.1.2.3:1234", wantStatus: http.StatusOK},
+		{name: "allowed ipv6", allow: []string{"::1"}, remoteAddr: "[::1]:1234", wantStatus: http.StatusOK},
+		{name: "denied ip", allow: []string{"10.0.0.0/8"}, remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusForbidden},
+		{name: "valid credentials", basicAuth: "fish:lobster", remoteAddr: "192.0.2.1:1234", user: "fish", pass: "lobster", wantStatus: http.StatusOK},
+		{name: "invalid credentials", basicAuth: "fish:lobster", remoteAddr: "192.0.2.1:1234", user: "fish", pass: "crab", wantStatus: http.StatusUnauthorized},
+		{name: "missing credentials", basicAuth: "fish:lobster", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusUnauthorized},
+		{name: "denied ip with valid credentials", basicAuth: "fish:lobster", allow: []string{"10.0.0.0/8"}, remoteAddr: "192.0.2.1:1234", user: "fish", pass: "lobster", wantStatus: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ac, err := NewAccessControl(test.basicAuth, test.allow)
+			require.NoError(t, err)
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.pass)
+			}
+			rec := httptest.NewRecorder()
+			ac.Handler(ok).ServeHTTP(rec, req)
+			require.Equal(t, test.wantStatus, rec.Code)
+		})
+	}
+}
+
+func TestNewAccessControl_RejectsInvalidConfig(t *testing.T) {
+	_, err := NewAccessControl("fish", nil)
+	require.Error(t, err)
+	_, err = NewAccessControl("", []string{"not-an-ip"})
+	require.Error(t, err)
+	_, err = NewAccessControl("", []string{"10.0.0.0/33"})
+	require.Error(t, err)
+}
@@ -0,0 +1,385 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricexport"
+)
+
+// statsdMaxPacketSize bounds the StatsD datagrams sent, so that they are not
+// fragmented over typical links.
+const statsdMaxPacketSize = 1432
+
+// PushOptions configures pushing metrics to sinks other than the Prometheus
+// scrape endpoint.
+type PushOptions struct {
+	// OTLPEndpoint is the URL of the OTLP/HTTP metrics endpoint that metrics
+	// are pushed to as JSON, e.g. http://collector:4318/v1/metrics. Metrics
+	// are not pushed over OTLP if empty.
+	OTLPEndpoint string
+	// OTLPHeaders are set on every OTLP request, e.g. for authentication.
+	OTLPHeaders map[string]string
+	// StatsDAddr is the host:port that metrics are sent to over StatsD via
+	// UDP. Metrics are not sent over StatsD if empty.
+	StatsDAddr string
+	// StatsDTags is whether metric tags are sent in the DogStatsD format, as
+	// understood by the Datadog agent. Tags are dropped otherwise.
+	StatsDTags bool
+	// Interval is the interval at which metrics are pushed.
+	Interval time.Duration
+}
+
+// StartPush starts pushing the metrics of registered views to every configured
+// sink at the configured interval, until the returned function is called.
+func StartPush(o PushOptions) (func(), error) {
+	var exporters []metricexport.Exporter
+	if o.OTLPEndpoint != "" {
+		exporters = append(exporters, &otlpExporter{
+			endpoint: o.OTLPEndpoint,
+			headers:  o.OTLPHeaders,
+			client:   &http.Client{Timeout: o.Interval},
+		})
+	}
+	if o.StatsDAddr != "" {
+		conn, err := net.Dial("udp", o.StatsDAddr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot dial StatsD address: %w", err)
+		}
+		exporters = append(exporters, newStatsDExporter(conn, o.StatsDTags))
+	}
+
+	var readers []*metricexport.IntervalReader
+	stop := func() {
+		for _, r := range readers {
+			r.Stop()
+		}
+	}
+	for _, e := range exporters {
+		r, err := metricexport.NewIntervalReader(metricexport.NewReader(), e)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		r.ReportingInterval = o.Interval
+		if err := r.Start(); err != nil {
+			stop()
+			return nil, fmt.Errorf("cannot start pushing metrics: %w", err)
+		}
+		readers = append(readers, r)
+	}
+	return stop, nil
+}
+
+// otlpExporter pushes metrics to an OTLP/HTTP endpoint using the JSON
+// encoding of OTLP.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value otlpValueUnion `json:"value"`
+	}
+	otlpValueUnion struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Unit        string         `json:"unit,omitempty"`
+		Gauge       *otlpData      `json:"gauge,omitempty"`
+		Sum         *otlpData      `json:"sum,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	}
+	otlpData struct {
+		AggregationTemporality int             `json:"aggregationTemporality,omitempty"`
+		IsMonotonic            bool            `json:"isMonotonic,omitempty"`
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsInt             *string         `json:"asInt,omitempty"`
+		AsDouble          *float64        `json:"asDouble,omitempty"`
+	}
+	otlpHistogram struct {
+		AggregationTemporality int                      `json:"aggregationTemporality"`
+		DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	}
+	otlpHistogramDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+)
+
+// otlpCumulative is the cumulative aggregation temporality of OTLP, which all
+// counts and distributions of views are.
+const otlpCumulative = 2
+
+func (e *otlpExporter) ExportMetrics(ctx context.Context, data []*metricdata.Metric) error {
+	metrics := make([]otlpMetric, 0, len(data))
+	for _, m := range data {
+		om := otlpMetric{Name: m.Descriptor.Name, Description: m.Descriptor.Description, Unit: string(m.Descriptor.Unit)}
+		switch m.Descriptor.Type {
+		case metricdata.TypeGaugeInt64, metricdata.TypeGaugeFloat64:
+			om.Gauge = &otlpData{DataPoints: otlpDataPoints(m)}
+		case metricdata.TypeCumulativeInt64, metricdata.TypeCumulativeFloat64:
+			om.Sum = &otlpData{AggregationTemporality: otlpCumulative, IsMonotonic: true, DataPoints: otlpDataPoints(m)}
+		case metricdata.TypeGaugeDistribution, metricdata.TypeCumulativeDistribution:
+			om.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative, DataPoints: otlpHistogramDataPoints(m)}
+		default:
+			continue
+		}
+		metrics = append(metrics, om)
+	}
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValueUnion{StringValue: "indexstar"}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "indexstar"}, Metrics: metrics}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Warnw("Failed to push metrics over OTLP", "err", err)
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("status %d response from OTLP endpoint", resp.StatusCode)
+		log.Warnw("Failed to push metrics over OTLP", "err", err)
+		return err
+	}
+	return nil
+}
+
+func otlpAttributes(m *metricdata.Metric, ts *metricdata.TimeSeries) []otlpAttribute {
+	var attrs []otlpAttribute
+	for i, v := range ts.LabelValues {
+		if v.Present {
+			attrs = append(attrs, otlpAttribute{Key: m.Descriptor.LabelKeys[i].Key, Value: otlpValueUnion{StringValue: v.Value}})
+		}
+	}
+	return attrs
+}
+
+func otlpTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpDataPoints(m *metricdata.Metric) []otlpDataPoint {
+	var points []otlpDataPoint
+	for _, ts := range m.TimeSeries {
+		for _, p := range ts.Points {
+			dp := otlpDataPoint{
+				Attributes:        otlpAttributes(m, ts),
+				StartTimeUnixNano: otlpTime(ts.StartTime),
+				TimeUnixNano:      otlpTime(p.Time),
+			}
+			switch v := p.Value.(type) {
+			case int64:
+				i := strconv.FormatInt(v, 10)
+				dp.AsInt = &i
+			case float64:
+				dp.AsDouble = &v
+			default:
+				continue
+			}
+			points = append(points, dp)
+		}
+	}
+	return points
+}
+
+func otlpHistogramDataPoints(m *metricdata.Metric) []otlpHistogramDataPoint {
+	var points []otlpHistogramDataPoint
+	for _, ts := range m.TimeSeries {
+		for _, p := range ts.Points {
+			d, ok := p.Value.(*metricdata.Distribution)
+			if !ok {
+				continue
+			}
+			dp := otlpHistogramDataPoint{
+				Attributes:        otlpAttributes(m, ts),
+				StartTimeUnixNano: otlpTime(ts.StartTime),
+				TimeUnixNano:      otlpTime(p.Time),
+				Count:             strconv.FormatInt(d.Count, 10),
+				Sum:               d.Sum,
+				BucketCounts:      make([]string, 0, len(d.Buckets)),
+				ExplicitBounds:    []float64{},
+			}
+			if d.BucketOptions != nil {
+				dp.ExplicitBounds = d.BucketOptions.Bounds
+			}
+			for _, b := range d.Buckets {
+				dp.BucketCounts = append(dp.BucketCounts, strconv.FormatInt(b.Count, 10))
+			}
+			points = append(points, dp)
+		}
+	}
+	return points
+}
+
+// statsdExporter sends metrics over StatsD. Since StatsD counters are deltas,
+// the cumulative counts of views are sent as the difference from the previous
+// export, and distributions as the counters <name>.count and <name>.sum.
+type statsdExporter struct {
+	conn net.Conn
+	tags bool
+
+	mu   sync.Mutex
+	last map[string]float64
+}
+
+func newStatsDExporter(conn net.Conn, tags bool) *statsdExporter {
+	return &statsdExporter{conn: conn, tags: tags, last: make(map[string]float64)}
+}
+
+func (e *statsdExporter) ExportMetrics(_ context.Context, data []*metricdata.Metric) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var packet bytes.Buffer
+	var err error
+	send := func(line string) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacketSize {
+			if _, werr := e.conn.Write(packet.Bytes()); werr != nil {
+				err = werr
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	for _, m := range data {
+		name := strings.ReplaceAll(m.Descriptor.Name, "/", ".")
+		for _, ts := range m.TimeSeries {
+			if len(ts.Points) == 0 {
+				continue
+			}
+			tags := e.formatTags(m, ts)
+			key := name + tags
+			switch v := ts.Points[len(ts.Points)-1].Value.(type) {
+			case int64:
+				e.sendValue(send, name, key, tags, m.Descriptor.Type, float64(v))
+			case float64:
+				e.sendValue(send, name, key, tags, m.Descriptor.Type, v)
+			case *metricdata.Distribution:
+				if delta := e.delta(key+".count", float64(v.Count)); delta != 0 {
+					send(name + ".count:" + formatStatsDValue(delta) + "|c" + tags)
+				}
+				if delta := e.delta(key+".sum", v.Sum); delta != 0 {
+					send(name + ".sum:" + formatStatsDValue(delta) + "|c" + tags)
+				}
+			}
+		}
+	}
+	if packet.Len() > 0 {
+		if _, werr := e.conn.Write(packet.Bytes()); werr != nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		log.Warnw("Failed to send metrics over StatsD", "err", err)
+	}
+	return err
+}
+
+func (e *statsdExporter) sendValue(send func(string), name, key, tags string, typ metricdata.Type, v float64) {
+	switch typ {
+	case metricdata.TypeGaugeInt64, metricdata.TypeGaugeFloat64:
+		send(name + ":" + formatStatsDValue(v) + "|g" + tags)
+	default:
+		if delta := e.delta(key, v); delta != 0 {
+			send(name + ":" + formatStatsDValue(delta) + "|c" + tags)
+		}
+	}
+}
+
+// delta returns the difference of the given cumulative value from its
+// previous export. The cumulative value is taken as is if it decreased, since
+// it must have been reset.
+func (e *statsdExporter) delta(key string, v float64) float64 {
+	last, ok := e.last[key]
+	e.last[key] = v
+	if !ok || v < last {
+		return v
+	}
+	return v - last
+}
+
+// formatTags formats the tags of the given time series in the DogStatsD
+// format, or returns the empty string if tags are not sent.
+func (e *statsdExporter) formatTags(m *metricdata.Metric, ts *metricdata.TimeSeries) string {
+	if !e.tags {
+		return ""
+	}
+	var tags []string
+	for i, v := range ts.LabelValues {
+		if v.Present {
+			tags = append(tags, m.Descriptor.LabelKeys[i].Key+":"+v.Value)
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+func formatStatsDValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/metric/metricdata"
+)
+
+func testMetrics(count int64, sum float64) []*metricdata.Metric {
+	now := time.Now()
+	labels := []metricdata.LabelKey{{Key: "method"}}
+	return []*metricdata.Metric{
+		{
+			Descriptor: metricdata.Descriptor{Name: "indexstar/find/http_request_count", Type: metricdata.TypeCumulativeInt64, LabelKeys: labels},
+			TimeSeries: []*metricdata.TimeSeries{{
+				LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue("http")},
+				Points:      []metricdata.Point{metricdata.NewInt64Point(now, count)},
+				StartTime:   now.Add(-time.Minute),
+			}},
+		},
+		{
+			Descriptor: metricdata.Descriptor{Name: "indexstar/backends/count", Type: metricdata.TypeGaugeInt64},
+			TimeSeries: []*metricdata.TimeSeries{{Points: []metricdata.Point{metricdata.NewInt64Point(now, 3)}}},
+		},
+		{
+			Descriptor: metricdata.Descriptor{Name: "indexstar/find/latency", Type: metricdata.TypeCumulativeDistribution, LabelKeys: labels},
+			TimeSeries: []*metricdata.TimeSeries{{
+				LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue("http")},
+				Points: []metricdata.Point{metricdata.NewDistributionPoint(now, &metricdata.Distribution{
+					Count:         count,
+					Sum:           sum,
+					BucketOptions: &metricdata.BucketOptions{Bounds: []float64{10}},
+					Buckets:       []metricdata.Bucket{{Count: count - 1}, {Count: 1}},
+				})},
+			}},
+		},
+	}
+}
+
+func TestStatsDExporter_SendsDeltas(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	receive := func() []string {
+		buf := make([]byte, statsdMaxPacketSize)
+		require.NoError(t, listener.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := listener.ReadFrom(buf)
+		require.NoError(t, err)
+		lines := strings.Split(string(buf[:n]), "\n")
+		sort.Strings(lines)
+		return lines
+	}
+
+	subject := newStatsDExporter(conn, true)
+	require.NoError(t, subject.ExportMetrics(context.Background(), testMetrics(5, 50)))
+	require.Equal(t, []string{
+		"indexstar.backends.count:3|g",
+		"indexstar.find.http_request_count:5|c|#method:http",
+		"indexstar.find.latency.count:5|c|#method:http",
+		"indexstar.find.latency.sum:50|c|#method:http",
+	}, receive())
+
+	require.NoError(t, subject.ExportMetrics(context.Background(), testMetrics(7, 62.5)))
+	require.Equal(t, []string{
+		"indexstar.backends.count:3|g",
+		"indexstar.find.http_request_count:2|c|#method:http",
+		"indexstar.find.latency.count:2|c|#method:http",
+		"indexstar.find.latency.sum:12.5|c|#method:http",
+	}, receive())
+
+	// Tags are dropped unless sent in the DogStatsD format.
+	subject = newStatsDExporter(conn, false)
+	require.NoError(t, subject.ExportMetrics(context.Background(), testMetrics(1, 1)))
+	require.Contains(t, receive(), "indexstar.find.http_request_count:1|c")
+}
+
+func TestOTLPExporter_PushesJSON(t *testing.T) {
+	var got otlpRequest
+	var auth string
+	var reject atomic.Bool
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reject.Load() {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer collector.Close()
+
+	subject := &otlpExporter{
+		endpoint: collector.URL + "/v1/metrics",
+		headers:  map[string]string{"Authorization": "Bearer fish"},
+		client:   collector.Client(),
+	}
+	require.NoError(t, subject.ExportMetrics(context.Background(), testMetrics(5, 50)))
+	require.Equal(t, "Bearer fish", auth)
+
+	require.Len(t, got.ResourceMetrics, 1)
+	require.Len(t, got.ResourceMetrics[0].ScopeMetrics, 1)
+	metrics := got.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 3)
+
+	count := metrics[0]
+	require.Equal(t, "indexstar/find/http_request_count", count.Name)
+	require.NotNil(t, count.Sum)
+	require.True(t, count.Sum.IsMonotonic)
+	require.Equal(t, otlpCumulative, count.Sum.AggregationTemporality)
+	require.Len(t, count.Sum.DataPoints, 1)
+	require.Equal(t, "5", *count.Sum.DataPoints[0].AsInt)
+	require.Equal(t, []otlpAttribute{{Key: "method", Value: otlpValueUnion{StringValue: "http"}}}, count.Sum.DataPoints[0].Attributes)
+
+	require.NotNil(t, metrics[1].Gauge)
+	require.Equal(t, "3", *metrics[1].Gauge.DataPoints[0].AsInt)
+
+	latency := metrics[2].Histogram
+	require.NotNil(t, latency)
+	require.Equal(t, "5", latency.DataPoints[0].Count)
+	require.Equal(t, 50.0, latency.DataPoints[0].Sum)
+	require.Equal(t, []string{"4", "1"}, latency.DataPoints[0].BucketCounts)
+	require.Equal(t, []float64{10}, latency.DataPoints[0].ExplicitBounds)
+
+	reject.Store(true)
+	require.Error(t, subject.ExportMetrics(context.Background(), testMetrics(5, 50)))
+}
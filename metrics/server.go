@@ -25,15 +25,59 @@ var (
 	FoundRegular, _ = tag.NewKey("foundRegular")
 	Version, _      = tag.NewKey("version")
 	Transport, _    = tag.NewKey("transport")
+	Backend, _      = tag.NewKey("backend")
+	Probe, _        = tag.NewKey("probe")
+	Outcome, _      = tag.NewKey("outcome")
+	Experiment, _   = tag.NewKey("experiment")
+	Variant, _      = tag.NewKey("variant")
+	Route, _        = tag.NewKey("route")
+	Encoding, _     = tag.NewKey("encoding")
+	Surface, _      = tag.NewKey("surface")
+	Status, _       = tag.NewKey("status")
+	Family, _       = tag.NewKey("family")
 )
 
 // Measures
 var (
 	FindLatency                = stats.Float64("indexstar/find/latency", "Time to respond to a find request", stats.UnitMilliseconds)
-	FindBackends               = stats.Float64("indexstar/find/backends", "Backends reached in a find request", stats.UnitDimensionless)
+	FindBackends               = stats.Float64("indexstar/find/backends", "Backends per find request by outcome", stats.UnitDimensionless)
 	FindLoad                   = stats.Int64("indexstar/find/load", "Amount of calls to find", stats.UnitDimensionless)
 	FindResponse               = stats.Int64("indexstar/find/response", "Find response stats", stats.UnitDimensionless)
 	HttpDelegatedRoutingMethod = stats.Int64("indexstar/http_delegated_routing/load", "Amount of HTTP delegated routing calls by tagged method", stats.UnitDimensionless)
+	NDJsonSkippedLines         = stats.Int64("indexstar/find/ndjson_skipped_lines", "Amount of oversized NDJSON lines skipped in backend responses", stats.UnitDimensionless)
+	BackendConnsOpen           = stats.Int64("indexstar/backend/conns_open", "Number of open connections to a backend", stats.UnitDimensionless)
+	BackendConnsInUse          = stats.Int64("indexstar/backend/conns_in_use", "Number of connections to a backend in use", stats.UnitDimensionless)
+	BackendConnsIdle           = stats.Int64("indexstar/backend/conns_idle", "Number of idle connections to a backend", stats.UnitDimensionless)
+	BackendDialErrors          = stats.Int64("indexstar/backend/dial_errors", "Amount of failed dials to a backend", stats.UnitDimensionless)
+	BackendDials               = stats.Int64("indexstar/backend/dials", "Amount of successful dials to a backend by address family", stats.UnitDimensionless)
+	OutboundConnsRejected      = stats.Int64("indexstar/backend/outbound_conns_rejected", "Amount of dials to a backend rejected since the outbound connection budget was exhausted", stats.UnitDimensionless)
+	EgressDenied               = stats.Int64("indexstar/backend/egress_denied", "Amount of dials to a backend refused since the destination is not on the egress allowlist", stats.UnitDimensionless)
+	BackendDNSLatency          = stats.Float64("indexstar/backend/dns_latency", "Time to resolve a backend host", stats.UnitMilliseconds)
+	AuditRecall                = stats.Float64("indexstar/audit/recall", "Fraction of providers found across all backends that a backend knew about", stats.UnitDimensionless)
+	AuditMissedProviders       = stats.Int64("indexstar/audit/missed_providers", "Providers found by other backends that a backend did not know about", stats.UnitDimensionless)
+	CanaryPass                 = stats.Int64("indexstar/canary/pass", "Whether the last canary probe passed (1) or failed (0)", stats.UnitDimensionless)
+	BackendIngestLag           = stats.Float64("indexstar/backend/ingest_lag", "Time since the latest advertisement ingested by a backend", stats.UnitSeconds)
+	BackendSyncLag             = stats.Int64("indexstar/backend/sync_lag", "Advertisements left to sync across all providers of a backend", stats.UnitDimensionless)
+	PriorityShed               = stats.Int64("indexstar/priority/shed", "Amount of low priority requests rejected under load", stats.UnitDimensionless)
+	BackendConcurrencyLimit    = stats.Float64("indexstar/backend/concurrency_limit", "Adaptive limit of concurrent requests scattered to a backend", stats.UnitDimensionless)
+	BackendConcurrencyShed     = stats.Int64("indexstar/backend/concurrency_shed", "Amount of requests not scattered to a backend since it was at its adaptive concurrency limit", stats.UnitDimensionless)
+	TunedDeadline              = stats.Float64("indexstar/find/tuned_deadline", "Backend deadline tuned to observed backend latency", stats.UnitMilliseconds)
+	NegativeFilterHits         = stats.Int64("indexstar/find/negative_filter_hits", "Amount of find requests answered as not found by the negative lookup filter", stats.UnitDimensionless)
+	OpenStreams                = stats.Int64("indexstar/streams/open", "Number of streaming responses open", stats.UnitDimensionless)
+	StreamsRejected            = stats.Int64("indexstar/streams/rejected", "Amount of streaming requests rejected since too many streams were open", stats.UnitDimensionless)
+	BackendFailures            = stats.Int64("indexstar/backend/failures", "Amount of failed backend requests by kind of failure", stats.UnitDimensionless)
+	CascadesSuppressed         = stats.Int64("indexstar/cascade/suppressed", "Amount of lookups not cascaded to a backend since its rate limit was exceeded", stats.UnitDimensionless)
+	BackendCertExpiry          = stats.Float64("indexstar/backend/cert_expiry", "Time until the TLS certificate of a backend expires", stats.UnitSeconds)
+	NDJsonMalformed            = stats.Int64("indexstar/find/ndjson_malformed", "Amount of malformed NDJSON backend responses tolerated by kind", stats.UnitDimensionless)
+	ProviderCacheSize          = stats.Int64("indexstar/pcache/size", "Number of providers in the provider cache", stats.UnitDimensionless)
+	ProviderCacheRefresh       = stats.Float64("indexstar/pcache/refresh_latency", "Time to refresh the provider cache", stats.UnitMilliseconds)
+	ProviderCacheSourceErrors  = stats.Int64("indexstar/pcache/source_errors", "Amount of failed fetches of provider information by source", stats.UnitDimensionless)
+	ProviderCacheConflicts     = stats.Int64("indexstar/pcache/conflicts", "Amount of providers listed with conflicting addresses by providers backends", stats.UnitDimensionless)
+	ResponseSize               = stats.Int64("indexstar/http/response_size", "Size of response bodies served", stats.UnitBytes)
+	BackendResponseSize        = stats.Int64("indexstar/backend/response_size", "Size of response bodies read from a backend", stats.UnitBytes)
+	APILatency                 = stats.Float64("indexstar/api/latency", "Time to respond to a lookup request by public API surface", stats.UnitMilliseconds)
+	DHFallbacks                = stats.Int64("indexstar/find/dh_fallbacks", "Amount of plaintext lookups that fell back on double hashed backends, by whether they found results", stats.UnitDimensionless)
+	InflightRejected           = stats.Int64("indexstar/inflight/rejected", "Amount of requests rejected since their client had too many requests in flight", stats.UnitDimensionless)
 )
 
 // Views
@@ -41,27 +85,200 @@ var (
 	findLatencyView = &view.View{
 		Measure:     FindLatency,
 		Aggregation: view.Distribution(0, 1, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 200, 300, 400, 500, 1000, 2000, 5000),
-		TagKeys:     []tag.Key{Method, Found, FoundCaskade, FoundRegular},
+		TagKeys:     []tag.Key{Method, Found, FoundCaskade, FoundRegular, Surface, Experiment, Variant},
 	}
 	findBackendView = &view.View{
 		Measure:     FindBackends,
-		Aggregation: view.LastValue(),
+		Aggregation: view.Distribution(0, 1, 2, 3, 4, 5, 10, 20, 50),
+		TagKeys:     []tag.Key{Outcome, Surface, Experiment, Variant},
 	}
 	findLoadView = &view.View{
 		Measure:     FindLoad,
 		Aggregation: view.Count(),
-		TagKeys:     []tag.Key{Method},
+		TagKeys:     []tag.Key{Method, Surface, Experiment, Variant},
 	}
 	findResponseView = &view.View{
 		Measure:     FindResponse,
 		Aggregation: view.Count(),
-		TagKeys:     []tag.Key{Method, Transport},
+		TagKeys:     []tag.Key{Method, Transport, Surface, Experiment, Variant},
 	}
 	httpDelegRoutingMethodView = &view.View{
 		Measure:     HttpDelegatedRoutingMethod,
 		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Method, Experiment, Variant},
+	}
+	ndjsonSkippedLinesView = &view.View{
+		Measure:     NDJsonSkippedLines,
+		Aggregation: view.Count(),
+	}
+	backendConnsOpenView = &view.View{
+		Measure:     BackendConnsOpen,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	backendConnsInUseView = &view.View{
+		Measure:     BackendConnsInUse,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	backendConnsIdleView = &view.View{
+		Measure:     BackendConnsIdle,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	backendDialErrorsView = &view.View{
+		Measure:     BackendDialErrors,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	backendDialsView = &view.View{
+		Measure:     BackendDials,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend, Family},
+	}
+	outboundConnsRejectedView = &view.View{
+		Measure:     OutboundConnsRejected,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	egressDeniedView = &view.View{
+		Measure:     EgressDenied,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	backendDNSLatencyView = &view.View{
+		Measure:     BackendDNSLatency,
+		Aggregation: view.Distribution(0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000),
+		TagKeys:     []tag.Key{Backend},
+	}
+	auditRecallView = &view.View{
+		Measure:     AuditRecall,
+		Aggregation: view.Distribution(0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 0.95, 0.99, 1),
+		TagKeys:     []tag.Key{Backend},
+	}
+	auditMissedProvidersView = &view.View{
+		Measure:     AuditMissedProviders,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	canaryPassView = &view.View{
+		Measure:     CanaryPass,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Probe},
+	}
+	backendIngestLagView = &view.View{
+		Measure:     BackendIngestLag,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	backendSyncLagView = &view.View{
+		Measure:     BackendSyncLag,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	priorityShedView = &view.View{
+		Measure:     PriorityShed,
+		Aggregation: view.Count(),
+	}
+	backendConcurrencyLimitView = &view.View{
+		Measure:     BackendConcurrencyLimit,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	backendConcurrencyShedView = &view.View{
+		Measure:     BackendConcurrencyShed,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	tunedDeadlineView = &view.View{
+		Measure:     TunedDeadline,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Route},
+	}
+	negativeFilterHitsView = &view.View{
+		Measure:     NegativeFilterHits,
+		Aggregation: view.Count(),
 		TagKeys:     []tag.Key{Method},
 	}
+	openStreamsView = &view.View{
+		Measure:     OpenStreams,
+		Aggregation: view.LastValue(),
+	}
+	streamsRejectedView = &view.View{
+		Measure:     StreamsRejected,
+		Aggregation: view.Count(),
+	}
+	backendFailuresView = &view.View{
+		Measure:     BackendFailures,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend, ErrKind},
+	}
+	cascadesSuppressedView = &view.View{
+		Measure:     CascadesSuppressed,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	backendCertExpiryView = &view.View{
+		Measure:     BackendCertExpiry,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	ndjsonMalformedView = &view.View{
+		Measure:     NDJsonMalformed,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend, ErrKind},
+	}
+	providerCacheSizeView = &view.View{
+		Measure:     ProviderCacheSize,
+		Aggregation: view.LastValue(),
+	}
+	providerCacheRefreshView = &view.View{
+		Measure:     ProviderCacheRefresh,
+		Aggregation: view.Distribution(0, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 20000, 60000),
+	}
+	providerCacheSourceErrorsView = &view.View{
+		Measure:     ProviderCacheSourceErrors,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	providerCacheConflictsView = &view.View{
+		Measure:     ProviderCacheConflicts,
+		Aggregation: view.Count(),
+	}
+	responseSizeView = &view.View{
+		Measure:     ResponseSize,
+		Aggregation: payloadSizeDistribution,
+		TagKeys:     []tag.Key{Route, Encoding},
+	}
+	backendResponseSizeView = &view.View{
+		Measure:     BackendResponseSize,
+		Aggregation: payloadSizeDistribution,
+		TagKeys:     []tag.Key{Backend, Route},
+	}
+	apiRequestsView = &view.View{
+		Name:        "indexstar/api/requests",
+		Measure:     APILatency,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Surface, Status},
+	}
+	apiLatencyView = &view.View{
+		Measure:     APILatency,
+		Aggregation: view.Distribution(0, 1, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 200, 300, 400, 500, 1000, 2000, 5000),
+		TagKeys:     []tag.Key{Surface},
+	}
+	dhFallbacksView = &view.View{
+		Measure:     DHFallbacks,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Found},
+	}
+	inflightRejectedView = &view.View{
+		Measure:     InflightRejected,
+		Aggregation: view.Count(),
+	}
+
+	// payloadSizeDistribution buckets payload sizes from 256B to 64MiB by
+	// factors of 4.
+	payloadSizeDistribution = view.Distribution(0, 256, 1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20, 64<<20)
 )
 
 // Start creates an HTTP router for serving metric info
@@ -73,6 +290,41 @@ func Start(views []*view.View) http.Handler {
 		findLoadView,
 		findResponseView,
 		httpDelegRoutingMethodView,
+		ndjsonSkippedLinesView,
+		backendConnsOpenView,
+		backendConnsInUseView,
+		backendConnsIdleView,
+		backendDialErrorsView,
+		backendDialsView,
+		outboundConnsRejectedView,
+		egressDeniedView,
+		backendDNSLatencyView,
+		auditRecallView,
+		auditMissedProvidersView,
+		canaryPassView,
+		backendIngestLagView,
+		backendSyncLagView,
+		negativeFilterHitsView,
+		priorityShedView,
+		tunedDeadlineView,
+		backendConcurrencyLimitView,
+		backendConcurrencyShedView,
+		openStreamsView,
+		streamsRejectedView,
+		backendFailuresView,
+		cascadesSuppressedView,
+		backendCertExpiryView,
+		ndjsonMalformedView,
+		providerCacheSizeView,
+		providerCacheRefreshView,
+		providerCacheSourceErrorsView,
+		providerCacheConflictsView,
+		responseSizeView,
+		backendResponseSizeView,
+		apiRequestsView,
+		apiLatencyView,
+		dhFallbacksView,
+		inflightRejectedView,
 	)
 	if err != nil {
 		log.Errorf("cannot register metrics default views: %s", err)
@@ -0,0 +1,175 @@
+// Package mockbackend provides an in-memory IPNI backend that serves the find
+// and providers API expected by indexstar from records held in memory. It is
+// intended for local development and integration testing of clients against
+// indexstar without access to a real indexer.
+package mockbackend
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	mediaTypeNDJson = "application/x-ndjson"
+	mediaTypeJson   = "application/json"
+)
+
+// Backend is an in-memory IPNI backend. It implements http.Handler and serves:
+//   - GET /cid/{cid} and /multihash/{multihash}, as JSON or NDJSON depending
+//     on the Accept header,
+//   - GET /providers and /providers/{peer-id},
+//   - GET /health.
+//
+// Encrypted lookups and metadata are not supported and always respond with
+// 404. Backend is safe for concurrent use.
+type Backend struct {
+	mu        sync.RWMutex
+	providers map[peer.ID]model.ProviderInfo
+	results   map[string][]model.ProviderResult
+}
+
+// New instantiates an empty Backend.
+func New() *Backend {
+	return &Backend{
+		providers: make(map[peer.ID]model.ProviderInfo),
+		results:   make(map[string][]model.ProviderResult),
+	}
+}
+
+// PutProvider adds or replaces the information about a provider, returned by
+// the providers endpoints.
+func (b *Backend) PutProvider(info model.ProviderInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.providers[info.AddrInfo.ID] = info
+}
+
+// Put adds provider results for the given multihash.
+func (b *Backend) Put(mh multihash.Multihash, results ...model.ProviderResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.results[string(mh)] = append(b.results[string(mh)], results...)
+}
+
+// Remove removes all provider results for the given multihash.
+func (b *Backend) Remove(mh multihash.Multihash) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.results, string(mh))
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/cid/"):
+		c, err := cid.Decode(path.Base(r.URL.Path))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		b.find(w, r, c.Hash())
+	case strings.HasPrefix(r.URL.Path, "/multihash/"):
+		mh, err := multihash.FromB58String(path.Base(r.URL.Path))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		b.find(w, r, mh)
+	case r.URL.Path == "/providers":
+		b.listProviders(w)
+	case strings.HasPrefix(r.URL.Path, "/providers/"):
+		b.getProvider(w, r)
+	case r.URL.Path == "/health":
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write([]byte("ready"))
+	default:
+		http.Error(w, "", http.StatusNotFound)
+	}
+}
+
+func (b *Backend) find(w http.ResponseWriter, r *http.Request, mh multihash.Multihash) {
+	b.mu.RLock()
+	results := b.results[string(mh)]
+	b.mu.RUnlock()
+	if len(results) == 0 {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), mediaTypeNDJson) {
+		w.Header().Set("Content-Type", mediaTypeNDJson)
+		encoder := json.NewEncoder(w)
+		for _, result := range results {
+			if err := encoder.Encode(result); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	data, err := model.MarshalFindResponse(&model.FindResponse{
+		MultihashResults: []model.MultihashResult{{
+			Multihash:       mh,
+			ProviderResults: results,
+		}},
+	})
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, data)
+}
+
+func (b *Backend) listProviders(w http.ResponseWriter) {
+	b.mu.RLock()
+	infos := make([]model.ProviderInfo, 0, len(b.providers))
+	for _, info := range b.providers {
+		infos = append(infos, info)
+	}
+	b.mu.RUnlock()
+
+	data, err := json.Marshal(infos)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, data)
+}
+
+func (b *Backend) getProvider(w http.ResponseWriter, r *http.Request) {
+	pid, err := peer.Decode(path.Base(r.URL.Path))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	b.mu.RLock()
+	info, ok := b.providers[pid]
+	b.mu.RUnlock()
+	if !ok {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, data)
+}
+
+func writeJson(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", mediaTypeJson)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,73 @@
+package mockbackend_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackend_Find(t *testing.T) {
+	subject := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer subject.Close()
+
+	resp, err := http.Get(subject.URL + "/cid/" + mockbackend.SampleCids[0])
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	found, err := model.UnmarshalFindResponse(data)
+	require.NoError(t, err)
+	require.Len(t, found.MultihashResults, 1)
+	require.Len(t, found.MultihashResults[0].ProviderResults, 2)
+
+	req, err := http.NewRequest(http.MethodGet, subject.URL+"/multihash/"+mockbackend.SampleCids[2], nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	scanner := bufio.NewScanner(resp.Body)
+	require.True(t, scanner.Scan())
+	var result model.ProviderResult
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+	require.Equal(t, mockbackend.SampleProviders[1], result.Provider.ID.String())
+	require.False(t, scanner.Scan())
+
+	resp, err = http.Get(subject.URL + "/multihash/QmPNHBy5h7f19yJDt7ip9TvmMRbqmYsa6aetkrsc1ghjLB")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestBackend_Providers(t *testing.T) {
+	subject := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer subject.Close()
+
+	resp, err := http.Get(subject.URL + "/providers")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var infos []model.ProviderInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&infos))
+	require.Len(t, infos, len(mockbackend.SampleProviders))
+
+	resp, err = http.Get(subject.URL + "/providers/" + mockbackend.SampleProviders[0])
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var info model.ProviderInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	require.Equal(t, mockbackend.SampleProviders[0], info.AddrInfo.ID.String())
+
+	resp, err = http.Get(subject.URL + "/providers/12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
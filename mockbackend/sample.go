@@ -0,0 +1,73 @@
+package mockbackend
+
+import (
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// SampleCids are the CIDs for which a Backend instantiated via
+// NewWithSampleData returns provider records.
+var SampleCids = []string{
+	// Provided by both sample providers over bitswap and HTTP respectively.
+	"bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e",
+	// Provided by the bitswap sample provider only.
+	"bafkreiesyjwgvt5yeicy4kqrhjbl5tmxmrobt55zgf5xj2i6sb5j2jf6hq",
+	// Provided by the HTTP sample provider only.
+	"QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH",
+}
+
+// SampleProviders are the peer IDs of providers known to a Backend
+// instantiated via NewWithSampleData.
+var SampleProviders = []string{
+	"12D3KooWJj44TLtZhkRapBX2ChKo3hXhSzLKw3HyJADDpcUzkNr2",
+	"12D3KooWNas8WHaPAnzotPJpnF3KnrDf6ZFaRACcBapf4Gwfk5Dg",
+}
+
+// NewWithSampleData instantiates a Backend pre-loaded with records of
+// SampleProviders providing SampleCids.
+func NewWithSampleData() *Backend {
+	b := New()
+
+	bitswap := sampleProvider(SampleProviders[0], "/ip4/127.0.0.1/tcp/4001")
+	httpProvider := sampleProvider(SampleProviders[1], "/dns4/example.com/tcp/443/https")
+	b.PutProvider(bitswap)
+	b.PutProvider(httpProvider)
+
+	bitswapResult := sampleResult(bitswap, metadata.Bitswap{})
+	httpResult := sampleResult(httpProvider, &metadata.IpfsGatewayHttp{})
+	b.Put(cid.MustParse(SampleCids[0]).Hash(), bitswapResult, httpResult)
+	b.Put(cid.MustParse(SampleCids[1]).Hash(), bitswapResult)
+	b.Put(cid.MustParse(SampleCids[2]).Hash(), httpResult)
+	return b
+}
+
+func sampleProvider(id, addr string) model.ProviderInfo {
+	return model.ProviderInfo{
+		AddrInfo: peer.AddrInfo{
+			ID:    must(peer.Decode(id)),
+			Addrs: []multiaddr.Multiaddr{must(multiaddr.NewMultiaddr(addr))},
+		},
+		LastAdvertisementTime: time.Now().Format(time.RFC3339),
+	}
+}
+
+func sampleResult(info model.ProviderInfo, protocol metadata.Protocol) model.ProviderResult {
+	md := metadata.Default.New(protocol)
+	return model.ProviderResult{
+		ContextID: []byte("sample"),
+		Metadata:  must(md.MarshalBinary()),
+		Provider:  &info.AddrInfo,
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
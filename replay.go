@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipni/indexstar/router"
+	"github.com/urfave/cli/v2"
+)
+
+var replayCommand = &cli.Command{
+	Name:  "replay",
+	Usage: "Replays captured find requests against a target",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:      "capture",
+			Usage:     "Path to the file of captured requests",
+			TakesFile: true,
+			Required:  true,
+		},
+		&cli.StringFlag{
+			Name:     "target",
+			Usage:    "Base URL of the target to replay requests against, e.g. a backend or another indexstar",
+			Required: true,
+		},
+		&cli.Float64Flag{
+			Name:  "rate",
+			Usage: "Requests per second to replay at",
+			Value: 10,
+		},
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "Maximum number of concurrent in-flight requests",
+			Value: 16,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		target, err := url.Parse(cctx.String("target"))
+		if err != nil {
+			return fmt.Errorf("invalid target: %w", err)
+		}
+		if cctx.Float64("rate") <= 0 {
+			return fmt.Errorf("rate must be positive")
+		}
+		f, err := os.Open(cctx.String("capture"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		report, err := replay(cctx.Context, f, target, cctx.Float64("rate"), cctx.Int("concurrency"))
+		if err != nil {
+			return err
+		}
+		report.print(cctx.App.Writer)
+		return nil
+	},
+}
+
+// replayReport summarizes the outcome of replayed requests.
+type replayReport struct {
+	mu        sync.Mutex
+	statuses  map[int]int
+	errors    int
+	latencies []time.Duration
+}
+
+func (rr *replayReport) record(status int, latency time.Duration, err error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if err != nil {
+		rr.errors++
+		return
+	}
+	rr.statuses[status]++
+	rr.latencies = append(rr.latencies, latency)
+}
+
+func (rr *replayReport) print(w io.Writer) {
+	slices.Sort(rr.latencies)
+	fmt.Fprintf(w, "requests: %d, errors: %d\n", len(rr.latencies)+rr.errors, rr.errors)
+	statuses := make([]int, 0, len(rr.statuses))
+	for status := range rr.statuses {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "status %d: %d\n", status, rr.statuses[status])
+	}
+	if len(rr.latencies) == 0 {
+		return
+	}
+	for _, p := range []float64{50, 90, 99} {
+		fmt.Fprintf(w, "p%.0f latency: %s\n", p, percentile(rr.latencies, p))
+	}
+	fmt.Fprintf(w, "max latency: %s\n", rr.latencies[len(rr.latencies)-1])
+}
+
+// percentile returns the p-th percentile of the given sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+// replay sends the captured requests read from r to the target at the given
+// rate, with at most the given number of requests in flight.
+func replay(ctx context.Context, r io.Reader, target *url.URL, rate float64, concurrency int) (*replayReport, error) {
+	report := &replayReport{statuses: make(map[int]int)}
+	client, err := router.NewBackendClient(router.BackendConfig{URL: target.String()})
+	if err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var cr router.CapturedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &cr); err != nil {
+			return nil, fmt.Errorf("invalid captured request: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		case <-ticker.C:
+		}
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			status, latency, err := replayRequest(ctx, client, target, cr)
+			report.record(status, latency, err)
+		}()
+	}
+	return report, scanner.Err()
+}
+
+func replayRequest(ctx context.Context, client *http.Client, target *url.URL, cr router.CapturedRequest) (int, time.Duration, error) {
+	endpoint := *target
+	endpoint.Path = cr.Path
+	endpoint.RawQuery = cr.Query
+	req, err := http.NewRequestWithContext(ctx, cr.Method, endpoint.String(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if cr.Accept != "" {
+		req.Header.Set("Accept", cr.Accept)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	// Read the whole body, so that latency includes streamed responses.
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return 0, 0, err
+	}
+	return resp.StatusCode, time.Since(start), nil
+}
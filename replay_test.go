@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipni/indexstar/router"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	var gotURIs []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		gotURIs = append(gotURIs, r.URL.RequestURI())
+		mu.Unlock()
+		if r.Header.Get("Accept") == router.MediaTypeNDJson {
+			http.Error(w, "", http.StatusNotFound)
+		}
+	}))
+	defer target.Close()
+
+	var capture strings.Builder
+	encoder := json.NewEncoder(&capture)
+	require.NoError(t, encoder.Encode(router.CapturedRequest{Method: http.MethodGet, Path: "/multihash/fish", Query: "cascade=ipfs-dht"}))
+	require.NoError(t, encoder.Encode(router.CapturedRequest{Method: http.MethodGet, Path: "/cid/lobster", Accept: router.MediaTypeNDJson}))
+
+	targetURL, err := url.Parse(target.URL)
+	require.NoError(t, err)
+	report, err := replay(context.Background(), strings.NewReader(capture.String()), targetURL, 100, 2)
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []string{"/multihash/fish?cascade=ipfs-dht", "/cid/lobster"}, gotURIs)
+	require.Equal(t, map[int]int{http.StatusOK: 1, http.StatusNotFound: 1}, report.statuses)
+	require.Zero(t, report.errors)
+}
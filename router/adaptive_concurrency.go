@@ -0,0 +1,127 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// adaptiveConcurrency holds the adaptive concurrency limit of each backend
+// scattered to. A nil adaptiveConcurrency does not limit backends.
+type adaptiveConcurrency struct {
+	mu       sync.Mutex
+	backends map[string]*aimdLimiter
+}
+
+func newAdaptiveConcurrency() *adaptiveConcurrency {
+	return &adaptiveConcurrency{backends: make(map[string]*aimdLimiter)}
+}
+
+// acquire admits a request scattered to the given backend, unless it is at its
+// concurrency limit, and returns the limiter of the backend, which must be
+// released once the request is done. A nil limiter is returned if backends are
+// not limited.
+func (c *adaptiveConcurrency) acquire(b Backend) (*aimdLimiter, bool) {
+	if c == nil {
+		return nil, true
+	}
+	key := clusterKey(b)
+	c.mu.Lock()
+	l := c.backends[key]
+	if l == nil {
+		l = newAIMDLimiter(b.URL().Host)
+		c.backends[key] = l
+	}
+	c.mu.Unlock()
+	if !l.acquire() {
+		l.record(metrics.BackendConcurrencyShed.M(1))
+		return nil, false
+	}
+	return l, true
+}
+
+// aimdLimiter limits the concurrent requests scattered to a backend by
+// additive increase and multiplicative decrease of the limit, as per the
+// configured concurrency settings: the limit grows by one for every limit's
+// worth of requests that succeed, and shrinks by the backoff factor whenever
+// one fails, so that pressure on a degrading backend eases well before its
+// circuit trips and recovers gradually once the backend does.
+type aimdLimiter struct {
+	host string
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+}
+
+func newAIMDLimiter(host string) *aimdLimiter {
+	l := &aimdLimiter{host: host, limit: float64(config.Concurrency.InitialLimit)}
+	l.record(metrics.BackendConcurrencyLimit.M(l.limit))
+	return l
+}
+
+func (l *aimdLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= max(int(l.limit), 1) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// release stops counting a request admitted by acquire.
+func (l *aimdLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+}
+
+// observe adapts the limit to the outcome of a request that took the given
+// time and failed with the given error, if any.
+func (l *aimdLimiter) observe(elapsed time.Duration, err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil || (config.Concurrency.LatencyThreshold > 0 && elapsed > config.Concurrency.LatencyThreshold) {
+		backoff := config.Concurrency.Backoff
+		if backoff <= 0 || backoff >= 1 {
+			backoff = defaultConcurrencyBackoff
+		}
+		l.limit *= backoff
+	} else {
+		l.limit += 1 / l.limit
+	}
+	l.limit = min(max(l.limit, float64(config.Concurrency.MinLimit), 1), float64(max(config.Concurrency.MaxLimit, config.Concurrency.MinLimit, 1)))
+	l.record(metrics.BackendConcurrencyLimit.M(l.limit))
+}
+
+func (l *aimdLimiter) record(ms ...stats.Measurement) {
+	_ = stats.RecordWithOptions(context.Background(),
+		stats.WithTags(tag.Insert(metrics.Backend, l.host)),
+		stats.WithMeasurements(ms...))
+}
+
+// observeConcurrency adapts the concurrency limit of the backend scattered to
+// with the given context to the outcome of its request. Requests cut short by
+// the client, or by a deadline overridden or shortened for the request, say
+// nothing of the backend and are not observed.
+func (sg *scatterGather[B, R]) observeConcurrency(ctx context.Context, l *aimdLimiter, elapsed time.Duration, err error) {
+	if l == nil || ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) && deadlineShortened(ctx) {
+		return
+	}
+	l.observe(elapsed, err)
+}
@@ -0,0 +1,93 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAIMDLimiter_AdaptsLimit(t *testing.T) {
+	defer func(old int) { config.Concurrency.InitialLimit = old }(config.Concurrency.InitialLimit)
+	defer func(old int) { config.Concurrency.MinLimit = old }(config.Concurrency.MinLimit)
+	defer func(old int) { config.Concurrency.MaxLimit = old }(config.Concurrency.MaxLimit)
+	defer func(old time.Duration) { config.Concurrency.LatencyThreshold = old }(config.Concurrency.LatencyThreshold)
+	defer func(old float64) { config.Concurrency.Backoff = old }(config.Concurrency.Backoff)
+	config.Concurrency.InitialLimit = 4
+	config.Concurrency.MinLimit = 2
+	config.Concurrency.MaxLimit = 5
+	config.Concurrency.LatencyThreshold = time.Second
+	config.Concurrency.Backoff = 0.5
+
+	l := newAIMDLimiter("fish")
+	for range 4 {
+		require.True(t, l.acquire())
+	}
+	require.False(t, l.acquire())
+	l.release()
+
+	// A limit's worth of successes raises the limit by one.
+	for range 4 {
+		l.observe(time.Millisecond, nil)
+	}
+	require.InDelta(t, 5, l.limit, 0.1)
+	for range 20 {
+		l.observe(time.Millisecond, nil)
+	}
+	require.Equal(t, 5.0, l.limit)
+
+	l.observe(time.Millisecond, errors.New("fish"))
+	require.Equal(t, 2.5, l.limit)
+	// Slow successes count as failures.
+	l.observe(2*time.Second, nil)
+	require.Equal(t, 2.0, l.limit)
+	require.False(t, l.acquire())
+}
+
+func TestScatterGather_SkipsBackendsAtConcurrencyLimit(t *testing.T) {
+	defer func(old int) { config.Concurrency.InitialLimit = old }(config.Concurrency.InitialLimit)
+	config.Concurrency.InitialLimit = 2
+
+	// Test backends share a URL, and so a concurrency limit.
+	subject := scatterGather[testBackend, string]{
+		backends:    []testBackend{testBackend(1), testBackend(2), testBackend(3)},
+		maxWait:     time.Second,
+		concurrency: newAdaptiveConcurrency(),
+	}
+	ctx := context.Background()
+	require.NoError(t, subject.scatter(ctx, func(context.Context, testBackend) (*string, error) {
+		fish := "fish"
+		return &fish, nil
+	}))
+	var got int
+	for range subject.gather(ctx) {
+		got++
+	}
+	require.Equal(t, 2, got)
+	require.Equal(t, []testBackend{testBackend(3)}, subject.concurrencyLimited)
+	require.Empty(t, subject.circuitOpen)
+
+	// Requests done are released from the limit.
+	subject = scatterGather[testBackend, string]{
+		backends:    subject.backends,
+		maxWait:     time.Second,
+		concurrency: subject.concurrency,
+	}
+	require.NoError(t, subject.scatter(ctx, func(context.Context, testBackend) (*string, error) { return nil, nil }))
+	for range subject.gather(ctx) {
+	}
+	require.Len(t, subject.concurrencyLimited, 1)
+}
+
+func TestBackendOutcomes_ConcurrencyLimitedBackendsConfirmNoAbsence(t *testing.T) {
+	b, err := NewBackend("http://fish.invalid", nil, Matchers.Any, nil)
+	require.NoError(t, err)
+
+	var subject backendOutcomes
+	subject.notFound.Add(1)
+	require.True(t, subject.confirmedAbsent(nil, nil, false))
+	// Backends shed at their concurrency limit were not consulted.
+	require.False(t, subject.confirmedAbsent(nil, []Backend{b}, false))
+}
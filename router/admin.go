@@ -0,0 +1,112 @@
+package router
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	adminPathPrefix     = "/admin/"
+	adminCachePath      = adminPathPrefix + "cache"
+	adminUsagePath      = adminPathPrefix + "usage"
+	adminLogPath        = adminPathPrefix + "log"
+	adminReloadPath     = adminPathPrefix + "reload"
+	adminReputationPath = adminPathPrefix + "reputation"
+)
+
+// cachePurge is the response to a cache purge request.
+type cachePurge struct {
+	// Purged is the number of cached results and delegated routing
+	// responses evicted.
+	Purged int
+}
+
+// adminHandler serves the given admin endpoint to requests that carry the
+// configured admin token as their bearer token.
+func adminHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.Server.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// purgeCache evicts cached find results, so that operators can purge stale or
+// removed results immediately rather than waiting for them to expire.
+// Cached delegated routing responses are evicted alongside.
+// DELETE /admin/cache/{multihash} evicts the results of a multihash, which
+// may also be given as a CID, and DELETE /admin/cache evicts every result.
+// GET /admin/cache serves the cumulative cache statistics.
+func (s *Server) purgeCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == adminCachePath {
+		s.serveCacheStatistics(w)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var mh multihash.Multihash
+	if arg := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminCachePath), "/"); arg != "" {
+		var err error
+		if mh, err = parseMultihash(arg); err != nil {
+			c, cidErr := cid.Decode(arg)
+			if cidErr != nil {
+				http.Error(w, "invalid multihash: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			mh = c.Hash()
+		}
+	}
+
+	var resp cachePurge
+	switch {
+	case s.cache == nil:
+	case mh == nil:
+		resp.Purged = s.cache.flush()
+		log.Infow("Flushed result cache", "purged", resp.Purged)
+	default:
+		resp.Purged = s.cache.purge(mh)
+		log.Infow("Purged cached results of multihash", "multihash", mh.B58String(), "purged", resp.Purged)
+	}
+	switch {
+	case s.delegatedCache == nil:
+	case mh == nil:
+		resp.Purged += s.delegatedCache.flush()
+	default:
+		resp.Purged += s.delegatedCache.purge(mh)
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Errorw("Failed to marshal cache purge response", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, data)
+}
+
+func (s *Server) serveCacheStatistics(w http.ResponseWriter) {
+	var stats resultCacheStats
+	if s.cache != nil {
+		stats = s.cache.statistics()
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		log.Errorw("Failed to marshal cache statistics", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, data)
+}
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin_PurgesCachedResults(t *testing.T) {
+	defer func(old time.Duration) { config.Cache.TTL = old }(config.Cache.TTL)
+	defer func(old string) { config.Server.AdminToken = old }(config.Server.AdminToken)
+	config.Cache.TTL = time.Hour
+	config.Server.AdminToken = "fish"
+
+	var finds atomic.Int32
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/providers") {
+			finds.Add(1)
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(target string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	purge := func(target, token string) (int, cachePurge) {
+		req := httptest.NewRequest(http.MethodDelete, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		var got cachePurge
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		}
+		return rec.Code, got
+	}
+
+	mh := cid.MustParse(mockbackend.SampleCids[0]).Hash().B58String()
+	find("/cid/" + mockbackend.SampleCids[0])
+	find("/multihash/" + mh)
+	find("/cid/" + mockbackend.SampleCids[1])
+	require.Equal(t, int32(6), finds.Load())
+
+	code, _ := purge("/admin/cache/"+mh, "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = purge("/admin/cache/"+mh, "lobster")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	// Results of a multihash are purged whether looked up by CID or multihash.
+	code, got := purge("/admin/cache/"+mh, "fish")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, cachePurge{Purged: 2}, got)
+	find("/cid/" + mockbackend.SampleCids[0])
+	find("/cid/" + mockbackend.SampleCids[1])
+	require.Equal(t, int32(8), finds.Load())
+
+	code, got = purge("/admin/cache", "fish")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, cachePurge{Purged: 2}, got)
+	find("/cid/" + mockbackend.SampleCids[1])
+	require.Equal(t, int32(10), finds.Load())
+
+	code, _ = purge("/admin/cache/fish", "fish")
+	require.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,237 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The provider records returned by backends are merged into responses by the
+// aggregation engine below, whatever the endpoint. Endpoints pick a dedup key
+// rather than comparing records themselves, so that they agree on which records
+// are duplicates and on which of conflicting records is kept.
+
+type (
+	// dedupKey writes the key by which records are duplicates of one another
+	// to the given digest.
+	dedupKey[T any] func(d *xxhash.Digest, v T)
+
+	// dedupSet tracks the keys of the records gathered so far, to tell apart
+	// records that duplicate them. Of duplicate records the first gathered is
+	// kept.
+	dedupSet[T any] struct {
+		key        dedupKey[T]
+		keys       map[uint64]struct{}
+		digest     *xxhash.Digest
+		maxSize    int
+		count      int
+		overflowed bool
+	}
+
+	// resultSet deduplicates the provider records of find responses.
+	resultSet = dedupSet[*encryptedOrPlainResult]
+)
+
+// newDedupSet instantiates a set that deduplicates records by the given key,
+// and tracks up to maxSize keys if positive.
+func newDedupSet[T any](maxSize int, key dedupKey[T]) *dedupSet[T] {
+	return &dedupSet[T]{
+		key:     key,
+		keys:    make(map[uint64]struct{}),
+		digest:  xxhash.New(),
+		maxSize: maxSize,
+	}
+}
+
+// newResultSet instantiates a set that deduplicates provider records by
+// byRecord.
+func newResultSet(maxSize int) *resultSet {
+	return newDedupSet(maxSize, byRecord)
+}
+
+// putIfAbsent tracks the given record and returns whether it is not a duplicate
+// of any tracked so far.
+func (s *dedupSet[T]) putIfAbsent(v T) bool {
+	// Keys are 64-bit xxhashes, which make false-positive collisions negligible
+	// within a lookup request, while offering a small memory footprint compared
+	// to storing complete keys.
+	s.digest.Reset()
+	s.key(s.digest, v)
+	key := s.digest.Sum64()
+	if _, seen := s.keys[key]; seen {
+		return false
+	}
+	s.count++
+	// Once the upper bound is reached stop tracking new keys, so that multihashes
+	// with huge provider sets cannot grow memory unboundedly. Records beyond the
+	// bound are passed through without deduplication.
+	if s.maxSize > 0 && len(s.keys) >= s.maxSize {
+		if !s.overflowed {
+			s.overflowed = true
+			log.Warnw("Result deduplication limit reached; passing through remaining results", "limit", s.maxSize)
+		}
+		return true
+	}
+	s.keys[key] = struct{}{}
+	return true
+}
+
+// len returns the number of distinct records accepted by the set.
+func (s *dedupSet[T]) len() int {
+	return s.count
+}
+
+// writeKeyField writes the given field of a key prefixed by its length, so
+// that keys of different fields cannot collide by concatenation.
+func writeKeyField(d *xxhash.Digest, field []byte) {
+	var l [binary.MaxVarintLen64]byte
+	_, _ = d.Write(l[:binary.PutUvarint(l[:], uint64(len(field)))])
+	_, _ = d.Write(field)
+}
+
+func writeRecordKey(d *xxhash.Digest, r *encryptedOrPlainResult, withMetadata bool) {
+	if len(r.EncryptedValueKey) > 0 {
+		writeKeyField(d, r.EncryptedValueKey)
+		return
+	}
+	var id []byte
+	if r.Provider != nil {
+		id = []byte(r.Provider.ID)
+	}
+	writeKeyField(d, id)
+	writeKeyField(d, r.ContextID)
+	if withMetadata {
+		writeKeyField(d, r.Metadata)
+	}
+}
+
+// byRecord keys provider records by provider, context ID and metadata, so
+// that records of the same provider and context that conflict in metadata are
+// all kept. Encrypted records are keyed by their encrypted value key.
+func byRecord(d *xxhash.Digest, r *encryptedOrPlainResult) {
+	writeRecordKey(d, r, true)
+}
+
+// byValueKey keys provider records by provider and context ID, i.e. the value
+// key by which indexers store them, so that of records that conflict in
+// metadata only the first gathered is kept. Encrypted records are keyed by
+// their encrypted value key.
+func byValueKey(d *xxhash.Digest, r *encryptedOrPlainResult) {
+	writeRecordKey(d, r, false)
+}
+
+// mergeFindResponse merges the records of the given backend response into the
+// aggregated response, skipping those the given set deems duplicates, and
+// returns whether any record was merged. A response for a different multihash
+// than that of the records merged so far conflicts with them, and fails the
+// merge.
+func mergeFindResponse(into, from *model.FindResponse, seen *resultSet) (bool, error) {
+	var merged bool
+	if len(from.MultihashResults) > 0 {
+		mr := from.MultihashResults[0]
+		if len(into.MultihashResults) > 0 && !bytes.Equal(into.MultihashResults[0].Multihash, mr.Multihash) {
+			return false, fmt.Errorf("conflicting results: first %s, second %s", into.MultihashResults[0].Multihash, mr.Multihash)
+		}
+		for _, pr := range mr.ProviderResults {
+			if !seen.putIfAbsent(&encryptedOrPlainResult{ProviderResult: pr}) {
+				continue
+			}
+			if len(into.MultihashResults) == 0 {
+				into.MultihashResults = []model.MultihashResult{{Multihash: mr.Multihash}}
+			}
+			into.MultihashResults[0].ProviderResults = append(into.MultihashResults[0].ProviderResults, pr)
+			merged = true
+		}
+	}
+	if len(from.EncryptedMultihashResults) > 0 {
+		emr := from.EncryptedMultihashResults[0]
+		if len(into.EncryptedMultihashResults) > 0 && !bytes.Equal(into.EncryptedMultihashResults[0].Multihash, emr.Multihash) {
+			return false, fmt.Errorf("conflicting encrypted results: first %s, second %s", into.EncryptedMultihashResults[0].Multihash, emr.Multihash)
+		}
+		for _, evk := range emr.EncryptedValueKeys {
+			if !seen.putIfAbsent(&encryptedOrPlainResult{EncryptedValueKey: evk}) {
+				continue
+			}
+			if len(into.EncryptedMultihashResults) == 0 {
+				into.EncryptedMultihashResults = []model.EncryptedMultihashResult{{Multihash: emr.Multihash}}
+			}
+			into.EncryptedMultihashResults[0].EncryptedValueKeys = append(into.EncryptedMultihashResults[0].EncryptedValueKeys, evk)
+			merged = true
+		}
+	}
+	return merged, nil
+}
+
+// mergeProviderInfo merges the given information on the same provider returned
+// by different backends. The information of the backend that received the
+// latest advertisement of the provider wins, except that extended providers
+// are the union of those known to either.
+func mergeProviderInfo(a, b *model.ProviderInfo) *model.ProviderInfo {
+	if advertisedAt(b).After(advertisedAt(a)) {
+		a, b = b, a
+	}
+	merged := *a
+	merged.ExtendedProviders = mergeExtendedProviders(a.ExtendedProviders, b.ExtendedProviders)
+	return &merged
+}
+
+func advertisedAt(pi *model.ProviderInfo) time.Time {
+	t, _ := time.Parse(time.RFC3339, pi.LastAdvertisementTime)
+	return t
+}
+
+// mergeExtendedProviders returns the union of the given extended providers, of
+// which the first wins on conflict.
+func mergeExtendedProviders(a, b *model.ExtendedProviders) *model.ExtendedProviders {
+	if a == nil || b == nil {
+		if a == nil {
+			return b
+		}
+		return a
+	}
+	merged := &model.ExtendedProviders{
+		Providers: unionAddrInfos(a.Providers, b.Providers),
+		Metadatas: unionBytes(a.Metadatas, b.Metadatas),
+	}
+	merged.Contextual = append(merged.Contextual, a.Contextual...)
+	for _, bc := range b.Contextual {
+		i := slices.IndexFunc(merged.Contextual, func(c model.ContextualExtendedProviders) bool { return c.ContextID == bc.ContextID })
+		if i < 0 {
+			merged.Contextual = append(merged.Contextual, bc)
+			continue
+		}
+		c := merged.Contextual[i]
+		c.Providers = unionAddrInfos(c.Providers, bc.Providers)
+		c.Metadatas = unionBytes(c.Metadatas, bc.Metadatas)
+		merged.Contextual[i] = c
+	}
+	return merged
+}
+
+// unionAddrInfos returns the union of the given providers by ID, of which the
+// first wins on conflict.
+func unionAddrInfos(a, b []peer.AddrInfo) []peer.AddrInfo {
+	union := slices.Clone(a)
+	for _, ai := range b {
+		if !slices.ContainsFunc(union, func(u peer.AddrInfo) bool { return u.ID == ai.ID }) {
+			union = append(union, ai)
+		}
+	}
+	return union
+}
+
+func unionBytes(a, b [][]byte) [][]byte {
+	union := slices.Clone(a)
+	for _, v := range b {
+		if !slices.ContainsFunc(union, func(u []byte) bool { return bytes.Equal(u, v) }) {
+			union = append(union, v)
+		}
+	}
+	return union
+}
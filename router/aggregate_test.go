@@ -0,0 +1,220 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultSet_PutIfAbsent(t *testing.T) {
+	subject := newResultSet(0)
+
+	first := &encryptedOrPlainResult{ProviderResult: model.ProviderResult{
+		ContextID: []byte("fish"),
+		Provider:  &peer.AddrInfo{ID: "lobster"},
+	}}
+	second := &encryptedOrPlainResult{ProviderResult: model.ProviderResult{
+		ContextID: []byte("fish"),
+		Provider:  &peer.AddrInfo{ID: "crab"},
+	}}
+	encrypted := &encryptedOrPlainResult{EncryptedValueKey: []byte("undersea")}
+
+	require.True(t, subject.putIfAbsent(first))
+	require.False(t, subject.putIfAbsent(first))
+	require.True(t, subject.putIfAbsent(second))
+	require.True(t, subject.putIfAbsent(encrypted))
+	require.False(t, subject.putIfAbsent(encrypted))
+	require.Equal(t, 3, subject.len())
+}
+
+func TestResultSet_StopsTrackingBeyondMaxSize(t *testing.T) {
+	subject := newResultSet(1)
+
+	first := &encryptedOrPlainResult{EncryptedValueKey: []byte("fish")}
+	second := &encryptedOrPlainResult{EncryptedValueKey: []byte("lobster")}
+
+	require.True(t, subject.putIfAbsent(first))
+	require.False(t, subject.putIfAbsent(first))
+	// Beyond the bound results are no longer tracked and so are always accepted.
+	require.True(t, subject.putIfAbsent(second))
+	require.True(t, subject.putIfAbsent(second))
+	require.Len(t, subject.keys, 1)
+	require.Equal(t, 3, subject.len())
+}
+
+func TestResultSet_FieldsDoNotCollideByConcatenation(t *testing.T) {
+	subject := newResultSet(0)
+
+	require.True(t, subject.putIfAbsent(&encryptedOrPlainResult{ProviderResult: model.ProviderResult{
+		ContextID: []byte("fish"),
+		Provider:  &peer.AddrInfo{ID: "lob"},
+	}}))
+	require.True(t, subject.putIfAbsent(&encryptedOrPlainResult{ProviderResult: model.ProviderResult{
+		ContextID: []byte("sterfish"),
+		Provider:  &peer.AddrInfo{ID: "lob"},
+	}}))
+	require.True(t, subject.putIfAbsent(&encryptedOrPlainResult{ProviderResult: model.ProviderResult{
+		ContextID: []byte("fish"),
+		Provider:  &peer.AddrInfo{ID: "lobster"},
+	}}))
+}
+
+func TestMergeFindResponse(t *testing.T) {
+	mh, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	lobster := model.ProviderResult{ContextID: []byte("fish"), Metadata: []byte("a"), Provider: &peer.AddrInfo{ID: "lobster"}}
+	lobsterConflict := model.ProviderResult{ContextID: []byte("fish"), Metadata: []byte("b"), Provider: &peer.AddrInfo{ID: "lobster"}}
+	crab := model.ProviderResult{ContextID: []byte("fish"), Provider: &peer.AddrInfo{ID: "crab"}}
+	shrimp := model.ProviderResult{ContextID: []byte("fish"), Provider: &peer.AddrInfo{ID: "shrimp"}}
+	response := func(prs ...model.ProviderResult) *model.FindResponse {
+		return &model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: mh, ProviderResults: prs}}}
+	}
+
+	t.Run("by value key", func(t *testing.T) {
+		var resp model.FindResponse
+		seen := newDedupSet(0, byValueKey)
+
+		merged, err := mergeFindResponse(&resp, response(lobster, crab), seen)
+		require.NoError(t, err)
+		require.True(t, merged)
+		// Records after a duplicate are merged too.
+		merged, err = mergeFindResponse(&resp, response(crab, lobsterConflict, shrimp), seen)
+		require.NoError(t, err)
+		require.True(t, merged)
+		merged, err = mergeFindResponse(&resp, response(shrimp), seen)
+		require.NoError(t, err)
+		require.False(t, merged)
+
+		require.Len(t, resp.MultihashResults, 1)
+		require.Equal(t, mh, resp.MultihashResults[0].Multihash)
+		// Of conflicting records the first is kept.
+		require.Equal(t, []model.ProviderResult{lobster, crab, shrimp}, resp.MultihashResults[0].ProviderResults)
+	})
+
+	t.Run("by record", func(t *testing.T) {
+		var resp model.FindResponse
+		seen := newResultSet(0)
+
+		_, err := mergeFindResponse(&resp, response(lobster), seen)
+		require.NoError(t, err)
+		merged, err := mergeFindResponse(&resp, response(lobster, lobsterConflict), seen)
+		require.NoError(t, err)
+		require.True(t, merged)
+		require.Equal(t, []model.ProviderResult{lobster, lobsterConflict}, resp.MultihashResults[0].ProviderResults)
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		var resp model.FindResponse
+		seen := newDedupSet(0, byValueKey)
+		encrypted := func(evks ...string) *model.FindResponse {
+			emr := model.EncryptedMultihashResult{Multihash: mh}
+			for _, evk := range evks {
+				emr.EncryptedValueKeys = append(emr.EncryptedValueKeys, []byte(evk))
+			}
+			return &model.FindResponse{EncryptedMultihashResults: []model.EncryptedMultihashResult{emr}}
+		}
+
+		_, err := mergeFindResponse(&resp, encrypted("fish", "lobster"), seen)
+		require.NoError(t, err)
+		merged, err := mergeFindResponse(&resp, encrypted("lobster", "crab"), seen)
+		require.NoError(t, err)
+		require.True(t, merged)
+		require.Empty(t, resp.MultihashResults)
+		require.Equal(t, [][]byte{[]byte("fish"), []byte("lobster"), []byte("crab")}, resp.EncryptedMultihashResults[0].EncryptedValueKeys)
+	})
+
+	t.Run("conflicting multihash", func(t *testing.T) {
+		other, err := multihash.Sum([]byte("lobster"), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		var resp model.FindResponse
+		seen := newResultSet(0)
+
+		_, err = mergeFindResponse(&resp, response(lobster), seen)
+		require.NoError(t, err)
+		_, err = mergeFindResponse(&resp, &model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: other, ProviderResults: []model.ProviderResult{crab}}}}, seen)
+		require.ErrorContains(t, err, "conflicting results")
+		require.Len(t, resp.MultihashResults[0].ProviderResults, 1)
+	})
+
+	t.Run("no records", func(t *testing.T) {
+		var resp model.FindResponse
+
+		merged, err := mergeFindResponse(&resp, response(), newResultSet(0))
+		require.NoError(t, err)
+		require.False(t, merged)
+		require.Empty(t, resp.MultihashResults)
+	})
+}
+
+func TestDrResp_AppendDeduplicates(t *testing.T) {
+	subject := newDrResp()
+	first := &drProvider{
+		Protocols: []string{"transport-bitswap", "transport-graphsync-filecoinv1"},
+		Schema:    peerSchema,
+		ID:        "lobster",
+		Metadata:  map[string][]byte{"transport-bitswap": []byte("a"), "transport-graphsync-filecoinv1": []byte("b")},
+	}
+	require.True(t, subject.append(first))
+	// A record equal in all but addresses is a duplicate, whatever the order
+	// its metadata is iterated in.
+	for range 10 {
+		same := *first
+		same.Addrs = []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}
+		same.Metadata = map[string][]byte{"transport-graphsync-filecoinv1": []byte("b"), "transport-bitswap": []byte("a")}
+		require.False(t, subject.append(&same))
+	}
+	other := *first
+	other.ID = "crab"
+	require.True(t, subject.append(&other))
+	require.Len(t, subject.Providers, 2)
+}
+
+func TestMergeProviderInfo(t *testing.T) {
+	addr := func(s string) []multiaddr.Multiaddr { return []multiaddr.Multiaddr{multiaddr.StringCast(s)} }
+	stale := &model.ProviderInfo{
+		AddrInfo:              peer.AddrInfo{ID: "lobster", Addrs: addr("/ip4/127.0.0.1/tcp/1")},
+		LastAdvertisementTime: "2024-01-01T00:00:00Z",
+		ExtendedProviders: &model.ExtendedProviders{
+			Providers: []peer.AddrInfo{{ID: "crab", Addrs: addr("/ip4/127.0.0.1/tcp/2")}, {ID: "shrimp"}},
+			Contextual: []model.ContextualExtendedProviders{
+				{ContextID: "fish", Providers: []peer.AddrInfo{{ID: "crab"}}, Metadatas: [][]byte{[]byte("a")}},
+				{ContextID: "chips", Providers: []peer.AddrInfo{{ID: "crab"}}},
+			},
+			Metadatas: [][]byte{[]byte("a")},
+		},
+	}
+	fresh := &model.ProviderInfo{
+		AddrInfo:              peer.AddrInfo{ID: "lobster", Addrs: addr("/ip4/127.0.0.1/tcp/3")},
+		LastAdvertisementTime: "2024-01-02T00:00:00Z",
+		ExtendedProviders: &model.ExtendedProviders{
+			Providers: []peer.AddrInfo{{ID: "crab", Addrs: addr("/ip4/127.0.0.1/tcp/4")}},
+			Contextual: []model.ContextualExtendedProviders{
+				{ContextID: "fish", Override: true, Providers: []peer.AddrInfo{{ID: "shrimp"}}, Metadatas: [][]byte{[]byte("b")}},
+			},
+			Metadatas: [][]byte{[]byte("a"), []byte("b")},
+		},
+	}
+
+	// The freshest information wins regardless of the order of merging.
+	for _, merged := range []*model.ProviderInfo{mergeProviderInfo(stale, fresh), mergeProviderInfo(fresh, stale)} {
+		require.Equal(t, fresh.AddrInfo, merged.AddrInfo)
+		require.Equal(t, fresh.LastAdvertisementTime, merged.LastAdvertisementTime)
+		require.Equal(t, []peer.AddrInfo{{ID: "crab", Addrs: addr("/ip4/127.0.0.1/tcp/4")}, {ID: "shrimp"}}, merged.ExtendedProviders.Providers)
+		require.Equal(t, [][]byte{[]byte("a"), []byte("b")}, merged.ExtendedProviders.Metadatas)
+		require.Equal(t, []model.ContextualExtendedProviders{
+			{ContextID: "fish", Override: true, Providers: []peer.AddrInfo{{ID: "shrimp"}, {ID: "crab"}}, Metadatas: [][]byte{[]byte("b"), []byte("a")}},
+			{ContextID: "chips", Providers: []peer.AddrInfo{{ID: "crab"}}},
+		}, merged.ExtendedProviders.Contextual)
+	}
+	// Merging leaves the given information as is.
+	require.Len(t, fresh.ExtendedProviders.Providers, 1)
+	require.Len(t, fresh.ExtendedProviders.Contextual[0].Providers, 1)
+
+	withoutExtended := *stale
+	withoutExtended.ExtendedProviders = nil
+	require.Equal(t, fresh.ExtendedProviders, mergeProviderInfo(&withoutExtended, fresh).ExtendedProviders)
+}
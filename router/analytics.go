@@ -0,0 +1,480 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+)
+
+// queryRecord is an anonymized record of a find lookup. The multihash looked
+// up is only recorded as its salted hash, and nothing about the client is
+// recorded.
+type queryRecord struct {
+	Time time.Time
+	// Multihash is the hex-encoded, salted SHA-256 hash of the multihash
+	// looked up. CID lookups are recorded by the multihash of the CID.
+	Multihash string
+	// Route is the route the lookup was made on, one of ipni or delegated.
+	Route     string
+	Encrypted bool `json:",omitempty"`
+	Found     bool
+	// Transports are the distinct transports of the provider results served.
+	Transports []string `json:",omitempty"`
+	// Latency is the time taken to respond in milliseconds.
+	Latency int64
+}
+
+type analyticsRequestKey struct{}
+
+// analyticsRequest accumulates the transports of results served to a request
+// while it is handled.
+type analyticsRequest struct {
+	mu         sync.Mutex
+	transports []string
+}
+
+// analyticsSink ships batches of query records to where they are analyzed.
+type analyticsSink interface {
+	send(ctx context.Context, records []queryRecord) error
+	close() error
+}
+
+// analytics records anonymized find lookups and ships them to a sink in
+// batches, for content demand analysis. Records are shipped asynchronously and
+// dropped if the sink falls behind, so that analytics never slows down
+// request handling.
+//
+// Transports are observed as middleware, so it must be last in the chain to
+// observe the results actually served.
+type analytics struct {
+	BaseMiddleware
+	sink    analyticsSink
+	salt    []byte
+	records chan queryRecord
+}
+
+func newAnalytics(ctx context.Context, sinkURL string) (*analytics, error) {
+	if config.Analytics.BatchSize <= 0 {
+		return nil, fmt.Errorf("analytics batch size must be positive, got %d", config.Analytics.BatchSize)
+	}
+	sink, err := newAnalyticsSink(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	a := &analytics{
+		sink:    sink,
+		salt:    []byte(config.Analytics.Salt),
+		records: make(chan queryRecord, max(config.Analytics.QueueSize, config.Analytics.BatchSize)),
+	}
+	go a.run(ctx)
+	return a, nil
+}
+
+// run ships records in batches of the configured size, or whatever is
+// batched at each flush interval, until the given context is done. Records
+// batched by then are shipped before returning.
+func (a *analytics) run(ctx context.Context) {
+	defer func() {
+		if err := a.sink.close(); err != nil {
+			log.Errorw("Failed to close analytics sink", "err", err)
+		}
+	}()
+	ticker := time.NewTicker(config.Analytics.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]queryRecord, 0, config.Analytics.BatchSize)
+	ship := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.sink.send(ctx, batch); err != nil {
+			log.Errorw("Failed to ship query records", "count", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for {
+				select {
+				case qr := <-a.records:
+					batch = append(batch, qr)
+					if len(batch) == config.Analytics.BatchSize {
+						ship(shutdownCtx)
+					}
+				default:
+					ship(shutdownCtx)
+					return
+				}
+			}
+		case <-ticker.C:
+			ship(ctx)
+		case qr := <-a.records:
+			batch = append(batch, qr)
+			if len(batch) == config.Analytics.BatchSize {
+				ship(ctx)
+			}
+		}
+	}
+}
+
+// handler records the find lookups handled by next. Lookups of several
+// multihashes at once are not recorded.
+func (a *analytics) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qr, ok := a.newRecord(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ar := &analyticsRequest{}
+		sw := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), analyticsRequestKey{}, ar)))
+		qr.Latency = time.Since(qr.Time).Milliseconds()
+		qr.Found = sw.status == http.StatusOK
+		ar.mu.Lock()
+		qr.Transports = ar.transports
+		ar.mu.Unlock()
+		select {
+		case a.records <- qr:
+		default:
+			log.Debug("Dropped query record")
+		}
+	})
+}
+
+// newRecord returns the record of the given request, and whether it is a find
+// lookup that is recorded.
+func (a *analytics) newRecord(r *http.Request) (queryRecord, bool) {
+	if r.Method != http.MethodGet {
+		return queryRecord{}, false
+	}
+	p := strings.TrimPrefix(r.URL.Path, legacyFinderPrefix)
+	qr := queryRecord{Route: "ipni"}
+	var isCid bool
+	switch {
+	case strings.HasPrefix(p, "/encrypted/multihash/"):
+		qr.Encrypted = true
+	case strings.HasPrefix(p, "/multihash/"):
+	case strings.HasPrefix(p, "/encrypted/cid/"):
+		qr.Encrypted, isCid = true, true
+	case strings.HasPrefix(p, "/cid/"):
+		isCid = true
+	case strings.HasPrefix(p, "/routing/v1/encrypted/providers/"):
+		qr.Route, qr.Encrypted = "delegated", true
+	case strings.HasPrefix(p, "/routing/v1/providers/"):
+		qr.Route, isCid = "delegated", true
+	default:
+		return queryRecord{}, false
+	}
+	key := path.Base(strings.TrimSuffix(p, countPathSuffix))
+	if strings.Contains(key, ",") {
+		return queryRecord{}, false
+	}
+	var mh []byte
+	if isCid {
+		c, err := cid.Decode(key)
+		if err != nil {
+			return queryRecord{}, false
+		}
+		mh = c.Hash()
+	} else if qr.Route == "delegated" {
+		// Encrypted delegated lookups are keyed by a multibase-encoded hash,
+		// which is recorded as is.
+		mh = []byte(key)
+	} else {
+		parsed, err := parseMultihash(key)
+		if err != nil {
+			return queryRecord{}, false
+		}
+		mh = parsed
+	}
+	h := sha256.New()
+	h.Write(a.salt)
+	h.Write(mh)
+	qr.Multihash = hex.EncodeToString(h.Sum(nil))
+	qr.Time = time.Now()
+	return qr, true
+}
+
+// AfterAggregation observes the transports of the given results, as served to
+// the request.
+func (a *analytics) AfterAggregation(ctx context.Context, results []model.ProviderResult) []model.ProviderResult {
+	ar, ok := ctx.Value(analyticsRequestKey{}).(*analyticsRequest)
+	if !ok {
+		return results
+	}
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	for _, pr := range results {
+		for _, t := range transportsOf(pr.Metadata) {
+			if !slices.Contains(ar.transports, t) {
+				ar.transports = append(ar.transports, t)
+			}
+		}
+	}
+	return results
+}
+
+// newAnalyticsSink instantiates the sink at the given URL, which is one of:
+//   - a file path, or a file:// URL, to append records to as NDJSON;
+//   - an http:// or https:// URL to POST records to as NDJSON, such as the
+//     ClickHouse HTTP interface with an INSERT ... FORMAT JSONEachRow query;
+//   - a kafka+http:// or kafka+https:// URL of a topic of a Kafka REST proxy
+//     to produce records to;
+//   - an s3://bucket/prefix URL to upload each batch to as an NDJSON object,
+//     using the standard AWS_* env vars for credentials and region.
+func newAnalyticsSink(sinkURL string) (analyticsSink, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil || u.Scheme == "" {
+		return newFileAnalyticsSink(sinkURL)
+	}
+	switch u.Scheme {
+	case "file":
+		return newFileAnalyticsSink(u.Path)
+	case "http", "https":
+		return &httpAnalyticsSink{url: u.String(), contentType: "application/x-ndjson"}, nil
+	case "kafka+http", "kafka+https":
+		u.Scheme = strings.TrimPrefix(u.Scheme, "kafka+")
+		return &httpAnalyticsSink{url: u.String(), contentType: "application/vnd.kafka.json.v2+json", kafka: true}, nil
+	case "s3":
+		return newS3AnalyticsSink(u)
+	default:
+		return nil, fmt.Errorf("unsupported analytics sink scheme: %s", u.Scheme)
+	}
+}
+
+// marshalRecords encodes the given records as NDJSON.
+func marshalRecords(records []queryRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, qr := range records {
+		if err := encoder.Encode(qr); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// fileAnalyticsSink appends records to a file as NDJSON.
+type fileAnalyticsSink struct {
+	f  *os.File
+	bw *bufio.Writer
+}
+
+func newFileAnalyticsSink(filePath string) (*fileAnalyticsSink, error) {
+	filePath, err := expandHome(filePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAnalyticsSink{f: f, bw: bufio.NewWriter(f)}, nil
+}
+
+func (s *fileAnalyticsSink) send(_ context.Context, records []queryRecord) error {
+	data, err := marshalRecords(records)
+	if err != nil {
+		return err
+	}
+	if _, err := s.bw.Write(data); err != nil {
+		return err
+	}
+	return s.bw.Flush()
+}
+
+func (s *fileAnalyticsSink) close() error {
+	if err := s.bw.Flush(); err != nil {
+		_ = s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// httpAnalyticsSink POSTs each batch of records to a URL, either as NDJSON or
+// as records of the Kafka REST proxy v2 API.
+type httpAnalyticsSink struct {
+	url         string
+	contentType string
+	kafka       bool
+}
+
+func (s *httpAnalyticsSink) send(ctx context.Context, records []queryRecord) error {
+	var body []byte
+	var err error
+	if s.kafka {
+		type kafkaRecord struct {
+			Value queryRecord `json:"value"`
+		}
+		krs := make([]kafkaRecord, 0, len(records))
+		for _, qr := range records {
+			krs = append(krs, kafkaRecord{Value: qr})
+		}
+		body, err = json.Marshal(struct {
+			Records []kafkaRecord `json:"records"`
+		}{Records: krs})
+	} else {
+		body, err = marshalRecords(records)
+	}
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", s.contentType)
+	return doAnalyticsRequest(req)
+}
+
+func (s *httpAnalyticsSink) close() error { return nil }
+
+// s3AnalyticsSink uploads each batch of records as an NDJSON object to an S3
+// bucket, signing requests with AWS Signature Version 4.
+type s3AnalyticsSink struct {
+	// endpoint is the URL of the bucket, to which object keys are appended.
+	endpoint        *url.URL
+	prefix          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+func newS3AnalyticsSink(u *url.URL) (*s3AnalyticsSink, error) {
+	s := &s3AnalyticsSink{
+		prefix:          strings.Trim(u.Path, "/"),
+		region:          os.Getenv("AWS_REGION"),
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no bucket in analytics sink %s", u)
+	}
+	if s.accessKeyID == "" || s.secretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for analytics sink %s", u)
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	// S3-compatible stores are addressed by path-style URLs at their
+	// endpoint.
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_S3"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL_S3: %w", err)
+		}
+		s.endpoint = e.JoinPath(u.Host)
+	} else {
+		s.endpoint = &url.URL{Scheme: "https", Host: u.Host + ".s3." + s.region + ".amazonaws.com", Path: "/"}
+	}
+	return s, nil
+}
+
+func (s *s3AnalyticsSink) send(ctx context.Context, records []queryRecord) error {
+	body, err := marshalRecords(records)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	// Objects are keyed by time, so that they list in order.
+	key := now.Format("2006/01/02/150405.000000000") + "-" + strconv.Itoa(os.Getpid()) + ".ndjson"
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint.JoinPath(key).String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	s.sign(req, body, now)
+	return doAnalyticsRequest(req)
+}
+
+// sign signs the given request with body at the given time, as specified by
+// AWS Signature Version 4.
+func (s *s3AnalyticsSink) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signed := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		signed = append(signed, strings.ToLower(name))
+	}
+	slices.Sort(signed)
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (s *s3AnalyticsSink) close() error { return nil }
+
+// doAnalyticsRequest sends the given request to a sink, and returns an error
+// unless it succeeds.
+func doAnalyticsRequest(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("analytics sink responded with %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,128 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalytics_ShipsAnonymizedLookups(t *testing.T) {
+	defer func(old string) { config.Analytics.Sink = old }(config.Analytics.Sink)
+	defer func(old string) { config.Analytics.Salt = old }(config.Analytics.Salt)
+	defer func(old int) { config.Analytics.BatchSize = old }(config.Analytics.BatchSize)
+
+	batches := make(chan []queryRecord, 10)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		var batch []queryRecord
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var qr queryRecord
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &qr))
+			batch = append(batch, qr)
+		}
+		batches <- batch
+	}))
+	defer sink.Close()
+	config.Analytics.Sink = sink.URL
+	config.Analytics.Salt = "fish"
+	config.Analytics.BatchSize = 3
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subject, err := New(Options{
+		Context: ctx,
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, p := range []string{
+		"/cid/" + mockbackend.SampleCids[0],
+		"/routing/v1/providers/" + mockbackend.SampleCids[0],
+		"/providers",
+		"/multihash/QmPNHBy5h7f19yJDt7ip9TvmMRbqmYsa6aetkrsc1ghjLB",
+	} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		subject.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var got []queryRecord
+	select {
+	case got = <-batches:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for query records")
+	}
+	require.Len(t, got, 3)
+
+	c, err := cid.Decode(mockbackend.SampleCids[0])
+	require.NoError(t, err)
+	hashed := sha256.Sum256(append([]byte("fish"), c.Hash()...))
+	require.Equal(t, hex.EncodeToString(hashed[:]), got[0].Multihash)
+	require.Equal(t, "ipni", got[0].Route)
+	require.True(t, got[0].Found)
+	require.NotEmpty(t, got[0].Transports)
+
+	require.Equal(t, got[0].Multihash, got[1].Multihash)
+	require.Equal(t, "delegated", got[1].Route)
+	require.True(t, got[1].Found)
+
+	require.Equal(t, "ipni", got[2].Route)
+	require.False(t, got[2].Found)
+	require.Empty(t, got[2].Transports)
+}
+
+func TestAnalytics_FileSinkAppendsNDJSON(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "queries.ndjson")
+	subject, err := newAnalyticsSink("file://" + filePath)
+	require.NoError(t, err)
+	records := []queryRecord{{Multihash: "fish", Found: true}, {Multihash: "lobster"}}
+	require.NoError(t, subject.send(context.Background(), records))
+	require.NoError(t, subject.close())
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	want, err := marshalRecords(records)
+	require.NoError(t, err)
+	require.Equal(t, want, data)
+}
+
+func TestAnalytics_KafkaSinkProducesRecords(t *testing.T) {
+	var got struct {
+		Records []struct {
+			Value queryRecord `json:"value"`
+		} `json:"records"`
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/topics/queries", r.URL.Path)
+		require.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &got))
+	}))
+	defer proxy.Close()
+
+	subject, err := newAnalyticsSink("kafka+" + proxy.URL + "/topics/queries")
+	require.NoError(t, err)
+	require.NoError(t, subject.send(context.Background(), []queryRecord{{Multihash: "fish"}}))
+	require.Len(t, got.Records, 1)
+	require.Equal(t, "fish", got.Records[0].Value.Multihash)
+}
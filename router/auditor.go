@@ -0,0 +1,179 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// auditor samples recently looked up multihashes and periodically re-issues
+// them to every regular backend individually, recording per-backend recall,
+// i.e. the fraction of providers found across all backends that each backend
+// knew about. This quantifies index divergence across backends.
+type auditor struct {
+	backends func() []Backend
+
+	mu      sync.Mutex
+	samples []multihash.Multihash
+}
+
+func newAuditor(backends func() []Backend) *auditor {
+	return &auditor{backends: backends}
+}
+
+// observe samples the given looked up multihash at the configured sample
+// rate. At most the configured number of most recent samples is retained.
+func (a *auditor) observe(mh multihash.Multihash) {
+	if rand.Float64() >= config.Audit.SampleRate {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.samples) >= config.Audit.MaxSamples {
+		a.samples = a.samples[1:]
+	}
+	a.samples = append(a.samples, mh)
+}
+
+// run audits a batch of samples at the configured interval until the context
+// is done.
+func (a *auditor) run(ctx context.Context) {
+	ticker := time.NewTicker(config.Audit.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			batch := a.samples[:min(config.Audit.BatchSize, len(a.samples))]
+			a.samples = a.samples[len(batch):]
+			a.mu.Unlock()
+			for _, mh := range batch {
+				a.audit(ctx, mh)
+			}
+		}
+	}
+}
+
+// audit looks up the given multihash on each regular backend and records the
+// recall of each backend.
+func (a *auditor) audit(ctx context.Context, mh multihash.Multihash) {
+	var targets []Backend
+	for _, b := range a.backends() {
+		switch b.(type) {
+		case dhBackend, providersBackend, caskadeBackend:
+			continue
+		}
+		if !circuitReady(b, circuitFind) {
+			continue
+		}
+		targets = append(targets, b)
+	}
+	if len(targets) < 2 {
+		// Recall is meaningless without other backends to compare with.
+		return
+	}
+
+	found := make([]map[peer.ID]struct{}, len(targets))
+	failed := make([]bool, len(targets))
+	var wg sync.WaitGroup
+	for i, b := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			providers, err := auditLookup(ctx, b, mh)
+			if err != nil {
+				log.Debugw("Failed to audit backend", "backend", b.URL().Host, "err", err)
+				failed[i] = true
+				return
+			}
+			found[i] = providers
+		}()
+	}
+	wg.Wait()
+
+	union := make(map[peer.ID]struct{})
+	for _, providers := range found {
+		for p := range providers {
+			union[p] = struct{}{}
+		}
+	}
+	if len(union) == 0 {
+		return
+	}
+	for i, b := range targets {
+		if failed[i] {
+			continue
+		}
+		recall := float64(len(found[i])) / float64(len(union))
+		_ = stats.RecordWithOptions(context.Background(),
+			stats.WithTags(tag.Insert(metrics.Backend, b.URL().Host)),
+			stats.WithMeasurements(metrics.AuditRecall.M(recall)))
+		if missed := len(union) - len(found[i]); missed > 0 {
+			_ = stats.RecordWithOptions(context.Background(),
+				stats.WithTags(tag.Insert(metrics.Backend, b.URL().Host)),
+				stats.WithMeasurements(metrics.AuditMissedProviders.M(int64(missed))))
+		}
+	}
+}
+
+// auditLookup looks up the given multihash on a single backend and returns the
+// set of providers it returned.
+func auditLookup(ctx context.Context, b Backend, mh multihash.Multihash) (map[peer.ID]struct{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Server.ResultMaxWait)
+	defer cancel()
+	endpoint := url.URL{
+		Scheme: b.URL().Scheme,
+		Host:   b.URL().Host,
+		Path:   path.Join("/multihash", mh.B58String()),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", MediaTypeJson)
+	resp, err := b.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	providers := make(map[peer.ID]struct{})
+	switch resp.StatusCode {
+	case http.StatusOK:
+		fr, err := model.UnmarshalFindResponse(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, mhr := range fr.MultihashResults {
+			for _, pr := range mhr.ProviderResults {
+				if pr.Provider != nil {
+					providers[pr.Provider.ID] = struct{}{}
+				}
+			}
+		}
+		return providers, nil
+	case http.StatusNotFound:
+		return providers, nil
+	default:
+		return nil, fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
+	}
+}
@@ -0,0 +1,62 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditor_ObserveRetainsMostRecentSamples(t *testing.T) {
+	defer func(rate float64, maxSamples int) {
+		config.Audit.SampleRate = rate
+		config.Audit.MaxSamples = maxSamples
+	}(config.Audit.SampleRate, config.Audit.MaxSamples)
+	config.Audit.SampleRate = 1
+	config.Audit.MaxSamples = 2
+
+	subject := newAuditor(nil)
+	for _, s := range []string{"fish", "lobster", "crab"} {
+		mh, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		subject.observe(mh)
+	}
+	require.Len(t, subject.samples, 2)
+	want, err := multihash.Sum([]byte("crab"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.Equal(t, want, subject.samples[1])
+}
+
+func TestAuditLookup(t *testing.T) {
+	mh, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/multihash/"+mh.B58String(), r.URL.Path)
+		data, err := model.MarshalFindResponse(&model.FindResponse{
+			MultihashResults: []model.MultihashResult{{
+				Multihash: mh,
+				ProviderResults: []model.ProviderResult{
+					{ContextID: []byte("lobster"), Provider: &peer.AddrInfo{ID: pid}},
+					{ContextID: []byte("crab"), Provider: &peer.AddrInfo{ID: pid}},
+				},
+			}},
+		})
+		require.NoError(t, err)
+		_, _ = w.Write(data)
+	}))
+	defer backend.Close()
+
+	b, err := NewBackend(backend.URL, nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	got, err := auditLookup(context.Background(), b, mh)
+	require.NoError(t, err)
+	require.Equal(t, map[peer.ID]struct{}{pid: {}}, got)
+}
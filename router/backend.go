@@ -0,0 +1,190 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mercari/go-circuitbreaker"
+)
+
+var Matchers struct {
+	Any        HttpRequestMatcher
+	AnyOf      func(...HttpRequestMatcher) HttpRequestMatcher
+	AllOf      func(...HttpRequestMatcher) HttpRequestMatcher
+	Not        func(HttpRequestMatcher) HttpRequestMatcher
+	QueryParam func(key, value string) HttpRequestMatcher
+	// Header matches requests with the given header value, either on the
+	// request to the backend or on the inbound request it originates from.
+	Header     func(key, value string) HttpRequestMatcher
+	PathPrefix func(prefix string) HttpRequestMatcher
+	PathRegexp func(re *regexp.Regexp) HttpRequestMatcher
+	Method     func(methods ...string) HttpRequestMatcher
+}
+
+// Route classes whose requests to a backend trip separate circuit breakers,
+// so that a backend failing one class of requests is still sent the others.
+// Cascade backends have circuit breakers of their own.
+const (
+	circuitFind      = "find"
+	circuitMetadata  = "metadata"
+	circuitProviders = "providers"
+)
+
+type (
+	HttpRequestMatcher func(r *http.Request) bool
+	Backend            interface {
+		URL() *url.URL
+		// CB returns the circuit breaker of find requests.
+		CB() *circuitbreaker.CircuitBreaker
+		// CBFor returns the circuit breaker of requests of the given route
+		// class.
+		CBFor(class string) *circuitbreaker.CircuitBreaker
+		Matches(r *http.Request) bool
+		Client() *http.Client
+	}
+	SimpleBackend struct {
+		url *url.URL
+		cb  *circuitbreaker.CircuitBreaker
+		// circuits are the circuit breakers by route class of the classes
+		// that do not share cb.
+		circuits map[string]*circuitbreaker.CircuitBreaker
+		matcher  HttpRequestMatcher
+		client   *http.Client
+	}
+)
+
+func (b *SimpleBackend) URL() *url.URL {
+	return b.url
+}
+
+func (b *SimpleBackend) CB() *circuitbreaker.CircuitBreaker {
+	return b.cb
+}
+
+func (b *SimpleBackend) CBFor(class string) *circuitbreaker.CircuitBreaker {
+	if cb, ok := b.circuits[class]; ok {
+		return cb
+	}
+	return b.cb
+}
+
+func (b *SimpleBackend) Client() *http.Client {
+	return b.client
+}
+
+func init() {
+	Matchers.Any = func(*http.Request) bool { return true }
+	Matchers.AnyOf = func(ms ...HttpRequestMatcher) HttpRequestMatcher {
+		return func(r *http.Request) bool {
+			for _, m := range ms {
+				if m(r) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	Matchers.AllOf = func(ms ...HttpRequestMatcher) HttpRequestMatcher {
+		return func(r *http.Request) bool {
+			for _, m := range ms {
+				if !m(r) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	Matchers.Not = func(m HttpRequestMatcher) HttpRequestMatcher {
+		return func(r *http.Request) bool {
+			return !m(r)
+		}
+	}
+	Matchers.QueryParam = func(key, value string) HttpRequestMatcher {
+		return func(r *http.Request) bool {
+			if r == nil {
+				return false
+			}
+			values, ok := r.URL.Query()[key]
+			if !ok {
+				return false
+			}
+			for _, got := range values {
+				if value == got {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	Matchers.Header = func(key, value string) HttpRequestMatcher {
+		return func(r *http.Request) bool {
+			if r == nil {
+				return false
+			}
+			if slices.Contains(r.Header.Values(key), value) {
+				return true
+			}
+			inbound, ok := r.Context().Value(inboundHeaderKey{}).(http.Header)
+			return ok && slices.Contains(inbound.Values(key), value)
+		}
+	}
+	Matchers.PathPrefix = func(prefix string) HttpRequestMatcher {
+		return func(r *http.Request) bool {
+			return r != nil && strings.HasPrefix(r.URL.Path, prefix)
+		}
+	}
+	Matchers.PathRegexp = func(re *regexp.Regexp) HttpRequestMatcher {
+		return func(r *http.Request) bool {
+			return r != nil && re.MatchString(r.URL.Path)
+		}
+	}
+	Matchers.Method = func(methods ...string) HttpRequestMatcher {
+		return func(r *http.Request) bool {
+			return r != nil && slices.Contains(methods, r.Method)
+		}
+	}
+}
+
+type inboundHeaderKey struct{}
+
+// withInboundHeader makes the header of the inbound request available to
+// header matchers of backends, since requests to backends do not carry it.
+func withInboundHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), inboundHeaderKey{}, r.Header)))
+	})
+}
+
+// NewBackend instantiates a backend whose requests of every route class trip
+// the given circuit breaker.
+func NewBackend(u string, cb *circuitbreaker.CircuitBreaker, matcher HttpRequestMatcher, client *http.Client) (Backend, error) {
+	return newBackend(u, cb, nil, matcher, client)
+}
+
+// newBackend instantiates a backend whose requests trip the circuit breaker of
+// their route class in the given circuits, or cb if it has none.
+func newBackend(u string, cb *circuitbreaker.CircuitBreaker, circuits map[string]*circuitbreaker.CircuitBreaker, matcher HttpRequestMatcher, client *http.Client) (Backend, error) {
+	burl, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &SimpleBackend{
+		url:      burl,
+		cb:       cb,
+		circuits: circuits,
+		matcher:  matcher,
+		client:   client,
+	}, nil
+}
+
+func (b *SimpleBackend) Matches(r *http.Request) bool {
+	return b.matcher(r)
+}
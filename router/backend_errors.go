@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// Kinds of backend failure, recorded as the errKind tag of the backend
+// failures metric so that alerting can tell a misconfigured backend, e.g. one
+// that fails dials, TLS handshakes or requests with 4xx, apart from one that is
+// down or overloaded.
+const (
+	errKindDial     = "dial"
+	errKindTLS      = "tls"
+	errKindTimeout  = "timeout"
+	errKind4xx      = "4xx"
+	errKind5xx      = "5xx"
+	errKindBodyRead = "body_read"
+	errKindDecode   = "decode"
+	errKindOther    = "other"
+)
+
+// requestErrKind classifies the error of sending a request to a backend, or of
+// reading its response if reading is true. It returns the empty string for
+// requests canceled since they are no longer needed, which are not failures
+// of the backend.
+func requestErrKind(err error, reading bool) string {
+	var (
+		opErr     *net.OpError
+		dnsErr    *net.DNSError
+		headerErr tls.RecordHeaderError
+		alertErr  tls.AlertError
+		verifyErr *tls.CertificateVerificationError
+		authErr   x509.UnknownAuthorityError
+		hostErr   x509.HostnameError
+		certErr   x509.CertificateInvalidError
+		netErr    net.Error
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ""
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return errKindTimeout
+	case errors.As(err, &dnsErr), errors.As(err, &opErr) && opErr.Op == "dial":
+		return errKindDial
+	case errors.As(err, &headerErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &authErr), errors.As(err, &hostErr), errors.As(err, &certErr):
+		return errKindTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errKindTimeout
+	case reading:
+		return errKindBodyRead
+	default:
+		return errKindOther
+	}
+}
+
+// statusErrKind classifies an unsuccessful response status of a backend.
+func statusErrKind(status int) string {
+	if status >= http.StatusInternalServerError {
+		return errKind5xx
+	}
+	return errKind4xx
+}
+
+// recordBackendFailure counts a failure of the given kind towards the given
+// backend. Failures of no kind are not counted.
+func recordBackendFailure(ctx context.Context, host string, kind string) {
+	if kind == "" {
+		return
+	}
+	_ = stats.RecordWithOptions(ctx,
+		stats.WithTags(tag.Insert(metrics.Backend, host), tag.Insert(metrics.ErrKind, kind)),
+		stats.WithMeasurements(metrics.BackendFailures.M(1)))
+}
@@ -0,0 +1,96 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestRequestErrKind(t *testing.T) {
+	get := func(client *http.Client, url string) error {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedURL := "http://" + listener.Addr().String()
+	require.NoError(t, listener.Close())
+	require.Equal(t, errKindDial, requestErrKind(get(http.DefaultClient, closedURL), false))
+
+	tlsBackend := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsBackend.Close()
+	require.Equal(t, errKindTLS, requestErrKind(get(http.DefaultClient, tlsBackend.URL), false))
+
+	hang := make(chan struct{})
+	slowBackend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-hang }))
+	defer slowBackend.Close()
+	defer close(hang)
+	require.Equal(t, errKindTimeout, requestErrKind(get(&http.Client{Timeout: 10 * time.Millisecond}, slowBackend.URL), false))
+
+	canceled := &url.Error{Op: "Get", URL: slowBackend.URL, Err: context.Canceled}
+	require.Empty(t, requestErrKind(canceled, false))
+	require.Equal(t, errKindBodyRead, requestErrKind(io.ErrUnexpectedEOF, true))
+	require.Equal(t, errKindOther, requestErrKind(io.ErrUnexpectedEOF, false))
+}
+
+func TestFind_RecordsBackendFailures(t *testing.T) {
+	failuresView := &view.View{
+		Name:        "test/backend/failures",
+		Measure:     metrics.BackendFailures,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{metrics.Backend, metrics.ErrKind},
+	}
+	require.NoError(t, view.Register(failuresView))
+	defer view.Unregister(failuresView)
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	malformed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"MultihashResults": [`))
+	}))
+	defer malformed.Close()
+	providers := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer providers.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: unavailable.URL},
+			{URL: malformed.URL},
+			{URL: providers.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+	req.Header.Set("Accept", MediaTypeJson)
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rows, err := view.RetrieveData(failuresView.Name)
+	require.NoError(t, err)
+	var got [][]tag.Tag
+	for _, row := range rows {
+		got = append(got, row.Tags)
+	}
+	host := func(u string) string { return strings.TrimPrefix(u, "http://") }
+	require.Contains(t, got, []tag.Tag{{Key: metrics.Backend, Value: host(unavailable.URL)}, {Key: metrics.ErrKind, Value: errKind5xx}})
+	require.Contains(t, got, []tag.Tag{{Key: metrics.Backend, Value: host(malformed.URL)}, {Key: metrics.ErrKind, Value: errKindDecode}})
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// bodyLimit is the maximum request body size of requests with a method and
+// path prefix.
+type bodyLimit struct {
+	method string
+	prefix string
+	size   int64
+}
+
+// bodyLimits bounds the size of request bodies by method and path, so that
+// lookups are held to small bodies while batch and announce payloads may be
+// larger. Requests that match no limit are bounded by the default size.
+type bodyLimits struct {
+	limits      []bodyLimit
+	defaultSize int64
+}
+
+// parseBodyLimits parses the given comma-separated list of METHOD=bytes or
+// METHOD /path/prefix=bytes rules.
+func parseBodyLimits(rules string, defaultSize int64) (*bodyLimits, error) {
+	l := &bodyLimits{defaultSize: defaultSize}
+	for _, rule := range strings.Split(rules, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		pattern, size, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("body size limit must be of the form METHOD[ /path]=bytes, got %s", rule)
+		}
+		var limit bodyLimit
+		var err error
+		if limit.size, err = strconv.ParseInt(strings.TrimSpace(size), 10, 64); err != nil || limit.size < 0 {
+			return nil, fmt.Errorf("invalid body size limit in %s", rule)
+		}
+		limit.method, limit.prefix, _ = strings.Cut(strings.TrimSpace(pattern), " ")
+		limit.prefix = strings.TrimSpace(limit.prefix)
+		if limit.method == "" || (limit.prefix != "" && !strings.HasPrefix(limit.prefix, "/")) {
+			return nil, fmt.Errorf("body size limit must be of the form METHOD[ /path]=bytes, got %s", rule)
+		}
+		l.limits = append(l.limits, limit)
+	}
+	return l, nil
+}
+
+// sizeFor returns the maximum body size of the given request.
+func (l *bodyLimits) sizeFor(r *http.Request) int64 {
+	size := l.defaultSize
+	matched := -1
+	for _, limit := range l.limits {
+		if limit.method == r.Method && strings.HasPrefix(r.URL.Path, limit.prefix) && len(limit.prefix) > matched {
+			size = limit.size
+			matched = len(limit.prefix)
+		}
+	}
+	return size
+}
+
+// handler bounds the body of requests to next by their maximum size, as
+// http.MaxBytesHandler does.
+func (l *bodyLimits) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := *r
+		r2.Body = http.MaxBytesReader(w, r.Body, l.sizeFor(r))
+		next.ServeHTTP(w, &r2)
+	})
+}
@@ -0,0 +1,43 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyLimits_BoundsBodiesByMethodAndPath(t *testing.T) {
+	subject, err := parseBodyLimits("POST=100, PUT /ingest/=1000, PUT /ingest/announce=10000", 10)
+	require.NoError(t, err)
+	handler := subject.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, "", http.StatusRequestEntityTooLarge)
+		}
+	}))
+	serve := func(method, path string, size int) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(strings.Repeat("x", size))))
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/cid/fish", 10))
+	require.Equal(t, http.StatusRequestEntityTooLarge, serve(http.MethodGet, "/cid/fish", 11))
+	require.Equal(t, http.StatusOK, serve(http.MethodPost, "/multihash", 100))
+	require.Equal(t, http.StatusRequestEntityTooLarge, serve(http.MethodPost, "/multihash", 101))
+	require.Equal(t, http.StatusRequestEntityTooLarge, serve(http.MethodPut, "/multihash", 11))
+	require.Equal(t, http.StatusOK, serve(http.MethodPut, "/ingest/fish", 1000))
+	require.Equal(t, http.StatusRequestEntityTooLarge, serve(http.MethodPut, "/ingest/fish", 1001))
+	// The longest matching prefix applies.
+	require.Equal(t, http.StatusOK, serve(http.MethodPut, "/ingest/announce", 10000))
+}
+
+func TestParseBodyLimits_RejectsInvalid(t *testing.T) {
+	for _, rules := range []string{"POST", "POST=fish", "POST=-1", "=10", "PUT ingest=10"} {
+		_, err := parseBodyLimits(rules, 10)
+		require.Error(t, err, rules)
+	}
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity above which buffers are dropped rather
+// than pooled, so that an occasional large response does not stay pinned in
+// memory.
+const maxPooledBufferSize = 1 << 20 // 1MiB
+
+var (
+	// bodyBufferPool pools the buffers that backend responses are read into,
+	// which otherwise account for much of the garbage produced per request
+	// at high QPS.
+	bodyBufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	// scanBufferPool pools the initial buffers of NDJSON scanners.
+	scanBufferPool sync.Pool
+)
+
+// getBuffer returns an empty pooled buffer, which must be returned via
+// putBuffer once its bytes are no longer referenced.
+func getBuffer() *bytes.Buffer {
+	buf := bodyBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns the given buffer obtained from getBuffer to the pool.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		bodyBufferPool.Put(buf)
+	}
+}
+
+// getScanBuffer returns a pooled buffer of at least the given capacity.
+func getScanBuffer(size int) *[]byte {
+	if buf, ok := scanBufferPool.Get().(*[]byte); ok && cap(*buf) >= size {
+		return buf
+	}
+	buf := make([]byte, 0, size)
+	return &buf
+}
+
+// releaseScanBuffer returns the given buffer obtained from getScanBuffer to
+// the pool.
+func releaseScanBuffer(buf *[]byte) {
+	if cap(*buf) <= maxPooledBufferSize {
+		scanBufferPool.Put(buf)
+	}
+}
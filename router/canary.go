@@ -0,0 +1,86 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/metrics"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+const findMethodCanary = "canary-v0"
+
+// canary periodically looks up known multihashes that must always resolve
+// through the full aggregation path, and records whether each probe passed.
+type canary struct {
+	find   findFunc
+	probes map[string]multihash.Multihash
+}
+
+// newCanary instantiates a canary that probes the given comma-separated CIDs
+// or multihashes, keyed by their original string representation.
+func newCanary(specs string, find findFunc) (*canary, error) {
+	probes := make(map[string]multihash.Multihash)
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if c, err := cid.Decode(spec); err == nil {
+			probes[spec] = c.Hash()
+			continue
+		}
+		mh, err := parseMultihash(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid canary probe %q: must be a cid or multihash", spec)
+		}
+		probes[spec] = mh
+	}
+	return &canary{find: find, probes: probes}, nil
+}
+
+// run probes all multihashes at the configured interval until the context is
+// done.
+func (c *canary) run(ctx context.Context) {
+	ticker := time.NewTicker(config.Canary.Interval)
+	defer ticker.Stop()
+	for {
+		c.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *canary) probeAll(ctx context.Context) {
+	for name, mh := range c.probes {
+		if ctx.Err() != nil {
+			return
+		}
+		var pass int64
+		if c.probe(ctx, mh) {
+			pass = 1
+		} else {
+			log.Warnw("Canary probe failed", "probe", name)
+		}
+		_ = stats.RecordWithOptions(context.Background(),
+			stats.WithTags(tag.Insert(metrics.Probe, name)),
+			stats.WithMeasurements(metrics.CanaryPass.M(pass)))
+	}
+}
+
+func (c *canary) probe(ctx context.Context, mh multihash.Multihash) bool {
+	reqURL := &url.URL{Path: path.Join("/multihash", mh.B58String())}
+	rcode, _ := c.find(ctx, http.MethodGet, findMethodCanary, reqURL, nil, false)
+	return rcode == http.StatusOK
+}
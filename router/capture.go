@@ -0,0 +1,107 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// CapturedRequest is an anonymized find request. Only the information needed
+// to replay the request is captured; client addresses and all other headers
+// are omitted.
+type CapturedRequest struct {
+	Time   time.Time
+	Method string
+	Path   string
+	Query  string `json:",omitempty"`
+	Accept string `json:",omitempty"`
+}
+
+// capturePathPrefixes are the path prefixes of find requests that are
+// captured.
+var capturePathPrefixes = []string{
+	"/cid/",
+	"/multihash/",
+	"/encrypted/cid/",
+	"/encrypted/multihash/",
+	"/routing/v1/providers/",
+	"/routing/v1/encrypted/providers/",
+}
+
+// capturer writes a sample of find requests to a file as NDJSON, for later
+// replay. Requests are written asynchronously and dropped if the writer falls
+// behind, so that capturing never slows down request handling.
+type capturer struct {
+	requests chan CapturedRequest
+}
+
+func newCapturer(ctx context.Context, filePath string) (*capturer, error) {
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	c := &capturer{
+		requests: make(chan CapturedRequest, 1024),
+	}
+	go func() {
+		defer f.Close()
+		bw := bufio.NewWriter(f)
+		defer bw.Flush()
+		encoder := json.NewEncoder(bw)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := bw.Flush(); err != nil {
+					log.Errorw("Failed to flush captured requests", "err", err)
+				}
+			case cr := <-c.requests:
+				if err := encoder.Encode(cr); err != nil {
+					log.Errorw("Failed to write captured request", "err", err)
+				}
+			}
+		}
+	}()
+	return c, nil
+}
+
+// middleware samples find requests handled by the given handler at the
+// configured sample rate.
+func (c *capturer) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.captures(r) {
+			select {
+			case c.requests <- CapturedRequest{
+				Time:   time.Now(),
+				Method: r.Method,
+				Path:   r.URL.Path,
+				Query:  r.URL.RawQuery,
+				Accept: r.Header.Get("Accept"),
+			}:
+			default:
+				log.Debug("Dropped captured request")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *capturer) captures(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	for _, prefix := range capturePathPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return rand.Float64() < config.Capture.SampleRate
+		}
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapturer_CapturesOnlyFindRequests(t *testing.T) {
+	defer func(rate float64) { config.Capture.SampleRate = rate }(config.Capture.SampleRate)
+	config.Capture.SampleRate = 1
+
+	subject := &capturer{}
+	require.True(t, subject.captures(httptest.NewRequest(http.MethodGet, "/multihash/fish", nil)))
+	require.True(t, subject.captures(httptest.NewRequest(http.MethodGet, "/routing/v1/providers/fish", nil)))
+	require.False(t, subject.captures(httptest.NewRequest(http.MethodGet, "/providers", nil)))
+	require.False(t, subject.captures(httptest.NewRequest(http.MethodPost, "/multihash/fish", nil)))
+}
@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// cascadeQueryParam is the query parameter with which clients request lookups
+// to be cascaded to the backends of the given label.
+const cascadeQueryParam = "cascade"
+
+// cascadeLabels returns the configured cascade labels.
+func cascadeLabels() []string {
+	return parseCascadeLabels(config.Server.CascadeLabels)
+}
+
+// parseCascadeLabels parses the given comma-separated cascade labels.
+func parseCascadeLabels(labels string) []string {
+	if labels == "" {
+		return nil
+	}
+	return strings.Split(labels, ",")
+}
+
+// validateCascade rejects requests for cascade labels other than the given ones
+// with 400 and the list of supported labels, since such requests would
+// otherwise silently match no cascade backend. Requests are not validated
+// when no cascade labels are configured.
+func validateCascade(labels []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(labels) > 0 {
+			for _, label := range r.URL.Query()[cascadeQueryParam] {
+				if !slices.Contains(labels, label) {
+					httpError(w, fmt.Sprintf("unsupported cascade label %q; supported labels: %s", label, strings.Join(labels, ", ")), errCodeUnknownCascadeLabel, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimited checks whether lookups cascaded to the given backend are rate
+// limited.
+func rateLimited(b Backend) bool {
+	cb, ok := b.(caskadeBackend)
+	return ok && cb.limiter != nil
+}
+
+// admitCascade checks whether the rate limit of the given backend admits a
+// lookup, waiting for up to the configured queue wait if not right away.
+// Lookups that are not admitted are suppressed, so that the remaining backends
+// are still queried. Backends other than rate limited cascade backends admit
+// every lookup.
+func admitCascade(ctx context.Context, b Backend) bool {
+	if !rateLimited(b) {
+		return true
+	}
+	limiter := b.(caskadeBackend).limiter
+	if limiter.Allow() {
+		return true
+	}
+	if config.CascadeRateLimit.QueueWait > 0 {
+		qctx, cancel := context.WithTimeout(ctx, config.CascadeRateLimit.QueueWait)
+		defer cancel()
+		if limiter.Wait(qctx) == nil {
+			return true
+		}
+	}
+	if ctx.Err() == nil {
+		log.Debugw("Suppressed cascade beyond rate limit", "backend", b.URL().Host)
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(tag.Insert(metrics.Backend, b.URL().Host)),
+			stats.WithMeasurements(metrics.CascadesSuppressed.M(1)))
+	}
+	return false
+}
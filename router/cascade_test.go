@@ -0,0 +1,144 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/metrics"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestValidateCascade(t *testing.T) {
+	serve := func(labels []string, target string) *httptest.ResponseRecorder {
+		subject := validateCascade(labels, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		rr := httptest.NewRecorder()
+		subject.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		return rr
+	}
+
+	// Any label is accepted when none are configured.
+	require.Equal(t, http.StatusOK, serve(nil, "/multihash/fish?cascade=lobster").Code)
+
+	labels := parseCascadeLabels("ipfs-dht,legacy")
+	require.Equal(t, http.StatusOK, serve(labels, "/multihash/fish").Code)
+	require.Equal(t, http.StatusOK, serve(labels, "/multihash/fish?cascade=ipfs-dht").Code)
+	require.Equal(t, http.StatusOK, serve(labels, "/multihash/fish?cascade=legacy&cascade=ipfs-dht").Code)
+
+	rr := serve(labels, "/multihash/fish?cascade=ipfs-dht&cascade=lobster")
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, rr.Body.String(), "supported labels: ipfs-dht, legacy")
+}
+
+func TestFind_SuppressesCascadesBeyondRateLimit(t *testing.T) {
+	defer func(labels string) { config.Server.CascadeLabels = labels }(config.Server.CascadeLabels)
+	config.Server.CascadeLabels = "ipfs-dht"
+	suppressedView := &view.View{
+		Name:        "test/cascade/suppressed",
+		Measure:     metrics.CascadesSuppressed,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{metrics.Backend},
+	}
+	require.NoError(t, view.Register(suppressedView))
+	defer view.Unregister(suppressedView)
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	var cascaded atomic.Int32
+	cascade := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		cascaded.Add(1)
+		http.Error(w, "", http.StatusNotFound)
+	}))
+	defer cascade.Close()
+	// A rate so low that only the initial burst of one lookup is admitted.
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+			{URL: cascade.URL, Type: BackendTypeCascade, MaxQPS: 0.001},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0]+"?cascade=ipfs-dht", nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		// Results of regular backends are served regardless.
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.Equal(t, int32(1), cascaded.Load())
+
+	rows, err := view.RetrieveData(suppressedView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.Equal(t, int64(1), rows[0].Data.(*view.CountData).Value)
+}
+
+func TestFind_OrdersCascadeResultsLast(t *testing.T) {
+	defer func(labels string) { config.Server.CascadeLabels = labels }(config.Server.CascadeLabels)
+	config.Server.CascadeLabels = "ipfs-dht"
+
+	c, err := cid.Decode(mockbackend.SampleCids[0])
+	require.NoError(t, err)
+	respondWith := func(delay time.Duration, prs ...model.ProviderResult) *httptest.Server {
+		data, err := model.MarshalFindResponse(&model.FindResponse{
+			MultihashResults: []model.MultihashResult{{Multihash: c.Hash(), ProviderResults: prs}},
+		})
+		require.NoError(t, err)
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/providers" {
+				writeJsonResponse(w, http.StatusOK, []byte("[]"))
+				return
+			}
+			time.Sleep(delay)
+			writeJsonResponse(w, http.StatusOK, data)
+		}))
+	}
+	lobster, err := peer.Decode(mockbackend.SampleProviders[0])
+	require.NoError(t, err)
+	crab, err := peer.Decode(mockbackend.SampleProviders[1])
+	require.NoError(t, err)
+	fromIndexer := model.ProviderResult{ContextID: []byte("fish"), Metadata: []byte("indexer"), Provider: &peer.AddrInfo{ID: lobster}}
+	fromCascade := model.ProviderResult{ContextID: []byte("fish"), Metadata: []byte("cascade"), Provider: &peer.AddrInfo{ID: lobster}}
+	cascadeOnly := model.ProviderResult{ContextID: []byte("fish"), Metadata: []byte("cascade"), Provider: &peer.AddrInfo{ID: crab}}
+	// The cascade backend responds first, yet its records come last.
+	indexer := respondWith(100*time.Millisecond, fromIndexer)
+	defer indexer.Close()
+	cascade := respondWith(0, cascadeOnly, fromCascade)
+	defer cascade.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: indexer.URL},
+			{URL: indexer.URL, Type: BackendTypeProviders},
+			{URL: cascade.URL, Type: BackendTypeCascade},
+		},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0]+"?cascade=ipfs-dht", nil)
+	req.Header.Set("Accept", MediaTypeJson)
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	resp, err := model.UnmarshalFindResponse(rec.Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, resp.MultihashResults, 1)
+	got := resp.MultihashResults[0].ProviderResults
+	require.Len(t, got, 2)
+	require.Equal(t, fromIndexer.Provider.ID, got[0].Provider.ID)
+	require.Equal(t, fromIndexer.Metadata, got[0].Metadata)
+	require.Equal(t, cascadeOnly.Provider.ID, got[1].Provider.ID)
+	require.Equal(t, cascadeOnly.Metadata, got[1].Metadata)
+}
@@ -0,0 +1,121 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// certMonitor periodically checks when the TLS certificates of HTTPS backends
+// expire, records the time left, and warns about certificates due to expire
+// within the configured window, so that expiring certificates are caught
+// before backends start failing requests.
+type certMonitor struct {
+	backends func() []Backend
+
+	mu     sync.RWMutex
+	expiry map[string]time.Time
+}
+
+func newCertMonitor(backends func() []Backend) *certMonitor {
+	return &certMonitor{
+		backends: backends,
+		expiry:   make(map[string]time.Time),
+	}
+}
+
+// run checks all HTTPS backends at the configured interval until the context
+// is done.
+func (m *certMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(config.CertExpiry.Interval)
+	defer ticker.Stop()
+	for {
+		m.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *certMonitor) checkAll(ctx context.Context) {
+	expiry := make(map[string]time.Time)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, b := range m.backends() {
+		if b.URL().Scheme != "https" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notAfter, err := certExpiry(ctx, b)
+			if err != nil {
+				log.Debugw("Failed to check backend certificate expiry", "backend", b.URL().Host, "err", err)
+				return
+			}
+			left := time.Until(notAfter)
+			_ = stats.RecordWithOptions(context.Background(),
+				stats.WithTags(tag.Insert(metrics.Backend, b.URL().Host)),
+				stats.WithMeasurements(metrics.BackendCertExpiry.M(left.Seconds())))
+			if left < config.CertExpiry.Window {
+				log.Warnw("Backend TLS certificate is about to expire", "backend", b.URL().Host, "expiry", notAfter, "left", left.Round(time.Second))
+			}
+			mu.Lock()
+			expiry[b.URL().String()] = notAfter
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	m.expiry = expiry
+	m.mu.Unlock()
+}
+
+// expiryOf returns when the TLS certificate of the given backend expires as
+// of its latest check, if checked successfully.
+func (m *certMonitor) expiryOf(b Backend) (time.Time, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.expiry[b.URL().String()]
+	return t, ok
+}
+
+// certExpiry returns when the leaf TLS certificate presented by the given
+// backend expires. The certificate is that of a request via the backend's own
+// client, so that it is dialed like any other request to the backend, e.g.
+// via its proxy and within the outbound connection budget. The expiry of
+// certificates that fail verification is returned too, since expired
+// certificates are among them.
+func certExpiry(ctx context.Context, b Backend) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Server.ResultMaxWait)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, b.URL().String(), nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := b.Client().Do(req)
+	if err != nil {
+		var verifyErr *tls.CertificateVerificationError
+		if errors.As(err, &verifyErr) && len(verifyErr.UnverifiedCertificates) > 0 {
+			return verifyErr.UnverifiedCertificates[0].NotAfter, nil
+		}
+		return time.Time{}, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return time.Time{}, errors.New("no certificate presented")
+	}
+	return resp.TLS.PeerCertificates[0].NotAfter, nil
+}
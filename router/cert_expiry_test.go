@@ -0,0 +1,71 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestCertMonitor_RecordsExpiryOfHTTPSBackends(t *testing.T) {
+	expiryView := &view.View{
+		Name:        "test/backend/cert_expiry",
+		Measure:     metrics.BackendCertExpiry,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{metrics.Backend},
+	}
+	require.NoError(t, view.Register(expiryView))
+	defer view.Unregister(expiryView)
+
+	tlsBackend := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsBackend.Close()
+	plainBackend := httptest.NewServer(http.NotFoundHandler())
+	defer plainBackend.Close()
+	backends, err := loadBackends([]BackendConfig{{URL: tlsBackend.URL}, {URL: plainBackend.URL}}, nil, false)
+	require.NoError(t, err)
+
+	subject := newCertMonitor(func() []Backend { return backends })
+	subject.checkAll(context.Background())
+
+	// The certificate of the test server is not trusted, yet its expiry is
+	// still checked.
+	want := tlsBackend.Certificate().NotAfter
+	got, ok := subject.expiryOf(backends[0])
+	require.True(t, ok)
+	require.True(t, want.Equal(got))
+	_, ok = subject.expiryOf(backends[1])
+	require.False(t, ok)
+
+	rows, err := view.RetrieveData(expiryView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.Equal(t, []tag.Tag{{Key: metrics.Backend, Value: strings.TrimPrefix(tlsBackend.URL, "https://")}}, rows[0].Tags)
+	left := rows[0].Data.(*view.LastValueData).Value
+	require.InDelta(t, time.Until(want).Seconds(), left, 60)
+}
+
+func TestCertExpiry_DialsLikeBackendRequests(t *testing.T) {
+	tlsBackend := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsBackend.Close()
+	backends, err := loadBackends([]BackendConfig{{URL: tlsBackend.URL}}, nil, false)
+	require.NoError(t, err)
+	// The budget is taken up by another connection.
+	budget := newConnBudget(1, 0, 0)
+	require.NoError(t, budget.acquire(context.Background()))
+	backends[0].Client().Transport.(*instrumentedTransport).budget = budget
+
+	_, err = certExpiry(context.Background(), backends[0])
+	require.ErrorIs(t, err, errOutboundConnBudget)
+
+	budget.release()
+	got, err := certExpiry(context.Background(), backends[0])
+	require.NoError(t, err)
+	require.True(t, tlsBackend.Certificate().NotAfter.Equal(got))
+}
@@ -0,0 +1,63 @@
+package router
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// chaosTransport injects faults into requests to a backend, so that circuit
+// breaking and related behavior can be validated without breaking real
+// backends. It must only ever be enabled for testing.
+type chaosTransport struct {
+	next http.RoundTripper
+}
+
+// chaosTargets reports whether faults should be injected toward the backend
+// with the given host, if chaos is enabled.
+func chaosTargets(host string) bool {
+	if config.Chaos.Backends == "" {
+		return true
+	}
+	return slices.Contains(strings.Split(config.Chaos.Backends, ","), host)
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if config.Chaos.Latency > 0 {
+		timer := time.NewTimer(config.Chaos.Latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if rand.Float64() < config.Chaos.DropRate {
+		// Simulate a dropped response by never responding.
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if rand.Float64() < config.Chaos.ErrorRate {
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("injected fault")),
+			Request:    req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+func (t *chaosTransport) CloseIdleConnections() {
+	if ci, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
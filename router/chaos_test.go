@@ -0,0 +1,40 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosTransport_InjectsErrorsTowardTargetedBackends(t *testing.T) {
+	defer func(backends string, errorRate float64) {
+		config.Chaos.Backends = backends
+		config.Chaos.ErrorRate = errorRate
+	}(config.Chaos.Backends, config.Chaos.ErrorRate)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	config.Chaos.ErrorRate = 1
+	client, err := NewBackendClient(BackendConfig{URL: backend.URL})
+	require.NoError(t, err)
+	resp, err := client.Get(backend.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "faults must not be injected unless enabled")
+
+	config.Chaos.Backends = "fish.invalid"
+	client, err = newBackendClient(BackendConfig{URL: backend.URL}, true)
+	require.NoError(t, err)
+	resp, err = client.Get(backend.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "faults must only be injected toward targeted backends")
+
+	config.Chaos.Backends = ""
+	client, err = newBackendClient(BackendConfig{URL: backend.URL}, true)
+	require.NoError(t, err)
+	resp, err = client.Get(backend.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
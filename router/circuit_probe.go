@@ -0,0 +1,142 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mercari/go-circuitbreaker"
+)
+
+// circuitClasses are the route classes that backends may have separate
+// circuit breakers for.
+var circuitClasses = []string{circuitFind, circuitMetadata, circuitProviders}
+
+// circuitProber probes backends whose circuits are half-open with synthetic
+// requests to the configured probe path, so that whether a backend recovered
+// is decided without sending it user requests. Probes that fail reopen the
+// circuits, and enough probes that succeed close them.
+type circuitProber struct {
+	backends func() []Backend
+}
+
+func newCircuitProber(backends func() []Backend) (*circuitProber, error) {
+	for _, p := range []string{config.Circuit.ProbePath, config.CascadeCircuit.ProbePath} {
+		if _, err := url.Parse(p); err != nil {
+			return nil, fmt.Errorf("invalid circuit probe path %q: %w", p, err)
+		}
+	}
+	if config.Circuit.ProbeInterval <= 0 {
+		return nil, fmt.Errorf("circuit probe interval must be positive, got %s", config.Circuit.ProbeInterval)
+	}
+	return &circuitProber{backends: backends}, nil
+}
+
+// probePathOf returns the probe path of the given backend, or the empty
+// string if its circuits are not probed.
+func probePathOf(b Backend) string {
+	if _, isCascade := b.(caskadeBackend); isCascade {
+		return config.CascadeCircuit.ProbePath
+	}
+	return config.Circuit.ProbePath
+}
+
+// circuitReady checks whether user requests of the given route class may be
+// sent to the given backend as per its circuit breaker.
+func circuitReady(b Backend, class string) bool {
+	return cbReady(b.CBFor(class), probePathOf(b) != "")
+}
+
+// cbReady checks whether user requests may be sent through the given circuit
+// breaker. Probed circuits must be closed, since only probes are sent through
+// them while half-open.
+func cbReady(cb *circuitbreaker.CircuitBreaker, probed bool) bool {
+	if cb == nil {
+		return true
+	}
+	if probed {
+		return cb.State() == circuitbreaker.StateClosed
+	}
+	return cb.Ready()
+}
+
+// run probes half-open circuits at the configured interval until the context
+// is done.
+func (p *circuitProber) run(ctx context.Context) {
+	ticker := time.NewTicker(config.Circuit.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.probeAll(ctx)
+	}
+}
+
+func (p *circuitProber) probeAll(ctx context.Context) {
+	for _, b := range p.backends() {
+		path := probePathOf(b)
+		if path == "" {
+			continue
+		}
+		// Classes may share a circuit breaker, which must be probed once.
+		var halfOpen []*circuitbreaker.CircuitBreaker
+		seen := make(map[*circuitbreaker.CircuitBreaker]struct{})
+		for _, class := range circuitClasses {
+			cb := b.CBFor(class)
+			if cb == nil {
+				continue
+			}
+			if _, ok := seen[cb]; ok {
+				continue
+			}
+			seen[cb] = struct{}{}
+			if cb.State() == circuitbreaker.StateHalfOpen {
+				halfOpen = append(halfOpen, cb)
+			}
+		}
+		if len(halfOpen) == 0 {
+			continue
+		}
+		err := p.probe(ctx, b, path)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Infow("Probe of half-open circuit failed", "backend", b.URL().Host, "err", err)
+		}
+		for _, cb := range halfOpen {
+			_ = cb.Done(ctx, err)
+		}
+	}
+}
+
+// probe sends a probe request to the given path of the given backend. Only
+// 5xx responses fail the probe, as is the case for user requests.
+func (p *circuitProber) probe(ctx context.Context, b Backend, path string) error {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Server.ResultMaxWait)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL().ResolveReference(ref).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitProber_DecidesRecoveryOfHalfOpenCircuits(t *testing.T) {
+	defer func(old string) { config.Circuit.ProbePath = old }(config.Circuit.ProbePath)
+	defer func(old int) { config.Circuit.HalfOpenSuccesses = old }(config.Circuit.HalfOpenSuccesses)
+	defer func(old time.Duration) { config.Circuit.OpenTimeout = old }(config.Circuit.OpenTimeout)
+	config.Circuit.ProbePath = "/health?probe=true"
+	config.Circuit.HalfOpenSuccesses = 2
+	config.Circuit.OpenTimeout = time.Hour
+
+	var healthy atomic.Bool
+	var probes, others atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.URL.Query().Get("probe") != "true" {
+			others.Add(1)
+			return
+		}
+		probes.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "", http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	backends, err := loadBackends([]BackendConfig{{URL: backend.URL}}, nil, false)
+	require.NoError(t, err)
+	b := backends[0]
+	subject, err := newCircuitProber(func() []Backend { return backends })
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// Closed circuits are not probed.
+	subject.probeAll(ctx)
+	require.Zero(t, probes.Load())
+	require.True(t, circuitReady(b, circuitFind))
+
+	// Half-open circuits are not sent user requests, and reopen once a probe
+	// fails.
+	b.CB().SetState(circuitbreaker.StateHalfOpen)
+	require.False(t, circuitReady(b, circuitFind))
+	require.True(t, circuitReady(b, circuitMetadata))
+	subject.probeAll(ctx)
+	require.Equal(t, int32(1), probes.Load())
+	require.Equal(t, circuitbreaker.StateOpen, b.CB().State())
+
+	// Half-open circuits close once enough probes succeed.
+	healthy.Store(true)
+	b.CB().SetState(circuitbreaker.StateHalfOpen)
+	subject.probeAll(ctx)
+	require.Equal(t, circuitbreaker.StateHalfOpen, b.CB().State())
+	subject.probeAll(ctx)
+	require.Equal(t, circuitbreaker.StateClosed, b.CB().State())
+	require.True(t, circuitReady(b, circuitFind))
+	require.Equal(t, int32(3), probes.Load())
+	require.Zero(t, others.Load())
+}
@@ -0,0 +1,39 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// statusClientClosedRequest is the non-standard status of requests whose
+// client went away before they were responded to, as logged by nginx.
+const statusClientClosedRequest = 499
+
+// errClientGone is the cause of the cancellation of request contexts once the
+// client goes away. It wraps context.Canceled, since HTTP clients fail
+// requests with the cause of the cancellation of their context.
+var errClientGone = fmt.Errorf("client gone: %w", context.Canceled)
+
+// withClientGone cancels the context of requests to next with errClientGone
+// as soon as the client goes away, so that the backend fan-out of any handler
+// is cut short and told apart from failures. The request context is otherwise
+// only canceled once the handler returns.
+func withClientGone(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancelCause(context.WithoutCancel(r.Context()))
+		defer cancel(nil)
+		// While the handler runs, the request context is canceled only if the
+		// connection is closed, or the stream is reset for HTTP/2.
+		stop := context.AfterFunc(r.Context(), func() { cancel(errClientGone) })
+		defer stop()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientGone checks whether the given context was canceled since the client
+// went away.
+func clientGone(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errClientGone)
+}
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestFind_CancelsScatterOnceClientIsGone(t *testing.T) {
+	defer func(old time.Duration) { config.Server.ResultMaxWait = old }(config.Server.ResultMaxWait)
+	config.Server.ResultMaxWait = time.Minute
+	backendsView := &view.View{
+		Name:        "test/find/backends_client_gone",
+		Measure:     metrics.FindBackends,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{metrics.Outcome},
+	}
+	require.NoError(t, view.Register(backendsView))
+	defer view.Unregister(backendsView)
+
+	// Backends hang until their request is canceled.
+	queried := make(chan struct{}, 2)
+	canceled := make(chan struct{}, 2)
+	hanging := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		queried <- struct{}{}
+		<-r.Context().Done()
+		canceled <- struct{}{}
+	}))
+	defer hanging.Close()
+	providers := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer providers.Close()
+	handler, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: hanging.URL},
+			{URL: hanging.URL},
+			{URL: providers.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/cid/"+mockbackend.SampleCids[0], nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", MediaTypeJson)
+	go func() {
+		for range 2 {
+			<-queried
+		}
+		// The client goes away once every backend is queried.
+		cancel()
+	}()
+	_, err = server.Client().Do(req)
+	require.ErrorIs(t, err, context.Canceled)
+
+	for range 2 {
+		select {
+		case <-canceled:
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "backend requests were not canceled once the client went away")
+		}
+	}
+	require.Eventually(t, func() bool {
+		rows, err := view.RetrieveData(backendsView.Name)
+		require.NoError(t, err)
+		for _, row := range rows {
+			if row.Tags[0].Value == "client-gone" {
+				return row.Data.(*view.SumData).Value == 2
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+}
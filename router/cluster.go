@@ -0,0 +1,200 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mercari/go-circuitbreaker"
+)
+
+// clusterStatePath is the path on which instances serve the circuit state of
+// their backends to peers.
+const clusterStatePath = "/cluster/state"
+
+// clusterState is the circuit state of the backends of an instance as served
+// to its peers.
+type clusterState struct {
+	Backends []clusterBackendState
+}
+
+type clusterBackendState struct {
+	URL     string
+	Type    string
+	Circuit string
+	// Adopted is whether the circuit was opened on behalf of a peer rather
+	// than by failures observed by the instance itself.
+	Adopted bool `json:",omitempty"`
+}
+
+// cluster shares circuit breaker state between indexstar instances, so that a
+// backend found to be failing by one instance is skipped by all of them.
+//
+// Each instance periodically polls the state of its peers, and opens the
+// closed circuit of any backend that a peer opened due to failures it
+// observed itself. Circuits opened on behalf of peers are not propagated any
+// further, so that instances do not keep reopening each other's circuits once
+// the backend recovers. Backends are matched across instances by type and
+// URL.
+type cluster struct {
+	peers    []*url.URL
+	client   *http.Client
+	backends func() []Backend
+
+	mu      sync.Mutex
+	adopted map[string]struct{}
+}
+
+func newCluster(backends func() []Backend) (*cluster, error) {
+	peers, err := clusterPeers()
+	if err != nil {
+		return nil, err
+	}
+	c := &cluster{
+		client:   &http.Client{Timeout: config.Server.HttpClientTimeout},
+		backends: backends,
+		adopted:  make(map[string]struct{}),
+	}
+	for _, peer := range peers {
+		c.peers = append(c.peers, peer.JoinPath(clusterStatePath))
+	}
+	return c, nil
+}
+
+// clusterPeers parses the configured cluster peers.
+func clusterPeers() ([]*url.URL, error) {
+	var peers []*url.URL
+	for _, peer := range strings.Split(config.Cluster.Peers, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		u, err := url.Parse(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster peer %s: %w", peer, err)
+		}
+		peers = append(peers, u)
+	}
+	return peers, nil
+}
+
+func clusterKey(b Backend) string {
+	return backendType(b) + " " + b.URL().String()
+}
+
+// run synchronizes circuit state with peers at the configured interval until
+// the context is done.
+func (c *cluster) run(ctx context.Context) {
+	ticker := time.NewTicker(config.Cluster.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.syncAll(ctx)
+	}
+}
+
+func (c *cluster) syncAll(ctx context.Context) {
+	byKey := make(map[string]Backend)
+	for _, b := range c.backends() {
+		if b.CB() != nil {
+			byKey[clusterKey(b)] = b
+		}
+	}
+
+	c.mu.Lock()
+	// Circuits that closed or half-opened since being adopted report
+	// failures observed locally from then on.
+	for key := range c.adopted {
+		if b, ok := byKey[key]; !ok || b.CB().State() != circuitbreaker.StateOpen {
+			delete(c.adopted, key)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, peer := range c.peers {
+		st, err := c.fetch(ctx, peer)
+		if err != nil {
+			log.Warnw("Failed to fetch cluster state of peer", "peer", peer, "err", err)
+			continue
+		}
+		for _, bs := range st.Backends {
+			if bs.Adopted || bs.Circuit != string(circuitbreaker.StateOpen) {
+				continue
+			}
+			key := bs.Type + " " + bs.URL
+			b, ok := byKey[key]
+			if !ok || b.CB().State() != circuitbreaker.StateClosed {
+				continue
+			}
+			log.Infow("Opening circuit of backend on behalf of peer", "backend", bs.URL, "peer", peer.Host)
+			c.mu.Lock()
+			c.adopted[key] = struct{}{}
+			c.mu.Unlock()
+			b.CB().SetState(circuitbreaker.StateOpen)
+		}
+	}
+}
+
+func (c *cluster) fetch(ctx context.Context, peer *url.URL) (*clusterState, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d response from peer", resp.StatusCode)
+	}
+	var st clusterState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// serveHTTP serves the circuit state of backends to peers.
+func (c *cluster) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	var st clusterState
+	c.mu.Lock()
+	for _, b := range c.backends() {
+		if b.CB() == nil {
+			continue
+		}
+		_, adopted := c.adopted[clusterKey(b)]
+		st.Backends = append(st.Backends, clusterBackendState{
+			URL:     b.URL().String(),
+			Type:    backendType(b),
+			Circuit: string(b.CB().State()),
+			Adopted: adopted,
+		})
+	}
+	c.mu.Unlock()
+	data, err := json.Marshal(st)
+	if err != nil {
+		log.Errorw("Failed to marshal cluster state", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, data)
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCluster_SharesLocallyOpenedCircuits(t *testing.T) {
+	newBackends := func() []Backend {
+		var backends []Backend
+		for _, u := range []string{"http://a.invalid", "http://b.invalid"} {
+			b, err := NewBackend(u, circuitbreaker.New(), Matchers.Any, nil)
+			require.NoError(t, err)
+			backends = append(backends, b)
+		}
+		return backends
+	}
+	newTestCluster := func(backends []Backend, peer string) *cluster {
+		defer func(old string) { config.Cluster.Peers = old }(config.Cluster.Peers)
+		config.Cluster.Peers = peer
+		c, err := newCluster(func() []Backend { return backends })
+		require.NoError(t, err)
+		return c
+	}
+
+	// Instances a and b are peers of each other.
+	var a, b *cluster
+	aServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { a.serveHTTP(w, r) }))
+	defer aServer.Close()
+	bServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { b.serveHTTP(w, r) }))
+	defer bServer.Close()
+	aBackends, bBackends := newBackends(), newBackends()
+	a = newTestCluster(aBackends, bServer.URL)
+	b = newTestCluster(bBackends, aServer.URL)
+
+	aBackends[0].CB().SetState(circuitbreaker.StateOpen)
+	b.syncAll(context.Background())
+	require.Equal(t, circuitbreaker.StateOpen, bBackends[0].CB().State())
+	require.Equal(t, circuitbreaker.StateClosed, bBackends[1].CB().State())
+
+	// Once the backend recovers, the circuit adopted by b does not reopen the
+	// circuit of a.
+	aBackends[0].CB().SetState(circuitbreaker.StateClosed)
+	a.syncAll(context.Background())
+	require.Equal(t, circuitbreaker.StateClosed, aBackends[0].CB().State())
+
+	// A circuit adopted by b reports local failures again once it leaves the
+	// open state.
+	bBackends[0].CB().SetState(circuitbreaker.StateHalfOpen)
+	b.syncAll(context.Background())
+	bBackends[0].CB().SetState(circuitbreaker.StateOpen)
+	a.syncAll(context.Background())
+	require.Equal(t, circuitbreaker.StateOpen, aBackends[0].CB().State())
+}
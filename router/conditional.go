@@ -0,0 +1,67 @@
+package router
+
+import (
+	"bytes"
+	"sync"
+)
+
+// backendValidator is the response of a backend to a find request along with
+// the entity tag the backend gave it, retained so that the request can later
+// be revalidated conditionally.
+type backendValidator struct {
+	etag string
+	data []byte
+}
+
+// conditionalFind revalidates a find request whose result is cached but
+// expired without re-transferring unchanged responses.
+//
+// Backends that support conditional requests give their responses an ETag,
+// such as a hash of the result. Those responses are retained along with the
+// cached result, and the request is sent to those backends with their
+// previous ETag in If-None-Match. A backend replying 304 Not Modified is
+// taken to have responded with its previous response.
+type conditionalFind struct {
+	prev map[string]backendValidator
+
+	mu   sync.Mutex
+	next map[string]backendValidator
+}
+
+func newConditionalFind(prev map[string]backendValidator) *conditionalFind {
+	return &conditionalFind{prev: prev, next: make(map[string]backendValidator)}
+}
+
+// validatorFor returns the previous response of the given backend, if it
+// gave it an ETag. A nil conditionalFind has no validators.
+func (c *conditionalFind) validatorFor(b Backend) (backendValidator, bool) {
+	if c == nil {
+		return backendValidator{}, false
+	}
+	v, ok := c.prev[clusterKey(b)]
+	return v, ok
+}
+
+// observe retains a copy of the given response of the given backend if the
+// backend gave it an ETag.
+func (c *conditionalFind) observe(b Backend, etag string, data []byte) {
+	if c == nil || etag == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.next[clusterKey(b)] = backendValidator{etag: etag, data: bytes.Clone(data)}
+}
+
+// validators returns the responses observed with an ETag, or nil if none were.
+func (c *conditionalFind) validators() map[string]backendValidator {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.next) == 0 {
+		return nil
+	}
+	return c.next
+}
@@ -0,0 +1,72 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind_RevalidatesConditionally(t *testing.T) {
+	defer func(old time.Duration) { config.Cache.TTL = old }(config.Cache.TTL)
+	defer func(old time.Duration) { config.Cache.RevalidateWindow = old }(config.Cache.RevalidateWindow)
+	config.Cache.TTL = time.Nanosecond
+	config.Cache.RevalidateWindow = time.Hour
+
+	const etag = `"sample"`
+	var conditional, notModified atomic.Int32
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/providers") {
+			mock.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") != "" {
+			conditional.Add(1)
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(c string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+c, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+
+	fresh := find(mockbackend.SampleCids[0])
+	require.Equal(t, http.StatusOK, fresh.Code)
+	require.Zero(t, conditional.Load())
+
+	// Revalidation sends the previous ETag, and the previous response is
+	// reused when the backend replies that it is unchanged.
+	require.Equal(t, http.StatusOK, find(mockbackend.SampleCids[0]).Code)
+	require.Eventually(t, func() bool { return notModified.Load() == 2 }, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		rec := find(mockbackend.SampleCids[0])
+		return rec.Code == http.StatusOK && notModified.Load() >= 4
+	}, time.Second, 10*time.Millisecond)
+	require.JSONEq(t, fresh.Body.String(), find(mockbackend.SampleCids[0]).Body.String())
+	require.Equal(t, conditional.Load(), notModified.Load())
+}
@@ -0,0 +1,1157 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultServerMaxIdleConns                    = 100
+	defaultServerMaxConnsPerHost                 = 100
+	defaultServerMaxIdleConnsPerHost             = 100
+	defaultServerDialerTimeout                   = 10 * time.Second
+	defaultServerDialerKeepAlive                 = 15 * time.Second
+	defaultServerDialerFallbackDelay             = 300 * time.Millisecond
+	defaultServerDialerPreferredFamily           = ""
+	defaultServerMaxOutboundConns                = 0
+	defaultServerOutboundConnQueueSize           = 64
+	defaultServerOutboundConnQueueTimeout        = 100 * time.Millisecond
+	defaultServerEgressAllowlist                 = ""
+	defaultServerHttpClientTimeout               = 30 * time.Second
+	defaultServerResultMaxWait                   = 5 * time.Second
+	defaultServerResultStreamMaxWait             = 20 * time.Second
+	defaultServerMaxRequestBodySize       int64  = 8 << 10 // 8KiB
+	defaultServerCascadeLabels            string = ""      // 8KiB
+	defaultServerMaxDedupEntries                 = 1 << 17
+	defaultServerNDJsonScannerBufferSize         = 4 << 10 // 4KiB
+	defaultServerNDJsonMaxLineSize               = 1 << 20 // 1MiB
+	defaultServerSingleBackendFastPath           = true
+	defaultServerDNSRefreshInterval              = 0
+	defaultServerMaxMultihashesPerLookup         = 10
+	defaultServerWatchInterval                   = 10 * time.Second
+	defaultServerWatchMaxDuration                = 5 * time.Minute
+	defaultServerMiddlewares                     = ""
+	defaultServerBackendPinningToken             = ""
+	defaultServerCascadeMaxWait                  = 0
+	defaultServerCascadeStreamMaxWait            = 0
+	defaultServerMaxRequestBodySizes             = "POST=1048576,PUT=1048576"
+	defaultServerAdminToken                      = ""
+	defaultServerScatterWorkers                  = 16384
+	defaultServerScatterBackendWorkers           = 4096
+	defaultServerMaxStreams                      = 0
+	defaultServerStreamWriteTimeout              = 10 * time.Second
+	defaultServerStreamingRecheck                = 10 * time.Minute
+	defaultServerOptionsCacheTTL                 = 5 * time.Minute
+	defaultServerDHFallback                      = false
+
+	defaultCircuitHalfOpenSuccesses = 10
+	defaultCircuitOpenTimeout       = 0
+	defaultCircuitCounterReset      = 1 * time.Second
+	defaultCircuitProbePath         = ""
+	defaultCircuitProbeInterval     = 1 * time.Second
+
+	defaultConcurrencyInitialLimit     = 0
+	defaultConcurrencyMinLimit         = 1
+	defaultConcurrencyMaxLimit         = 1000
+	defaultConcurrencyLatencyThreshold = 0
+	defaultConcurrencyBackoff          = 0.9
+
+	defaultCascadeCircuitHalfOpenSuccesses = 10
+	defaultCascadeCircuitOpenTimeout       = 0
+	defaultCascadeCircuitCounterReset      = 1 * time.Second
+	defaultCascadeCircuitProbePath         = ""
+
+	defaultCascadeRateLimitMaxQPS    = 0.0
+	defaultCascadeRateLimitQueueWait = 0
+
+	defaultSubscriptionsStorePath        = ""
+	defaultSubscriptionsCheckInterval    = 1 * time.Minute
+	defaultSubscriptionsWorkers          = 8
+	defaultSubscriptionsMaxSubscriptions = 10_000
+	defaultSubscriptionsTTL              = 24 * time.Hour
+	defaultSubscriptionsCallbackTimeout  = 10 * time.Second
+
+	defaultAuditInterval   = 0
+	defaultAuditSampleRate = 0.01
+	defaultAuditMaxSamples = 1000
+	defaultAuditBatchSize  = 10
+
+	defaultCanaryProbes   = ""
+	defaultCanaryInterval = 1 * time.Minute
+
+	defaultIngestInterval = 0
+	defaultIngestMaxLag   = 0
+
+	defaultCertExpiryInterval = 1 * time.Hour
+	defaultCertExpiryWindow   = 14 * 24 * time.Hour
+
+	defaultMirrorTarget     = ""
+	defaultMirrorSampleRate = 0.01
+	defaultMirrorPaths      = ""
+	defaultMirrorMethods    = "GET"
+	defaultMirrorMaxQPS     = 10.0
+
+	defaultExperimentPath = ""
+
+	defaultCacheMaxEntries       = 10_000
+	defaultCacheTTL              = 0
+	defaultCacheRevalidateWindow = 0
+	defaultCacheStaleWindow      = 0
+
+	defaultDelegatedCacheTTL        = 0
+	defaultDelegatedCacheMaxEntries = 10_000
+	defaultDelegatedMaxAge          = 5 * time.Minute
+	defaultDelegatedNotFoundMaxAge  = 15 * time.Second
+
+	defaultNegativeWindow       = 0
+	defaultNegativeBits         = 1 << 23
+	defaultNegativeHashes       = 4
+	defaultNegativePeers        = ""
+	defaultNegativeSyncInterval = 10 * time.Second
+
+	defaultClusterPeers    = ""
+	defaultClusterInterval = 5 * time.Second
+
+	defaultRateLimitPerIP        = 0
+	defaultRateLimitPerKey       = 0
+	defaultRateLimitWindow       = time.Minute
+	defaultRateLimitSyncInterval = time.Second
+
+	defaultInflightLimitPerIP  = 0
+	defaultInflightLimitPerKey = 0
+
+	defaultLeaderLease         = ""
+	defaultLeaderIdentity      = ""
+	defaultLeaderAPIServer     = ""
+	defaultLeaderLeaseDuration = 15 * time.Second
+	defaultLeaderRenewInterval = 5 * time.Second
+
+	defaultShardReplicas = 0
+
+	defaultPriorityDefault       = "high"
+	defaultPriorityKeys          = ""
+	defaultPriorityLoadThreshold = 0
+	defaultPriorityShedThreshold = 0
+	defaultPriorityLowMaxWait    = 0
+
+	defaultMaxWaitKeys = ""
+	defaultMaxWaitMin  = 0
+	defaultMaxWaitMax  = time.Minute
+
+	defaultDeadlinePercentile = 0.0
+	defaultDeadlineMargin     = 250 * time.Millisecond
+	defaultDeadlineMin        = 500 * time.Millisecond
+	defaultDeadlineMax        = 0
+	defaultDeadlineSamples    = 1000
+
+	defaultUsageRetention  = 0
+	defaultUsageBucket     = time.Hour
+	defaultUsageIPv4Prefix = 24
+	defaultUsageIPv6Prefix = 48
+
+	defaultChaosBackends  = ""
+	defaultChaosLatency   = 0
+	defaultChaosDropRate  = 0.0
+	defaultChaosErrorRate = 0.0
+
+	defaultCapturePath       = ""
+	defaultCaptureSampleRate = 0.01
+
+	defaultAnalyticsSink          = ""
+	defaultAnalyticsSalt          = ""
+	defaultAnalyticsBatchSize     = 1000
+	defaultAnalyticsFlushInterval = 10 * time.Second
+	defaultAnalyticsQueueSize     = 10_000
+
+	defaultSnapshotPath     = ""
+	defaultSnapshotInterval = 5 * time.Minute
+
+	defaultPolicyPath              = ""
+	defaultPolicyDefaultAction     = policyActionAllow
+	defaultPolicyTrustForwardedFor = false
+
+	defaultIndexTemplateDir = ""
+	defaultIndexNetworkName = ""
+	defaultIndexDocsLinks   = ""
+	defaultIndexVars        = ""
+	defaultIndexCacheTTL    = 10 * time.Second
+
+	defaultProvidersScatter              = false
+	defaultProvidersCacheRefreshInterval = 2 * time.Minute
+	defaultProvidersCacheTTL             = 10 * time.Minute
+	defaultProvidersCachePreload         = true
+	defaultProvidersCacheMaxSize         = 0
+	defaultProvidersExpandExtended       = false
+	defaultProvidersMergePolicy          = providersMergeFreshest
+	defaultProvidersPreferredSource      = ""
+
+	defaultReadYourWritesTTL = 0
+
+	defaultReputationSource          = ""
+	defaultReputationRefreshInterval = 10 * time.Minute
+	defaultReputationDefaultScore    = 1.0
+	defaultReputationMinScore        = 0.0
+
+	// DefaultPathName is the default config dir name.
+	DefaultPathName = ".indexstar"
+	// DefaultPathRoot is the path to the default config dir location.
+	DefaultPathRoot = "~/" + DefaultPathName
+	// DefaultConfigFile is the filename of the configuration file.
+	DefaultConfigFile = "config"
+	// EnvDir is the environment variable used to change the path root.
+	EnvDir = "INDEXSTAR_PATH"
+)
+
+var config struct {
+	Server struct {
+		MaxIdleConns        int
+		MaxConnsPerHost     int
+		MaxIdleConnsPerHost int
+		DialerTimeout       time.Duration
+		DialerKeepAlive     time.Duration
+		// DialerFallbackDelay is how long dials to a backend over its
+		// preferred address family are given before a dial over the other
+		// family is raced against them, so that a broken IPv6 or IPv4 path
+		// does not cost a full dial timeout. Dials fall back only after
+		// the preferred family fails if negative.
+		DialerFallbackDelay time.Duration
+		// DialerPreferredFamily is the address family, ipv4 or ipv6, that
+		// backends reachable over both are dialed over first. Backends are
+		// dialed in the order their addresses resolve if empty.
+		DialerPreferredFamily string
+		// MaxOutboundConns is the budget of connections open to all
+		// backends at once, idle or in use, so that memory and file
+		// descriptors stay bounded during retry storms regardless of the
+		// number of backends. Idle connections count against the budget,
+		// so it should allow for those kept by MaxIdleConnsPerHost.
+		// Unbounded if zero.
+		MaxOutboundConns int
+		// OutboundConnQueueSize is the number of dials that may wait for a
+		// connection of the exhausted outbound budget to close. Dials
+		// beyond it fail fast.
+		OutboundConnQueueSize int
+		// OutboundConnQueueTimeout is how long dials wait in the outbound
+		// connection queue before failing.
+		OutboundConnQueueTimeout time.Duration
+		HttpClientTimeout        time.Duration
+		ResultMaxWait            time.Duration
+		ResultStreamMaxWait      time.Duration
+		MaxRequestBodySize       int64
+		CascadeLabels            string
+		MaxDedupEntries          int
+		NDJsonScannerBufferSize  int
+		NDJsonMaxLineSize        int
+		SingleBackendFastPath    bool
+		DNSRefreshInterval       time.Duration
+		MaxMultihashesPerLookup  int
+		WatchInterval            time.Duration
+		WatchMaxDuration         time.Duration
+		// EgressAllowlist is the comma-separated list of CIDRs, IP addresses
+		// and hostnames that backends, including cascade backends, may be
+		// connected to. Hostnames prefixed with "*." allow their subdomains.
+		// It is enforced on every dial, so that backends outside it cannot
+		// be reached whatever the backends config. Every destination is
+		// allowed if empty.
+		EgressAllowlist string
+		// Middlewares is the comma-separated, ordered chain of middlewares
+		// registered via RegisterMiddleware to apply to requests. Like
+		// Options.Middlewares, any middleware disables proxying find requests
+		// to a sole backend and caching translated delegated responses.
+		Middlewares string
+		// BackendPinningToken is the secret that authenticates requests
+		// pinned to a single backend via the X-IPNI-Backend header. Pinning
+		// is disabled if empty.
+		BackendPinningToken string
+		// CascadeMaxWait and CascadeStreamMaxWait override ResultMaxWait and
+		// ResultStreamMaxWait respectively for cascade backends, if non-zero.
+		CascadeMaxWait       time.Duration
+		CascadeStreamMaxWait time.Duration
+		// MaxRequestBodySizes is the comma-separated list of METHOD=bytes or
+		// METHOD /path/prefix=bytes rules that override MaxRequestBodySize
+		// for matching requests, so that lookups are held to small bodies
+		// while batch and announce payloads may be larger. The matching rule
+		// with the longest path prefix applies.
+		MaxRequestBodySizes string
+		// AdminToken is the bearer token that authenticates requests to the
+		// /admin/ endpoints. Admin endpoints are disabled if empty.
+		AdminToken string
+		// ScatterWorkers and ScatterBackendWorkers bound the number of
+		// requests to backends in flight across all backends and per backend
+		// respectively. Requests queue once either bound is reached.
+		// Unbounded if zero.
+		ScatterWorkers        int
+		ScatterBackendWorkers int
+		// MaxStreams is the number of streaming responses that may be open at
+		// once, beyond which streaming requests are rejected with 503 Service
+		// Unavailable. Unlimited if zero.
+		MaxStreams int
+		// StreamWriteTimeout bounds each write of results to streaming
+		// responses, beyond which the client is considered stalled and the
+		// response is aborted. Unbounded if zero.
+		StreamWriteTimeout time.Duration
+		// StreamingRecheck is how long backends that rejected a streaming
+		// request are asked for JSON responses instead, before streaming is
+		// tried again.
+		StreamingRecheck time.Duration
+		// OptionsCacheTTL is how long the capabilities of backends, merged
+		// from their responses to OPTIONS requests, are cached for. OPTIONS
+		// requests are answered with static capabilities if zero.
+		OptionsCacheTTL time.Duration
+		// DHFallback sets whether plaintext lookups that find nothing fall
+		// back on looking up the double hash of the multihash on dh backends
+		// before responding 404, decrypting their records like dhfind does,
+		// so that content only indexed by dh backends is still found.
+		DHFallback bool
+	}
+	Circuit struct {
+		HalfOpenSuccesses int
+		OpenTimeout       time.Duration
+		CounterReset      time.Duration
+		// ProbePath is the path of the synthetic requests that half-open
+		// circuits of backends are probed with, rather than with user
+		// requests. Half-open circuits are sent user requests if empty.
+		ProbePath string
+		// ProbeInterval is the interval at which half-open circuits are
+		// probed.
+		ProbeInterval time.Duration
+	}
+	Concurrency struct {
+		// InitialLimit is the number of concurrent requests each backend is
+		// scattered at first, which is then adapted to the backend by
+		// additive increase and multiplicative decrease: raised by one per
+		// limit's worth of requests that succeed, and multiplied by Backoff
+		// whenever one fails. Backends scattered to beyond their limit are
+		// skipped, so that a degrading backend is relieved before its
+		// circuit trips. Disabled if zero.
+		InitialLimit int
+		// MinLimit and MaxLimit bound the adapted limits.
+		MinLimit int
+		MaxLimit int
+		// LatencyThreshold is the latency above which requests that succeed
+		// count as failed. Only failed requests do if zero.
+		LatencyThreshold time.Duration
+		// Backoff is the factor within (0, 1) that limits are multiplied by
+		// on failures.
+		Backoff float64
+	}
+	CascadeCircuit struct {
+		HalfOpenSuccesses int
+		OpenTimeout       time.Duration
+		CounterReset      time.Duration
+		// ProbePath is the probe path of cascade backends. See
+		// Circuit.ProbePath.
+		ProbePath string
+	}
+	CascadeRateLimit struct {
+		// MaxQPS bounds the rate of lookups cascaded to each cascade backend
+		// that does not configure its own. Unbounded if zero.
+		MaxQPS float64
+		// QueueWait is how long lookups beyond the rate wait to be cascaded
+		// before they are skipped. Skipped right away if zero.
+		QueueWait time.Duration
+	}
+	Subscriptions struct {
+		StorePath        string
+		CheckInterval    time.Duration
+		Workers          int
+		MaxSubscriptions int
+		TTL              time.Duration
+		CallbackTimeout  time.Duration
+	}
+	Audit struct {
+		Interval   time.Duration
+		SampleRate float64
+		MaxSamples int
+		BatchSize  int
+	}
+	Canary struct {
+		Probes   string
+		Interval time.Duration
+	}
+	Ingest struct {
+		// Interval is the interval at which backend ingestion status is
+		// polled. Polling is disabled if zero.
+		Interval time.Duration
+		// MaxLag is the time since the latest ingested advertisement beyond
+		// which a backend is left out of find requests, as long as fresher
+		// backends of the same type are available. Disabled if zero.
+		MaxLag time.Duration
+	}
+	CertExpiry struct {
+		// Interval is the interval at which the expiry of the TLS
+		// certificates of HTTPS backends is checked. Checking is disabled if
+		// zero.
+		Interval time.Duration
+		// Window is the time before a certificate expires from which its
+		// expiry is warned about.
+		Window time.Duration
+	}
+	Mirror struct {
+		// Target is the URL of the backend to mirror requests to. Mirroring
+		// is disabled if empty.
+		Target     string
+		SampleRate float64
+		// Paths is the comma-separated list of path prefixes of requests to
+		// mirror. Defaults to find requests if empty.
+		Paths string
+		// Methods is the comma-separated list of HTTP methods of requests to
+		// mirror.
+		Methods string
+		// MaxQPS bounds the rate of mirrored requests, and so the mirrored
+		// requests in flight, which are sent concurrently. Nothing is
+		// mirrored unless positive.
+		MaxQPS float64
+	}
+	Cache struct {
+		MaxEntries int
+		// TTL is how long a cached find response is served without
+		// contacting backends. Caching fresh responses is disabled if zero.
+		TTL time.Duration
+		// RevalidateWindow is how long past its TTL a cached find response
+		// is still served while it is refreshed in the background.
+		RevalidateWindow time.Duration
+		// StaleWindow is how old a cached find response may be to still be
+		// served when every backend fails. Serving stale responses is
+		// disabled if zero.
+		StaleWindow time.Duration
+	}
+	Delegated struct {
+		// CacheTTL is how long translated delegated routing responses with
+		// providers are cached. Caching is disabled if zero.
+		CacheTTL        time.Duration
+		CacheMaxEntries int
+		// MaxAge and NotFoundMaxAge are the max-age of the Cache-Control
+		// header of delegated routing responses with and without providers
+		// respectively. Responses without providers are cached for at most
+		// NotFoundMaxAge.
+		MaxAge         time.Duration
+		NotFoundMaxAge time.Duration
+	}
+	Negative struct {
+		// Window is how long a find lookup confirmed absent by every backend
+		// is answered with not found without contacting backends. The
+		// negative lookup filter is disabled if zero.
+		Window time.Duration
+		// Bits is the size of the filter, which bounds its false positive
+		// rate for a given number of entries.
+		Bits   int
+		Hashes int
+		// Peers is the comma-separated list of indexstar instances whose
+		// filters are merged into this one.
+		Peers        string
+		SyncInterval time.Duration
+	}
+	Cluster struct {
+		// Peers is the comma-separated list of indexstar instances to share
+		// backend circuit state with. Cluster mode is disabled if empty.
+		Peers string
+		// Interval is how often the circuit state of peers is polled.
+		Interval time.Duration
+	}
+	RateLimit struct {
+		// PerIP is the number of requests a client IP may make per window.
+		// Unlimited if zero.
+		PerIP int
+		// PerKey is the number of requests an API key may make per window.
+		// Unlimited if zero.
+		PerKey int
+		Window time.Duration
+		// SyncInterval is how often the counters of cluster peers are
+		// fetched.
+		SyncInterval time.Duration
+	}
+	InflightLimit struct {
+		// PerIP is the number of requests a client IP may have in flight at
+		// once. Unlimited if zero.
+		PerIP int
+		// PerKey is the number of requests an API key may have in flight at
+		// once. Unlimited if zero.
+		PerKey int
+	}
+	Leader struct {
+		// Lease is the namespace/name of the Kubernetes Lease that replicas
+		// compete for to run singleton background jobs. Leader election is
+		// disabled if empty, in which case every replica runs them.
+		Lease string
+		// Identity identifies this replica as the holder of the lease.
+		// Defaults to the hostname.
+		Identity string
+		// APIServer is the URL of the Kubernetes API server. Defaults to the
+		// in-cluster API server.
+		APIServer     string
+		LeaseDuration time.Duration
+		RenewInterval time.Duration
+	}
+	Shard struct {
+		// Replicas is the number of replicas of each replica group that a
+		// lookup is sent to. Shard affinity is disabled if zero, in which
+		// case lookups are sent to every replica.
+		Replicas int
+	}
+	Priority struct {
+		// Default is the priority class of requests that specify none,
+		// either high or low.
+		Default string
+		// Keys is the comma-separated list of key=class pairs that set the
+		// priority class of requests by API key.
+		Keys string
+		// LoadThreshold is the number of requests in flight above which low
+		// priority requests are served from cache when possible and get
+		// shorter backend deadlines. Disabled if zero.
+		LoadThreshold int
+		// ShedThreshold is the number of requests in flight above which low
+		// priority requests are rejected. Disabled if zero.
+		ShedThreshold int
+		// LowMaxWait bounds the backend deadline of low priority requests
+		// under load. Unbounded if zero.
+		LowMaxWait time.Duration
+	}
+	MaxWait struct {
+		// Keys is the comma-separated list of API keys trusted to override
+		// backend deadlines via the X-IPNI-Max-Wait header. The header is
+		// ignored if empty.
+		Keys string
+		// Min and Max bound overridden deadlines.
+		Min time.Duration
+		Max time.Duration
+	}
+	Deadline struct {
+		// Percentile is the percentile of recently observed backend latency,
+		// within (0, 1], that the backend deadline of each route is tuned to.
+		// Deadlines are not tuned if zero.
+		Percentile float64
+		// Margin is added to the observed latency percentile.
+		Margin time.Duration
+		// Min and Max bound tuned deadlines. Max defaults to the configured
+		// deadline of each route if zero.
+		Min time.Duration
+		Max time.Duration
+		// Samples is the number of most recent latencies per route that the
+		// percentile is computed over.
+		Samples int
+	}
+	Usage struct {
+		// Retention is how long usage per API key and client IP prefix is
+		// retained for, as served on /admin/usage. Usage is not accounted if
+		// zero.
+		Retention time.Duration
+		// Bucket is the granularity of retained usage.
+		Bucket time.Duration
+		// IPv4Prefix and IPv6Prefix are the prefix lengths that client IPs
+		// of requests without an API key are accounted by.
+		IPv4Prefix int
+		IPv6Prefix int
+	}
+	Experiment struct {
+		// Path is the path to the JSON file of the experiment to bucket
+		// requests into. Experiments are disabled if empty.
+		Path string
+	}
+	// Chaos configures the faults injected toward backends once enabled via
+	// the chaos CLI flag only, so that faults are never injected by accident.
+	Chaos struct {
+		Backends  string
+		Latency   time.Duration
+		DropRate  float64
+		ErrorRate float64
+	}
+	Capture struct {
+		Path       string
+		SampleRate float64
+	}
+	Analytics struct {
+		// Sink is where anonymized records of find lookups are shipped to
+		// for content demand analysis: a file path, an HTTP URL such as that
+		// of ClickHouse, a kafka+http URL of a Kafka REST proxy topic, or an
+		// s3://bucket/prefix URL. Query analytics is disabled if empty.
+		Sink string
+		// Salt is mixed into the hash of looked up multihashes, so that they
+		// cannot be recovered by hashing known multihashes.
+		Salt string
+		// BatchSize is the number of records shipped at once.
+		BatchSize int
+		// FlushInterval is how often records are shipped regardless of how
+		// many are batched.
+		FlushInterval time.Duration
+		// QueueSize is the number of records awaiting shipment beyond which
+		// records are dropped.
+		QueueSize int
+	}
+	Snapshot struct {
+		// Path is the path to the JSON file that cumulative counters, such as
+		// usage accounting and result cache statistics, are snapshotted to
+		// and restored from on startup. Snapshots are disabled if empty.
+		Path string
+		// Interval is how often counters are snapshotted, in addition to on
+		// shutdown.
+		Interval time.Duration
+	}
+	Policy struct {
+		// Path is the path to the JSON file of policy rules. Policy
+		// evaluation is disabled if empty.
+		Path string
+		// DefaultAction is the action taken when no rule allows or denies a
+		// request, either allow or deny.
+		DefaultAction string
+		// TrustForwardedFor sets whether the client IP is taken from the
+		// X-Forwarded-For header, for deployments behind a trusted proxy.
+		TrustForwardedFor bool
+	}
+	Index struct {
+		// TemplateDir is the path to a directory of templates whose
+		// index.html template overrides the embedded index page, so that the
+		// landing page can be changed without rebuilding. The embedded index
+		// page is served if empty.
+		TemplateDir string
+		// NetworkName is the name of the network served, as rendered on the
+		// index page.
+		NetworkName string
+		// DocsLinks is the comma-separated list of title=url links to
+		// documentation rendered on the index page.
+		DocsLinks string
+		// Vars is the comma-separated list of name=value variables passed to
+		// the index page template.
+		Vars string
+		// CacheTTL is how long the index page, rendered with the live state
+		// of the server such as its backends and the providers known, is
+		// served before being rendered anew. Rendered on every request if
+		// zero.
+		CacheTTL time.Duration
+	}
+	ReadYourWrites struct {
+		// TTL is how long lookups by a client that announced via the
+		// fallback backend, and provider lookups of the announced provider,
+		// include the backend that acknowledged the announcement. Disabled if
+		// zero.
+		TTL time.Duration
+	}
+	Reputation struct {
+		// Source is the HTTP URL or file path of a JSON object of provider
+		// reliability scores within [0, 1] keyed by peer ID, by which
+		// provider results are ranked. Reputation is disabled if empty,
+		// unless a source is given via the server options.
+		Source string
+		// RefreshInterval is how often scores are refreshed from the source.
+		RefreshInterval time.Duration
+		// DefaultScore is the score of providers unknown to the source.
+		DefaultScore float64
+		// MinScore is the score below which results of a provider are
+		// filtered out. Results are only ranked if zero.
+		MinScore float64
+	}
+	Providers struct {
+		// Scatter sets whether provider lookups are scattered to providers
+		// backends and merged, rather than answered from the provider cache,
+		// so that newly registered providers appear without waiting for the
+		// cache to refresh. The cache answers lookups when no backend responds.
+		Scatter bool
+		// CacheRefreshInterval is the interval at which the provider cache is
+		// refreshed from providers backends. Never refreshed if zero.
+		CacheRefreshInterval time.Duration
+		// CacheTTL is how long providers no longer listed by any backend
+		// remain in the provider cache.
+		CacheTTL time.Duration
+		// CachePreload sets whether the provider cache is loaded on start,
+		// rather than on the first refresh.
+		CachePreload bool
+		// CacheMaxSize bounds the number of providers loaded into the
+		// provider cache by each refresh. Unbounded if zero.
+		CacheMaxSize int
+		// ExpandExtended sets whether find responses include records of the
+		// extended providers of providers found, as known to the provider
+		// cache, for backends that do not expand them.
+		ExpandExtended bool
+		// MergePolicy is how the provider cache resolves conflicting
+		// information on a provider listed by several providers backends:
+		// freshest takes that of the most recent advertisement, union also
+		// takes the addresses listed by every backend, and prefer takes that
+		// of PreferredSource when it lists the provider.
+		MergePolicy string
+		// PreferredSource is the host of the providers backend preferred by
+		// the prefer merge policy.
+		PreferredSource string
+	}
+}
+
+func init() {
+	config.Server.MaxIdleConns = getEnvOrDefault[int]("SERVER_MAX_IDLE_CONNS", defaultServerMaxIdleConns)
+	config.Server.MaxConnsPerHost = getEnvOrDefault[int]("SERVER_MAX_CONNS_PER_HOST", defaultServerMaxConnsPerHost)
+	config.Server.MaxIdleConnsPerHost = getEnvOrDefault[int]("SERVER_MAX_IDLE_CONNS_PER_HOST", defaultServerMaxIdleConnsPerHost)
+	config.Server.DialerTimeout = getEnvOrDefault[time.Duration]("SERVER_DIALER_TIMEOUT", defaultServerDialerTimeout)
+	config.Server.DialerKeepAlive = getEnvOrDefault[time.Duration]("SERVER_DIALER_KEEP_ALIVE", defaultServerDialerKeepAlive)
+	config.Server.DialerFallbackDelay = getEnvOrDefault[time.Duration]("SERVER_DIALER_FALLBACK_DELAY", defaultServerDialerFallbackDelay)
+	config.Server.DialerPreferredFamily = getEnvOrDefault[string]("SERVER_DIALER_PREFERRED_FAMILY", defaultServerDialerPreferredFamily)
+	config.Server.MaxOutboundConns = getEnvOrDefault[int]("SERVER_MAX_OUTBOUND_CONNS", defaultServerMaxOutboundConns)
+	config.Server.OutboundConnQueueSize = getEnvOrDefault[int]("SERVER_OUTBOUND_CONN_QUEUE_SIZE", defaultServerOutboundConnQueueSize)
+	config.Server.OutboundConnQueueTimeout = getEnvOrDefault[time.Duration]("SERVER_OUTBOUND_CONN_QUEUE_TIMEOUT", defaultServerOutboundConnQueueTimeout)
+	config.Server.EgressAllowlist = getEnvOrDefault[string]("SERVER_EGRESS_ALLOWLIST", defaultServerEgressAllowlist)
+	config.Server.HttpClientTimeout = getEnvOrDefault[time.Duration]("SERVER_HTTP_CLIENT_TIMEOUT", defaultServerHttpClientTimeout)
+	config.Server.ResultMaxWait = getEnvOrDefault[time.Duration]("SERVER_RESULT_MAX_WAIT", defaultServerResultMaxWait)
+	config.Server.ResultStreamMaxWait = getEnvOrDefault[time.Duration]("SERVER_RESULT_STREAM_MAX_WAIT", defaultServerResultStreamMaxWait)
+	config.Server.MaxRequestBodySize = getEnvOrDefault[int64]("SERVER_MAX_REQUEST_BODY_SIZE", defaultServerMaxRequestBodySize)
+	config.Server.MaxRequestBodySizes = getEnvOrDefault[string]("SERVER_MAX_REQUEST_BODY_SIZES", defaultServerMaxRequestBodySizes)
+	config.Server.AdminToken = getEnvOrDefault[string]("SERVER_ADMIN_TOKEN", defaultServerAdminToken)
+	config.Server.ScatterWorkers = getEnvOrDefault[int]("SERVER_SCATTER_WORKERS", defaultServerScatterWorkers)
+	config.Server.ScatterBackendWorkers = getEnvOrDefault[int]("SERVER_SCATTER_BACKEND_WORKERS", defaultServerScatterBackendWorkers)
+	config.Server.MaxStreams = getEnvOrDefault[int]("SERVER_MAX_STREAMS", defaultServerMaxStreams)
+	config.Server.StreamWriteTimeout = getEnvOrDefault[time.Duration]("SERVER_STREAM_WRITE_TIMEOUT", defaultServerStreamWriteTimeout)
+	config.Server.StreamingRecheck = getEnvOrDefault[time.Duration]("SERVER_STREAMING_RECHECK", defaultServerStreamingRecheck)
+	config.Server.OptionsCacheTTL = getEnvOrDefault[time.Duration]("SERVER_OPTIONS_CACHE_TTL", defaultServerOptionsCacheTTL)
+	config.Server.DHFallback = getEnvOrDefault[bool]("SERVER_DH_FALLBACK", defaultServerDHFallback)
+	config.Server.CascadeLabels = getEnvOrDefault[string]("SERVER_CASCADE_LABELS", defaultServerCascadeLabels)
+	config.Server.MaxDedupEntries = getEnvOrDefault[int]("SERVER_MAX_DEDUP_ENTRIES", defaultServerMaxDedupEntries)
+	config.Server.NDJsonScannerBufferSize = getEnvOrDefault[int]("SERVER_NDJSON_SCANNER_BUFFER_SIZE", defaultServerNDJsonScannerBufferSize)
+	config.Server.NDJsonMaxLineSize = getEnvOrDefault[int]("SERVER_NDJSON_MAX_LINE_SIZE", defaultServerNDJsonMaxLineSize)
+	config.Server.SingleBackendFastPath = getEnvOrDefault[bool]("SERVER_SINGLE_BACKEND_FAST_PATH", defaultServerSingleBackendFastPath)
+	config.Server.DNSRefreshInterval = getEnvOrDefault[time.Duration]("SERVER_DNS_REFRESH_INTERVAL", defaultServerDNSRefreshInterval)
+	config.Server.MaxMultihashesPerLookup = getEnvOrDefault[int]("SERVER_MAX_MULTIHASHES_PER_LOOKUP", defaultServerMaxMultihashesPerLookup)
+	config.Server.WatchInterval = getEnvOrDefault[time.Duration]("SERVER_WATCH_INTERVAL", defaultServerWatchInterval)
+	config.Server.WatchMaxDuration = getEnvOrDefault[time.Duration]("SERVER_WATCH_MAX_DURATION", defaultServerWatchMaxDuration)
+	config.Server.Middlewares = getEnvOrDefault[string]("SERVER_MIDDLEWARES", defaultServerMiddlewares)
+	config.Server.BackendPinningToken = getEnvOrDefault[string]("SERVER_BACKEND_PINNING_TOKEN", defaultServerBackendPinningToken)
+	config.Server.CascadeMaxWait = getEnvOrDefault[time.Duration]("SERVER_CASCADE_MAX_WAIT", defaultServerCascadeMaxWait)
+	config.Server.CascadeStreamMaxWait = getEnvOrDefault[time.Duration]("SERVER_CASCADE_STREAM_MAX_WAIT", defaultServerCascadeStreamMaxWait)
+
+	config.Circuit.HalfOpenSuccesses = getEnvOrDefault[int]("CIRCUIT_HALF_OPEN_SUCCESSES", defaultCircuitHalfOpenSuccesses)
+	config.Circuit.OpenTimeout = getEnvOrDefault[time.Duration]("CIRCUIT_OPEN_TIMEOUT", defaultCircuitOpenTimeout)
+	config.Circuit.CounterReset = getEnvOrDefault[time.Duration]("CIRCUIT_COUNTER_RESET", defaultCircuitCounterReset)
+	config.Circuit.ProbePath = getEnvOrDefault[string]("CIRCUIT_PROBE_PATH", defaultCircuitProbePath)
+	config.Circuit.ProbeInterval = getEnvOrDefault[time.Duration]("CIRCUIT_PROBE_INTERVAL", defaultCircuitProbeInterval)
+
+	config.Concurrency.InitialLimit = getEnvOrDefault[int]("CONCURRENCY_INITIAL_LIMIT", defaultConcurrencyInitialLimit)
+	config.Concurrency.MinLimit = getEnvOrDefault[int]("CONCURRENCY_MIN_LIMIT", defaultConcurrencyMinLimit)
+	config.Concurrency.MaxLimit = getEnvOrDefault[int]("CONCURRENCY_MAX_LIMIT", defaultConcurrencyMaxLimit)
+	config.Concurrency.LatencyThreshold = getEnvOrDefault[time.Duration]("CONCURRENCY_LATENCY_THRESHOLD", defaultConcurrencyLatencyThreshold)
+	config.Concurrency.Backoff = getEnvOrDefault[float64]("CONCURRENCY_BACKOFF", defaultConcurrencyBackoff)
+
+	config.CascadeCircuit.HalfOpenSuccesses = getEnvOrDefault[int]("CASCADE_CIRCUIT_HALF_OPEN_SUCCESSES", defaultCascadeCircuitHalfOpenSuccesses)
+	config.CascadeCircuit.OpenTimeout = getEnvOrDefault[time.Duration]("CASCADE_CIRCUIT_OPEN_TIMEOUT", defaultCascadeCircuitOpenTimeout)
+	config.CascadeCircuit.CounterReset = getEnvOrDefault[time.Duration]("CASCADE_CIRCUIT_COUNTER_RESET", defaultCascadeCircuitCounterReset)
+	config.CascadeCircuit.ProbePath = getEnvOrDefault[string]("CASCADE_CIRCUIT_PROBE_PATH", defaultCascadeCircuitProbePath)
+
+	config.CascadeRateLimit.MaxQPS = getEnvOrDefault[float64]("CASCADE_RATE_LIMIT_MAX_QPS", defaultCascadeRateLimitMaxQPS)
+	config.CascadeRateLimit.QueueWait = getEnvOrDefault[time.Duration]("CASCADE_RATE_LIMIT_QUEUE_WAIT", defaultCascadeRateLimitQueueWait)
+
+	config.Subscriptions.StorePath = getEnvOrDefault[string]("SUBSCRIPTIONS_STORE_PATH", defaultSubscriptionsStorePath)
+	config.Subscriptions.CheckInterval = getEnvOrDefault[time.Duration]("SUBSCRIPTIONS_CHECK_INTERVAL", defaultSubscriptionsCheckInterval)
+	config.Subscriptions.Workers = getEnvOrDefault[int]("SUBSCRIPTIONS_WORKERS", defaultSubscriptionsWorkers)
+	config.Subscriptions.MaxSubscriptions = getEnvOrDefault[int]("SUBSCRIPTIONS_MAX_SUBSCRIPTIONS", defaultSubscriptionsMaxSubscriptions)
+	config.Subscriptions.TTL = getEnvOrDefault[time.Duration]("SUBSCRIPTIONS_TTL", defaultSubscriptionsTTL)
+	config.Subscriptions.CallbackTimeout = getEnvOrDefault[time.Duration]("SUBSCRIPTIONS_CALLBACK_TIMEOUT", defaultSubscriptionsCallbackTimeout)
+
+	config.Audit.Interval = getEnvOrDefault[time.Duration]("AUDIT_INTERVAL", defaultAuditInterval)
+	config.Audit.SampleRate = getEnvOrDefault[float64]("AUDIT_SAMPLE_RATE", defaultAuditSampleRate)
+	config.Audit.MaxSamples = getEnvOrDefault[int]("AUDIT_MAX_SAMPLES", defaultAuditMaxSamples)
+	config.Audit.BatchSize = getEnvOrDefault[int]("AUDIT_BATCH_SIZE", defaultAuditBatchSize)
+
+	config.Canary.Probes = getEnvOrDefault[string]("CANARY_PROBES", defaultCanaryProbes)
+	config.Canary.Interval = getEnvOrDefault[time.Duration]("CANARY_INTERVAL", defaultCanaryInterval)
+
+	config.Ingest.Interval = getEnvOrDefault[time.Duration]("INGEST_INTERVAL", defaultIngestInterval)
+	config.Ingest.MaxLag = getEnvOrDefault[time.Duration]("INGEST_MAX_LAG", defaultIngestMaxLag)
+
+	config.CertExpiry.Interval = getEnvOrDefault[time.Duration]("CERT_EXPIRY_INTERVAL", defaultCertExpiryInterval)
+	config.CertExpiry.Window = getEnvOrDefault[time.Duration]("CERT_EXPIRY_WINDOW", defaultCertExpiryWindow)
+
+	config.Mirror.Target = getEnvOrDefault[string]("MIRROR_TARGET", defaultMirrorTarget)
+	config.Mirror.SampleRate = getEnvOrDefault[float64]("MIRROR_SAMPLE_RATE", defaultMirrorSampleRate)
+	config.Mirror.Paths = getEnvOrDefault[string]("MIRROR_PATHS", defaultMirrorPaths)
+	config.Mirror.Methods = getEnvOrDefault[string]("MIRROR_METHODS", defaultMirrorMethods)
+	config.Mirror.MaxQPS = getEnvOrDefault[float64]("MIRROR_MAX_QPS", defaultMirrorMaxQPS)
+
+	config.Experiment.Path = getEnvOrDefault[string]("EXPERIMENT_PATH", defaultExperimentPath)
+
+	config.Cache.MaxEntries = getEnvOrDefault[int]("CACHE_MAX_ENTRIES", defaultCacheMaxEntries)
+	config.Cache.TTL = getEnvOrDefault[time.Duration]("CACHE_TTL", defaultCacheTTL)
+	config.Cache.RevalidateWindow = getEnvOrDefault[time.Duration]("CACHE_REVALIDATE_WINDOW", defaultCacheRevalidateWindow)
+	config.Cache.StaleWindow = getEnvOrDefault[time.Duration]("CACHE_STALE_WINDOW", defaultCacheStaleWindow)
+
+	config.Delegated.CacheTTL = getEnvOrDefault[time.Duration]("DELEGATED_CACHE_TTL", defaultDelegatedCacheTTL)
+	config.Delegated.CacheMaxEntries = getEnvOrDefault[int]("DELEGATED_CACHE_MAX_ENTRIES", defaultDelegatedCacheMaxEntries)
+	config.Delegated.MaxAge = getEnvOrDefault[time.Duration]("DELEGATED_MAX_AGE", defaultDelegatedMaxAge)
+	config.Delegated.NotFoundMaxAge = getEnvOrDefault[time.Duration]("DELEGATED_NOT_FOUND_MAX_AGE", defaultDelegatedNotFoundMaxAge)
+
+	config.Negative.Window = getEnvOrDefault[time.Duration]("NEGATIVE_WINDOW", defaultNegativeWindow)
+	config.Negative.Bits = getEnvOrDefault[int]("NEGATIVE_BITS", defaultNegativeBits)
+	config.Negative.Hashes = getEnvOrDefault[int]("NEGATIVE_HASHES", defaultNegativeHashes)
+	config.Negative.Peers = getEnvOrDefault[string]("NEGATIVE_PEERS", defaultNegativePeers)
+	config.Negative.SyncInterval = getEnvOrDefault[time.Duration]("NEGATIVE_SYNC_INTERVAL", defaultNegativeSyncInterval)
+
+	config.Cluster.Peers = getEnvOrDefault[string]("CLUSTER_PEERS", defaultClusterPeers)
+	config.Cluster.Interval = getEnvOrDefault[time.Duration]("CLUSTER_INTERVAL", defaultClusterInterval)
+
+	config.RateLimit.PerIP = getEnvOrDefault[int]("RATELIMIT_PER_IP", defaultRateLimitPerIP)
+	config.RateLimit.PerKey = getEnvOrDefault[int]("RATELIMIT_PER_KEY", defaultRateLimitPerKey)
+	config.RateLimit.Window = getEnvOrDefault[time.Duration]("RATELIMIT_WINDOW", defaultRateLimitWindow)
+	config.RateLimit.SyncInterval = getEnvOrDefault[time.Duration]("RATELIMIT_SYNC_INTERVAL", defaultRateLimitSyncInterval)
+	config.InflightLimit.PerIP = getEnvOrDefault[int]("INFLIGHT_LIMIT_PER_IP", defaultInflightLimitPerIP)
+	config.InflightLimit.PerKey = getEnvOrDefault[int]("INFLIGHT_LIMIT_PER_KEY", defaultInflightLimitPerKey)
+
+	config.Leader.Lease = getEnvOrDefault[string]("LEADER_LEASE", defaultLeaderLease)
+	config.Leader.Identity = getEnvOrDefault[string]("LEADER_IDENTITY", defaultLeaderIdentity)
+	config.Leader.APIServer = getEnvOrDefault[string]("LEADER_API_SERVER", defaultLeaderAPIServer)
+	config.Leader.LeaseDuration = getEnvOrDefault[time.Duration]("LEADER_LEASE_DURATION", defaultLeaderLeaseDuration)
+	config.Leader.RenewInterval = getEnvOrDefault[time.Duration]("LEADER_RENEW_INTERVAL", defaultLeaderRenewInterval)
+
+	config.Shard.Replicas = getEnvOrDefault[int]("SHARD_REPLICAS", defaultShardReplicas)
+
+	config.Priority.Default = getEnvOrDefault[string]("PRIORITY_DEFAULT", defaultPriorityDefault)
+	config.Priority.Keys = getEnvOrDefault[string]("PRIORITY_KEYS", defaultPriorityKeys)
+	config.Priority.LoadThreshold = getEnvOrDefault[int]("PRIORITY_LOAD_THRESHOLD", defaultPriorityLoadThreshold)
+	config.Priority.ShedThreshold = getEnvOrDefault[int]("PRIORITY_SHED_THRESHOLD", defaultPriorityShedThreshold)
+	config.Priority.LowMaxWait = getEnvOrDefault[time.Duration]("PRIORITY_LOW_MAX_WAIT", defaultPriorityLowMaxWait)
+
+	config.MaxWait.Keys = getEnvOrDefault[string]("MAX_WAIT_KEYS", defaultMaxWaitKeys)
+	config.MaxWait.Min = getEnvOrDefault[time.Duration]("MAX_WAIT_MIN", defaultMaxWaitMin)
+	config.MaxWait.Max = getEnvOrDefault[time.Duration]("MAX_WAIT_MAX", defaultMaxWaitMax)
+
+	config.Deadline.Percentile = getEnvOrDefault[float64]("DEADLINE_PERCENTILE", defaultDeadlinePercentile)
+	config.Deadline.Margin = getEnvOrDefault[time.Duration]("DEADLINE_MARGIN", defaultDeadlineMargin)
+	config.Deadline.Min = getEnvOrDefault[time.Duration]("DEADLINE_MIN", defaultDeadlineMin)
+	config.Deadline.Max = getEnvOrDefault[time.Duration]("DEADLINE_MAX", defaultDeadlineMax)
+	config.Deadline.Samples = getEnvOrDefault[int]("DEADLINE_SAMPLES", defaultDeadlineSamples)
+
+	config.Usage.Retention = getEnvOrDefault[time.Duration]("USAGE_RETENTION", defaultUsageRetention)
+	config.Usage.Bucket = getEnvOrDefault[time.Duration]("USAGE_BUCKET", defaultUsageBucket)
+	config.Usage.IPv4Prefix = getEnvOrDefault[int]("USAGE_IPV4_PREFIX", defaultUsageIPv4Prefix)
+	config.Usage.IPv6Prefix = getEnvOrDefault[int]("USAGE_IPV6_PREFIX", defaultUsageIPv6Prefix)
+
+	config.Chaos.Backends = getEnvOrDefault[string]("CHAOS_BACKENDS", defaultChaosBackends)
+	config.Chaos.Latency = getEnvOrDefault[time.Duration]("CHAOS_LATENCY", defaultChaosLatency)
+	config.Chaos.DropRate = getEnvOrDefault[float64]("CHAOS_DROP_RATE", defaultChaosDropRate)
+	config.Chaos.ErrorRate = getEnvOrDefault[float64]("CHAOS_ERROR_RATE", defaultChaosErrorRate)
+
+	config.Capture.Path = getEnvOrDefault[string]("CAPTURE_PATH", defaultCapturePath)
+	config.Capture.SampleRate = getEnvOrDefault[float64]("CAPTURE_SAMPLE_RATE", defaultCaptureSampleRate)
+
+	config.Analytics.Sink = getEnvOrDefault[string]("ANALYTICS_SINK", defaultAnalyticsSink)
+	config.Analytics.Salt = getEnvOrDefault[string]("ANALYTICS_SALT", defaultAnalyticsSalt)
+	config.Analytics.BatchSize = getEnvOrDefault[int]("ANALYTICS_BATCH_SIZE", defaultAnalyticsBatchSize)
+	config.Analytics.FlushInterval = getEnvOrDefault[time.Duration]("ANALYTICS_FLUSH_INTERVAL", defaultAnalyticsFlushInterval)
+	config.Analytics.QueueSize = getEnvOrDefault[int]("ANALYTICS_QUEUE_SIZE", defaultAnalyticsQueueSize)
+
+	config.Snapshot.Path = getEnvOrDefault[string]("SNAPSHOT_PATH", defaultSnapshotPath)
+	config.Snapshot.Interval = getEnvOrDefault[time.Duration]("SNAPSHOT_INTERVAL", defaultSnapshotInterval)
+
+	config.Policy.Path = getEnvOrDefault[string]("POLICY_PATH", defaultPolicyPath)
+	config.Policy.DefaultAction = getEnvOrDefault[string]("POLICY_DEFAULT_ACTION", defaultPolicyDefaultAction)
+	config.Policy.TrustForwardedFor = getEnvOrDefault[bool]("POLICY_TRUST_FORWARDED_FOR", defaultPolicyTrustForwardedFor)
+
+	config.Index.TemplateDir = getEnvOrDefault[string]("INDEX_TEMPLATE_DIR", defaultIndexTemplateDir)
+	config.Index.NetworkName = getEnvOrDefault[string]("INDEX_NETWORK_NAME", defaultIndexNetworkName)
+	config.Index.DocsLinks = getEnvOrDefault[string]("INDEX_DOCS_LINKS", defaultIndexDocsLinks)
+	config.Index.Vars = getEnvOrDefault[string]("INDEX_VARS", defaultIndexVars)
+	config.Index.CacheTTL = getEnvOrDefault[time.Duration]("INDEX_CACHE_TTL", defaultIndexCacheTTL)
+	config.Providers.Scatter = getEnvOrDefault[bool]("PROVIDERS_SCATTER", defaultProvidersScatter)
+	config.Providers.CacheRefreshInterval = getEnvOrDefault[time.Duration]("PROVIDERS_CACHE_REFRESH_INTERVAL", defaultProvidersCacheRefreshInterval)
+	config.Providers.CacheTTL = getEnvOrDefault[time.Duration]("PROVIDERS_CACHE_TTL", defaultProvidersCacheTTL)
+	config.Providers.CachePreload = getEnvOrDefault[bool]("PROVIDERS_CACHE_PRELOAD", defaultProvidersCachePreload)
+	config.Providers.CacheMaxSize = getEnvOrDefault[int]("PROVIDERS_CACHE_MAX_SIZE", defaultProvidersCacheMaxSize)
+	config.Providers.ExpandExtended = getEnvOrDefault[bool]("PROVIDERS_EXPAND_EXTENDED", defaultProvidersExpandExtended)
+	config.Providers.MergePolicy = getEnvOrDefault[string]("PROVIDERS_MERGE_POLICY", defaultProvidersMergePolicy)
+	config.Providers.PreferredSource = getEnvOrDefault[string]("PROVIDERS_PREFERRED_SOURCE", defaultProvidersPreferredSource)
+
+	config.ReadYourWrites.TTL = getEnvOrDefault[time.Duration]("READ_YOUR_WRITES_TTL", defaultReadYourWritesTTL)
+
+	config.Reputation.Source = getEnvOrDefault[string]("REPUTATION_SOURCE", defaultReputationSource)
+	config.Reputation.RefreshInterval = getEnvOrDefault[time.Duration]("REPUTATION_REFRESH_INTERVAL", defaultReputationRefreshInterval)
+	config.Reputation.DefaultScore = getEnvOrDefault[float64]("REPUTATION_DEFAULT_SCORE", defaultReputationDefaultScore)
+	config.Reputation.MinScore = getEnvOrDefault[float64]("REPUTATION_MIN_SCORE", defaultReputationMinScore)
+}
+
+func getEnvOrDefault[T any](key string, def T) T {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	switch any(def).(type) {
+	case int:
+		pv, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			log.Warnf("Failed to parse %s=%s environment variable as int. Falling back on default %v", key, v, def)
+			return def
+		}
+		return any(int(pv)).(T)
+	case int64:
+		pv, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Warnf("Failed to parse %s=%s environment variable as int64. Falling back on default %v", key, v, def)
+			return def
+		}
+		return any(pv).(T)
+	case time.Duration:
+		pv, err := time.ParseDuration(v)
+		if err != nil {
+			log.Warnf("Failed to parse %s=%s environment variable as time.Duration. Falling back on default %v", key, v, def)
+			return def
+		}
+		return any(pv).(T)
+	case float64:
+		pv, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Warnf("Failed to parse %s=%s environment variable as float64. Falling back on default %v", key, v, def)
+			return def
+		}
+		return any(pv).(T)
+	case bool:
+		pv, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Warnf("Failed to parse %s=%s environment variable as bool. Falling back on default %v", key, v, def)
+			return def
+		}
+		return any(pv).(T)
+	case string:
+		if v == "" {
+			return def
+		}
+		return any(v).(T)
+	default:
+		log.Warnf("Unknown type for %s=%s environment variable. Falling back on default %v", key, v, def)
+		return def
+	}
+}
+
+var (
+	ErrNotInitialized = errors.New("not initialized")
+)
+
+// Path returns the config file path relative to the configuration root. If an
+// empty string is provided for `configRoot`, the default root is used. If
+// configFile is an absolute path, then configRoot is ignored.
+func Path(configRoot, configFile string) (string, error) {
+	var err error
+	if configFile == "" {
+		configFile = DefaultConfigFile
+	} else {
+		configFile, err = expandHome(configFile)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(configFile) {
+			return filepath.Clean(configFile), nil
+		}
+	}
+	if configRoot == "" {
+		configRoot, err = PathRoot()
+	} else {
+		configRoot, err = expandHome(configRoot)
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configRoot, configFile), nil
+}
+
+// PathRoot returns the default configuration root directory.
+func PathRoot() (string, error) {
+	dir := os.Getenv(EnvDir)
+	if dir == "" {
+		dir = DefaultPathRoot
+	}
+	return expandHome(dir)
+}
+
+// Backend types that may be specified in BackendConfig.
+const (
+	BackendTypeRegular   = "regular"
+	BackendTypeCascade   = "cascade"
+	BackendTypeDH        = "dh"
+	BackendTypeProviders = "providers"
+
+	proxyDirect = "direct"
+)
+
+// BackendConfig captures the configuration of a single backend. Any
+// zero-valued setting falls back on the corresponding global server setting.
+type BackendConfig struct {
+	URL string
+	// Type is the type of backend, one of regular, cascade, dh or providers.
+	// Defaults to regular if unspecified.
+	Type                string `json:",omitempty"`
+	MaxIdleConns        int    `json:",omitempty"`
+	MaxConnsPerHost     int    `json:",omitempty"`
+	MaxIdleConnsPerHost int    `json:",omitempty"`
+	// HttpClientTimeout, DialerTimeout and DialerKeepAlive override the
+	// corresponding server settings for requests to the backend, e.g. to
+	// allow a distant backend longer than a local one. Specified as Go
+	// duration strings, such as "45s".
+	HttpClientTimeout Duration `json:",omitempty"`
+	DialerTimeout     Duration `json:",omitempty"`
+	DialerKeepAlive   Duration `json:",omitempty"`
+	// DialerFallbackDelay and DialerPreferredFamily override the
+	// corresponding server settings for dials to the backend, e.g. to
+	// prefer IPv4 for a backend whose IPv6 path is known to be broken.
+	DialerFallbackDelay   Duration `json:",omitempty"`
+	DialerPreferredFamily string   `json:",omitempty"`
+	// Proxy is the URL of the egress proxy through which the backend is
+	// reached, with http, https, socks5 or socks5h scheme. Set to "direct" to
+	// bypass any proxy configured via environment variables.
+	Proxy string `json:",omitempty"`
+	// SigningSecret is the shared secret with which requests to the backend
+	// are signed using HMAC-SHA256. Requests are not signed if unspecified.
+	SigningSecret string `json:",omitempty"`
+	// Match restricts the requests the backend is queried for. Cascade
+	// backends must match both this and the configured cascade labels.
+	Match *MatcherConfig `json:",omitempty"`
+	// ReplicaGroup names the group of equivalent backends that this backend
+	// is a replica of. When shard affinity is enabled, each lookup is only
+	// sent to the configured number of replicas of each group.
+	ReplicaGroup string `json:",omitempty"`
+	// MaxQPS bounds the rate of lookups cascaded to a cascade backend,
+	// overriding the configured cascade rate limit. Unbounded if negative.
+	MaxQPS float64 `json:",omitempty"`
+}
+
+// UnmarshalJSON allows a backend to be specified either as a plain URL string
+// or as a JSON object.
+func (bc *BackendConfig) UnmarshalJSON(data []byte) error {
+	var u string
+	if err := json.Unmarshal(data, &u); err == nil {
+		*bc = BackendConfig{URL: u}
+		return nil
+	}
+	type plain BackendConfig
+	return json.Unmarshal(data, (*plain)(bc))
+}
+
+// Duration is a time.Duration specified in the config file either as a Go
+// duration string or as a number of nanoseconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+// FileConfig is the content of the config file.
+type FileConfig struct {
+	Backends []BackendConfig
+	// Log configures logging. Logging is configured via env vars only if nil.
+	Log *LogConfig `json:",omitempty"`
+	// Tenants are served alongside the backends above, which serve requests
+	// addressed to no tenant.
+	Tenants []TenantConfig `json:",omitempty"`
+}
+
+// UnmarshalJSON allows the config file to be either a JSON array of backends,
+// or a JSON object.
+func (fc *FileConfig) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		*fc = FileConfig{}
+		return json.Unmarshal(trimmed, &fc.Backends)
+	}
+	type plain FileConfig
+	return json.Unmarshal(data, (*plain)(fc))
+}
+
+// Load reads the backends from the config file at the given path. See
+// LoadFile.
+func Load(filePath string) ([]BackendConfig, error) {
+	fc, err := LoadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return fc.Backends, nil
+}
+
+// LoadFile reads the config file at the given path. The config file is either
+// a JSON array of backends or a FileConfig object, where each backend is
+// either a backend URL or a BackendConfig object.
+func LoadFile(filePath string) (*FileConfig, error) {
+	var err error
+	if filePath == "" {
+		filePath, err = Path("", "")
+	} else {
+		filePath, err = expandHome(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotInitialized
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var fc FileConfig
+	if err = json.NewDecoder(f).Decode(&fc); err != nil {
+		return nil, err
+	}
+	if err := defaultBackendTypes(fc.Backends); err != nil {
+		return nil, err
+	}
+	for i := range fc.Tenants {
+		if err := fc.Tenants[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &fc, nil
+}
+
+// defaultBackendTypes checks that the given backends are of known types, and
+// defaults their type to regular if unspecified.
+func defaultBackendTypes(cfgs []BackendConfig) error {
+	for i, b := range cfgs {
+		switch b.Type {
+		case "":
+			cfgs[i].Type = BackendTypeRegular
+		case BackendTypeRegular, BackendTypeCascade, BackendTypeDH, BackendTypeProviders:
+		default:
+			return fmt.Errorf("unknown type %q for backend %s", b.Type, b.URL)
+		}
+	}
+	return nil
+}
+
+// expandHome expands the path to include the home directory if the path is
+// prefixed with `~`. If it isn't prefixed with `~`, the path is returned
+// as-is.
+func expandHome(path string) (string, error) {
+	if path == "" {
+		return path, nil
+	}
+
+	if path[0] != '~' {
+		return path, nil
+	}
+
+	if len(path) > 1 && path[1] != '/' && path[1] != '\\' {
+		return "", errors.New("cannot expand user-specific home dir")
+	}
+
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, path[1:]), nil
+}
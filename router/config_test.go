@@ -0,0 +1,76 @@
+package router
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DefaultConfig(t *testing.T) {
+	require.Equal(t, defaultServerMaxIdleConns, config.Server.MaxIdleConns)
+	require.Equal(t, defaultServerMaxConnsPerHost, config.Server.MaxConnsPerHost)
+	require.Equal(t, defaultServerMaxIdleConnsPerHost, config.Server.MaxIdleConnsPerHost)
+	require.Equal(t, defaultServerHttpClientTimeout, config.Server.HttpClientTimeout)
+	require.Equal(t, defaultServerMaxRequestBodySize, config.Server.MaxRequestBodySize)
+	require.Equal(t, defaultServerCascadeLabels, config.Server.CascadeLabels)
+}
+
+func Test_LoadBackendConfigs(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfgPath, []byte(`[
+		"https://fish.invalid",
+		{"URL": "https://lobster.invalid", "Type": "cascade", "MaxConnsPerHost": 7, "HttpClientTimeout": "1m30s", "DialerTimeout": 5000000000}
+	]`), 0o600)
+	require.NoError(t, err)
+
+	got, err := Load(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t, []BackendConfig{
+		{URL: "https://fish.invalid", Type: BackendTypeRegular},
+		{URL: "https://lobster.invalid", Type: BackendTypeCascade, MaxConnsPerHost: 7, HttpClientTimeout: Duration(90 * time.Second), DialerTimeout: Duration(5 * time.Second)},
+	}, got)
+
+	err = os.WriteFile(cfgPath, []byte(`[{"URL": "https://fish.invalid", "DialerTimeout": "soon"}]`), 0o600)
+	require.NoError(t, err)
+	_, err = Load(cfgPath)
+	require.Error(t, err)
+
+	err = os.WriteFile(cfgPath, []byte(`[{"URL": "https://fish.invalid", "Type": "undersea"}]`), 0o600)
+	require.NoError(t, err)
+	_, err = Load(cfgPath)
+	require.ErrorContains(t, err, "unknown type")
+}
+
+func Test_LoadFileConfig(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfgPath, []byte(`{
+		"Backends": ["https://fish.invalid"],
+		"Log": {"Format": "json", "Levels": {"indexstar/mux": "debug"}},
+		"Tenants": [{"Name": "testnet", "PathPrefix": "/testnet", "Backends": ["https://lobster.invalid"]}]
+	}`), 0o600)
+	require.NoError(t, err)
+
+	got, err := LoadFile(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t, &FileConfig{
+		Backends: []BackendConfig{{URL: "https://fish.invalid", Type: BackendTypeRegular}},
+		Log:      &LogConfig{Format: "json", Levels: map[string]string{"indexstar/mux": "debug"}},
+		Tenants: []TenantConfig{{
+			Name:       "testnet",
+			PathPrefix: "/testnet",
+			Backends:   []BackendConfig{{URL: "https://lobster.invalid", Type: BackendTypeRegular}},
+		}},
+	}, got)
+
+	backends, err := Load(cfgPath)
+	require.NoError(t, err)
+	require.Equal(t, got.Backends, backends)
+
+	err = os.WriteFile(cfgPath, []byte(`["https://fish.invalid", 7]`), 0o600)
+	require.NoError(t, err)
+	_, err = LoadFile(cfgPath)
+	require.ErrorContains(t, err, "cannot unmarshal number")
+}
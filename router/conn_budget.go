@@ -0,0 +1,94 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errOutboundConnBudget is returned by dials to backends while the outbound
+// connection budget is exhausted and its queue is full or waited on for too
+// long.
+var errOutboundConnBudget = errors.New("outbound connection budget exhausted")
+
+// outboundConns returns the budget of connections open to all backends,
+// shared by the transports of every backend, as configured when first used.
+var outboundConns = sync.OnceValue(func() *connBudget {
+	return newConnBudget(config.Server.MaxOutboundConns, config.Server.OutboundConnQueueSize, config.Server.OutboundConnQueueTimeout)
+})
+
+// connBudget bounds the number of connections open at once to its limit, if
+// positive. Dials beyond the budget wait in a short bounded queue for a
+// connection to close, and fail fast once the queue is full or waited on for
+// longer than the queue timeout.
+type connBudget struct {
+	limit        int
+	queueSize    int
+	queueTimeout time.Duration
+
+	mu   sync.Mutex
+	open int
+	// waiters are the dials waiting for a connection to close, in the order
+	// they arrived. A connection closing hands its slot to the first waiter
+	// by closing its channel.
+	waiters []chan struct{}
+}
+
+func newConnBudget(limit, queueSize int, queueTimeout time.Duration) *connBudget {
+	return &connBudget{limit: limit, queueSize: queueSize, queueTimeout: queueTimeout}
+}
+
+// acquire takes a slot of the budget for a connection about to be dialed,
+// waiting in the queue for one if the budget is exhausted. Slots must be
+// released once the connection closes or the dial fails.
+func (b *connBudget) acquire(ctx context.Context) error {
+	b.mu.Lock()
+	if b.limit <= 0 || (b.open < b.limit && len(b.waiters) == 0) {
+		b.open++
+		b.mu.Unlock()
+		return nil
+	}
+	if len(b.waiters) >= b.queueSize {
+		b.mu.Unlock()
+		return errOutboundConnBudget
+	}
+	ready := make(chan struct{})
+	b.waiters = append(b.waiters, ready)
+	b.mu.Unlock()
+
+	timer := time.NewTimer(b.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = errOutboundConnBudget
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, w := range b.waiters {
+		if w == ready {
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			return err
+		}
+	}
+	// The slot was handed over while giving up on it, and is now held.
+	return nil
+}
+
+// release returns the slot of a closed connection or failed dial, handing it
+// to the first dial waiting if any.
+func (b *connBudget) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.waiters) > 0 && b.open <= b.limit {
+		close(b.waiters[0])
+		b.waiters = b.waiters[1:]
+		return
+	}
+	b.open--
+}
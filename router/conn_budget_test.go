@@ -0,0 +1,73 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnBudget_QueuesThenFailsFast(t *testing.T) {
+	b := newConnBudget(2, 1, time.Minute)
+	ctx := context.Background()
+	require.NoError(t, b.acquire(ctx))
+	require.NoError(t, b.acquire(ctx))
+
+	queued := make(chan error)
+	go func() { queued <- b.acquire(ctx) }()
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.waiters) == 1
+	}, time.Second, time.Millisecond)
+	// The queue is full, so further dials fail fast.
+	require.ErrorIs(t, b.acquire(ctx), errOutboundConnBudget)
+
+	// Closing a connection hands its slot to the queued dial.
+	b.release()
+	require.NoError(t, <-queued)
+	require.Equal(t, 2, b.open)
+
+	b.queueTimeout = 10 * time.Millisecond
+	require.ErrorIs(t, b.acquire(ctx), errOutboundConnBudget)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, b.acquire(cctx), context.Canceled)
+	require.Empty(t, b.waiters)
+
+	b.release()
+	b.release()
+	require.Zero(t, b.open)
+}
+
+func TestNewBackendClient_RespectsOutboundConnBudget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer backend.Close()
+	budget := newConnBudget(1, 0, 0)
+	first, err := NewBackendClient(BackendConfig{URL: backend.URL})
+	require.NoError(t, err)
+	first.Transport.(*instrumentedTransport).budget = budget
+	second, err := NewBackendClient(BackendConfig{URL: backend.URL})
+	require.NoError(t, err)
+	second.Transport.(*instrumentedTransport).budget = budget
+
+	resp, err := first.Get(backend.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	// The idle connection of the first client takes up the budget.
+	_, err = second.Get(backend.URL)
+	require.ErrorIs(t, err, errOutboundConnBudget)
+
+	first.CloseIdleConnections()
+	require.Eventually(t, func() bool {
+		resp, err := second.Get(backend.URL)
+		if err != nil {
+			return false
+		}
+		return resp.Body.Close() == nil
+	}, time.Second, 10*time.Millisecond)
+	second.CloseIdleConnections()
+}
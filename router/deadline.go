@@ -0,0 +1,123 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// Routes whose backend deadlines are tuned separately, since their backend
+// latencies differ.
+const (
+	routeFind       = "find"
+	routeFindStream = "find_stream"
+	routeMetadata   = "metadata"
+)
+
+const (
+	// deadlineMinSamples is the number of latencies observed on a route before
+	// its deadline is tuned.
+	deadlineMinSamples = 100
+	// deadlineUpdateEvery is the number of latencies observed between
+	// recomputing the deadline of a route.
+	deadlineUpdateEvery = 16
+)
+
+// latencyTracker tunes the backend deadline of a route to the latency
+// recently observed from its backends, so that a deadline chosen once neither
+// truncates results once backends slow down nor waits longer than needed
+// while they are fast.
+//
+// The tuned deadline is the configured percentile of the most recent
+// latencies plus a margin, bounded by the configured minimum and maximum.
+// Backends that time out are observed as taking the full deadline, so that
+// the deadline grows back towards its maximum when backends slow down. The
+// configured deadline is used until enough latencies are observed.
+type latencyTracker struct {
+	route      string
+	percentile float64
+	margin     time.Duration
+	min        time.Duration
+	max        time.Duration
+
+	mu          sync.Mutex
+	samples     []time.Duration
+	next        int
+	sinceUpdate int
+	tuned       atomic.Int64
+}
+
+// newLatencyTrackers instantiates a latencyTracker per route.
+func newLatencyTrackers() (map[string]*latencyTracker, error) {
+	if p := config.Deadline.Percentile; p <= 0 || p > 1 {
+		return nil, fmt.Errorf("deadline percentile must be within (0, 1], got %v", p)
+	}
+	if config.Deadline.Samples <= 0 {
+		return nil, fmt.Errorf("deadline samples must be positive, got %d", config.Deadline.Samples)
+	}
+	trackers := make(map[string]*latencyTracker)
+	for _, route := range []string{routeFind, routeFindStream, routeMetadata} {
+		trackers[route] = &latencyTracker{
+			route:      route,
+			percentile: config.Deadline.Percentile,
+			margin:     config.Deadline.Margin,
+			min:        config.Deadline.Min,
+			max:        config.Deadline.Max,
+			samples:    make([]time.Duration, 0, config.Deadline.Samples),
+		}
+	}
+	return trackers, nil
+}
+
+// maxWait returns the tuned deadline, or the given configured deadline if
+// not yet tuned. The configured deadline is the maximum unless a maximum is
+// configured. A nil tracker always returns the configured deadline.
+func (t *latencyTracker) maxWait(configured time.Duration) time.Duration {
+	if t == nil {
+		return configured
+	}
+	tuned := time.Duration(t.tuned.Load())
+	if tuned == 0 {
+		return configured
+	}
+	upper := t.max
+	if upper <= 0 {
+		upper = configured
+	}
+	return min(max(tuned, t.min), upper)
+}
+
+// record observes the given latency of a backend.
+func (t *latencyTracker) record(latency time.Duration) {
+	t.mu.Lock()
+	if len(t.samples) < cap(t.samples) {
+		t.samples = append(t.samples, latency)
+	} else {
+		t.samples[t.next] = latency
+		t.next = (t.next + 1) % len(t.samples)
+	}
+	t.sinceUpdate++
+	if t.sinceUpdate < deadlineUpdateEvery || len(t.samples) < min(deadlineMinSamples, cap(t.samples)) {
+		t.mu.Unlock()
+		return
+	}
+	t.sinceUpdate = 0
+	sorted := slices.Clone(t.samples)
+	t.mu.Unlock()
+
+	slices.Sort(sorted)
+	i := int(math.Ceil(t.percentile*float64(len(sorted)))) - 1
+	tuned := sorted[max(i, 0)] + t.margin
+	t.tuned.Store(int64(tuned))
+	_ = stats.RecordWithOptions(context.Background(),
+		stats.WithTags(tag.Insert(metrics.Route, t.route)),
+		stats.WithMeasurements(metrics.TunedDeadline.M(float64(tuned.Milliseconds()))))
+}
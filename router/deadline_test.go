@@ -0,0 +1,106 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLatencyTracker(t *testing.T, percentile float64, samples int) *latencyTracker {
+	defer func(old float64) { config.Deadline.Percentile = old }(config.Deadline.Percentile)
+	defer func(old time.Duration) { config.Deadline.Margin = old }(config.Deadline.Margin)
+	defer func(old time.Duration) { config.Deadline.Min = old }(config.Deadline.Min)
+	defer func(old int) { config.Deadline.Samples = old }(config.Deadline.Samples)
+	config.Deadline.Percentile = percentile
+	config.Deadline.Margin = 10 * time.Millisecond
+	config.Deadline.Min = 50 * time.Millisecond
+	config.Deadline.Samples = samples
+	trackers, err := newLatencyTrackers()
+	require.NoError(t, err)
+	return trackers[routeFind]
+}
+
+func TestLatencyTracker_TunesToPercentile(t *testing.T) {
+	subject := newTestLatencyTracker(t, 0.9, 200)
+
+	// The configured deadline is used until enough latencies are observed.
+	for i := 1; i < deadlineMinSamples; i++ {
+		subject.record(time.Duration(i) * time.Millisecond)
+	}
+	require.Equal(t, 5*time.Second, subject.maxWait(5*time.Second))
+	subject.record(100 * time.Millisecond)
+	require.Equal(t, 100*time.Millisecond, subject.maxWait(5*time.Second))
+	require.Equal(t, 80*time.Millisecond, subject.maxWait(80*time.Millisecond))
+
+	// Deadlines shrink once backends speed up, down to the minimum.
+	for range 200 {
+		subject.record(time.Millisecond)
+	}
+	require.Equal(t, 50*time.Millisecond, subject.maxWait(5*time.Second))
+
+	// Deadlines grow once backends slow down, up to the configured maximum.
+	subject.max = 3 * time.Second
+	for range 200 {
+		subject.record(5 * time.Second)
+	}
+	require.Equal(t, 3*time.Second, subject.maxWait(time.Second))
+
+	var nilTracker *latencyTracker
+	require.Equal(t, time.Second, nilTracker.maxWait(time.Second))
+}
+
+func TestNewLatencyTrackers_RejectsInvalidPercentile(t *testing.T) {
+	defer func(old float64) { config.Deadline.Percentile = old }(config.Deadline.Percentile)
+	config.Deadline.Percentile = 1.5
+	_, err := newLatencyTrackers()
+	require.Error(t, err)
+}
+
+func TestScatterGather_ObservesLatencyOfQueriedBackends(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	latency := newTestLatencyTracker(t, 0.99, 10)
+	subject := scatterGather[Backend, string]{
+		backends: []Backend{testBackend(1), testBackend(2), caskadeBackend{Backend: testBackend(3)}},
+		maxWait:  50 * time.Millisecond,
+		latency:  latency,
+	}
+
+	err := subject.scatter(context.Background(), func(cctx context.Context, b Backend) (*string, error) {
+		path := "/"
+		if b == testBackend(2) {
+			// Skipped backends are not observed.
+			return nil, nil
+		} else if b == testBackend(1) {
+			path = "/slow"
+		}
+		req, err := http.NewRequestWithContext(cctx, http.MethodGet, backend.URL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return nil, nil
+	})
+	require.NoError(t, err)
+	for range subject.gather(context.Background()) {
+	}
+
+	// Only the backend that timed out is observed, since cascade backends
+	// are not tuned.
+	latency.mu.Lock()
+	defer latency.mu.Unlock()
+	require.Len(t, latency.samples, 1)
+	require.GreaterOrEqual(t, latency.samples[0], 50*time.Millisecond)
+}
@@ -0,0 +1,234 @@
+package router
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// delegatedStaleMaxAge is how long delegated routing clients and CDNs
+	// may serve responses with providers stale, while revalidating or when
+	// indexstar fails, as recommended by the Delegated Routing V1 HTTP API
+	// spec.
+	delegatedStaleMaxAge = 48 * time.Hour
+	// delegatedCacheMaxBodySize bounds the size of each cached delegated
+	// routing response, so that a few CIDs with huge numbers of providers
+	// cannot take up the cache.
+	delegatedCacheMaxBodySize = 1 << 20 // 1MiB
+)
+
+// delegatedFilterParams are the query parameters that filter delegated
+// routing responses, which responses are cached by.
+var delegatedFilterParams = []string{"filter-addrs", "filter-protocols"}
+
+// setDelegatedCacheHeaders sets the Cache-Control and Vary headers of a
+// delegated routing response with the given status, as recommended by the
+// spec. Responses with providers may be cached longer than those without,
+// since providers are added and removed far less often than they are first
+// looked up.
+func setDelegatedCacheHeaders(w http.ResponseWriter, status int) {
+	switch status {
+	case http.StatusOK:
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d, stale-if-error=%d",
+			int(config.Delegated.MaxAge.Seconds()), int(delegatedStaleMaxAge.Seconds()), int(delegatedStaleMaxAge.Seconds())))
+	case http.StatusNotFound:
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(config.Delegated.NotFoundMaxAge.Seconds())))
+	default:
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+}
+
+// delegatedCacheKey returns the key of the delegated routing response to the
+// given request of the given multihash, in the given media type. Filter
+// parameters are keyed in sorted order, so that equivalent filters share a
+// key.
+func delegatedCacheKey(mh multihash.Multihash, encrypted bool, mediaType string, query url.Values) string {
+	var key strings.Builder
+	key.WriteString(mediaType)
+	if encrypted {
+		key.WriteString(" encrypted")
+	}
+	key.WriteByte(' ')
+	key.WriteString(mh.B58String())
+	for _, param := range delegatedFilterParams {
+		var values []string
+		for _, v := range query[param] {
+			for _, f := range strings.Split(v, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					values = append(values, f)
+				}
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		slices.Sort(values)
+		key.WriteString(" " + param + "=" + strings.Join(slices.Compact(values), ","))
+	}
+	return key.String()
+}
+
+// delegatedCache retains translated delegated routing responses, since
+// delegated routing clients such as kubo repeatedly resolve the same CIDs.
+// Responses with providers are retained for the configured TTL, and those
+// without for at most the not found max age. At most the configured number
+// of responses are retained, evicting the least recently used first.
+type delegatedCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type delegatedCacheEntry struct {
+	key         string
+	multihash   string
+	status      int
+	contentType string
+	body        []byte
+	storedAt    time.Time
+	ttl         time.Duration
+}
+
+func newDelegatedCache(maxEntries int) *delegatedCache {
+	return &delegatedCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// put retains the given response of the given multihash under the given key.
+// Responses other than found and not found are not retained.
+func (c *delegatedCache) put(key string, mh multihash.Multihash, status int, contentType string, body []byte) {
+	ttl := config.Delegated.CacheTTL
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		ttl = min(ttl, config.Delegated.NotFoundMaxAge)
+	default:
+		return
+	}
+	if ttl <= 0 || len(body) > delegatedCacheMaxBodySize {
+		return
+	}
+	entry := &delegatedCacheEntry{
+		key:         key,
+		multihash:   string(mh),
+		status:      status,
+		contentType: contentType,
+		body:        body,
+		storedAt:    time.Now(),
+		ttl:         ttl,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*delegatedCacheEntry).key)
+	}
+}
+
+// serve responds with the response retained under the given key, if any is
+// still fresh, and returns whether it did.
+func (c *delegatedCache) serve(w http.ResponseWriter, key string) bool {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return false
+	}
+	entry := e.Value.(*delegatedCacheEntry)
+	age := time.Since(entry.storedAt)
+	if age > entry.ttl {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		c.mu.Unlock()
+		return false
+	}
+	c.lru.MoveToFront(e)
+	c.mu.Unlock()
+
+	setDelegatedCacheHeaders(w, entry.status)
+	w.Header().Set(cacheStatusHeader, cacheHit)
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	if entry.status != http.StatusOK {
+		streamError(w, entry.contentType == MediaTypeNDJson, entry.status)
+		return true
+	}
+	w.Header().Set("Content-Type", entry.contentType)
+	if _, err := w.Write(entry.body); err != nil {
+		log.Debugw("Failed to write cached delegated routing response", "err", err)
+	}
+	return true
+}
+
+// purge evicts every response of the given multihash, and returns the number
+// of responses evicted.
+func (c *delegatedCache) purge(mh multihash.Multihash) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var purged int
+	for key, e := range c.entries {
+		if e.Value.(*delegatedCacheEntry).multihash == string(mh) {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// flush evicts every response and returns the number of responses evicted.
+func (c *delegatedCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := c.lru.Len()
+	clear(c.entries)
+	c.lru.Init()
+	return purged
+}
+
+// teeResponseWriter copies the response body written up to the max cached
+// body size, so that streamed responses can be cached once complete.
+type teeResponseWriter struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+	// overflow is whether the body written exceeds the max cached size.
+	overflow bool
+}
+
+func (w *teeResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if !w.overflow {
+		if w.buf.Len()+n > delegatedCacheMaxBodySize {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+func (w *teeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
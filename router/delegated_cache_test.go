@@ -0,0 +1,128 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelegatedCacheKey_NormalizesFilters(t *testing.T) {
+	c, err := cid.Decode(mockbackend.SampleCids[0])
+	require.NoError(t, err)
+	mh := c.Hash()
+
+	a := delegatedCacheKey(mh, false, MediaTypeJson, url.Values{"filter-protocols": {"unknown,transport-bitswap"}})
+	b := delegatedCacheKey(mh, false, MediaTypeJson, url.Values{"filter-protocols": {"transport-bitswap", " unknown", "unknown"}})
+	require.Equal(t, a, b)
+	require.NotEqual(t, a, delegatedCacheKey(mh, false, MediaTypeJson, nil))
+	require.NotEqual(t, a, delegatedCacheKey(mh, false, MediaTypeNDJson, url.Values{"filter-protocols": {"unknown,transport-bitswap"}}))
+	require.NotEqual(t, a, delegatedCacheKey(mh, true, MediaTypeJson, url.Values{"filter-protocols": {"unknown,transport-bitswap"}}))
+}
+
+func TestDelegated_CachesResponses(t *testing.T) {
+	defer func(old time.Duration) { config.Delegated.CacheTTL = old }(config.Delegated.CacheTTL)
+	config.Delegated.CacheTTL = time.Minute
+
+	var lookups atomic.Int32
+	sample := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/providers" {
+			lookups.Add(1)
+		}
+		sample.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	get := func(p string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get("/routing/v1/providers/" + mockbackend.SampleCids[0])
+	require.Equal(t, http.StatusOK, first.Code)
+	require.Equal(t, cacheMiss, first.Header().Get(cacheStatusHeader))
+	require.Equal(t, "public, max-age=300, stale-while-revalidate=172800, stale-if-error=172800", first.Header().Get("Cache-Control"))
+	require.Equal(t, "Accept", first.Header().Get("Vary"))
+	afterFirst := lookups.Load()
+
+	second := get("/routing/v1/providers/" + mockbackend.SampleCids[0])
+	require.Equal(t, http.StatusOK, second.Code)
+	require.Equal(t, cacheHit, second.Header().Get(cacheStatusHeader))
+	require.Equal(t, first.Header().Get("Cache-Control"), second.Header().Get("Cache-Control"))
+	require.Equal(t, first.Body.String(), second.Body.String())
+	require.Equal(t, afterFirst, lookups.Load())
+
+	missing := get("/routing/v1/providers/QmPNHBy5h7f19yJDt7ip9TvmMRbqmYsa6aetkrsc1ghjLB")
+	require.Equal(t, http.StatusNotFound, missing.Code)
+	require.Equal(t, "public, max-age=15", missing.Header().Get("Cache-Control"))
+	require.Equal(t, "Accept", missing.Header().Get("Vary"))
+}
+
+func TestDelegated_DoesNotCachePinnedResponses(t *testing.T) {
+	defer func(old time.Duration) { config.Delegated.CacheTTL = old }(config.Delegated.CacheTTL)
+	defer func(token string) { config.Server.BackendPinningToken = token }(config.Server.BackendPinningToken)
+	config.Delegated.CacheTTL = time.Minute
+	config.Server.BackendPinningToken = "fish"
+
+	populated := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer populated.Close()
+	empty := httptest.NewServer(mockbackend.New())
+	defer empty.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: populated.URL},
+			{URL: empty.URL},
+			{URL: populated.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	get := func(pinned, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/routing/v1/providers/"+mockbackend.SampleCids[0], nil)
+		req.Header.Set("Accept", accept)
+		if pinned != "" {
+			u, err := url.Parse(pinned)
+			require.NoError(t, err)
+			req.Header.Set(backendPinningHeader, u.Host)
+			req.Header.Set(backendPinningTokenHeader, "fish")
+		}
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, accept := range []string{MediaTypeJson, MediaTypeNDJson} {
+		pinned := get(empty.URL, accept)
+		require.Equal(t, http.StatusNotFound, pinned.Code, accept)
+		require.Empty(t, pinned.Header().Get(cacheStatusHeader), accept)
+		require.Equal(t, "private, no-store", pinned.Header().Get("Cache-Control"), accept)
+
+		// Unpinned requests are not answered with the response of one
+		// backend.
+		unpinned := get("", accept)
+		require.Equal(t, http.StatusOK, unpinned.Code, accept)
+		require.Equal(t, cacheMiss, unpinned.Header().Get(cacheStatusHeader), accept)
+
+		// Nor are pinned requests answered with that of every backend.
+		pinned = get(empty.URL, accept)
+		require.Equal(t, http.StatusNotFound, pinned.Code, accept)
+		require.Empty(t, pinned.Header().Get(cacheStatusHeader), accept)
+	}
+}
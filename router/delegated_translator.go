@@ -1,46 +1,64 @@
-package main
+package router
 
 import (
 	"context"
 	"encoding/json"
-	"hash/crc32"
+	"maps"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/ipfs/go-cid"
 	"github.com/ipni/go-libipni/find/model"
 	"github.com/ipni/go-libipni/metadata"
 	"github.com/ipni/indexstar/metrics"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 )
 
 const (
 	peerSchema = "peer"
+	// encryptedSchema is the schema of records returned by the encrypted
+	// route, each carrying an encrypted value key to be decrypted by the
+	// client.
+	encryptedSchema = "encrypted"
 )
 
-type findFunc func(ctx context.Context, method, source string, req *url.URL, encrypted bool) (int, []byte)
-type findStreamFunc func(ctx context.Context, method string, req *url.URL, encrypted bool) (int, chan model.ProviderResult)
+// findFunc looks up the given find request with the given body, which is nil
+// for requests without one.
+type findFunc func(ctx context.Context, method, source string, req *url.URL, body []byte, encrypted bool) (int, []byte)
+type findStreamFunc func(ctx context.Context, method string, req *url.URL, encrypted bool) (int, chan *encryptedOrPlainResult)
 
 func NewDelegatedTranslator(backend findFunc, streamingBackend findStreamFunc) (http.Handler, error) {
-	finder := delegatedTranslator{backend, streamingBackend}
+	return newDelegatedTranslator(backend, streamingBackend, nil), nil
+}
+
+// newDelegatedTranslator instantiates a delegated translator that serves
+// responses from the given cache, if non-nil.
+func newDelegatedTranslator(backend findFunc, streamingBackend findStreamFunc, cache *delegatedCache) http.Handler {
+	finder := delegatedTranslator{be: backend, sbe: streamingBackend, cache: cache}
 	m := http.NewServeMux()
 	m.HandleFunc("/providers", finder.provide)
 	m.HandleFunc("/encrypted/providers", finder.provide)
 	m.HandleFunc("/providers/", func(w http.ResponseWriter, r *http.Request) { finder.find(w, r, false) })
 	m.HandleFunc("/encrypted/providers/", func(w http.ResponseWriter, r *http.Request) { finder.find(w, r, true) })
-	return m, nil
+	return m
 }
 
 type delegatedTranslator struct {
 	be  findFunc
 	sbe findStreamFunc
+	// cache retains translated responses, if non-nil.
+	cache *delegatedCache
 }
 
 func (dt *delegatedTranslator) provide(w http.ResponseWriter, r *http.Request) {
-	_ = stats.RecordWithOptions(context.Background(),
+	_ = stats.RecordWithOptions(r.Context(),
 		stats.WithTags(tag.Insert(metrics.Method, r.Method)),
 		stats.WithMeasurements(metrics.HttpDelegatedRoutingMethod.M(1)))
 
@@ -60,7 +78,7 @@ func (dt *delegatedTranslator) provide(w http.ResponseWriter, r *http.Request) {
 }
 
 func (dt *delegatedTranslator) find(w http.ResponseWriter, r *http.Request, encrypted bool) {
-	_ = stats.RecordWithOptions(context.Background(),
+	_ = stats.RecordWithOptions(r.Context(),
 		stats.WithTags(tag.Insert(metrics.Method, r.Method)),
 		stats.WithMeasurements(metrics.HttpDelegatedRoutingMethod.M(1)))
 
@@ -86,48 +104,112 @@ func (dt *delegatedTranslator) find(w http.ResponseWriter, r *http.Request, encr
 
 	acc, err := getAccepts(r)
 	if err != nil {
-		http.Error(w, "invalid Accept header", http.StatusBadRequest)
+		httpError(w, "invalid Accept header", errCodeInvalidAccept, http.StatusBadRequest)
 		return
 	}
 
+	mediaType := MediaTypeJson
+	if acc.ndjson {
+		mediaType = MediaTypeNDJson
+	}
+	// Responses of requests scattered to backends chosen for them are partial,
+	// so are neither cached nor cacheable by clients and CDNs.
+	narrowed := narrowedBackends(r.Context())
+	setCacheHeaders := func(status int) {
+		if narrowed {
+			w.Header().Set("Cache-Control", "private, no-store")
+			return
+		}
+		setDelegatedCacheHeaders(w, status)
+	}
+	var cacheKey string
+	var mh multihash.Multihash
+	if c, err := cid.Decode(cidUrlParam); err == nil && dt.cache != nil && !narrowed {
+		mh = c.Hash()
+		cacheKey = delegatedCacheKey(mh, encrypted, mediaType, r.URL.Query())
+		if dt.cache.serve(w, cacheKey) {
+			return
+		}
+		w.Header().Set(cacheStatusHeader, cacheMiss)
+	}
+
 	switch {
 	case acc.ndjson:
 		rcode, respChan := dt.sbe(r.Context(), findMethodDelegated, uri, encrypted)
 		if rcode != http.StatusOK {
-			http.Error(w, "", rcode)
+			setCacheHeaders(rcode)
+			if cacheKey != "" {
+				dt.cache.put(cacheKey, mh, rcode, MediaTypeNDJson, nil)
+			}
+			streamError(w, true, rcode)
 			return
 		}
-		out := &drResp{}
+		var tee *teeResponseWriter
+		if cacheKey != "" {
+			tee = &teeResponseWriter{ResponseWriter: w}
+			w = tee
+		}
+		out := newDrResp()
 		hasWritten := false
-		encoder := json.NewEncoder(w)
+		var written int
+		stream := newNDJsonWriter(w)
+		defer stream.close()
 
 		for rcrd := range respChan {
 			if !hasWritten {
-				w.Header().Set("Content-Type", mediaTypeNDJson)
+				w.Header().Set("Content-Type", MediaTypeNDJson)
 				w.Header().Set("Connection", "Keep-Alive")
 				w.Header().Set("X-Content-Type-Options", "nosniff")
+				setCacheHeaders(http.StatusOK)
 				w.WriteHeader(200)
 				hasWritten = true
 			}
-			prov := drProvFromResult(rcrd)
-			// if new
-			if out.append(prov) {
-				if err := encoder.Encode(prov); err != nil {
-					return
+			var rec any
+			if len(rcrd.EncryptedValueKey) > 0 {
+				// Encrypted value keys are already deduplicated by the
+				// streaming backend.
+				rec = drEncrypted{Schema: encryptedSchema, EncryptedValueKey: rcrd.EncryptedValueKey}
+			} else {
+				prov := drProvFromResult(rcrd.ProviderResult)
+				// if new
+				if !out.append(prov) {
+					continue
 				}
+				rec = prov
 			}
+			if err := stream.write(rec); err != nil {
+				log.Debugw("Failed to write delegated routing record", "err", err)
+				return
+			}
+			written++
 		}
-		if len(out.seenProviders) == 0 {
+		if written == 0 {
 			// no response.
-			w.WriteHeader(http.StatusNotFound)
+			setCacheHeaders(http.StatusNotFound)
+			streamError(w, true, http.StatusNotFound)
+		} else if !clientGone(r.Context()) {
+			setStreamStatus(w, streamStatusOK)
+		}
+		// Streams cut short since the client went away are partial, so are
+		// not cached.
+		if tee != nil && !tee.overflow && !clientGone(r.Context()) {
+			if written == 0 {
+				dt.cache.put(cacheKey, mh, http.StatusNotFound, MediaTypeNDJson, nil)
+			} else {
+				dt.cache.put(cacheKey, mh, http.StatusOK, MediaTypeNDJson, tee.buf.Bytes())
+			}
 		}
 		return
 	default:
 	}
 
-	rcode, resp := dt.be(r.Context(), http.MethodGet, findMethodDelegated, uri, encrypted)
+	rcode, resp := dt.be(r.Context(), http.MethodGet, findMethodDelegated, uri, nil, encrypted)
 	if rcode != http.StatusOK {
-		http.Error(w, "", rcode)
+		setCacheHeaders(rcode)
+		if cacheKey != "" {
+			dt.cache.put(cacheKey, mh, rcode, "", nil)
+		}
+		lookupError(w, rcode)
 		return
 	}
 
@@ -149,7 +231,7 @@ func (dt *delegatedTranslator) find(w http.ResponseWriter, r *http.Request, encr
 
 	res := parsed.MultihashResults[0]
 
-	out := &drResp{}
+	out := newDrResp()
 
 	// Records returned from IPNI via Delegated Routing don't have ContextID in them. Becuase of that,
 	// some records that are valid from the IPNI point of view might look like duplicates from the Delegated Routing point of view.
@@ -163,42 +245,59 @@ func (dt *delegatedTranslator) find(w http.ResponseWriter, r *http.Request, encr
 	if err != nil {
 		log.Warnw("failed to serialize response", "err", err)
 		http.Error(w, "", http.StatusInternalServerError)
+		return
 	}
 
+	if cacheKey != "" {
+		dt.cache.put(cacheKey, mh, http.StatusOK, "application/json; charset=utf-8", outBytes)
+	}
+	setCacheHeaders(http.StatusOK)
 	writeJsonResponse(w, http.StatusOK, outBytes)
 }
 
 type drResp struct {
-	Providers     []drProvider
-	seenProviders map[uint32]struct{}
+	Providers []drProvider
+	seen      *dedupSet[*drProvider]
 }
 
-func (dr *drResp) append(drp *drProvider) bool {
-	capacity := len(drp.ID) + len(drp.Schema)
-	for _, proto := range drp.Protocols {
-		capacity += len(proto)
-	}
-	for _, meta := range drp.Metadata {
-		capacity += len(meta)
-	}
-	drpb := make([]byte, 0, capacity)
-	drpb = append(drpb, []byte(drp.ID)...)
+func newDrResp() *drResp {
+	return &drResp{seen: newDedupSet(config.Server.MaxDedupEntries, byDrProvider)}
+}
+
+// byDrProvider keys delegated routing records by all their fields but their
+// addresses. Records lack context IDs, so that records of a provider for
+// different contexts are duplicates if they advertise the same protocols.
+func byDrProvider(d *xxhash.Digest, drp *drProvider) {
+	writeKeyField(d, []byte(drp.ID))
 	for _, proto := range drp.Protocols {
-		drpb = append(drpb, []byte(proto)...)
+		writeKeyField(d, []byte(proto))
 	}
-	drpb = append(drpb, []byte(drp.Schema)...)
-	for _, meta := range drp.Metadata {
-		drpb = append(drpb, meta...)
+	writeKeyField(d, []byte(drp.Schema))
+	// Metadata is keyed in order of protocol, since maps are iterated in
+	// random order.
+	for _, proto := range slices.Sorted(maps.Keys(drp.Metadata)) {
+		writeKeyField(d, []byte(proto))
+		writeKeyField(d, drp.Metadata[proto])
 	}
-	key := crc32.ChecksumIEEE(drpb)
-	if _, ok := dr.seenProviders[key]; ok {
+}
+
+// append appends the given record unless it duplicates any appended so far,
+// and returns whether it did.
+func (dr *drResp) append(drp *drProvider) bool {
+	if !dr.seen.putIfAbsent(drp) {
 		return false
 	}
-	dr.seenProviders[key] = struct{}{}
 	dr.Providers = append(dr.Providers, *drp)
 	return true
 }
 
+// drEncrypted is a record of the encrypted route, carrying an encrypted value
+// key in place of provider information.
+type drEncrypted struct {
+	Schema            string
+	EncryptedValueKey []byte
+}
+
 type drProvider struct {
 	Protocols []string
 	Schema    string
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelegatedTranslator_StreamsEncryptedResults(t *testing.T) {
+	var gotPath string
+	var gotEncrypted bool
+	streaming := func(_ context.Context, _ string, req *url.URL, encrypted bool) (int, chan *encryptedOrPlainResult) {
+		gotPath, gotEncrypted = req.Path, encrypted
+		out := make(chan *encryptedOrPlainResult, 2)
+		out <- &encryptedOrPlainResult{EncryptedValueKey: []byte("fish")}
+		out <- &encryptedOrPlainResult{EncryptedValueKey: []byte("lobster")}
+		close(out)
+		return http.StatusOK, out
+	}
+	subject, err := NewDelegatedTranslator(nil, streaming)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/encrypted/providers/bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", nil)
+	r.Header.Set("Accept", MediaTypeNDJson)
+	rr := httptest.NewRecorder()
+	subject.ServeHTTP(rr, r)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, MediaTypeNDJson, rr.Header().Get("Content-Type"))
+	require.Equal(t, "/encrypted/cid/bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", gotPath)
+	require.True(t, gotEncrypted)
+
+	var got []drEncrypted
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var rec drEncrypted
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		got = append(got, rec)
+	}
+	require.Equal(t, []drEncrypted{
+		{Schema: encryptedSchema, EncryptedValueKey: []byte("fish")},
+		{Schema: encryptedSchema, EncryptedValueKey: []byte("lobster")},
+	}, got)
+}
@@ -0,0 +1,140 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/ipni/go-libipni/dhash"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/metrics"
+	b58 "github.com/mr-tron/base58/base58"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// dhFallbackMultihash returns the multihash of the given plaintext find
+// request that found nothing, if it is to fall back on dh backends.
+func (s *Server) dhFallbackMultihash(ctx context.Context, reqURL *url.URL, encrypted bool) (multihash.Multihash, bool) {
+	if !config.Server.DHFallback || encrypted {
+		return nil, false
+	}
+	mh, err := multihash.Cast(extractShardingKey(reqURL))
+	if err != nil {
+		return nil, false
+	}
+	for _, b := range s.backendsFor(ctx) {
+		if _, ok := b.(dhBackend); ok {
+			return mh, true
+		}
+	}
+	return nil, false
+}
+
+// findDoubleHashed looks up the double hash of the given multihash on dh
+// backends, and translates the encrypted records found into provider results
+// like dhfind does: each value key is decrypted with the multihash, and its
+// metadata is looked up and decrypted with the value key. The results of
+// providers unknown to the provider cache are dropped, since they cannot be
+// reached.
+func (s *Server) findDoubleHashed(ctx context.Context, mh multihash.Multihash) []model.ProviderResult {
+	found := "no"
+	defer func() {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(tag.Insert(metrics.Found, found)),
+			stats.WithMeasurements(metrics.DHFallbacks.M(1)))
+	}()
+
+	dhURL := &url.URL{Path: "/encrypted/multihash/" + dhash.SecondMultihash(mh).B58String()}
+	g, err := s.gatherFind(ctx, http.MethodGet, dhURL, nil, true)
+	if err != nil {
+		log.Warnw("Failed to fall back on dh backends", "err", err)
+		return nil
+	}
+	if len(g.resp.EncryptedMultihashResults) == 0 {
+		return nil
+	}
+
+	evks := g.resp.EncryptedMultihashResults[0].EncryptedValueKeys
+	resultsByKey := make([][]model.ProviderResult, len(evks))
+	var wg sync.WaitGroup
+	for i, evk := range evks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resultsByKey[i] = s.decryptValueKey(ctx, mh, evk)
+		}()
+	}
+	wg.Wait()
+
+	var prs []model.ProviderResult
+	for _, results := range resultsByKey {
+		prs = append(prs, results...)
+	}
+	if len(prs) > 0 {
+		found = "yes"
+	}
+	return prs
+}
+
+// decryptValueKey returns the provider results of the given encrypted value
+// key of the given multihash, or nil if it cannot be translated.
+func (s *Server) decryptValueKey(ctx context.Context, mh multihash.Multihash, evk []byte) []model.ProviderResult {
+	vk, err := dhash.DecryptValueKey(evk, mh)
+	if err != nil {
+		log.Debugw("Failed to decrypt value key", "err", err)
+		return nil
+	}
+	pid, contextID, err := dhash.SplitValueKey(vk)
+	if err != nil {
+		log.Debugw("Failed to split value key", "err", err)
+		return nil
+	}
+
+	mdURL := &url.URL{Path: "/metadata/" + b58.Encode(dhash.SHA256(vk, nil))}
+	data, err := s.gatherMetadata(ctx, mdURL)
+	if err != nil || data == nil {
+		log.Debugw("Failed to find metadata of value key", "provider", pid, "err", err)
+		return nil
+	}
+	var md struct {
+		EncryptedMetadata []byte
+	}
+	if err := json.Unmarshal(data, &md); err != nil {
+		log.Debugw("Invalid metadata response", "err", err)
+		return nil
+	}
+	metadata, err := dhash.DecryptMetadata(md.EncryptedMetadata, vk)
+	if err != nil {
+		log.Debugw("Failed to decrypt metadata", "provider", pid, "err", err)
+		return nil
+	}
+
+	prs, err := s.pcache.GetResults(ctx, pid, contextID, metadata)
+	if err != nil {
+		log.Debugw("Failed to get provider of value key", "provider", pid, "err", err)
+		return nil
+	}
+	return prs
+}
+
+// dhFallbackResults returns the results of the given plaintext find request
+// that found nothing from dh backends, if it is to fall back on them, as they
+// are streamed: deduplicated by the given set and passed through middleware.
+func (s *Server) dhFallbackResults(ctx context.Context, reqURL *url.URL, encrypted bool, seen *resultSet) []*encryptedOrPlainResult {
+	mh, ok := s.dhFallbackMultihash(ctx, reqURL, encrypted)
+	if !ok {
+		return nil
+	}
+	var results []*encryptedOrPlainResult
+	for _, pr := range s.findDoubleHashed(ctx, mh) {
+		r := &encryptedOrPlainResult{ProviderResult: pr}
+		if seen.putIfAbsent(r) {
+			results = append(results, s.afterAggregation(ctx, r, seen)...)
+		}
+	}
+	return results
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/go-libipni/dhash"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	b58 "github.com/mr-tron/base58/base58"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind_FallsBackOnDHBackends(t *testing.T) {
+	defer func(old bool) { config.Server.DHFallback = old }(config.Server.DHFallback)
+	config.Server.DHFallback = true
+
+	mh, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	pid, err := peer.Decode(mockbackend.SampleProviders[0])
+	require.NoError(t, err)
+	bitswap := metadata.Default.New(metadata.Bitswap{})
+	md, err := bitswap.MarshalBinary()
+	require.NoError(t, err)
+
+	vk := dhash.CreateValueKey(pid, []byte("lobster"))
+	evk, err := dhash.EncryptValueKey(vk, mh)
+	require.NoError(t, err)
+	emd, err := dhash.EncryptMetadata(md, vk)
+	require.NoError(t, err)
+	dhPath := "/encrypted/multihash/" + dhash.SecondMultihash(mh).B58String()
+	mdPath := "/metadata/" + b58.Encode(dhash.SHA256(vk, nil))
+	dh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp any
+		switch r.URL.Path {
+		case dhPath:
+			resp = model.FindResponse{EncryptedMultihashResults: []model.EncryptedMultihashResult{
+				{Multihash: dhash.SecondMultihash(mh), EncryptedValueKeys: [][]byte{evk}},
+			}}
+		case mdPath:
+			resp = map[string][]byte{"EncryptedMetadata": emd}
+		default:
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		data, err := json.Marshal(resp)
+		require.NoError(t, err)
+		writeJsonResponse(w, http.StatusOK, data)
+	}))
+	defer dh.Close()
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+			{URL: dh.URL, Type: BackendTypeDH},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, accept := range []string{MediaTypeJson, MediaTypeNDJson} {
+		t.Run(accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/multihash/"+mh.B58String(), nil)
+			req.Header.Set("Accept", accept)
+			rec := httptest.NewRecorder()
+			subject.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			var got model.ProviderResult
+			if accept == MediaTypeJson {
+				resp, err := model.UnmarshalFindResponse(rec.Body.Bytes())
+				require.NoError(t, err)
+				require.Len(t, resp.MultihashResults, 1)
+				require.Len(t, resp.MultihashResults[0].ProviderResults, 1)
+				got = resp.MultihashResults[0].ProviderResults[0]
+			} else {
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+			}
+			require.Equal(t, pid, got.Provider.ID)
+			require.NotEmpty(t, got.Provider.Addrs)
+			require.Equal(t, []byte("lobster"), got.ContextID)
+			require.Equal(t, md, got.Metadata)
+		})
+	}
+
+	config.Server.DHFallback = false
+	req := httptest.NewRequest(http.MethodGet, "/multihash/"+mh.B58String(), nil)
+	req.Header.Set("Accept", MediaTypeJson)
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,101 @@
+package router
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hostResolver caches the resolved addresses of a backend host and refreshes
+// them at most once per interval, independently of the OS resolver caching.
+// Dials rotate among all A/AAAA records of the host.
+type hostResolver struct {
+	host     string
+	interval time.Duration
+
+	mu         sync.RWMutex
+	addrs      []string
+	resolvedAt time.Time
+
+	next       atomic.Uint32
+	refreshing atomic.Bool
+}
+
+func newHostResolver(host string, interval time.Duration) *hostResolver {
+	return &hostResolver{
+		host:     host,
+		interval: interval,
+	}
+}
+
+// lookup returns the cached addresses of the host, rotated so that successive
+// calls start at a different address. The host is resolved synchronously if
+// there are no cached addresses.
+func (r *hostResolver) lookup(ctx context.Context) ([]string, error) {
+	r.mu.RLock()
+	addrs := r.addrs
+	r.mu.RUnlock()
+	if len(addrs) == 0 {
+		if _, err := r.resolve(ctx); err != nil {
+			return nil, err
+		}
+		r.mu.RLock()
+		addrs = r.addrs
+		r.mu.RUnlock()
+	}
+	start := int(r.next.Add(1)) % len(addrs)
+	rotated := make([]string, 0, len(addrs))
+	rotated = append(rotated, addrs[start:]...)
+	return append(rotated, addrs[:start]...), nil
+}
+
+// resolve looks up the addresses of the host and reports whether they have
+// changed since the last lookup.
+func (r *hostResolver) resolve(ctx context.Context) (bool, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, r.host)
+	if err != nil {
+		return false, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	slices.Sort(addrs)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := !slices.Equal(r.addrs, addrs)
+	r.addrs = addrs
+	r.resolvedAt = time.Now()
+	return changed, nil
+}
+
+// maybeRefresh re-resolves the host in the background if the cached addresses
+// are older than the refresh interval, calling onChange if they have changed.
+func (r *hostResolver) maybeRefresh(onChange func()) {
+	r.mu.RLock()
+	stale := time.Since(r.resolvedAt) >= r.interval
+	r.mu.RUnlock()
+	if !stale || !r.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer r.refreshing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), config.Server.DialerTimeout)
+		defer cancel()
+		changed, err := r.resolve(ctx)
+		if err != nil {
+			log.Warnw("Failed to refresh backend host addresses", "host", r.host, "err", err)
+			return
+		}
+		if changed {
+			r.mu.RLock()
+			log.Infow("Backend host addresses changed", "host", r.host, "addrs", r.addrs)
+			r.mu.RUnlock()
+			onChange()
+		}
+	}()
+}
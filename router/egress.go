@@ -0,0 +1,110 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// errEgressDenied is returned by dials to destinations not on the egress
+// allowlist.
+var errEgressDenied = errors.New("destination not on egress allowlist")
+
+// egressAllowlist is the set of destinations that backends, including
+// cascade backends, may be connected to. It is enforced when connections are
+// dialed, on the addresses actually connected to, so that no edit of the
+// backends config can reach other destinations. A nil egressAllowlist allows
+// every destination.
+type egressAllowlist struct {
+	prefixes []netip.Prefix
+	// hosts are the allowed hostnames, in lower case. Those starting with
+	// "*." allow every subdomain of the rest.
+	hosts []string
+}
+
+// egressHostAllowedKey marks the context of dials of hosts on the egress
+// allowlist by name, whose resolved addresses need not be on it.
+type egressHostAllowedKey struct{}
+
+// newEgressAllowlist parses the given comma-separated list of CIDRs, IP
+// addresses and hostnames, and returns nil if it is empty.
+func newEgressAllowlist(list string) (*egressAllowlist, error) {
+	var a egressAllowlist
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			a.prefixes = append(a.prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			a.prefixes = append(a.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		if strings.ContainsAny(entry, "/:") {
+			return nil, fmt.Errorf("invalid egress allowlist entry %q: must be a CIDR, IP address or hostname", entry)
+		}
+		a.hosts = append(a.hosts, strings.ToLower(entry))
+	}
+	if len(a.prefixes) == 0 && len(a.hosts) == 0 {
+		return nil, nil
+	}
+	return &a, nil
+}
+
+// allowsHost checks whether the given hostname is on the allowlist by name.
+func (a *egressAllowlist) allowsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range a.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddr checks whether the given IP address is on the allowlist.
+func (a *egressAllowlist) allowsAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withHost returns the context of a dial of the given host:port, marked as
+// allowed if its host is on the allowlist by name.
+func (a *egressAllowlist) withHost(ctx context.Context, hostport string) context.Context {
+	if a == nil || !a.allowsHost(hostnameOf(hostport)) {
+		return ctx
+	}
+	return context.WithValue(ctx, egressHostAllowedKey{}, true)
+}
+
+// guard makes the given dialer refuse to connect to addresses not on the
+// allowlist, unless dialed with a context marked by withHost.
+func (a *egressAllowlist) guard(d *net.Dialer) {
+	if a == nil {
+		return
+	}
+	d.ControlContext = func(ctx context.Context, _, address string, _ syscall.RawConn) error {
+		if allowed, _ := ctx.Value(egressHostAllowedKey{}).(bool); allowed {
+			return nil
+		}
+		if addrPort, err := netip.ParseAddrPort(address); err == nil && a.allowsAddr(addrPort.Addr()) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", errEgressDenied, address)
+	}
+}
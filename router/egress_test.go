@@ -0,0 +1,58 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEgressAllowlist(t *testing.T) {
+	a, err := newEgressAllowlist("")
+	require.NoError(t, err)
+	require.Nil(t, a)
+
+	a, err = newEgressAllowlist("10.0.0.0/8, 192.0.2.1, 2001:db8::/32, indexer.example.com, *.internal.example.com")
+	require.NoError(t, err)
+	require.True(t, a.allowsAddr(netip.MustParseAddr("10.1.2.3")))
+	require.True(t, a.allowsAddr(netip.MustParseAddr("::ffff:10.1.2.3")))
+	require.True(t, a.allowsAddr(netip.MustParseAddr("192.0.2.1")))
+	require.False(t, a.allowsAddr(netip.MustParseAddr("192.0.2.2")))
+	require.True(t, a.allowsAddr(netip.MustParseAddr("2001:db8::1")))
+	require.True(t, a.allowsHost("Indexer.Example.com."))
+	require.True(t, a.allowsHost("cid.internal.example.com"))
+	require.False(t, a.allowsHost("internal.example.com"))
+	require.False(t, a.allowsHost("example.com"))
+
+	_, err = newEgressAllowlist("10.0.0.0/33")
+	require.Error(t, err)
+}
+
+func TestNewBackendClient_EnforcesEgressAllowlist(t *testing.T) {
+	defer func(old string) { config.Server.EgressAllowlist = old }(config.Server.EgressAllowlist)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer backend.Close()
+	get := func(url string) error {
+		client, err := NewBackendClient(BackendConfig{URL: url})
+		require.NoError(t, err)
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	config.Server.EgressAllowlist = "192.0.2.0/24, indexer.example.com"
+	require.ErrorIs(t, get(backend.URL), errEgressDenied)
+
+	config.Server.EgressAllowlist = "192.0.2.0/24, 127.0.0.0/8"
+	require.NoError(t, get(backend.URL))
+
+	// Hosts allowed by name may resolve to any address.
+	config.Server.EgressAllowlist = "localhost"
+	require.NoError(t, get(strings.Replace(backend.URL, "127.0.0.1", "localhost", 1)))
+}
@@ -0,0 +1,227 @@
+package router
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requestIDHeader is the header that identifies a request in responses and
+// logs. A valid request ID set by the client or a load balancer is kept.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the length of request IDs taken from clients.
+const maxRequestIDLength = 128
+
+// streamStatusTrailer is the trailer by which NDJSON streams report their
+// outcome: ok, or the code of the error that ended them. Unlike the status, it
+// can still be set once a stream has started.
+const streamStatusTrailer = "X-Stream-Status"
+
+// streamStatusOK is the stream status of streams that completed.
+const streamStatusOK = "ok"
+
+// Codes of error responses that tell errors of the same status apart. Errors
+// without a specific code are coded by their status, e.g. not_found.
+const (
+	errCodeInvalidCid          = "invalid_cid"
+	errCodeInvalidMultihash    = "invalid_multihash"
+	errCodeInvalidAccept       = "invalid_accept"
+	errCodeUnsupportedMedia    = "unsupported_media_type"
+	errCodeTooManyMultihashes  = "too_many_multihashes"
+	errCodeBackendsFailed      = "backends_failed"
+	errCodeRateLimited         = "rate_limited"
+	errCodeTooManyInflight     = "too_many_inflight_requests"
+	errCodeTooManyStreams      = "too_many_streams"
+	errCodeOverloaded          = "overloaded"
+	errCodeDeniedByPolicy      = "denied_by_policy"
+	errCodeUnknownCascadeLabel = "unknown_cascade_label"
+)
+
+// errorResponse is the body of error responses to clients that accept JSON.
+type errorResponse struct {
+	// Code identifies the kind of error.
+	Code string
+	// Message describes the error for humans.
+	Message string
+	// RequestID identifies the request, e.g. when reporting errors.
+	RequestID string `json:",omitempty"`
+	// RetryAfter is the number of seconds after which the request may be
+	// retried, if it may be.
+	RetryAfter int `json:",omitempty"`
+}
+
+// errCodeOf returns the code of errors of the given status that have no
+// specific code.
+func errCodeOf(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+// httpError replies to the request with the given error like http.Error, and
+// codes the error with the given code if it is responded to as JSON.
+func httpError(w http.ResponseWriter, message, code string, status int) {
+	for rw := w; rw != nil; {
+		if ew, ok := rw.(*errorResponseWriter); ok {
+			ew.code = code
+			break
+		}
+		u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		rw = u.Unwrap()
+	}
+	http.Error(w, message, status)
+}
+
+// lookupErrCode returns the code of the given error status of a lookup.
+// Lookups only fail with 500 Internal Server Error if backends could not be
+// queried, which is coded as such.
+func lookupErrCode(rcode int) string {
+	if rcode == http.StatusInternalServerError {
+		return errCodeBackendsFailed
+	}
+	return errCodeOf(rcode)
+}
+
+// lookupError replies with the given error status of a lookup.
+func lookupError(w http.ResponseWriter, rcode int) {
+	httpError(w, "", lookupErrCode(rcode), rcode)
+}
+
+// streamError replies with the given error status of a lookup that failed
+// before any record was written. Lookups streamed as NDJSON are responded to
+// with an empty NDJSON stream that carries the error code in its stream status
+// trailer, so that streaming clients need not parse another media type. Other
+// lookups are responded to like lookupError.
+func streamError(w http.ResponseWriter, ndjson bool, rcode int) {
+	if !ndjson {
+		lookupError(w, rcode)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", MediaTypeNDJson)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(rcode)
+	setStreamStatus(w, lookupErrCode(rcode))
+}
+
+// setStreamStatus sets the stream status trailer of a streamed response.
+func setStreamStatus(w http.ResponseWriter, status string) {
+	w.Header().Set(http.TrailerPrefix+streamStatusTrailer, status)
+}
+
+// wantsJSONErrors checks whether errors are responded to the given request as
+// JSON, i.e. whether it explicitly accepts JSON or NDJSON. Other requests get
+// plain text errors as before.
+func wantsJSONErrors(r *http.Request) bool {
+	acc, err := getAccepts(r)
+	return err == nil && (acc.json || acc.ndjson)
+}
+
+// requestIDOf returns the request ID set by the client, if valid, or a new
+// random one otherwise.
+func requestIDOf(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= maxRequestIDLength && isPrintableASCII(id) {
+		return id
+	}
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// withErrorResponses identifies each request by a request ID header on its
+// response, and responds with errors written via http.Error or httpError as
+// JSON errorResponse bodies to requests that accept JSON.
+func withErrorResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestIDHeader, requestIDOf(r))
+		if !wantsJSONErrors(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &errorResponseWriter{recordingResponseWriter: recordingResponseWriter{ResponseWriter: w}, head: r.Method == http.MethodHead}
+		next.ServeHTTP(ew, r)
+		ew.finish()
+	})
+}
+
+// errorResponseWriter rewrites plain text error responses, as written by
+// http.Error, into JSON error responses.
+type errorResponseWriter struct {
+	recordingResponseWriter
+	head bool
+	// code is the code of the error being written, if set via httpError.
+	code string
+
+	// errStatus is the status of the error being rewritten, if any.
+	errStatus int
+	message   bytes.Buffer
+}
+
+func (w *errorResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		h := w.Header()
+		if status >= http.StatusBadRequest && strings.HasPrefix(h.Get("Content-Type"), "text/plain") {
+			w.errStatus = status
+			h.Set("Content-Type", MediaTypeJson)
+			h.Del("Content-Length")
+		}
+	}
+	w.recordingResponseWriter.WriteHeader(status)
+}
+
+func (w *errorResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.errStatus != 0 {
+		return w.message.Write(b)
+	}
+	return w.recordingResponseWriter.Write(b)
+}
+
+// finish writes the JSON body of the error being rewritten, if any.
+func (w *errorResponseWriter) finish() {
+	if w.errStatus == 0 || w.head {
+		return
+	}
+	resp := errorResponse{
+		Code:      w.code,
+		Message:   strings.TrimSpace(w.message.String()),
+		RequestID: w.Header().Get(requestIDHeader),
+	}
+	if resp.Code == "" {
+		resp.Code = errCodeOf(w.errStatus)
+	}
+	if resp.Message == "" {
+		resp.Message = http.StatusText(w.errStatus)
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil && retryAfter > 0 {
+		resp.RetryAfter = retryAfter
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Errorw("Failed to marshal error response", "err", err)
+		return
+	}
+	_, _ = w.recordingResponseWriter.Write(append(data, '\n'))
+}
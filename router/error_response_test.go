@@ -0,0 +1,145 @@
+package router
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrCodeOf(t *testing.T) {
+	require.Equal(t, "not_found", errCodeOf(http.StatusNotFound))
+	require.Equal(t, "too_many_requests", errCodeOf(http.StatusTooManyRequests))
+	require.Equal(t, "error", errCodeOf(statusClientClosedRequest))
+}
+
+func TestErrorResponses_NegotiatedByAccept(t *testing.T) {
+	defer func(old int) { config.RateLimit.PerIP = old }(config.RateLimit.PerIP)
+	config.RateLimit.PerIP = 2
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	serve := func(target, accept, requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+	errorOf := func(rec *httptest.ResponseRecorder) errorResponse {
+		require.Equal(t, MediaTypeJson, rec.Header().Get("Content-Type"))
+		var resp errorResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	rec := serve("/multihash/fish", "", "")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.True(t, strings.HasPrefix(rec.Body.String(), "invalid multihash: "))
+	require.NotEmpty(t, rec.Header().Get(requestIDHeader))
+
+	rec = serve("/multihash/fish", MediaTypeNDJson, "lobster")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, "lobster", rec.Header().Get(requestIDHeader))
+	got := errorOf(rec)
+	require.Equal(t, errCodeInvalidMultihash, got.Code)
+	require.True(t, strings.HasPrefix(got.Message, "invalid multihash: "))
+	require.Equal(t, "lobster", got.RequestID)
+	require.Zero(t, got.RetryAfter)
+
+	rec = serve("/multihash/fish", MediaTypeJson, "")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	got = errorOf(rec)
+	require.Equal(t, errCodeRateLimited, got.Code)
+	require.Equal(t, http.StatusText(http.StatusTooManyRequests), got.Message)
+	require.Equal(t, rec.Header().Get(requestIDHeader), got.RequestID)
+	require.Positive(t, got.RetryAfter)
+	require.Equal(t, strconv.Itoa(got.RetryAfter), rec.Header().Get("Retry-After"))
+}
+
+func TestStreamError_RespectsNegotiatedMediaType(t *testing.T) {
+	absent, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+
+	for _, test := range []struct {
+		name     string
+		backends []BackendConfig
+	}{
+		{
+			name:     "proxied",
+			backends: []BackendConfig{{URL: backend.URL}, {URL: backend.URL, Type: BackendTypeProviders}},
+		},
+		{
+			name:     "aggregated",
+			backends: []BackendConfig{{URL: backend.URL}, {URL: backend.URL}, {URL: backend.URL, Type: BackendTypeProviders}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			subject, err := New(Options{Backends: test.backends})
+			require.NoError(t, err)
+			find := func(target, accept string) *http.Response {
+				req := httptest.NewRequest(http.MethodGet, target, nil)
+				req.Header.Set("Accept", accept)
+				rec := httptest.NewRecorder()
+				subject.ServeHTTP(rec, req)
+				return rec.Result()
+			}
+
+			for _, target := range []string{"/multihash/" + absent.B58String(), "/routing/v1/providers/" + cid.NewCidV1(cid.Raw, absent).String()} {
+				resp := find(target, MediaTypeNDJson)
+				require.Equal(t, http.StatusNotFound, resp.StatusCode, target)
+				require.Equal(t, MediaTypeNDJson, resp.Header.Get("Content-Type"), target)
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Empty(t, body, target)
+				require.Equal(t, "not_found", resp.Trailer.Get(streamStatusTrailer), target)
+
+				resp = find(target, MediaTypeJson)
+				require.Equal(t, http.StatusNotFound, resp.StatusCode, target)
+				require.Equal(t, MediaTypeJson, resp.Header.Get("Content-Type"), target)
+				var got errorResponse
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+				require.Equal(t, "not_found", got.Code, target)
+				require.Empty(t, resp.Trailer.Get(streamStatusTrailer), target)
+			}
+
+			resp := find("/routing/v1/providers/"+mockbackend.SampleCids[0], MediaTypeNDJson)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, streamStatusOK, resp.Trailer.Get(streamStatusTrailer))
+		})
+	}
+
+	subject, err := New(Options{Backends: []BackendConfig{
+		{URL: backend.URL}, {URL: backend.URL}, {URL: backend.URL, Type: BackendTypeProviders},
+	}})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+	req.Header.Set("Accept", MediaTypeNDJson)
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, streamStatusOK, rec.Result().Trailer.Get(streamStatusTrailer))
+}
@@ -0,0 +1,170 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/tag"
+)
+
+const (
+	experimentBucketByClient    = "client"
+	experimentBucketByMultihash = "multihash"
+)
+
+type (
+	// experiment buckets requests into weighted variants, each of which may
+	// route to a different set of backends or aggregate with a different
+	// deadline. The experiment and variant names are tagged onto find
+	// metrics, so that variants can be compared on real traffic.
+	//
+	// Requests are bucketed by a hash of either the client IP or the looked up
+	// CID or multihash, so that the same client or content consistently lands
+	// in the same variant.
+	experiment struct {
+		BaseMiddleware
+		Name string
+		// BucketBy is either client or multihash. Defaults to client.
+		BucketBy string
+		Variants []*experimentVariant
+
+		totalWeight uint64
+	}
+	experimentVariant struct {
+		Name   string
+		Weight uint64
+		// Backends are the hosts of backends that requests in the variant are
+		// routed to. Backends of a type none of which is listed are routed to
+		// as usual. All backends are routed to if empty.
+		Backends []string `json:",omitempty"`
+		// MaxWait overrides the deadline for scattering to non-cascade
+		// backends, formatted as a Go duration, if set.
+		MaxWait string `json:",omitempty"`
+
+		maxWait time.Duration
+	}
+	experimentVariantKey struct{}
+)
+
+// newExperiment loads an experiment from the JSON file at the given path.
+func newExperiment(filePath string) (*experiment, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var e experiment
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid experiment: %w", err)
+	}
+	if e.Name == "" {
+		return nil, fmt.Errorf("experiment must have a name")
+	}
+	switch e.BucketBy {
+	case "":
+		e.BucketBy = experimentBucketByClient
+	case experimentBucketByClient, experimentBucketByMultihash:
+	default:
+		return nil, fmt.Errorf("invalid experiment bucketing: %s", e.BucketBy)
+	}
+	if len(e.Variants) == 0 {
+		return nil, fmt.Errorf("experiment must have at least one variant")
+	}
+	seen := make(map[string]struct{})
+	for i, v := range e.Variants {
+		if v.Name == "" {
+			return nil, fmt.Errorf("experiment variant %d: must have a name", i)
+		}
+		if _, ok := seen[v.Name]; ok {
+			return nil, fmt.Errorf("experiment variant %d: duplicate name %s", i, v.Name)
+		}
+		seen[v.Name] = struct{}{}
+		if v.MaxWait != "" {
+			if v.maxWait, err = time.ParseDuration(v.MaxWait); err != nil || v.maxWait <= 0 {
+				return nil, fmt.Errorf("experiment variant %s: invalid max wait: %s", v.Name, v.MaxWait)
+			}
+		}
+		e.totalWeight += v.Weight
+	}
+	if e.totalWeight == 0 {
+		return nil, fmt.Errorf("experiment variants must have a positive total weight")
+	}
+	return &e, nil
+}
+
+// BeforeRequest assigns the request to a variant.
+func (e *experiment) BeforeRequest(r *http.Request) (*http.Request, error) {
+	v := e.variantFor(r)
+	ctx, err := tag.New(r.Context(),
+		tag.Upsert(metrics.Experiment, e.Name),
+		tag.Upsert(metrics.Variant, v.Name))
+	if err != nil {
+		return nil, err
+	}
+	return r.WithContext(context.WithValue(ctx, experimentVariantKey{}, v)), nil
+}
+
+// variantFor deterministically picks the variant of the given request.
+func (e *experiment) variantFor(r *http.Request) *experimentVariant {
+	key := clientIP(r)
+	if e.BucketBy == experimentBucketByMultihash {
+		key = path.Base(r.URL.Path)
+		if c, err := cid.Decode(key); err == nil {
+			key = c.Hash().B58String()
+		}
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(e.Name))
+	_, _ = h.Write([]byte(key))
+	bucket := h.Sum64() % e.totalWeight
+	for _, v := range e.Variants {
+		if bucket < v.Weight {
+			return v
+		}
+		bucket -= v.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// experimentVariantFrom returns the experiment variant of the request with
+// the given context, if any.
+func experimentVariantFrom(ctx context.Context) *experimentVariant {
+	v, _ := ctx.Value(experimentVariantKey{}).(*experimentVariant)
+	return v
+}
+
+// backends returns the given backends restricted to the variant's backends.
+func (v *experimentVariant) backends(all []Backend) []Backend {
+	if len(v.Backends) == 0 {
+		return all
+	}
+	listedTypes := make(map[string]struct{})
+	for _, b := range all {
+		if v.lists(b) {
+			listedTypes[backendType(b)] = struct{}{}
+		}
+	}
+	selected := make([]Backend, 0, len(all))
+	for _, b := range all {
+		if _, ok := listedTypes[backendType(b)]; !ok || v.lists(b) {
+			selected = append(selected, b)
+		}
+	}
+	return selected
+}
+
+func (v *experimentVariant) lists(b Backend) bool {
+	for _, host := range v.Backends {
+		if pinnedTo(b, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/tag"
+)
+
+func newTestExperiment(t *testing.T, spec string) *experiment {
+	p := filepath.Join(t.TempDir(), "experiment.json")
+	require.NoError(t, os.WriteFile(p, []byte(spec), 0o644))
+	e, err := newExperiment(p)
+	require.NoError(t, err)
+	return e
+}
+
+func TestExperiment_BucketsRequests(t *testing.T) {
+	subject := newTestExperiment(t, `{
+		"Name": "fish",
+		"BucketBy": "multihash",
+		"Variants": [
+			{"Name": "control", "Weight": 1},
+			{"Name": "never", "Weight": 0},
+			{"Name": "lobster", "Weight": 1, "Backends": ["b.invalid"], "MaxWait": "100ms"}
+		]
+	}`)
+
+	seen := make(map[string]int)
+	for _, mh := range []string{
+		"QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH",
+		"QmVdfuDvddBW4MWnuWZmmVtv9W7HMr8dU3ssoBKpnKcHTz",
+		"QmPNHBy5h7f19yJDt7ip9TvmzRcySYGMhNM8JvVMVGiPUx",
+		"QmRVZ1VvAMgCTUDh8u4yJsT9axprpUtj9WpWLFp9GUR3e1",
+		"QmSnuWmxptJZdLJpKRarxBMS2Ju2oANVrgbr2xWbie9b2D",
+		"QmZTR5bcpQD7cFgTorqxZDYaew1Wqgfbd2ud9QqGPAkK2V",
+		"QmYCvbfNbCwFR45HiNP45rwJgvatpiW38D961L5qAhUM5Y",
+		"QmQy6xmJhrcC5QLboAcGFcAE1tC8CrwDVkrHdEYJkLscrQ",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/multihash/"+mh, nil)
+		v := subject.variantFor(r)
+		// Bucketing is deterministic.
+		require.Equal(t, v, subject.variantFor(r))
+		seen[v.Name]++
+	}
+	require.Zero(t, seen["never"])
+	require.Positive(t, seen["control"])
+	require.Positive(t, seen["lobster"])
+}
+
+func TestExperiment_BeforeRequestTagsVariant(t *testing.T) {
+	subject := newTestExperiment(t, `{"Name": "fish", "Variants": [{"Name": "lobster", "Weight": 1, "MaxWait": "100ms"}]}`)
+
+	r, err := subject.BeforeRequest(httptest.NewRequest(http.MethodGet, "/cid/fish", nil))
+	require.NoError(t, err)
+	v := experimentVariantFrom(r.Context())
+	require.NotNil(t, v)
+	require.Equal(t, "lobster", v.Name)
+	tags := tag.FromContext(r.Context())
+	experimentName, _ := tags.Value(metrics.Experiment)
+	require.Equal(t, "fish", experimentName)
+	variantName, _ := tags.Value(metrics.Variant)
+	require.Equal(t, "lobster", variantName)
+
+	sg := scatterGather[Backend, any]{maxWait: time.Second, cascadeMaxWait: 2 * time.Second}
+	require.Equal(t, 100*time.Millisecond, sg.maxWaitFor(r.Context(), testBackend(1)))
+	require.Equal(t, 2*time.Second, sg.maxWaitFor(r.Context(), caskadeBackend{Backend: testBackend(1)}))
+	require.Equal(t, time.Second, sg.maxWaitFor(context.Background(), testBackend(1)))
+}
+
+func TestExperimentVariant_Backends(t *testing.T) {
+	newBackend := func(u string) Backend {
+		b, err := NewBackend(u, nil, Matchers.Any, nil)
+		require.NoError(t, err)
+		return b
+	}
+	a := newBackend("http://a.invalid")
+	b := newBackend("http://b.invalid")
+	c := caskadeBackend{Backend: newBackend("http://c.invalid")}
+	p := providersBackend{newBackend("http://p.invalid")}
+	all := []Backend{a, b, c, p}
+
+	subject := &experimentVariant{Backends: []string{"b.invalid"}}
+	require.Equal(t, []Backend{b, c, p}, subject.backends(all))
+	subject = &experimentVariant{}
+	require.Equal(t, all, subject.backends(all))
+}
+
+func TestNewExperiment_RejectsInvalid(t *testing.T) {
+	for _, spec := range []string{
+		`{"Variants": [{"Name": "a", "Weight": 1}]}`,
+		`{"Name": "fish", "Variants": []}`,
+		`{"Name": "fish", "BucketBy": "moon", "Variants": [{"Name": "a", "Weight": 1}]}`,
+		`{"Name": "fish", "Variants": [{"Name": "a", "Weight": 0}]}`,
+		`{"Name": "fish", "Variants": [{"Name": "a", "Weight": 1}, {"Name": "a", "Weight": 1}]}`,
+		`{"Name": "fish", "Variants": [{"Name": "a", "Weight": 1, "MaxWait": "soon"}]}`,
+	} {
+		p := filepath.Join(t.TempDir(), "experiment.json")
+		require.NoError(t, os.WriteFile(p, []byte(spec), 0o644))
+		_, err := newExperiment(p)
+		require.Error(t, err, spec)
+	}
+}
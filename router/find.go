@@ -0,0 +1,896 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/metrics"
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+const (
+	findMethodOrig      = "http-v0"
+	findMethodDelegated = "delegated-v1"
+)
+
+func (s *Server) findCid(w http.ResponseWriter, r *http.Request, encrypted bool) {
+	switch r.Method {
+	case http.MethodOptions:
+		s.handleIPNIOptions(w, r)
+	case http.MethodGet, http.MethodHead:
+		sc := path.Base(strings.TrimSuffix(r.URL.Path, countPathSuffix))
+		c, err := cid.Decode(sc)
+		if err != nil {
+			httpError(w, "invalid cid: "+err.Error(), errCodeInvalidCid, http.StatusBadRequest)
+			return
+		}
+		s.find(w, r, c.Hash(), encrypted)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodHead)
+		w.Header().Add("Allow", http.MethodOptions)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+func (s *Server) findMultihashSubtree(w http.ResponseWriter, r *http.Request, encrypted bool) {
+	switch r.Method {
+	case http.MethodOptions:
+		s.handleIPNIOptions(w, r)
+	case http.MethodGet, http.MethodHead:
+		smh := path.Base(strings.TrimSuffix(r.URL.Path, countPathSuffix))
+		if strings.Contains(smh, ",") {
+			if isCountRequest(r) {
+				httpError(w, "counts of multiple multihashes are not supported", errCodeTooManyMultihashes, http.StatusBadRequest)
+				return
+			}
+			s.findMultihashes(w, r, strings.Split(smh, ","), encrypted)
+			return
+		}
+		mh, err := parseMultihash(smh)
+		if err != nil {
+			httpError(w, "invalid multihash: "+err.Error(), errCodeInvalidMultihash, http.StatusBadRequest)
+			return
+		}
+		s.find(w, r, mh, encrypted)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodHead)
+		w.Header().Add("Allow", http.MethodOptions)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+// parseMultihash parses a base58 or hex encoded multihash.
+func parseMultihash(smh string) (multihash.Multihash, error) {
+	mh, err := multihash.FromB58String(smh)
+	if err != nil {
+		var hexErr error
+		mh, hexErr = multihash.FromHexString(smh)
+		if hexErr != nil {
+			return nil, err
+		}
+	}
+	return mh, nil
+}
+
+// findMultihashes looks up multiple multihashes in parallel and responds with
+// a combined find response. Multi-multihash lookups are only supported with
+// JSON responses.
+func (s *Server) findMultihashes(w http.ResponseWriter, r *http.Request, smhs []string, encrypted bool) {
+	if len(smhs) > config.Server.MaxMultihashesPerLookup {
+		httpError(w, fmt.Sprintf("too many multihashes: at most %d allowed", config.Server.MaxMultihashesPerLookup), errCodeTooManyMultihashes, http.StatusBadRequest)
+		return
+	}
+	acc, err := getAccepts(r)
+	if err != nil {
+		httpError(w, "invalid Accept header", errCodeInvalidAccept, http.StatusBadRequest)
+		return
+	}
+	if !(acc.json || acc.any || !acc.acceptHeaderFound) {
+		httpError(w, "unsupported media type", errCodeUnsupportedMedia, http.StatusBadRequest)
+		return
+	}
+
+	seen := make(map[string]struct{}, len(smhs))
+	mhs := make([]multihash.Multihash, 0, len(smhs))
+	for _, smh := range smhs {
+		mh, err := parseMultihash(smh)
+		if err != nil {
+			httpError(w, "invalid multihash: "+err.Error(), errCodeInvalidMultihash, http.StatusBadRequest)
+			return
+		}
+		decoded, err := multihash.Decode(mh)
+		if err != nil {
+			httpError(w, "bad multihash: "+err.Error(), errCodeInvalidMultihash, http.StatusBadRequest)
+			return
+		}
+		if len(decoded.Digest) == 0 {
+			httpError(w, "bad multihash: zero-length digest", errCodeInvalidMultihash, http.StatusBadRequest)
+			return
+		}
+		if _, ok := seen[string(mh)]; ok {
+			continue
+		}
+		seen[string(mh)] = struct{}{}
+		mhs = append(mhs, mh)
+	}
+
+	type lookupResult struct {
+		rcode int
+		data  []byte
+	}
+	results := make([]lookupResult, len(mhs))
+	var wg sync.WaitGroup
+	for i, mh := range mhs {
+		// Look up each multihash as if it was requested individually.
+		reqURL := *r.URL
+		reqURL.Path = path.Join(path.Dir(r.URL.Path), mh.B58String())
+		reqURL.RawPath = ""
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rcode, data := s.doFind(r.Context(), r.Method, findMethodOrig, &reqURL, nil, encrypted)
+			results[i] = lookupResult{rcode: rcode, data: data}
+		}()
+	}
+	wg.Wait()
+
+	var resp model.FindResponse
+	rcode := http.StatusNotFound
+	for _, result := range results {
+		switch result.rcode {
+		case http.StatusOK:
+			found, err := model.UnmarshalFindResponse(result.data)
+			if err != nil {
+				log.Warnw("failed to unmarshal find response", "err", err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			resp.MultihashResults = append(resp.MultihashResults, found.MultihashResults...)
+			resp.EncryptedMultihashResults = append(resp.EncryptedMultihashResults, found.EncryptedMultihashResults...)
+			rcode = http.StatusOK
+		case http.StatusNotFound:
+		default:
+			if rcode == http.StatusNotFound {
+				rcode = result.rcode
+			}
+		}
+	}
+	if rcode != http.StatusOK {
+		lookupError(w, rcode)
+		return
+	}
+
+	outData, err := model.MarshalFindResponse(&resp)
+	if err != nil {
+		log.Warnw("failed marshal response", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, outData)
+}
+
+func (s *Server) findMetadataSubtree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	md, err := s.gatherMetadata(r.Context(), r.URL)
+	if err != nil {
+		log.Errorw("Failed to scatter HTTP find metadata request", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if md == nil {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, md)
+}
+
+// gatherMetadata scatters the given metadata request to dh backends, and
+// returns the first metadata found, or nil if none is.
+func (s *Server) gatherMetadata(ctx context.Context, reqURL *url.URL) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	method := http.MethodGet
+
+	sg := &scatterGather[Backend, []byte]{
+		backends:    s.backendsFor(ctx),
+		maxWait:     config.Server.ResultMaxWait,
+		latency:     s.deadlines[routeMetadata],
+		pool:        s.scatterPool,
+		concurrency: s.concurrency,
+		circuit:     circuitMetadata,
+	}
+
+	// TODO: wait for the first successful response instead
+	err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*[]byte, error) {
+		// send metadata requests only to dh backends
+		if _, isDhBackend := b.(dhBackend); !isDhBackend {
+			return nil, nil
+		}
+
+		// Copy the URL from original request and override host/schema to point
+		// to the server.
+		endpoint := *reqURL
+		endpoint.Host = b.URL().Host
+		endpoint.Scheme = b.URL().Scheme
+		log := log.With("backend", endpoint.Host)
+
+		req, err := http.NewRequestWithContext(cctx, method, endpoint.String(), nil)
+		if err != nil {
+			log.Warnw("Failed to construct find-metadata backend query", "err", err)
+			return nil, err
+		}
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		req.Header.Set("Accept", MediaTypeJson)
+		s.middlewares.decorateBackendRequest(req, b)
+		if !b.Matches(req) {
+			return nil, nil
+		}
+		resp, err := b.Client().Do(req)
+		if err != nil {
+			recordBackendFailure(cctx, b.URL().Host, requestErrKind(err, false))
+			log.Warnw("Failed to query backend for metadata", "err", err)
+			return nil, err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			recordBackendFailure(cctx, b.URL().Host, requestErrKind(err, true))
+			log.Warnw("Failed to read find-metadata backend response", "err", err)
+			return nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return &data, nil
+		case http.StatusNotFound:
+			return nil, nil
+		default:
+			recordBackendFailure(cctx, b.URL().Host, statusErrKind(resp.StatusCode))
+			body := string(data)
+			log := log.With("status", resp.StatusCode, "body", body)
+			log.Warn("Request processing was not successful")
+			err := fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
+			if resp.StatusCode < http.StatusInternalServerError {
+				err = circuitbreaker.MarkAsSuccess(err)
+			}
+			return nil, err
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for md := range sg.gather(ctx) {
+		// It is ok to return the first encountered metadata. This is because
+		// metadata is uniquely identified by ValueKey (peerID + contextID).
+		// I.e. it is not possible to have different metadata records for the
+		// same ValueKey.
+		//
+		// Whereas in regular find requests it is perfectly normal to have
+		// different results returned by different IPNI instances and hence
+		// they need to be aggregated.
+		if len(md) > 0 {
+			return md, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) find(w http.ResponseWriter, r *http.Request, mh multihash.Multihash, encrypted bool) {
+	decoded, err := multihash.Decode(mh)
+	if err != nil {
+		httpError(w, "bad multihash: "+err.Error(), errCodeInvalidMultihash, http.StatusBadRequest)
+		return
+	}
+	if len(decoded.Digest) == 0 {
+		httpError(w, "bad multihash: zero-length digest", errCodeInvalidMultihash, http.StatusBadRequest)
+		return
+	}
+
+	acc, err := getAccepts(r)
+	if err != nil {
+		httpError(w, "invalid Accept header", errCodeInvalidAccept, http.StatusBadRequest)
+		return
+	}
+
+	if s.auditor != nil && !encrypted {
+		s.auditor.observe(mh)
+	}
+
+	if isExistsRequest(r) {
+		s.findExists(w, r, encrypted)
+		return
+	}
+	if isCountRequest(r) {
+		s.findCount(w, r, encrypted)
+		return
+	}
+
+	if ok, reqURL := provenanceRequested(r); ok {
+		// Records are annotated as they are gathered, so neither cached
+		// responses nor responses proxied from a sole backend may be served.
+		switch {
+		case acc.ndjson:
+			s.doFindNDJson(r.Context(), w, findMethodOrig, reqURL, false, mh, encrypted, true)
+		case acc.json || acc.any || !acc.acceptHeaderFound:
+			s.doFindNDJson(r.Context(), w, findMethodOrig, reqURL, true, mh, encrypted, true)
+		default:
+			httpError(w, "unsupported media type", errCodeUnsupportedMedia, http.StatusBadRequest)
+		}
+		return
+	}
+
+	if config.Server.SingleBackendFastPath && (acc.ndjson || acc.json || acc.any || !acc.acceptHeaderFound) {
+		if b := s.soleFindBackend(r, encrypted); b != nil {
+			s.proxyFind(w, r, b, acc.ndjson)
+			return
+		}
+	}
+
+	// Use NDJSON response only when the request explicitly accepts it. Otherwise, fallback on
+	// JSON unless only unsupported media types are specified.
+	switch {
+	case acc.ndjson:
+		s.doFindNDJson(r.Context(), w, findMethodOrig, r.URL, false, mh, encrypted, false)
+	case acc.json || acc.any || !acc.acceptHeaderFound:
+		if s.translateNonStreaming {
+			s.doFindNDJson(r.Context(), w, findMethodOrig, r.URL, true, mh, encrypted, false)
+			return
+		}
+		// In a case where the request has no `Accept` header at all, be forgiving and respond with
+		// JSON.
+		rcode, resp, cached := s.doFindWithCacheStatus(r.Context(), r.Method, findMethodOrig, r.URL, nil, encrypted)
+		if rcode != http.StatusOK {
+			lookupError(w, rcode)
+			return
+		}
+		s.cache.served(cached)
+		cached.setHeaders(w)
+		writeJsonResponse(w, http.StatusOK, resp)
+	default:
+		// The request must have  specified an explicit media type that we do not support.
+		httpError(w, "unsupported media type", errCodeUnsupportedMedia, http.StatusBadRequest)
+		return
+	}
+}
+
+// soleFindBackend returns the backend to which a find request would be
+// scattered if there is exactly one such backend. Otherwise, nil is returned.
+func (s *Server) soleFindBackend(r *http.Request, encrypted bool) Backend {
+	// Results must pass through middleware tailoring them or be expanded
+	// with extended providers, which requires aggregating them. Requests
+	// reaching here were already admitted by middleware gating them.
+	// Likewise, plaintext lookups that find nothing may fall back on dh
+	// backends. Results are only cached, and absence only recorded in the
+	// negative filter, as they are aggregated.
+	if s.middlewares.tailorsResults() || config.Providers.ExpandExtended || (config.Server.DHFallback && !encrypted) || s.cache != nil || s.negative != nil {
+		return nil
+	}
+	var sole Backend
+	for _, b := range s.backendsFor(r.Context()) {
+		_, isDhBackend := b.(dhBackend)
+		_, isProvidersBackend := b.(providersBackend)
+		if (encrypted != isDhBackend) || isProvidersBackend {
+			continue
+		}
+		if !circuitReady(b, circuitFind) {
+			continue
+		}
+		if !b.Matches(r) {
+			continue
+		}
+		// Rate limited backends are only queried via scatter, which enforces
+		// the limit.
+		if sole != nil || rateLimited(b) {
+			return nil
+		}
+		sole = b
+	}
+	return sole
+}
+
+// proxyFind forwards a find request directly to the given backend, bypassing
+// the scatter/gather machinery and streaming the backend response back as-is.
+func (s *Server) proxyFind(w http.ResponseWriter, r *http.Request, b Backend, ndjson bool) {
+	start := time.Now()
+	latencyTags := []tag.Mutator{tag.Insert(metrics.Method, r.Method)}
+	loadTags := []tag.Mutator{tag.Insert(metrics.Method, findMethodOrig)}
+	defer func() {
+		_ = stats.RecordWithOptions(r.Context(),
+			stats.WithTags(latencyTags...),
+			stats.WithMeasurements(metrics.FindLatency.M(float64(time.Since(start).Milliseconds()))))
+		_ = stats.RecordWithOptions(r.Context(),
+			stats.WithTags(loadTags...),
+			stats.WithMeasurements(metrics.FindLoad.M(1)))
+	}()
+
+	sg := &scatterGather[Backend, any]{
+		maxWait:        config.Server.ResultMaxWait,
+		cascadeMaxWait: config.Server.CascadeMaxWait,
+		latency:        s.deadlines[routeFind],
+		pool:           s.scatterPool,
+		concurrency:    s.concurrency,
+	}
+	accept := MediaTypeJson
+	if ndjson {
+		sg.maxWait = config.Server.ResultStreamMaxWait
+		sg.cascadeMaxWait = config.Server.CascadeStreamMaxWait
+		sg.latency = s.deadlines[routeFindStream]
+		accept = MediaTypeNDJson
+	}
+	maxWait := sg.maxWaitFor(r.Context(), b)
+	ctx, cancel := context.WithTimeout(r.Context(), maxWait)
+	defer cancel()
+
+	req := r.Clone(ctx)
+	req.Header.Set("Accept", accept)
+
+	var status int
+	proxy := newBackendProxy(b)
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		status = resp.StatusCode
+		if ndjson && status != http.StatusOK {
+			// Respond with an empty stream like doFindNDJson, rather than
+			// with whatever error body the backend wrote.
+			_ = resp.Body.Close()
+			resp.Body = http.NoBody
+			resp.ContentLength = 0
+			resp.Header.Del("Content-Length")
+			resp.Header.Set("Content-Type", MediaTypeNDJson)
+			resp.Trailer = http.Header{streamStatusTrailer: {lookupErrCode(status)}}
+		}
+		return modifyResponse(resp)
+	}
+	proxyStart := time.Now()
+	proxy.ServeHTTP(w, req)
+	if status != 0 {
+		sg.observeLatency(r.Context(), b, time.Since(proxyStart), nil)
+	} else if err := ctx.Err(); err != nil {
+		sg.observeLatency(r.Context(), b, time.Since(proxyStart), err)
+	}
+
+	if status != http.StatusOK {
+		latencyTags = append(latencyTags, tag.Insert(metrics.Found, "no"))
+		return
+	}
+	latencyTags = append(latencyTags, tag.Insert(metrics.Found, "yes"))
+	yesno := func(yn bool) string {
+		if yn {
+			return "yes"
+		}
+		return "no"
+	}
+
+	_, isCaskade := b.(caskadeBackend)
+	latencyTags = append(latencyTags, tag.Insert(metrics.FoundCaskade, yesno(isCaskade)))
+	latencyTags = append(latencyTags, tag.Insert(metrics.FoundRegular, yesno(!isCaskade)))
+}
+
+// doFind scatters the given find request to backends along with the given
+// body, which is nil for requests without one, and returns the merged
+// response.
+func (s *Server) doFind(ctx context.Context, method, source string, reqURL *url.URL, body []byte, encrypted bool) (int, []byte) {
+	rcode, data, _ := s.doFindWithCacheStatus(ctx, method, source, reqURL, body, encrypted)
+	return rcode, data
+}
+
+// doFindWithCacheStatus is like doFind, and additionally returns whether the
+// response was served from the result cache.
+func (s *Server) doFindWithCacheStatus(ctx context.Context, method, source string, reqURL *url.URL, body []byte, encrypted bool) (int, []byte, cacheStatus) {
+	start := time.Now()
+	latencyTags := []tag.Mutator{tag.Insert(metrics.Method, method)}
+	loadTags := []tag.Mutator{tag.Insert(metrics.Method, source)}
+	defer func() {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(latencyTags...),
+			stats.WithMeasurements(metrics.FindLatency.M(float64(time.Since(start).Milliseconds()))))
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(loadTags...),
+			stats.WithMeasurements(metrics.FindLoad.M(1)))
+	}()
+
+	// Requests with a body are not keyed by their URL alone, so are never
+	// answered from the negative filter.
+	if body == nil && s.knownAbsent(ctx, source, reqURL, encrypted) {
+		latencyTags = append(latencyTags, tag.Insert(metrics.Found, "no"))
+		return http.StatusNotFound, nil, cacheStatus{}
+	}
+
+	// Results of requests scattered to backends chosen for them are not
+	// shared with other requests.
+	cache := s.resultCacheFor(ctx)
+	key := findCacheKey(method, reqURL, body)
+	var g *gatheredFind
+	var cached cacheStatus
+	if cache != nil && lowPriorityUnderLoad(ctx) {
+		// Serve low priority requests from cache for as long as any cached
+		// result would be served, without revalidating it.
+		maxAge := max(config.Cache.TTL+config.Cache.RevalidateWindow, config.Cache.StaleWindow)
+		if hit, age, ok := cache.get(key, maxAge); ok {
+			g, cached = hit, newCacheStatus(age)
+		}
+	}
+	if g == nil && cache != nil && config.Cache.TTL > 0 {
+		if hit, age, ok := cache.get(key, config.Cache.TTL+config.Cache.RevalidateWindow); ok {
+			g, cached = hit, newCacheStatus(age)
+			if age > config.Cache.TTL && cache.startRevalidating(key) {
+				go s.revalidate(context.WithoutCancel(ctx), method, key, reqURL, body, encrypted)
+			}
+		}
+	}
+	if g == nil {
+		var err error
+		g, err = s.gatherFind(ctx, method, reqURL, body, encrypted)
+		if err != nil {
+			log.Warnw("Failed to find", "err", err)
+			return http.StatusInternalServerError, nil, cacheStatus{}
+		}
+		if clientGone(ctx) {
+			// Results gathered once the client went away are partial, so
+			// are neither cached nor responded with.
+			log.Debugw("Client went away before find completed", "q", reqURL)
+			return statusClientClosedRequest, nil, cacheStatus{}
+		}
+		if cache != nil {
+			cached = cacheStatus{status: cacheMiss}
+			if g.found() {
+				cache.put(key, g)
+			} else if g.allFailed && config.Cache.StaleWindow > 0 {
+				if stale, staleAge, ok := cache.get(key, config.Cache.StaleWindow); ok {
+					log.Infow("Serving stale response since all backends failed", "q", reqURL, "age", staleAge)
+					g, cached = stale, cacheStatus{status: cacheStale, age: staleAge}
+				}
+			}
+		}
+	}
+
+	resp := g.resp
+	if len(resp.MultihashResults) > 0 {
+		prs := s.withExtended(ctx, resp.MultihashResults[0].ProviderResults)
+		resp.MultihashResults[0].ProviderResults = s.middlewares.afterAggregation(ctx, prs)
+		if len(resp.MultihashResults[0].ProviderResults) == 0 {
+			resp.MultihashResults = nil
+		}
+	}
+
+	if len(resp.MultihashResults) == 0 && len(resp.EncryptedMultihashResults) == 0 {
+		latencyTags = append(latencyTags, tag.Insert(metrics.Found, "no"))
+		return http.StatusNotFound, nil, cacheStatus{}
+	}
+
+	latencyTags = append(latencyTags, tag.Insert(metrics.Found, "yes"))
+	yesno := func(yn bool) string {
+		if yn {
+			return "yes"
+		}
+		return "no"
+	}
+
+	latencyTags = append(latencyTags, tag.Insert(metrics.FoundCaskade, yesno(g.foundCaskade)))
+	latencyTags = append(latencyTags, tag.Insert(metrics.FoundRegular, yesno(g.foundRegular)))
+
+	var rs resultStats
+	rs.observeFindResponse(&resp)
+	rs.reportMetrics(ctx, source)
+
+	// write out combined.
+	outData, err := model.MarshalFindResponse(&resp)
+	if err != nil {
+		log.Warnw("failed marshal response", "err", err)
+		return http.StatusInternalServerError, nil, cacheStatus{}
+	}
+	return http.StatusOK, outData, cached
+}
+
+// resultCacheFor returns the result cache of find requests with the given
+// context, or nil if their results must not be cached.
+func (s *Server) resultCacheFor(ctx context.Context) *resultCache {
+	if narrowedBackends(ctx) {
+		return nil
+	}
+	return s.cache
+}
+
+// findCacheKey returns the key of the given find request in the result cache.
+func findCacheKey(method string, reqURL *url.URL, body []byte) string {
+	key := reqURL.Path + "?" + reqURL.RawQuery
+	if body != nil {
+		key = method + " " + key + "\n" + string(body)
+	}
+	return key
+}
+
+// revalidate refreshes the cached result of the given find request in the
+// background.
+func (s *Server) revalidate(ctx context.Context, method, key string, reqURL *url.URL, body []byte, encrypted bool) {
+	defer s.cache.stopRevalidating(key)
+	g, err := s.gatherFind(ctx, method, reqURL, body, encrypted)
+	switch {
+	case err != nil:
+		log.Warnw("Failed to revalidate cached find result", "q", reqURL, "err", err)
+	case g.found():
+		s.cache.put(key, g)
+	case !g.allFailed:
+		// The result is gone from every backend that responded.
+		s.cache.remove(key)
+	}
+}
+
+// queryFindBackend sends the given find request to the given backend along
+// with the given body, if any, and records its outcome. The request is
+// conditional if cond has a validator for the backend. It returns nil if the
+// backend is not queried for the request or does not know the multihash.
+func (s *Server) queryFindBackend(ctx context.Context, b Backend, method string, reqURL *url.URL, body []byte, encrypted bool, cond *conditionalFind, outcomes *backendOutcomes) (*model.FindResponse, error) {
+	// forward double hashed requests to double hashed backends only and regular requests to regular backends
+	_, isDhBackend := b.(dhBackend)
+	_, isProvidersBackend := b.(providersBackend)
+	if (encrypted != isDhBackend) || isProvidersBackend {
+		return nil, nil
+	}
+
+	// Copy the URL from original request and override host/schema to point
+	// to the server.
+	endpoint := *reqURL
+	endpoint.Host = b.URL().Host
+	endpoint.Scheme = b.URL().Scheme
+	log := log.With("backend", endpoint.Host)
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), reqBody)
+	if err != nil {
+		log.Warnw("Failed to construct backend query", "err", err)
+		return nil, err
+	}
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("Accept", MediaTypeJson)
+	if body != nil {
+		req.Header.Set("Content-Type", MediaTypeJson)
+	}
+	prev, conditional := cond.validatorFor(b)
+	if conditional {
+		req.Header.Set("If-None-Match", prev.etag)
+	}
+	s.middlewares.decorateBackendRequest(req, b)
+
+	if !b.Matches(req) {
+		outcomes.skipped.Add(1)
+		return nil, nil
+	}
+	if !admitCascade(ctx, b) {
+		outcomes.suppressed.Add(1)
+		return nil, nil
+	}
+
+	resp, err := b.Client().Do(req)
+	if err != nil {
+		outcomes.fail(ctx)
+		recordBackendFailure(ctx, b.URL().Host, requestErrKind(err, false))
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			log.Debugw("Backend query ended", "err", err)
+		} else {
+			log.Warnw("Failed to query backend", "err", err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	status, etag := resp.StatusCode, resp.Header.Get("ETag")
+	respBody := &readErrReader{r: resp.Body}
+	if status == http.StatusNotModified && conditional {
+		log.Debug("Backend response not modified")
+		status, respBody.r = http.StatusOK, bytes.NewReader(prev.data)
+		if etag == "" {
+			etag = prev.etag
+		}
+	}
+
+	switch status {
+	case http.StatusOK:
+		// Only responses retained for conditional revalidation are kept
+		// raw, since responses are otherwise decoded as they are read.
+		var raw *bytes.Buffer
+		if cond != nil && etag != "" {
+			raw = getBuffer()
+			defer putBuffer(raw)
+			respBody.r = io.TeeReader(respBody.r, raw)
+		}
+		providers, err := decodeFindResponse(respBody)
+		if err != nil {
+			outcomes.fail(ctx)
+			if respBody.err == nil {
+				recordBackendFailure(ctx, b.URL().Host, errKindDecode)
+				return nil, circuitbreaker.MarkAsSuccess(err)
+			}
+			recordBackendFailure(ctx, b.URL().Host, requestErrKind(respBody.err, true))
+			if errors.Is(respBody.err, context.Canceled) || errors.Is(respBody.err, context.DeadlineExceeded) {
+				log.Debugw("Reading backend response ended", "err", respBody.err)
+			} else {
+				log.Warnw("Failed to read backend response", "err", respBody.err)
+			}
+			return nil, respBody.err
+		}
+		outcomes.responded.Add(1)
+		if raw != nil {
+			cond.observe(b, etag, raw.Bytes())
+		}
+		return providers, nil
+	case http.StatusNotFound:
+		outcomes.notFound.Add(1)
+		return nil, nil
+	default:
+		outcomes.failed.Add(1)
+		recordBackendFailure(ctx, b.URL().Host, statusErrKind(resp.StatusCode))
+		buf := getBuffer()
+		defer putBuffer(buf)
+		_, _ = buf.ReadFrom(respBody)
+		log := log.With("status", resp.StatusCode, "body", buf.String())
+		log.Warn("Request processing was not successful")
+		err := fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
+		if resp.StatusCode < http.StatusInternalServerError {
+			err = circuitbreaker.MarkAsSuccess(err)
+		}
+		return nil, err
+	}
+}
+
+// readErrReader records the error of reading from the wrapped reader, so that
+// failing to read a response can be told apart from a malformed response.
+type readErrReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// gatheredFind is the result of a find request merged across backends, before
+// middleware is applied.
+type gatheredFind struct {
+	resp         model.FindResponse
+	foundRegular bool
+	foundCaskade bool
+	// allFailed is whether every backend that would have served the request
+	// failed.
+	allFailed bool
+	// validators are the backend responses to retain for conditional
+	// revalidation.
+	validators map[string]backendValidator
+}
+
+func (g *gatheredFind) found() bool {
+	return len(g.resp.MultihashResults) > 0 || len(g.resp.EncryptedMultihashResults) > 0
+}
+
+// gatherFind scatters the given find request to backends along with the given
+// body, if any, and merges their responses.
+func (s *Server) gatherFind(ctx context.Context, method string, reqURL *url.URL, body []byte, encrypted bool) (*gatheredFind, error) {
+	// sgResponse is a struct that exists to capture the backend that the response has been received from
+	type sgResponse struct {
+		rsp  *model.FindResponse
+		bknd Backend
+	}
+
+	sg := &scatterGather[Backend, sgResponse]{
+		backends:       s.findBackendsFor(ctx, reqURL),
+		maxWait:        config.Server.ResultMaxWait,
+		cascadeMaxWait: config.Server.CascadeMaxWait,
+		latency:        s.deadlines[routeFind],
+		pool:           s.scatterPool,
+		concurrency:    s.concurrency,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var cond *conditionalFind
+	if cache := s.resultCacheFor(ctx); cache != nil {
+		cond = newConditionalFind(cache.validators(findCacheKey(method, reqURL, body)))
+	}
+	var outcomes backendOutcomes
+	if err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*sgResponse, error) {
+		rsp, err := s.queryFindBackend(cctx, b, method, reqURL, body, encrypted, cond, &outcomes)
+		if rsp == nil {
+			return nil, err
+		}
+		return &sgResponse{bknd: b, rsp: rsp}, nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to scatter HTTP find request: %w", err)
+	}
+
+	// TODO: stream out partial response as they come in.
+	var resp model.FindResponse
+	var foundRegular, foundCaskade bool
+	updateFoundFlags := func(b Backend) {
+		_, isCaskade := b.(caskadeBackend)
+		foundCaskade = foundCaskade || isCaskade
+		foundRegular = foundRegular || !isCaskade
+	}
+
+	// Records are merged by value key, as indexers respond with one record per
+	// provider and context.
+	seen := newDedupSet(config.Server.MaxDedupEntries, byValueKey)
+	merge := func(r sgResponse) error {
+		merged, err := mergeFindResponse(&resp, r.rsp, seen)
+		if err != nil {
+			// weird / invalid.
+			return fmt.Errorf("failed to merge results for %s: %w", reqURL, err)
+		}
+		if merged {
+			updateFoundFlags(r.bknd)
+		}
+		return nil
+	}
+	// Since the response is not streamed, records are ordered by quality
+	// rather than arrival: those of cascade backends are merged after those
+	// of every other backend, and extended providers are appended after both
+	// by withExtended. This way records of indexers win deduplication, and
+	// are the ones kept when middleware truncates the response.
+	var cascaded []sgResponse
+	for r := range sg.gather(ctx) {
+		if _, isCaskade := r.bknd.(caskadeBackend); isCaskade {
+			cascaded = append(cascaded, r)
+			continue
+		}
+		if err := merge(r); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range cascaded {
+		if err := merge(r); err != nil {
+			return nil, err
+		}
+	}
+
+	sg.settle(ctx)
+	outcomes.record(ctx, sg.circuitOpen, sg.concurrencyLimited, encrypted)
+	if body == nil && len(resp.MultihashResults) == 0 && len(resp.EncryptedMultihashResults) == 0 {
+		if mh, ok := s.dhFallbackMultihash(ctx, reqURL, encrypted); ok {
+			if prs := s.findDoubleHashed(ctx, mh); len(prs) > 0 {
+				resp.MultihashResults = []model.MultihashResult{{Multihash: mh, ProviderResults: prs}}
+				foundRegular = true
+			}
+		}
+	}
+	if body == nil && len(resp.MultihashResults) == 0 && len(resp.EncryptedMultihashResults) == 0 && outcomes.confirmedAbsent(sg.circuitOpen, sg.concurrencyLimited, encrypted) {
+		s.noteAbsent(ctx, reqURL, encrypted)
+	}
+	return &gatheredFind{
+		resp:         resp,
+		foundRegular: foundRegular,
+		foundCaskade: foundCaskade,
+		allFailed:    outcomes.allFailed(sg.circuitOpen, encrypted),
+		validators:   cond.validators(),
+	}, nil
+}
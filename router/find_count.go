@@ -0,0 +1,115 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/metadata"
+)
+
+// countPathSuffix is appended to the path of a find request to ask for the
+// number of providers rather than their records.
+const countPathSuffix = "/count"
+
+// providerCount is the response to a provider count request.
+type providerCount struct {
+	// Providers is the number of distinct providers of the multihash.
+	Providers int
+	// Transports is the number of distinct providers by the transports they
+	// serve the multihash over. Providers serving over several transports
+	// are counted once per transport.
+	Transports map[string]int
+	// Encrypted is the number of encrypted value keys, which are counted
+	// instead of providers for encrypted lookups.
+	Encrypted int `json:",omitempty"`
+}
+
+// isCountRequest checks whether the given find request asks for the number of
+// providers rather than their records.
+func isCountRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, countPathSuffix) || r.URL.Query().Get("count") == "true"
+}
+
+// findCount responds with the number of distinct providers of a multihash,
+// after results are aggregated across backends, deduplicated and passed
+// through middleware, for dashboards and availability metrics that do not
+// need provider records.
+func (s *Server) findCount(w http.ResponseWriter, r *http.Request, encrypted bool) {
+	// Backends are asked for the lookup as is, without the count suffix or
+	// parameter.
+	reqURL := *r.URL
+	reqURL.Path = strings.TrimSuffix(reqURL.Path, countPathSuffix)
+	reqURL.RawPath = ""
+	query := reqURL.Query()
+	query.Del("count")
+	reqURL.RawQuery = query.Encode()
+
+	rcode, data, cached := s.doFindWithCacheStatus(r.Context(), http.MethodGet, findMethodOrig, &reqURL, nil, encrypted)
+	if rcode != http.StatusOK {
+		lookupError(w, rcode)
+		return
+	}
+	resp, err := model.UnmarshalFindResponse(data)
+	if err != nil {
+		log.Warnw("Failed to unmarshal find response", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	count := countFindResponse(resp)
+	outData, err := json.Marshal(count)
+	if err != nil {
+		log.Warnw("Failed to marshal provider count", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	s.cache.served(cached)
+	cached.setHeaders(w)
+	writeJsonResponse(w, http.StatusOK, outData)
+}
+
+// countFindResponse counts the distinct providers in the given find response.
+func countFindResponse(resp *model.FindResponse) providerCount {
+	count := providerCount{Transports: make(map[string]int)}
+	transports := make(map[string]map[string]struct{})
+	for _, mhr := range resp.MultihashResults {
+		for _, pr := range mhr.ProviderResults {
+			if pr.Provider == nil {
+				continue
+			}
+			id := pr.Provider.ID.String()
+			if _, seen := transports[id]; !seen {
+				transports[id] = make(map[string]struct{})
+				count.Providers++
+			}
+			for _, transport := range transportsOf(pr.Metadata) {
+				if _, seen := transports[id][transport]; !seen {
+					transports[id][transport] = struct{}{}
+					count.Transports[transport]++
+				}
+			}
+		}
+	}
+	for _, emr := range resp.EncryptedMultihashResults {
+		count.Encrypted += len(emr.EncryptedValueKeys)
+	}
+	return count
+}
+
+// transportsOf returns the names of the transports in the given metadata.
+// Transports that are not known are named unknown.
+func transportsOf(md []byte) []string {
+	var transports []string
+	m := metadata.Default.New()
+	if err := m.UnmarshalBinary(md); err != nil && strings.HasPrefix(err.Error(), "unknown transport id") {
+		transports = append(transports, "unknown")
+	}
+	// Unmarshalling may have partially populated the metadata with known
+	// transports even if it failed.
+	for _, p := range m.Protocols() {
+		transports = append(transports, p.String())
+	}
+	return transports
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind_CountsDistinctProviders(t *testing.T) {
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	mh := cid.MustParse(mockbackend.SampleCids[0]).Hash().B58String()
+	for _, target := range []string{
+		"/cid/" + mockbackend.SampleCids[0] + "/count",
+		"/multihash/" + mh + "?count=true",
+	} {
+		rec := find(target)
+		require.Equal(t, http.StatusOK, rec.Code, target)
+		var got providerCount
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		// Results of both backends are deduplicated.
+		require.Equal(t, providerCount{
+			Providers: 2,
+			Transports: map[string]int{
+				multicodec.TransportBitswap.String():         1,
+				multicodec.TransportIpfsGatewayHttp.String(): 1,
+			},
+		}, got, target)
+	}
+
+	absent, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, find("/multihash/"+absent.B58String()+"/count").Code)
+	require.Equal(t, http.StatusBadRequest, find("/multihash/"+mh+","+mh+"/count").Code)
+}
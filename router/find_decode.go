@@ -0,0 +1,158 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipni/go-libipni/find/model"
+)
+
+// decodeFindResponse decodes a find response from the given reader as it is
+// read, one provider result or encrypted value key at a time, so that the raw
+// response is never held in memory in full alongside the decoded one. It
+// decodes the same responses as model.UnmarshalFindResponse, except that
+// anything following the response is ignored.
+func decodeFindResponse(r io.Reader) (*model.FindResponse, error) {
+	dec := json.NewDecoder(r)
+	var resp model.FindResponse
+	err := decodeObject(dec, func(key string) error {
+		switch {
+		case strings.EqualFold(key, "MultihashResults"):
+			resp.MultihashResults = nil
+			return decodeArray(dec, func() error {
+				var mhr model.MultihashResult
+				if err := decodeObject(dec, func(key string) error {
+					switch {
+					case strings.EqualFold(key, "Multihash"):
+						return dec.Decode(&mhr.Multihash)
+					case strings.EqualFold(key, "ProviderResults"):
+						mhr.ProviderResults = nil
+						return decodeArray(dec, func() error {
+							var pr model.ProviderResult
+							if err := dec.Decode(&pr); err != nil {
+								return err
+							}
+							mhr.ProviderResults = append(mhr.ProviderResults, pr)
+							return nil
+						})
+					default:
+						return skipValue(dec)
+					}
+				}); err != nil {
+					return err
+				}
+				resp.MultihashResults = append(resp.MultihashResults, mhr)
+				return nil
+			})
+		case strings.EqualFold(key, "EncryptedMultihashResults"):
+			resp.EncryptedMultihashResults = nil
+			return decodeArray(dec, func() error {
+				var emr model.EncryptedMultihashResult
+				if err := decodeObject(dec, func(key string) error {
+					switch {
+					case strings.EqualFold(key, "Multihash"):
+						return dec.Decode(&emr.Multihash)
+					case strings.EqualFold(key, "EncryptedValueKeys"):
+						emr.EncryptedValueKeys = nil
+						return decodeArray(dec, func() error {
+							var evk []byte
+							if err := dec.Decode(&evk); err != nil {
+								return err
+							}
+							emr.EncryptedValueKeys = append(emr.EncryptedValueKeys, evk)
+							return nil
+						})
+					default:
+						return skipValue(dec)
+					}
+				}); err != nil {
+					return err
+				}
+				resp.EncryptedMultihashResults = append(resp.EncryptedMultihashResults, emr)
+				return nil
+			})
+		default:
+			return skipValue(dec)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// decodeObject decodes the JSON object at the position of the given decoder
+// by calling decodeField with each of its keys, which must decode the value of
+// the key. A null object has no keys.
+func decodeObject(dec *json.Decoder, decodeField func(key string) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return noEOF(err)
+	}
+	switch tok {
+	case nil:
+		return nil
+	case json.Delim('{'):
+	default:
+		return fmt.Errorf("expected JSON object, got %v", tok)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return noEOF(err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("expected JSON object key, got %v", tok)
+		}
+		if err := decodeField(key); err != nil {
+			return noEOF(err)
+		}
+	}
+	// Consume the closing delimiter.
+	_, err = dec.Token()
+	return noEOF(err)
+}
+
+// decodeArray decodes the JSON array at the position of the given decoder by
+// calling decodeElem once per element, which must decode the element. A null
+// array has no elements.
+func decodeArray(dec *json.Decoder, decodeElem func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return noEOF(err)
+	}
+	switch tok {
+	case nil:
+		return nil
+	case json.Delim('['):
+	default:
+		return fmt.Errorf("expected JSON array, got %v", tok)
+	}
+	for dec.More() {
+		if err := decodeElem(); err != nil {
+			return noEOF(err)
+		}
+	}
+	// Consume the closing delimiter.
+	_, err = dec.Token()
+	return noEOF(err)
+}
+
+// skipValue consumes the JSON value at the position of the given decoder.
+func skipValue(dec *json.Decoder) error {
+	var skipped json.RawMessage
+	return dec.Decode(&skipped)
+}
+
+// noEOF reports a response that ends prematurely as io.ErrUnexpectedEOF
+// rather than io.EOF, which the decoder returns when the response ends
+// between tokens.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package router
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeFindResponse_MatchesUnmarshal(t *testing.T) {
+	for _, body := range []string{
+		`{}`,
+		`{"MultihashResults":null,"EncryptedMultihashResults":null}`,
+		`{"MultihashResults":[{"Multihash":"EiDMhfIPfNfDJ2cCaB6QyPU5UPsHQuXMoXdkm4iv1OypVA==","ProviderResults":[` +
+			`{"ContextID":"ZmlzaA==","Metadata":"gBI=","Provider":{"ID":"12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h","Addrs":["/ip4/127.0.0.1/tcp/4001"]}},` +
+			`{"ContextID":"bG9ic3Rlcg==","Provider":{"ID":"12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h","Addrs":[]},"Unknown":[1,{"a":2}]}]}]}`,
+		`{"multihashresults":[{"multihash":"EiDMhfIPfNfDJ2cCaB6QyPU5UPsHQuXMoXdkm4iv1OypVA==","providerResults":null}],"Signature":"ZmlzaA=="}`,
+		`{"EncryptedMultihashResults":[{"Multihash":"EiDMhfIPfNfDJ2cCaB6QyPU5UPsHQuXMoXdkm4iv1OypVA==","EncryptedValueKeys":["ZmlzaA==","bG9ic3Rlcg=="]}]}`,
+	} {
+		want, err := model.UnmarshalFindResponse([]byte(body))
+		require.NoError(t, err)
+		got, err := decodeFindResponse(strings.NewReader(body))
+		require.NoError(t, err, body)
+		require.Equal(t, want, got, body)
+	}
+}
+
+func TestDecodeFindResponse_RejectsMalformed(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"MultihashResults":{}}`,
+		`{"MultihashResults":[{"ProviderResults":[{}`,
+		`{"MultihashResults":[{"Multihash":42}]}`,
+	} {
+		_, err := decodeFindResponse(strings.NewReader(body))
+		require.Error(t, err, body)
+	}
+}
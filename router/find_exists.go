@@ -0,0 +1,126 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// providerCountHeader is set on responses to existence-only lookups to the
+// number of providers known for the multihash by the backend that first
+// responded with any.
+const providerCountHeader = "X-IPNI-Provider-Count"
+
+// isExistsRequest checks whether the given find request only asks whether the
+// multihash is known, rather than for its providers.
+func isExistsRequest(r *http.Request) bool {
+	return r.Method == http.MethodHead || r.URL.Query().Get("exists") == "true"
+}
+
+// findExists responds to an existence-only lookup with 200 OK as soon as any
+// backend knows the multihash, or 404 Not Found once none do. The response has
+// no body, so that gateways can cheaply check availability without
+// transferring provider lists.
+func (s *Server) findExists(w http.ResponseWriter, r *http.Request, encrypted bool) {
+	start := time.Now()
+	latencyTags := []tag.Mutator{tag.Insert(metrics.Method, r.Method)}
+	loadTags := []tag.Mutator{tag.Insert(metrics.Method, findMethodOrig)}
+	defer func() {
+		_ = stats.RecordWithOptions(r.Context(),
+			stats.WithTags(latencyTags...),
+			stats.WithMeasurements(metrics.FindLatency.M(float64(time.Since(start).Milliseconds()))))
+		_ = stats.RecordWithOptions(r.Context(),
+			stats.WithTags(loadTags...),
+			stats.WithMeasurements(metrics.FindLoad.M(1)))
+	}()
+	var cached cacheStatus
+	respond := func(count int) {
+		found := "no"
+		status := http.StatusNotFound
+		if count > 0 {
+			found = "yes"
+			status = http.StatusOK
+		}
+		latencyTags = append(latencyTags, tag.Insert(metrics.Found, found))
+		w.Header().Set(providerCountHeader, strconv.Itoa(count))
+		s.cache.served(cached)
+		cached.setHeaders(w)
+		w.WriteHeader(status)
+	}
+
+	// Backends are asked for the lookup as is, without the exists parameter.
+	reqURL := *r.URL
+	query := reqURL.Query()
+	query.Del("exists")
+	reqURL.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if s.knownAbsent(ctx, findMethodOrig, &reqURL, encrypted) {
+		respond(0)
+		return
+	}
+	cache := s.resultCacheFor(ctx)
+	if cache != nil && config.Cache.TTL > 0 {
+		if g, age, ok := cache.get(findCacheKey(http.MethodGet, &reqURL, nil), config.Cache.TTL); ok {
+			cached = newCacheStatus(age)
+			respond(s.countProviders(ctx, &g.resp))
+			return
+		}
+	}
+	if cache != nil {
+		cached.status = cacheMiss
+	}
+
+	sg := &scatterGather[Backend, model.FindResponse]{
+		backends:       s.findBackendsFor(ctx, &reqURL),
+		maxWait:        config.Server.ResultMaxWait,
+		cascadeMaxWait: config.Server.CascadeMaxWait,
+		latency:        s.deadlines[routeFind],
+		pool:           s.scatterPool,
+		concurrency:    s.concurrency,
+	}
+	var outcomes backendOutcomes
+	if err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*model.FindResponse, error) {
+		return s.queryFindBackend(cctx, b, http.MethodGet, &reqURL, nil, encrypted, nil, &outcomes)
+	}); err != nil {
+		log.Warnw("Failed to scatter HTTP find request", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	for resp := range sg.gather(ctx) {
+		// Stop at the first backend that knows the multihash, which cancels
+		// queries to the others.
+		if count := s.countProviders(ctx, &resp); count > 0 {
+			respond(count)
+			return
+		}
+	}
+
+	sg.settle(ctx)
+	outcomes.record(ctx, sg.circuitOpen, sg.concurrencyLimited, encrypted)
+	if outcomes.confirmedAbsent(sg.circuitOpen, sg.concurrencyLimited, encrypted) {
+		s.noteAbsent(ctx, &reqURL, encrypted)
+	}
+	respond(0)
+}
+
+// countProviders returns the number of providers in the given find response
+// that pass middleware.
+func (s *Server) countProviders(ctx context.Context, resp *model.FindResponse) int {
+	var count int
+	for _, mhr := range resp.MultihashResults {
+		providers := append([]model.ProviderResult(nil), mhr.ProviderResults...)
+		count += len(s.middlewares.afterAggregation(ctx, s.withExtended(ctx, providers)))
+	}
+	for _, emr := range resp.EncryptedMultihashResults {
+		count += len(emr.EncryptedValueKeys)
+	}
+	return count
+}
@@ -0,0 +1,60 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind_ExistsStopsAtFirstBackendHit(t *testing.T) {
+	mock := mockbackend.NewWithSampleData()
+	fast := httptest.NewServer(mock)
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/providers") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: fast.URL},
+			{URL: slow.URL},
+			{URL: fast.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	start := time.Now()
+	rec := find(http.MethodHead, "/cid/"+mockbackend.SampleCids[0])
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "2", rec.Header().Get(providerCountHeader))
+
+	rec = find(http.MethodGet, "/cid/"+mockbackend.SampleCids[1]+"?exists=true")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "1", rec.Header().Get(providerCountHeader))
+	require.Empty(t, rec.Body.String())
+
+	absent, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	rec = find(http.MethodHead, "/multihash/"+absent.B58String())
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, "0", rec.Header().Get(providerCountHeader))
+}
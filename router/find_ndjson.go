@@ -0,0 +1,701 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/ipni/indexstar/metrics"
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+type (
+	encryptedOrPlainResult struct {
+		model.ProviderResult
+		EncryptedValueKey []byte `json:"EncryptedValueKey,omitempty"`
+	}
+	resultStats struct {
+		encCount                int64
+		bitswapTransportCount   int64
+		graphsyncTransportCount int64
+		unknwonTransportCount   int64
+	}
+	// backendOutcomes tallies how each backend scattered to by a find request
+	// fared. A backend that responded with 200 counts as responded even if
+	// streaming its results fails part way.
+	backendOutcomes struct {
+		responded atomic.Int32
+		notFound  atomic.Int32
+		failed    atomic.Int32
+		skipped   atomic.Int32
+		// suppressed counts cascade backends not queried since their rate
+		// limit was exceeded.
+		suppressed atomic.Int32
+		// gone counts backend requests canceled since the client went away,
+		// which are not failures of the backends.
+		gone atomic.Int32
+	}
+)
+
+func (rs *resultStats) observeResult(result *encryptedOrPlainResult) {
+	if len(result.EncryptedValueKey) > 0 {
+		rs.encCount++
+	} else {
+		rs.observeProviderResult(&result.ProviderResult)
+	}
+}
+
+func (rs *resultStats) observeProviderResult(result *model.ProviderResult) {
+	md := metadata.Default.New()
+	if err := md.UnmarshalBinary(result.Metadata); err != nil {
+		// TODO Refactor once there is concrete error type in index-provider
+		if strings.HasPrefix(err.Error(), "unknown transport id") {
+			// There is at least one unknown transport protocol
+			rs.unknwonTransportCount++
+		}
+		// Proceed with checking md, as unmarshal binary may have partially
+		// populated md with known transports
+	}
+	for _, p := range md.Protocols() {
+		switch p {
+		case multicodec.TransportBitswap:
+			rs.bitswapTransportCount++
+		case multicodec.TransportGraphsyncFilecoinv1:
+			rs.graphsyncTransportCount++
+		default:
+			// In case new protocols are added to metadata.Default context and this
+			// switch is not updated count them as unknown.
+			rs.unknwonTransportCount++
+		}
+	}
+}
+
+func (rs *resultStats) observeFindResponse(resp *model.FindResponse) {
+	for _, emr := range resp.EncryptedMultihashResults {
+		rs.encCount += int64(len(emr.EncryptedValueKeys))
+	}
+	for _, mhr := range resp.MultihashResults {
+		for _, pr := range mhr.ProviderResults {
+			rs.observeProviderResult(&pr)
+		}
+	}
+}
+
+func (rs *resultStats) reportMetrics(ctx context.Context, method string) {
+	mt := tag.Insert(metrics.Method, method)
+	if rs.bitswapTransportCount > 0 {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(mt, tag.Insert(metrics.Transport, multicodec.TransportBitswap.String())),
+			stats.WithMeasurements(metrics.FindResponse.M(rs.bitswapTransportCount)))
+	}
+	if rs.graphsyncTransportCount > 0 {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(mt, tag.Insert(metrics.Transport, multicodec.TransportGraphsyncFilecoinv1.String())),
+			stats.WithMeasurements(metrics.FindResponse.M(rs.graphsyncTransportCount)))
+	}
+	if rs.unknwonTransportCount > 0 {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(mt, tag.Insert(metrics.Transport, "unknown")),
+			stats.WithMeasurements(metrics.FindResponse.M(rs.unknwonTransportCount)))
+	}
+	if rs.encCount > 0 {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(mt, tag.Insert(metrics.Transport, "encrypted")),
+			stats.WithMeasurements(metrics.FindResponse.M(rs.encCount)))
+	}
+}
+
+// afterAggregation expands a streamed result with the records of extended
+// providers not in the given set, passes them through middleware and returns
+// the results to write in its place. Encrypted results are returned as is.
+func (s *Server) afterAggregation(ctx context.Context, r *encryptedOrPlainResult, seen *resultSet) []*encryptedOrPlainResult {
+	if len(r.EncryptedValueKey) > 0 || (len(s.middlewares) == 0 && !config.Providers.ExpandExtended) {
+		return []*encryptedOrPlainResult{r}
+	}
+	prs := s.expandExtended(ctx, []model.ProviderResult{r.ProviderResult}, seen)
+	prs = s.middlewares.afterAggregation(ctx, prs)
+	results := make([]*encryptedOrPlainResult, 0, len(prs))
+	for i := range prs {
+		results = append(results, &encryptedOrPlainResult{ProviderResult: prs[i]})
+	}
+	return results
+}
+
+// doFindNDJson scatters the given find request to backends and streams the
+// results as NDJSON, or responds with them as JSON once gathered if
+// translateNonStreaming is set. Provider records are annotated with their
+// provenance if withProvenance is set.
+func (s *Server) doFindNDJson(ctx context.Context, w http.ResponseWriter, source string, reqURL *url.URL, translateNonStreaming bool, mh multihash.Multihash, encrypted, withProvenance bool) {
+	start := time.Now()
+	latencyTags := []tag.Mutator{tag.Insert(metrics.Method, http.MethodGet)}
+	loadTags := []tag.Mutator{tag.Insert(metrics.Method, source)}
+	defer func() {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(latencyTags...),
+			stats.WithMeasurements(metrics.FindLatency.M(float64(time.Since(start).Milliseconds()))))
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(loadTags...),
+			stats.WithMeasurements(metrics.FindLoad.M(1)))
+	}()
+
+	if s.knownAbsent(ctx, source, reqURL, encrypted) {
+		latencyTags = append(latencyTags, tag.Insert(metrics.Found, "no"))
+		streamError(w, !translateNonStreaming, http.StatusNotFound)
+		return
+	}
+
+	sg := &scatterGather[Backend, any]{
+		backends:    s.findBackendsFor(ctx, reqURL),
+		pool:        s.scatterPool,
+		concurrency: s.concurrency,
+	}
+	if translateNonStreaming {
+		sg.maxWait = config.Server.ResultMaxWait
+		sg.cascadeMaxWait = config.Server.CascadeMaxWait
+		sg.latency = s.deadlines[routeFind]
+	} else {
+		sg.maxWait = config.Server.ResultStreamMaxWait
+		sg.cascadeMaxWait = config.Server.CascadeStreamMaxWait
+		sg.latency = s.deadlines[routeFindStream]
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type resultWithBackend struct {
+		rslt *encryptedOrPlainResult
+		bknd Backend
+	}
+
+	resultsChan := make(chan *resultWithBackend, 1)
+	var outcomes backendOutcomes
+	if err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*any, error) {
+		// forward double hashed requests to double hashed backends only and regular requests to regular backends
+		_, isDhBackend := b.(dhBackend)
+		_, isProvidersBackend := b.(providersBackend)
+		if (encrypted != isDhBackend) || isProvidersBackend {
+			return nil, nil
+		}
+
+		return nil, s.queryNDJsonBackend(cctx, b, reqURL, &outcomes, func(result *encryptedOrPlainResult) bool {
+			select {
+			case <-cctx.Done():
+				return false
+			case resultsChan <- &resultWithBackend{rslt: result, bknd: b}:
+				return true
+			}
+		})
+	}); err != nil {
+		log.Errorw("Failed to scatter HTTP find request", "err", err)
+		streamError(w, !translateNonStreaming, http.StatusInternalServerError)
+		return
+	}
+
+	var provResults []model.ProviderResult
+	var encValKeys [][]byte
+	if translateNonStreaming {
+		w.Header().Set("Content-Type", MediaTypeJson)
+	} else {
+		w.Header().Set("Content-Type", MediaTypeNDJson)
+		w.Header().Set("Connection", "Keep-Alive")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+
+	encoder := json.NewEncoder(w)
+	stream := newNDJsonWriter(w)
+	defer stream.close()
+	results := newResultSet(config.Server.MaxDedupEntries)
+	var prov *provenanceTracker
+	if withProvenance && translateNonStreaming && !encrypted {
+		prov = newProvenanceTracker()
+	}
+
+	// Results chan is done when gathering is finished.
+	// Do this in a separate goroutine to avoid potentially closing results chan twice.
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-sg.gather(ctx):
+				if !ok {
+					close(resultsChan)
+					return
+				}
+			}
+		}
+	}()
+
+	var rs resultStats
+	var foundCaskade, foundRegular bool
+	var written int
+LOOP:
+	for {
+		select {
+		case <-ctx.Done():
+			break LOOP
+		case rwb, ok := <-resultsChan:
+			if !ok {
+				break LOOP
+			}
+			absent := results.putIfAbsent(rwb.rslt)
+			if !absent {
+				if prov != nil {
+					prov.returnedAgain(rwb.rslt, rwb.bknd)
+				}
+				continue
+			}
+
+			for _, result := range s.afterAggregation(ctx, rwb.rslt, results) {
+				written++
+				rs.observeResult(result)
+
+				_, isCaskade := rwb.bknd.(caskadeBackend)
+				foundCaskade = foundCaskade || isCaskade
+				foundRegular = foundRegular || !isCaskade
+
+				if translateNonStreaming {
+					if len(result.EncryptedValueKey) > 0 {
+						encValKeys = append(encValKeys, result.EncryptedValueKey)
+					} else {
+						provResults = append(provResults, result.ProviderResult)
+						if prov != nil {
+							prov.add(rwb.rslt, rwb.bknd)
+						}
+					}
+				} else {
+					var record any = result
+					if withProvenance && len(result.EncryptedValueKey) == 0 {
+						// Records are streamed as soon as first returned, so
+						// carry the backend that returned them first only.
+						record = annotatedResult{ProviderResult: result.ProviderResult, Provenance: []provenance{newProvenance(rwb.bknd)}}
+					}
+					// TODO: optimise the number of time we call flush based on some time-based or result
+					//       count heuristic.
+					if err := stream.write(record); err != nil {
+						// The client is stalled or gone, so the scatter is
+						// aborted rather than left to run until max wait.
+						log.Debugw("Failed to write streaming result", "err", err)
+						cancel()
+						break LOOP
+					}
+				}
+			}
+		}
+	}
+	sg.settle(ctx)
+	outcomes.record(ctx, sg.circuitOpen, sg.concurrencyLimited, encrypted)
+
+	// Records found on dh backends carry no provenance, so are not looked up
+	// for requests annotated with it.
+	if written == 0 && !withProvenance && ctx.Err() == nil {
+		for _, result := range s.dhFallbackResults(ctx, reqURL, encrypted, results) {
+			written++
+			foundRegular = true
+			rs.observeResult(result)
+			if translateNonStreaming {
+				provResults = append(provResults, result.ProviderResult)
+			} else if err := stream.write(result); err != nil {
+				log.Debugw("Failed to write streaming result", "err", err)
+				break
+			}
+		}
+	}
+
+	if written == 0 {
+		if outcomes.confirmedAbsent(sg.circuitOpen, sg.concurrencyLimited, encrypted) {
+			s.noteAbsent(ctx, reqURL, encrypted)
+		}
+		latencyTags = append(latencyTags, tag.Insert(metrics.Found, "no"))
+		streamError(w, !translateNonStreaming, http.StatusNotFound)
+		return
+	}
+
+	rs.reportMetrics(ctx, source)
+	if !translateNonStreaming && ctx.Err() == nil {
+		setStreamStatus(w, streamStatusOK)
+	}
+
+	if prov != nil {
+		resp := annotatedFindResponse{MultihashResults: []annotatedMultihashResult{
+			{
+				Multihash:       mh,
+				ProviderResults: prov.annotate(provResults),
+			},
+		}}
+		if err := encoder.Encode(resp); err != nil {
+			log.Errorw("Failed to encode annotated response", "err", err)
+		}
+	} else if translateNonStreaming {
+		var resp model.FindResponse
+		if len(provResults) > 0 {
+			resp.MultihashResults = []model.MultihashResult{
+				{
+					Multihash:       mh,
+					ProviderResults: provResults,
+				},
+			}
+		}
+		if len(encValKeys) > 0 {
+			resp.EncryptedMultihashResults = []model.EncryptedMultihashResult{
+				{
+					Multihash:          mh,
+					EncryptedValueKeys: encValKeys,
+				},
+			}
+		}
+		if err := encoder.Encode(resp); err != nil {
+			log.Errorw("Failed to encode translated non streaming response", "err", err)
+		}
+	}
+	latencyTags = append(latencyTags, tag.Insert(metrics.Found, "yes"))
+	yesno := func(yn bool) string {
+		if yn {
+			return "yes"
+		}
+		return "no"
+	}
+
+	latencyTags = append(latencyTags, tag.Insert(metrics.FoundCaskade, yesno(foundCaskade)))
+	latencyTags = append(latencyTags, tag.Insert(metrics.FoundRegular, yesno(foundRegular)))
+}
+
+// queryNDJsonBackend queries the given backend for the records of the given
+// find request as NDJSON, and passes each to emit until it returns false.
+// Backends that reject streaming requests with 405 Method Not Allowed or 406
+// Not Acceptable are retried for a JSON response, and asked for JSON responses
+// straight away until streaming is tried again.
+func (s *Server) queryNDJsonBackend(ctx context.Context, b Backend, reqURL *url.URL, outcomes *backendOutcomes, emit func(*encryptedOrPlainResult) bool) error {
+	// Copy the URL from original request and override host/schema to point
+	// to the server.
+	endpoint := *reqURL
+	endpoint.Host = b.URL().Host
+	endpoint.Scheme = b.URL().Scheme
+	log := log.With("backend", endpoint.Host)
+
+	newRequest := func(accept string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+		if err != nil {
+			log.Warnw("Failed to construct backend query", "err", err)
+			return nil, err
+		}
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		req.Header.Set("Accept", accept)
+		s.middlewares.decorateBackendRequest(req, b)
+		return req, nil
+	}
+
+	streaming := s.streaming.supports(b)
+	accept := MediaTypeNDJson
+	if !streaming {
+		accept = MediaTypeJson
+	}
+	req, err := newRequest(accept)
+	if err != nil {
+		return err
+	}
+	if !b.Matches(req) {
+		outcomes.skipped.Add(1)
+		return nil
+	}
+	if !admitCascade(ctx, b) {
+		outcomes.suppressed.Add(1)
+		return nil
+	}
+
+	resp, err := b.Client().Do(req)
+	if err == nil && streaming && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotAcceptable) {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		log.Infow("Backend rejected streaming request; retrying for JSON response", "status", resp.StatusCode)
+		s.streaming.reject(b)
+		streaming = false
+		if req, err = newRequest(MediaTypeJson); err != nil {
+			return err
+		}
+		resp, err = b.Client().Do(req)
+	}
+	if err != nil {
+		outcomes.fail(ctx)
+		recordBackendFailure(ctx, b.URL().Host, requestErrKind(err, false))
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			log.Debugw("Backend query ended", "err", err)
+		} else {
+			log.Warnw("Failed to query backend", "err", err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		outcomes.responded.Add(1)
+	case http.StatusNotFound:
+		io.Copy(io.Discard, resp.Body)
+		outcomes.notFound.Add(1)
+		return nil
+	default:
+		outcomes.failed.Add(1)
+		recordBackendFailure(ctx, b.URL().Host, statusErrKind(resp.StatusCode))
+		bb, _ := io.ReadAll(resp.Body)
+		body := string(bb)
+		log := log.With("status", resp.StatusCode, "body", body)
+		log.Warn("Request processing was not successful")
+		err := fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
+		if resp.StatusCode < http.StatusInternalServerError {
+			err = circuitbreaker.MarkAsSuccess(err)
+		}
+		return err
+	}
+
+	if streaming {
+		s.streaming.accept(b)
+		return readNDJsonResults(ctx, b, resp, emit)
+	}
+	body := &readErrReader{r: resp.Body}
+	_, err = readJSONResults(ctx, b, body, emit)
+	return readFailure(ctx, b, err)
+}
+
+func (s *Server) doFindStreaming(ctx context.Context, method string, req *url.URL, encrypted bool) (int, chan *encryptedOrPlainResult) {
+	start := time.Now()
+	latencyTags := []tag.Mutator{tag.Insert(metrics.Method, http.MethodGet)}
+	loadTags := []tag.Mutator{tag.Insert(metrics.Method, method)}
+	// Metrics are recorded once streaming is finished, since results are
+	// streamed after this function returns.
+	recordMetrics := func() {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(latencyTags...),
+			stats.WithMeasurements(metrics.FindLatency.M(float64(time.Since(start).Milliseconds()))))
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(loadTags...),
+			stats.WithMeasurements(metrics.FindLoad.M(1)))
+	}
+
+	// Watch requests poll for results to appear, so are never answered from
+	// the negative filter.
+	if method != findMethodWatch && s.knownAbsent(ctx, method, req, encrypted) {
+		latencyTags = append(latencyTags, tag.Insert(metrics.Found, "no"))
+		recordMetrics()
+		return http.StatusNotFound, nil
+	}
+
+	sg := &scatterGather[Backend, any]{
+		backends:       s.findBackendsFor(ctx, req),
+		maxWait:        config.Server.ResultStreamMaxWait,
+		cascadeMaxWait: config.Server.CascadeStreamMaxWait,
+		latency:        s.deadlines[routeFindStream],
+		pool:           s.scatterPool,
+		concurrency:    s.concurrency,
+	}
+
+	// The context is canceled once results are consumed, since results are
+	// streamed after this function returns.
+	ctx, cancel := context.WithCancel(ctx)
+
+	type resultWithBackend struct {
+		rslt *encryptedOrPlainResult
+		bknd Backend
+	}
+
+	resultsChan := make(chan *resultWithBackend, 1)
+	var outcomes backendOutcomes
+	if err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*any, error) {
+		// forward double hashed requests to double hashed backends only and regular requests to regular backends
+		_, isDhBackend := b.(dhBackend)
+		_, isProvidersBackend := b.(providersBackend)
+		if (encrypted != isDhBackend) || isProvidersBackend {
+			return nil, nil
+		}
+
+		return nil, s.queryNDJsonBackend(cctx, b, req, &outcomes, func(result *encryptedOrPlainResult) bool {
+			select {
+			case <-cctx.Done():
+				return false
+			case resultsChan <- &resultWithBackend{rslt: result, bknd: b}:
+				return true
+			}
+		})
+	}); err != nil {
+		cancel()
+		recordMetrics()
+		log.Errorw("Failed to scatter HTTP find request", "err", err)
+		return http.StatusInternalServerError, nil
+	}
+
+	out := make(chan *encryptedOrPlainResult)
+
+	// Results chan is done when gathering is finished.
+	// Do this in a separate goroutine to avoid potentially closing results chan twice.
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-sg.gather(ctx):
+				if !ok {
+					close(resultsChan)
+					return
+				}
+			}
+		}
+	}()
+
+	go func() {
+		defer recordMetrics()
+		defer cancel()
+		defer close(out)
+
+		results := newResultSet(config.Server.MaxDedupEntries)
+		var rs resultStats
+		var foundCaskade, foundRegular bool
+		var written int
+	LOOP:
+		for {
+			select {
+			case <-ctx.Done():
+				break LOOP
+			case rwb, ok := <-resultsChan:
+				if !ok {
+					break LOOP
+				}
+				absent := results.putIfAbsent(rwb.rslt)
+				if !absent {
+					continue
+				}
+
+				for _, result := range s.afterAggregation(ctx, rwb.rslt, results) {
+					written++
+					rs.observeResult(result)
+
+					_, isCaskade := rwb.bknd.(caskadeBackend)
+					foundCaskade = foundCaskade || isCaskade
+					foundRegular = foundRegular || !isCaskade
+
+					select {
+					case <-ctx.Done():
+						break LOOP
+					case out <- result:
+					}
+				}
+			}
+		}
+		sg.settle(ctx)
+		outcomes.record(ctx, sg.circuitOpen, sg.concurrencyLimited, encrypted)
+
+		if written == 0 && ctx.Err() == nil {
+		FALLBACK:
+			for _, result := range s.dhFallbackResults(ctx, req, encrypted, results) {
+				written++
+				foundRegular = true
+				rs.observeResult(result)
+				select {
+				case <-ctx.Done():
+					break FALLBACK
+				case out <- result:
+				}
+			}
+		}
+
+		if written == 0 {
+			if outcomes.confirmedAbsent(sg.circuitOpen, sg.concurrencyLimited, encrypted) {
+				s.noteAbsent(ctx, req, encrypted)
+			}
+			latencyTags = append(latencyTags, tag.Insert(metrics.Found, "no"))
+			return
+		}
+
+		rs.reportMetrics(ctx, method)
+
+		latencyTags = append(latencyTags, tag.Insert(metrics.Found, "yes"))
+		yesno := func(yn bool) string {
+			if yn {
+				return "yes"
+			}
+			return "no"
+		}
+
+		latencyTags = append(latencyTags, tag.Insert(metrics.FoundCaskade, yesno(foundCaskade)))
+		latencyTags = append(latencyTags, tag.Insert(metrics.FoundRegular, yesno(foundRegular)))
+	}()
+
+	return 200, out
+}
+
+// record records the number of backends per outcome for a find request of the
+// given kind. circuitOpen and limited list the backends skipped by scatter
+// because their circuit breaker was open or they were at their concurrency
+// limit respectively; only the ones that would have served the request are
+// counted.
+func (o *backendOutcomes) record(ctx context.Context, circuitOpen, limited []Backend, encrypted bool) {
+	for outcome, count := range map[string]int{
+		"responded":           int(o.responded.Load()),
+		"404":                 int(o.notFound.Load()),
+		"error":               int(o.failed.Load()),
+		"circuit-open":        countServing(circuitOpen, encrypted),
+		"concurrency-limited": countServing(limited, encrypted),
+		"skipped-by-matcher":  int(o.skipped.Load()),
+		"cascade-suppressed":  int(o.suppressed.Load()),
+		"client-gone":         int(o.gone.Load()),
+	} {
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(tag.Insert(metrics.Outcome, outcome)),
+			stats.WithMeasurements(metrics.FindBackends.M(float64(count))))
+	}
+}
+
+// fail counts a backend request that failed with the given context, unless it
+// was canceled since the client went away.
+func (o *backendOutcomes) fail(ctx context.Context) {
+	if clientGone(ctx) {
+		o.gone.Add(1)
+		return
+	}
+	o.failed.Add(1)
+}
+
+// allFailed checks whether every backend that would have served a find request
+// of the given kind failed, either by erroring or by having an open circuit.
+func (o *backendOutcomes) allFailed(circuitOpen []Backend, encrypted bool) bool {
+	if o.responded.Load() > 0 || o.notFound.Load() > 0 {
+		return false
+	}
+	return o.failed.Load() > 0 || o.suppressed.Load() > 0 || countServing(circuitOpen, encrypted) > 0
+}
+
+// confirmedAbsent checks whether every backend that would have served a find
+// request of the given kind responded with not found. Backends skipped since
+// they were at their concurrency limit were not consulted, so confirm nothing.
+func (o *backendOutcomes) confirmedAbsent(circuitOpen, limited []Backend, encrypted bool) bool {
+	if o.responded.Load() > 0 || o.failed.Load() > 0 || o.suppressed.Load() > 0 || o.gone.Load() > 0 || countServing(circuitOpen, encrypted) > 0 || countServing(limited, encrypted) > 0 {
+		return false
+	}
+	return o.notFound.Load() > 0
+}
+
+// countServing counts the given backends that would have served a find
+// request of the given kind.
+func countServing(backends []Backend, encrypted bool) int {
+	var n int
+	for _, b := range backends {
+		_, isDhBackend := b.(dhBackend)
+		_, isProvidersBackend := b.(providersBackend)
+		if encrypted == isDhBackend && !isProvidersBackend {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestFindNDJson_RecordsFoundTags(t *testing.T) {
+	latencyView := &view.View{
+		Name:        "test/find/ndjson_latency",
+		Measure:     metrics.FindLatency,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{metrics.Found, metrics.FoundCaskade, metrics.FoundRegular},
+	}
+	require.NoError(t, view.Register(latencyView))
+	defer view.Unregister(latencyView)
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	// Two regular backends, so that the request is scattered rather than
+	// proxied as-is to a sole backend.
+	handler, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+	req.Header.Set("Accept", MediaTypeNDJson)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	_, err = io.ReadAll(rec.Body)
+	require.NoError(t, err)
+
+	rows, err := view.RetrieveData(latencyView.Name)
+	require.NoError(t, err)
+	want := []tag.Tag{
+		{Key: metrics.Found, Value: "yes"},
+		{Key: metrics.FoundCaskade, Value: "no"},
+		{Key: metrics.FoundRegular, Value: "yes"},
+	}
+	var got [][]tag.Tag
+	for _, row := range rows {
+		got = append(got, row.Tags)
+	}
+	require.Contains(t, got, want)
+}
+
+func BenchmarkFind_NDJson(b *testing.B) {
+	handler := newBenchmarkHandler(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+		req.Header.Set("Accept", MediaTypeNDJson)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind_SingleBackendIsProxiedAsIs(t *testing.T) {
+	const body = `{"MultihashResults":[]}`
+	var gotPath, gotAccept string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAccept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", MediaTypeJson)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	b, err := NewBackend(backend.URL, nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	subject := serverWith(b)
+
+	const mh = "QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH"
+	req := httptest.NewRequest(http.MethodGet, "/multihash/"+mh, nil)
+	rec := httptest.NewRecorder()
+	subject.findMultihashSubtree(rec, req, false)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	gotBody, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, string(gotBody))
+	require.Equal(t, "/multihash/"+mh, gotPath)
+	require.Equal(t, MediaTypeJson, gotAccept)
+}
+
+func TestSoleFindBackend(t *testing.T) {
+	regular, err := NewBackend("http://regular.invalid", nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	dh, err := NewBackend("http://dh.invalid", nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	providers, err := NewBackend("http://providers.invalid", nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	cascade, err := NewBackend("http://cascade.invalid", nil, Matchers.QueryParam("cascade", "ipfs-dht"), nil)
+	require.NoError(t, err)
+
+	subject := serverWith(regular, dhBackend{dh}, providersBackend{providers}, caskadeBackend{Backend: cascade})
+
+	req := httptest.NewRequest(http.MethodGet, "/multihash/fish", nil)
+	require.Equal(t, regular, subject.soleFindBackend(req, false))
+	require.Equal(t, dhBackend{dh}, subject.soleFindBackend(req, true))
+
+	req = httptest.NewRequest(http.MethodGet, "/multihash/fish?cascade=ipfs-dht", nil)
+	require.Nil(t, subject.soleFindBackend(req, false))
+
+	// Middlewares that only gate requests need not see their results.
+	req = httptest.NewRequest(http.MethodGet, "/multihash/fish", nil)
+	subject.middlewares = middlewares{&rateLimiter{}, &policy{}}
+	require.Equal(t, regular, subject.soleFindBackend(req, false))
+	subject.middlewares = append(subject.middlewares, &reputation{})
+	require.Nil(t, subject.soleFindBackend(req, false))
+}
+
+func TestFind_MultipleMultihashes(t *testing.T) {
+	const (
+		mh1 = "QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH"
+		mh2 = "QmPNHBy5h7f19yJDt7ip9TvmMRbqmYsa6aetkrsc1ghjLB"
+		mh3 = "QmYhFwJSMXYfQBaAiw8FScRd4TSYbM2c34VDDQuPfyVexQ"
+	)
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	addr := multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		smh := path.Base(r.URL.Path)
+		if smh == mh3 {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		mh, err := multihash.FromB58String(smh)
+		require.NoError(t, err)
+		data, err := model.MarshalFindResponse(&model.FindResponse{
+			MultihashResults: []model.MultihashResult{{
+				Multihash: mh,
+				ProviderResults: []model.ProviderResult{{
+					ContextID: []byte("fish"),
+					Provider:  &peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{addr}},
+				}},
+			}},
+		})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", MediaTypeJson)
+		_, _ = w.Write(data)
+	}))
+	defer backend.Close()
+
+	b, err := NewBackend(backend.URL, nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	other, err := NewBackend("http://other.invalid", nil, func(*http.Request) bool { return false }, nil)
+	require.NoError(t, err)
+	subject := serverWith(b, other)
+
+	req := httptest.NewRequest(http.MethodGet, "/multihash/"+mh1+","+mh2+","+mh3+","+mh1, nil)
+	rec := httptest.NewRecorder()
+	subject.findMultihashSubtree(rec, req, false)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	resp, err := model.UnmarshalFindResponse(rec.Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, resp.MultihashResults, 2)
+	var gotMhs []string
+	for _, mhr := range resp.MultihashResults {
+		gotMhs = append(gotMhs, mhr.Multihash.B58String())
+		require.Len(t, mhr.ProviderResults, 1)
+	}
+	require.ElementsMatch(t, []string{mh1, mh2}, gotMhs)
+
+	req = httptest.NewRequest(http.MethodGet, "/multihash/"+mh3+","+mh3, nil)
+	rec = httptest.NewRecorder()
+	subject.findMultihashSubtree(rec, req, false)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	defer func(old int) { config.Server.MaxMultihashesPerLookup = old }(config.Server.MaxMultihashesPerLookup)
+	config.Server.MaxMultihashesPerLookup = 1
+	req = httptest.NewRequest(http.MethodGet, "/multihash/"+mh1+","+mh2, nil)
+	rec = httptest.NewRecorder()
+	subject.findMultihashSubtree(rec, req, false)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestDoFind_ForwardsRequestBody(t *testing.T) {
+	const body = `{"Multihashes":["fish"]}`
+	var gotMethod, gotBody, gotContentType string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		gotMethod, gotBody, gotContentType = r.Method, string(data), r.Header.Get("Content-Type")
+		http.Error(w, "", http.StatusNotFound)
+	}))
+	defer backend.Close()
+
+	b, err := NewBackend(backend.URL, nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	subject := serverWith(b)
+	reqURL, err := url.Parse("/multihash")
+	require.NoError(t, err)
+
+	rcode, _ := subject.doFind(context.Background(), http.MethodPost, findMethodOrig, reqURL, []byte(body), false)
+	require.Equal(t, http.StatusNotFound, rcode)
+	require.Equal(t, http.MethodPost, gotMethod)
+	require.Equal(t, body, gotBody)
+	require.Equal(t, MediaTypeJson, gotContentType)
+}
+
+// newBenchmarkHandler instantiates a handler that scatters finds across two
+// regular backends serving sample data.
+func newBenchmarkHandler(b *testing.B) http.Handler {
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	b.Cleanup(backend.Close)
+	handler, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(b, err)
+	return handler
+}
+
+func BenchmarkFind_JSON(b *testing.B) {
+	handler := newBenchmarkHandler(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
+
+// serverWith returns a bare Server that routes requests to the given backends.
+func serverWith(backends ...Backend) *Server {
+	s := &Server{}
+	s.routing.Store(&backendSet{backends: backends})
+	return s
+}
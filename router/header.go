@@ -1,4 +1,4 @@
-package main
+package router
 
 import (
 	"mime"
@@ -7,8 +7,8 @@ import (
 )
 
 const (
-	mediaTypeNDJson = "application/x-ndjson"
-	mediaTypeJson   = "application/json"
+	MediaTypeNDJson = "application/x-ndjson"
+	MediaTypeJson   = "application/json"
 	mediaTypeAny    = "*/*"
 )
 
@@ -28,9 +28,9 @@ func getAccepts(r *http.Request) (accepts, error) {
 		for _, amt := range amts {
 			if mt, _, err := mime.ParseMediaType(amt); err != nil {
 				return a, err
-			} else if mt == mediaTypeNDJson {
+			} else if mt == MediaTypeNDJson {
 				a.ndjson = true
-			} else if mt == mediaTypeJson {
+			} else if mt == MediaTypeJson {
 				a.json = true
 			} else if mt == mediaTypeAny {
 				a.any = true
@@ -0,0 +1,198 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// buildVersion is the version of the running build: the module version if
+// built from a tagged release, or the VCS revision it was built from otherwise.
+var buildVersion = func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	version := info.Main.Version
+	if version == "" || version == "(devel)" {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return version
+}()
+
+// indexLink is a link rendered on the index page.
+type indexLink struct {
+	Title string
+	URL   string
+}
+
+// indexPage is the data that the index page template is executed with.
+type indexPage struct {
+	// URL is the webUI rendered via iframe on the embedded index page.
+	URL         string
+	NetworkName string
+	DocsLinks   []indexLink
+	// Routes are the paths of the routes served, in the order they are
+	// documented.
+	Routes []string
+	// Vars are the configured template variables by name.
+	Vars map[string]string
+
+	// Backends is the number of backends currently configured.
+	Backends int
+	// Providers is the number of providers currently known to the network,
+	// as cached from the providers backends.
+	Providers int
+	// Version is the version of indexstar serving the page.
+	Version string
+	// RenderedAt is when the page was rendered.
+	RenderedAt time.Time
+}
+
+// indexRenderer renders the index page with live data, and retains the
+// rendered page for the configured cache TTL so that the data is not gathered
+// on every request.
+type indexRenderer struct {
+	s *Server
+	// data is the index page data as configured, to which live data is
+	// added on each render.
+	data indexPage
+
+	mu         sync.Mutex
+	page       []byte
+	renderedAt time.Time
+}
+
+// newIndexRenderer returns a renderer of the index page of the given server
+// with the configured branding, and renders the page once so that invalid
+// templates are reported at startup.
+func newIndexRenderer(s *Server, homepageURL string) (*indexRenderer, error) {
+	data := indexPage{
+		URL:         homepageURL,
+		NetworkName: config.Index.NetworkName,
+		Routes:      s.routes(),
+		Vars:        make(map[string]string),
+	}
+	for _, link := range strings.Split(config.Index.DocsLinks, ",") {
+		if link = strings.TrimSpace(link); link == "" {
+			continue
+		}
+		title, url, ok := strings.Cut(link, "=")
+		if !ok {
+			return nil, fmt.Errorf("index docs link must be of the form title=url, got %s", link)
+		}
+		data.DocsLinks = append(data.DocsLinks, indexLink{Title: title, URL: url})
+	}
+	for _, kv := range strings.Split(config.Index.Vars, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("index variable must be of the form name=value, got %s", kv)
+		}
+		data.Vars[name] = value
+	}
+
+	ir := &indexRenderer{s: s, data: data}
+	var err error
+	if ir.page, err = ir.render(time.Now()); err != nil {
+		return nil, err
+	}
+	ir.renderedAt = time.Now()
+	return ir, nil
+}
+
+// current returns the rendered index page and when it was rendered,
+// rendering it anew if the cached page is older than the cache TTL. The
+// previously rendered page is returned if rendering fails, e.g. while a
+// template being edited is invalid.
+func (ir *indexRenderer) current() ([]byte, time.Time) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	now := time.Now()
+	if now.Sub(ir.renderedAt) < config.Index.CacheTTL {
+		return ir.page, ir.renderedAt
+	}
+	page, err := ir.render(now)
+	if err != nil {
+		log.Errorw("Failed to render index page; serving previously rendered page", "err", err)
+		return ir.page, ir.renderedAt
+	}
+	ir.page, ir.renderedAt = page, now
+	return ir.page, ir.renderedAt
+}
+
+// ServeHTTP serves the current index page.
+func (ir *indexRenderer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page, renderedAt := ir.current()
+	http.ServeContent(w, r, "index.html", renderedAt, bytes.NewReader(page))
+}
+
+// render executes the index.html template of the configured template
+// directory, or the embedded one if none is configured, with the configured
+// branding and the live state of the server. Templates are parsed on each
+// render, so that changes to the template directory are served without a
+// restart.
+func (ir *indexRenderer) render(now time.Time) ([]byte, error) {
+	tmpl, err := template.ParseFS(webUI, "index.html")
+	if config.Index.TemplateDir != "" {
+		var dir string
+		if dir, err = expandHome(config.Index.TemplateDir); err != nil {
+			return nil, err
+		}
+		// Every template in the directory is parsed, so that index.html may
+		// include others.
+		tmpl, err = template.ParseFS(os.DirFS(dir), "*.html")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse index page template: %w", err)
+	}
+
+	data := ir.data
+	data.Backends = len(ir.s.backends())
+	if ir.s.pcache != nil {
+		data.Providers = ir.s.pcache.Len()
+	}
+	data.Version = buildVersion
+	data.RenderedAt = now
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "index.html", data); err != nil {
+		return nil, fmt.Errorf("cannot execute index page template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// routes returns the paths of the routes served by the server as configured.
+func (s *Server) routes() []string {
+	routes := []string{
+		"/cid/{cid}",
+		"/multihash/{multihash}",
+		"/encrypted/cid/{cid}",
+		"/encrypted/multihash/{multihash}",
+		"/metadata/{valueKey}",
+		"/providers",
+		"/providers/{peerID}",
+		"/providers/{peerID}/extended",
+		"/routing/v1/providers/{cid}",
+		"/routing/v1/encrypted/providers/{hash}",
+		"/watch/cid/{cid}",
+		"/watch/multihash/{multihash}",
+		"/health",
+	}
+	if s.subscriptions != nil {
+		routes = append(routes, "/subscriptions")
+	}
+	return routes
+}
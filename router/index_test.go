@@ -0,0 +1,94 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexPage_RendersConfiguredTemplate(t *testing.T) {
+	defer func(old string) { config.Index.TemplateDir = old }(config.Index.TemplateDir)
+	defer func(old string) { config.Index.NetworkName = old }(config.Index.NetworkName)
+	defer func(old string) { config.Index.DocsLinks = old }(config.Index.DocsLinks)
+	defer func(old string) { config.Index.Vars = old }(config.Index.Vars)
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	index := func() string {
+		subject, err := New(Options{
+			Backends:    []BackendConfig{{URL: backend.URL}, {URL: backend.URL, Type: BackendTypeProviders}},
+			HomepageURL: "https://example.com/ui",
+		})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	embedded := index()
+	require.Contains(t, embedded, "<title>Network Indexer</title>")
+	require.Contains(t, embedded, `src="https://example.com/ui"`)
+
+	config.Index.NetworkName = "Fishnet"
+	require.Contains(t, index(), "<title>Fishnet</title>")
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte(
+		`{{template "header.html" .}}{{range .DocsLinks}}[{{.Title}}]({{.URL}}){{end}} {{index .Vars "contact"}}{{range .Routes}} {{.}}{{end}}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "header.html"), []byte(`# {{.NetworkName}}
+`), 0o644))
+	config.Index.TemplateDir = dir
+	config.Index.DocsLinks = "Docs=https://example.com/docs?a=b, Specs=https://example.com/specs"
+	config.Index.Vars = "contact=fish@example.com"
+	got := index()
+	require.Contains(t, got, "# Fishnet\n[Docs](https://example.com/docs?a=b)[Specs](https://example.com/specs) fish@example.com")
+	require.Contains(t, got, " /cid/{cid}")
+	require.NotContains(t, got, "/subscriptions")
+
+	config.Index.Vars = "contact"
+	_, err := New(Options{Backends: []BackendConfig{{URL: backend.URL}, {URL: backend.URL, Type: BackendTypeProviders}}})
+	require.Error(t, err)
+}
+
+func TestIndexPage_RendersLiveData(t *testing.T) {
+	defer func(old string) { config.Index.TemplateDir = old }(config.Index.TemplateDir)
+	defer func(old time.Duration) { config.Index.CacheTTL = old }(config.Index.CacheTTL)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "index.html")
+	require.NoError(t, os.WriteFile(template, []byte(`{{.Backends}} backends, {{.Providers}} providers, {{.Version}}`), 0o644))
+	config.Index.TemplateDir = dir
+	config.Index.CacheTTL = time.Hour
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{{URL: backend.URL}, {URL: backend.URL}, {URL: backend.URL, Type: BackendTypeProviders}},
+	})
+	require.NoError(t, err)
+	index := func() string {
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+	require.Equal(t, "3 backends, 2 providers, "+buildVersion, index())
+
+	// The cached page is served until its TTL elapses.
+	require.NoError(t, os.WriteFile(template, []byte(`{{.Backends}} backends`), 0o644))
+	require.Equal(t, "3 backends, 2 providers, "+buildVersion, index())
+
+	config.Index.CacheTTL = 0
+	require.Equal(t, "3 backends", index())
+
+	// The previously rendered page is served while the template is invalid.
+	require.NoError(t, os.WriteFile(template, []byte(`{{.Backends`), 0o644))
+	require.Equal(t, "3 backends", index())
+}
@@ -0,0 +1,107 @@
+package router
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+)
+
+// inflightLimiter denies requests with 429 Too Many Requests while their
+// client IP or API key has the configured number of requests in flight.
+//
+// Unlike the rate limiter, which bounds the requests of a client over a
+// window, it bounds how many of them are served at once, so that a single
+// client opening many slow or streaming lookups in parallel cannot exhaust the
+// backend connections and goroutines shared by all clients. Counts are local
+// to each instance.
+type inflightLimiter struct {
+	perIP  int
+	perKey int
+
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+func newInflightLimiter(perIP, perKey int) *inflightLimiter {
+	return &inflightLimiter{
+		perIP:    perIP,
+		perKey:   perKey,
+		inflight: make(map[string]int),
+	}
+}
+
+// keysOf returns the keys of the limits that apply to the given request, or
+// nil if it is not limited. Requests of cluster peers are never limited.
+func (l *inflightLimiter) keysOf(r *http.Request) []string {
+	if strings.HasPrefix(r.URL.Path, "/cluster/") || r.URL.Path == negativeFilterPath {
+		return nil
+	}
+	var keys []string
+	if l.perIP > 0 {
+		keys = append(keys, "ip "+clientIP(r))
+	}
+	if apiKey := requestAPIKey(r); l.perKey > 0 && apiKey != "" {
+		keys = append(keys, "key "+hashAPIKey(apiKey))
+	}
+	return keys
+}
+
+// maxOf returns the limit of the given key.
+func (l *inflightLimiter) maxOf(key string) int {
+	if strings.HasPrefix(key, "key ") {
+		return l.perKey
+	}
+	return l.perIP
+}
+
+// acquire counts a request in flight against the given keys, unless any of
+// them is at its limit.
+func (l *inflightLimiter) acquire(keys []string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if l.inflight[key] >= l.maxOf(key) {
+			return false
+		}
+	}
+	for _, key := range keys {
+		l.inflight[key]++
+	}
+	return true
+}
+
+// release stops counting a request in flight against the given keys.
+func (l *inflightLimiter) release(keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if l.inflight[key]--; l.inflight[key] <= 0 {
+			delete(l.inflight, key)
+		}
+	}
+}
+
+// handler counts requests to next in flight for as long as they are served,
+// including any response stream, and rejects those beyond the limits of their
+// client.
+func (l *inflightLimiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := l.keysOf(r)
+		if len(keys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !l.acquire(keys) {
+			log.Debugw("Rejected request since its client has too many requests in flight", "path", r.URL.Path)
+			_ = stats.RecordWithOptions(r.Context(), stats.WithMeasurements(metrics.InflightRejected.M(1)))
+			w.Header().Set("Retry-After", "1")
+			httpError(w, "", errCodeTooManyInflight, http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(keys)
+		next.ServeHTTP(w, r)
+	})
+}
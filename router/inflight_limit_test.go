@@ -0,0 +1,85 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflightLimiter_LimitsPerKey(t *testing.T) {
+	subject := newInflightLimiter(0, 1)
+	req := httptest.NewRequest(http.MethodGet, "/cid/fish", nil)
+	require.Empty(t, subject.keysOf(req))
+
+	req.Header.Set("X-API-Key", "fish")
+	keys := subject.keysOf(req)
+	require.Equal(t, []string{"key " + hashAPIKey("fish")}, keys)
+	require.True(t, subject.acquire(keys))
+	require.False(t, subject.acquire(keys))
+	subject.release(keys)
+	require.Empty(t, subject.inflight)
+	require.True(t, subject.acquire(keys))
+
+	req = httptest.NewRequest(http.MethodGet, clusterRateLimitPath, nil)
+	req.Header.Set("X-API-Key", "fish")
+	require.Empty(t, subject.keysOf(req))
+}
+
+func TestInflightLimiter_RejectsRequestsBeyondPerIPLimit(t *testing.T) {
+	defer func(old int) { config.InflightLimit.PerIP = old }(config.InflightLimit.PerIP)
+	config.InflightLimit.PerIP = 1
+
+	unblock := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cid/") && r.Header.Get("Accept") == MediaTypeNDJson {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+			<-unblock
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(remoteAddr, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+
+	streamed := make(chan int)
+	go func() { streamed <- find("192.0.2.1:1234", MediaTypeNDJson).Code }()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("stream never reached the backend")
+	}
+
+	rec := find("192.0.2.1:5678", MediaTypeJson)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "1", rec.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusOK, find("192.0.2.2:1234", MediaTypeJson).Code)
+
+	close(unblock)
+	require.Equal(t, http.StatusOK, <-streamed)
+	require.Equal(t, http.StatusOK, find("192.0.2.1:5678", MediaTypeJson).Code)
+}
@@ -0,0 +1,201 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// ingestStatus is the ingestion status of a backend as of its latest poll.
+type ingestStatus struct {
+	// LastAdvertisement is the most recent advertisement ingested across all
+	// providers known to the backend.
+	LastAdvertisement     cid.Cid
+	LastAdvertisementTime time.Time
+	// Lag is the time since LastAdvertisementTime as of CheckedAt.
+	Lag time.Duration
+	// SyncLag is the number of advertisements left to sync across all
+	// providers known to the backend.
+	SyncLag int
+	// Stale is whether Lag exceeds the configured maximum lag.
+	Stale     bool
+	CheckedAt time.Time
+	// Error is set if the latest poll failed.
+	Error string
+}
+
+// ingestMonitor periodically polls the ingestion status of regular backends
+// via their providers endpoint, records their lag, and tracks which backends
+// are too far behind to be included in find requests.
+type ingestMonitor struct {
+	backends func() []Backend
+
+	mu     sync.RWMutex
+	status map[string]ingestStatus
+}
+
+func newIngestMonitor(backends func() []Backend) *ingestMonitor {
+	return &ingestMonitor{
+		backends: backends,
+		status:   make(map[string]ingestStatus),
+	}
+}
+
+// run polls all regular backends at the configured interval until the context
+// is done.
+func (m *ingestMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(config.Ingest.Interval)
+	defer ticker.Stop()
+	for {
+		m.pollAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *ingestMonitor) pollAll(ctx context.Context) {
+	status := make(map[string]ingestStatus)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, b := range m.backends() {
+		if !ingestMonitored(b) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := pollIngestStatus(ctx, b)
+			if err != nil {
+				log.Debugw("Failed to poll backend ingestion status", "backend", b.URL().Host, "err", err)
+				st = ingestStatus{CheckedAt: time.Now(), Error: err.Error()}
+			} else {
+				_ = stats.RecordWithOptions(context.Background(),
+					stats.WithTags(tag.Insert(metrics.Backend, b.URL().Host)),
+					stats.WithMeasurements(
+						metrics.BackendIngestLag.M(st.Lag.Seconds()),
+						metrics.BackendSyncLag.M(int64(st.SyncLag))))
+				if st.Stale {
+					log.Warnw("Backend ingestion is lagging", "backend", b.URL().Host, "lag", st.Lag)
+				}
+			}
+			mu.Lock()
+			status[b.URL().String()] = st
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	m.status = status
+	m.mu.Unlock()
+}
+
+// pollIngestStatus derives the ingestion status of the given backend from the
+// providers it lists.
+func pollIngestStatus(ctx context.Context, b Backend) (ingestStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Server.ResultMaxWait)
+	defer cancel()
+	endpoint := b.URL().JoinPath("/providers")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return ingestStatus{}, err
+	}
+	req.Header.Set("Accept", MediaTypeJson)
+	resp, err := b.Client().Do(req)
+	if err != nil {
+		return ingestStatus{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ingestStatus{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ingestStatus{}, fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
+	}
+	var providers []model.ProviderInfo
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return ingestStatus{}, err
+	}
+
+	st := ingestStatus{CheckedAt: time.Now()}
+	for _, pi := range providers {
+		st.SyncLag += pi.Lag
+		if pi.LastAdvertisementTime == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, pi.LastAdvertisementTime)
+		if err != nil {
+			continue
+		}
+		if t.After(st.LastAdvertisementTime) {
+			st.LastAdvertisementTime = t
+			st.LastAdvertisement = pi.LastAdvertisement
+		}
+	}
+	if !st.LastAdvertisementTime.IsZero() {
+		st.Lag = st.CheckedAt.Sub(st.LastAdvertisementTime)
+		st.Stale = config.Ingest.MaxLag > 0 && st.Lag > config.Ingest.MaxLag
+	}
+	return st, nil
+}
+
+// statusOf returns the latest ingestion status of the given backend, if any.
+func (m *ingestMonitor) statusOf(b Backend) (ingestStatus, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	st, ok := m.status[b.URL().String()]
+	return st, ok
+}
+
+// dropStale returns the given backends without the stale regular backends, as
+// long as at least one fresh regular backend remains available.
+func (m *ingestMonitor) dropStale(backends []Backend) []Backend {
+	var stale, fresh int
+	for _, b := range backends {
+		if !ingestMonitored(b) {
+			continue
+		}
+		if st, _ := m.statusOf(b); st.Stale {
+			stale++
+		} else if circuitReady(b, circuitFind) {
+			fresh++
+		}
+	}
+	if stale == 0 || fresh == 0 {
+		return backends
+	}
+	filtered := make([]Backend, 0, len(backends)-stale)
+	for _, b := range backends {
+		if ingestMonitored(b) {
+			if st, _ := m.statusOf(b); st.Stale {
+				continue
+			}
+		}
+		filtered = append(filtered, b)
+	}
+	return filtered
+}
+
+// ingestMonitored checks whether the ingestion status of the given backend is
+// monitored. Only regular backends ingest advertisements and list providers.
+func ingestMonitored(b Backend) bool {
+	switch b.(type) {
+	case caskadeBackend, dhBackend, providersBackend:
+		return false
+	}
+	return true
+}
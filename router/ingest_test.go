@@ -0,0 +1,96 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func newIngestTestBackend(t *testing.T, lastAdTime time.Time, lag int) Backend {
+	var infos []model.ProviderInfo
+	for i, adTime := range []time.Time{lastAdTime.Add(-time.Hour), lastAdTime} {
+		id, err := peer.Decode(mockbackend.SampleProviders[i])
+		require.NoError(t, err)
+		infos = append(infos, model.ProviderInfo{
+			AddrInfo:              peer.AddrInfo{ID: id},
+			LastAdvertisementTime: adTime.Format(time.RFC3339),
+		})
+	}
+	infos[1].Lag = lag
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/providers" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(infos)
+	}))
+	t.Cleanup(server.Close)
+	b, err := NewBackend(server.URL, nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	return b
+}
+
+func TestIngestMonitor_DropsStaleBackends(t *testing.T) {
+	defer func(old time.Duration) { config.Ingest.MaxLag = old }(config.Ingest.MaxLag)
+	config.Ingest.MaxLag = 10 * time.Minute
+
+	fresh := newIngestTestBackend(t, time.Now(), 0)
+	stale := newIngestTestBackend(t, time.Now().Add(-time.Hour), 42)
+	providers := providersBackend{Backend: stale}
+	backends := []Backend{fresh, stale, providers}
+	subject := newIngestMonitor(func() []Backend { return backends })
+	subject.pollAll(context.Background())
+
+	st, ok := subject.statusOf(stale)
+	require.True(t, ok)
+	require.True(t, st.Stale)
+	require.Equal(t, 42, st.SyncLag)
+	require.Greater(t, st.Lag, 59*time.Minute)
+	st, ok = subject.statusOf(fresh)
+	require.True(t, ok)
+	require.False(t, st.Stale)
+
+	require.Equal(t, []Backend{fresh, providers}, subject.dropStale(backends))
+	// Stale backends are kept if no fresh ones remain.
+	require.Equal(t, []Backend{stale, providers}, subject.dropStale([]Backend{stale, providers}))
+}
+
+func TestHealth_Detail(t *testing.T) {
+	b := newIngestTestBackend(t, time.Now(), 3)
+	subject := serverWith(b)
+	subject.ingest = newIngestMonitor(func() []Backend { return []Backend{b} })
+	subject.ingest.pollAll(context.Background())
+
+	rec := httptest.NewRecorder()
+	subject.health(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "ready", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	subject.health(rec, httptest.NewRequest(http.MethodGet, "/health?detail", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var detail struct {
+		Backends []struct {
+			URL    string
+			Type   string
+			Ingest struct {
+				SyncLag int
+				Stale   bool
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detail))
+	require.Len(t, detail.Backends, 1)
+	require.Equal(t, b.URL().String(), detail.Backends[0].URL)
+	require.Equal(t, BackendTypeRegular, detail.Backends[0].Type)
+	require.Equal(t, 3, detail.Backends[0].Ingest.SyncLag)
+	require.False(t, detail.Backends[0].Ingest.Stale)
+}
@@ -0,0 +1,265 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// leaseTimeFormat is the MicroTime format of Kubernetes Lease timestamps.
+	leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var (
+	errLeaseConflict = errors.New("lease was updated concurrently")
+	errLeaseHeld     = errors.New("lease is held by another replica")
+)
+
+type (
+	// lease is the subset of a coordination.k8s.io/v1 Lease used for leader
+	// election.
+	lease struct {
+		APIVersion string        `json:"apiVersion"`
+		Kind       string        `json:"kind"`
+		Metadata   leaseMetadata `json:"metadata"`
+		Spec       leaseSpec     `json:"spec"`
+	}
+	leaseMetadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	}
+	leaseSpec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	}
+)
+
+// leaderElector elects one of the replicas sharing a Kubernetes Lease to run
+// singleton background jobs, such as the consistency auditor and webhook
+// dispatch, so that they run on exactly one replica.
+//
+// Replicas periodically try to acquire the lease, or renew it if they hold
+// it. A lease that is not renewed within its duration may be acquired by
+// another replica. Updates rely on the optimistic concurrency of the
+// Kubernetes API, so that at most one replica acquires the lease at a time.
+// A replica stops its jobs as soon as it fails to renew the lease.
+type leaderElector struct {
+	endpoint  *url.URL
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+	interval  time.Duration
+	tokenPath string
+	client    *http.Client
+
+	leader atomic.Bool
+}
+
+func newLeaderElector(lease string) (*leaderElector, error) {
+	namespace, name, ok := strings.Cut(lease, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("leader lease must be of the form namespace/name, got %s", lease)
+	}
+	identity := config.Leader.Identity
+	if identity == "" {
+		var err error
+		if identity, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("cannot determine leader identity: %w", err)
+		}
+	}
+	e := &leaderElector{
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+		duration:  config.Leader.LeaseDuration,
+		interval:  config.Leader.RenewInterval,
+		tokenPath: serviceAccountDir + "/token",
+		client:    &http.Client{Timeout: config.Server.HttpClientTimeout},
+	}
+
+	apiServer := config.Leader.APIServer
+	if apiServer == "" {
+		// Use the in-cluster API server along with its service account.
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("leader election requires an API server when not running in Kubernetes")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+		ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return nil, fmt.Errorf("cannot read service account CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("invalid service account CA")
+		}
+		e.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	u, err := url.Parse(apiServer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid leader election API server: %w", err)
+	}
+	e.endpoint = u.JoinPath("/apis/coordination.k8s.io/v1/namespaces", namespace, "leases")
+	return e, nil
+}
+
+// run tries to acquire or renew the lease at the configured interval until
+// the context is done, and runs the given jobs for as long as the lease is
+// held.
+func (e *leaderElector) run(ctx context.Context, jobs ...func(context.Context)) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var stop context.CancelFunc
+	defer func() {
+		if stop != nil {
+			stop()
+		}
+	}()
+	for {
+		err := e.tryAcquireOrRenew(ctx)
+		switch {
+		case err == nil && stop == nil:
+			log.Infow("Acquired leader lease; starting singleton jobs", "identity", e.identity)
+			var jobsCtx context.Context
+			jobsCtx, stop = context.WithCancel(ctx)
+			for _, job := range jobs {
+				go job(jobsCtx)
+			}
+		case err != nil && stop != nil:
+			log.Warnw("Lost leader lease; stopping singleton jobs", "identity", e.identity, "err", err)
+			stop()
+			stop = nil
+		case err != nil && !errors.Is(err, errLeaseHeld):
+			log.Warnw("Failed to acquire leader lease", "err", err)
+		}
+		e.leader.Store(stop != nil)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryAcquireOrRenew acquires the lease if it is free or expired, or renews it
+// if already held, and returns an error if the lease is not held afterwards.
+func (e *leaderElector) tryAcquireOrRenew(ctx context.Context) error {
+	now := time.Now()
+	l, err := e.get(ctx)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		l = &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: e.name, Namespace: e.namespace},
+		}
+		e.claim(l, now)
+		return e.write(ctx, http.MethodPost, e.endpoint, l)
+	}
+
+	if l.Spec.HolderIdentity != e.identity && l.Spec.HolderIdentity != "" {
+		renewed, err := time.Parse(leaseTimeFormat, l.Spec.RenewTime)
+		expiry := renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second)
+		if err == nil && now.Before(expiry) {
+			return errLeaseHeld
+		}
+	}
+	e.claim(l, now)
+	return e.write(ctx, http.MethodPut, e.endpoint.JoinPath(e.name), l)
+}
+
+// claim updates the lease to be held by this replica as of the given time.
+func (e *leaderElector) claim(l *lease, now time.Time) {
+	if l.Spec.HolderIdentity != e.identity {
+		if l.Spec.HolderIdentity != "" {
+			l.Spec.LeaseTransitions++
+		}
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+	}
+	l.Spec.LeaseDurationSeconds = int(e.duration.Seconds())
+	l.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+}
+
+func (e *leaderElector) get(ctx context.Context) (*lease, error) {
+	resp, err := e.do(ctx, http.MethodGet, e.endpoint.JoinPath(e.name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var l lease
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		return &l, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("status %d response getting lease: %s", resp.StatusCode, data)
+	}
+}
+
+func (e *leaderElector) write(ctx context.Context, method string, u *url.URL, l *lease) error {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	resp, err := e.do(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errLeaseConflict
+	default:
+		return fmt.Errorf("status %d response writing lease: %s", resp.StatusCode, data)
+	}
+}
+
+func (e *leaderElector) do(ctx context.Context, method string, u *url.URL, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", MediaTypeJson)
+	if body != nil {
+		req.Header.Set("Content-Type", MediaTypeJson)
+	}
+	// The token is read on every request since it is rotated by Kubernetes.
+	if token, err := os.ReadFile(e.tokenPath); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return e.client.Do(req)
+}
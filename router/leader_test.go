@@ -0,0 +1,117 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLeaseServer serves a single Lease with optimistic concurrency, as the
+// Kubernetes API server would.
+type fakeLeaseServer struct {
+	mu      sync.Mutex
+	lease   *lease
+	version int
+}
+
+func (f *fakeLeaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		if f.lease == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(f.lease)
+	case http.MethodPost, http.MethodPut:
+		var l lease
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if (r.Method == http.MethodPost) != (f.lease == nil) ||
+			(f.lease != nil && l.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion) {
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+		f.version++
+		l.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.lease = &l
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func newTestLeaderElector(t *testing.T, apiServer, identity string) *leaderElector {
+	defer func(old string) { config.Leader.Lease = old }(config.Leader.Lease)
+	defer func(old string) { config.Leader.Identity = old }(config.Leader.Identity)
+	defer func(old string) { config.Leader.APIServer = old }(config.Leader.APIServer)
+	config.Leader.Lease = "ipni/indexstar"
+	config.Leader.Identity = identity
+	config.Leader.APIServer = apiServer
+	e, err := newLeaderElector(config.Leader.Lease)
+	require.NoError(t, err)
+	return e
+}
+
+func TestLeaderElector_AcquiresRenewsAndTakesOverExpiredLease(t *testing.T) {
+	fake := &fakeLeaseServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	a := newTestLeaderElector(t, server.URL, "a")
+	b := newTestLeaderElector(t, server.URL, "b")
+	ctx := context.Background()
+
+	require.NoError(t, a.tryAcquireOrRenew(ctx))
+	require.ErrorIs(t, b.tryAcquireOrRenew(ctx), errLeaseHeld)
+	require.NoError(t, a.tryAcquireOrRenew(ctx))
+	require.Equal(t, "a", fake.lease.Spec.HolderIdentity)
+
+	// Once a stops renewing, b takes over.
+	fake.mu.Lock()
+	fake.lease.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(leaseTimeFormat)
+	fake.mu.Unlock()
+	require.NoError(t, b.tryAcquireOrRenew(ctx))
+	require.Equal(t, "b", fake.lease.Spec.HolderIdentity)
+	require.Equal(t, 1, fake.lease.Spec.LeaseTransitions)
+	require.ErrorIs(t, a.tryAcquireOrRenew(ctx), errLeaseHeld)
+
+	_, err := time.Parse(leaseTimeFormat, fake.lease.Spec.AcquireTime)
+	require.NoError(t, err)
+}
+
+func TestLeaderElector_RunsJobsWhileLeader(t *testing.T) {
+	server := httptest.NewServer(&fakeLeaseServer{})
+	defer server.Close()
+	subject := newTestLeaderElector(t, server.URL, "a")
+	subject.interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		subject.run(ctx, func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+			close(stopped)
+		})
+	}()
+	<-started
+	require.Eventually(t, subject.leader.Load, time.Second, time.Millisecond)
+
+	// Losing the lease stops jobs.
+	server.Close()
+	<-stopped
+	require.Eventually(t, func() bool { return !subject.leader.Load() }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
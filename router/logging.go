@@ -0,0 +1,143 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// envLogConfig is the logging config set via GOLOG_* env vars, which the
+// config file overrides.
+var envLogConfig = logging.GetConfig()
+
+// LogConfig configures logging from the config file, overriding the format and
+// levels set via GOLOG_* env vars.
+type LogConfig struct {
+	// Format is the format of log output, one of color, nocolor or json.
+	// Defaults to the format set via env vars if empty.
+	Format string `json:",omitempty"`
+	// Level is the level of the subsystems not in Levels. Defaults to the
+	// level set via env vars if empty.
+	Level string `json:",omitempty"`
+	// Levels are the levels by subsystem, e.g. indexstar/mux.
+	Levels map[string]string `json:",omitempty"`
+}
+
+// Apply sets up logging as configured. Levels changed at runtime via the admin
+// endpoint are reset.
+func (c *LogConfig) Apply() error {
+	cfg, err := c.loggingConfig()
+	if err != nil {
+		return err
+	}
+	logging.SetupLogging(cfg)
+	return nil
+}
+
+// Validate checks that the config is valid without applying it.
+func (c *LogConfig) Validate() error {
+	_, err := c.loggingConfig()
+	return err
+}
+
+// loggingConfig returns the go-log config of the config.
+func (c *LogConfig) loggingConfig() (logging.Config, error) {
+	cfg := envLogConfig
+	cfg.SubsystemLevels = maps.Clone(envLogConfig.SubsystemLevels)
+	if cfg.SubsystemLevels == nil {
+		cfg.SubsystemLevels = make(map[string]logging.LogLevel)
+	}
+	switch strings.ToLower(c.Format) {
+	case "":
+	case "color":
+		cfg.Format = logging.ColorizedOutput
+	case "nocolor":
+		cfg.Format = logging.PlaintextOutput
+	case "json":
+		cfg.Format = logging.JSONOutput
+	default:
+		return cfg, fmt.Errorf("unknown log format %q", c.Format)
+	}
+	if c.Level != "" {
+		lvl, err := logging.LevelFromString(c.Level)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid log level %q: %w", c.Level, err)
+		}
+		cfg.Level = lvl
+	}
+	for name, level := range c.Levels {
+		lvl, err := logging.LevelFromString(level)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid log level %q of %s: %w", level, name, err)
+		}
+		cfg.SubsystemLevels[name] = lvl
+	}
+	return cfg, nil
+}
+
+// logLevels returns the level of every logging subsystem by name.
+func logLevels() map[string]string {
+	levels := make(map[string]string)
+	for _, name := range logging.GetSubsystems() {
+		levels[name] = logging.Logger(name).Level().String()
+	}
+	return levels
+}
+
+// serveLogLevels serves the level of every logging subsystem on GET, and sets
+// the levels by subsystem given as a JSON object on PUT, where subsystem *
+// sets every subsystem. Both respond with the levels as of after the request.
+func serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var levels map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+			http.Error(w, "invalid log levels: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Every level is validated before any is set, so that requests are
+		// applied in full or not at all.
+		subsystems := logLevels()
+		for name, level := range levels {
+			if _, err := logging.LevelFromString(level); err != nil {
+				http.Error(w, fmt.Sprintf("invalid log level %q of %s", level, name), http.StatusBadRequest)
+				return
+			}
+			if _, ok := subsystems[name]; !ok && name != "*" {
+				http.Error(w, "unknown log subsystem "+name, http.StatusBadRequest)
+				return
+			}
+		}
+		// The wildcard applies first, so that subsystems may be set apart.
+		if level, ok := levels["*"]; ok {
+			_ = logging.SetLogLevel("*", level)
+		}
+		for name, level := range levels {
+			if name == "*" {
+				continue
+			}
+			if err := logging.SetLogLevel(name, level); err != nil && !errors.Is(err, logging.ErrNoSuchLogger) {
+				log.Errorw("Failed to set log level", "subsystem", name, "err", err)
+			}
+		}
+		log.Infow("Changed log levels", "levels", levels)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(logLevels())
+	if err != nil {
+		log.Errorw("Failed to marshal log levels", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, data)
+}
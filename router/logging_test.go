@@ -0,0 +1,55 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeLogLevels(t *testing.T) {
+	defer logging.SetupLogging(logging.GetConfig())
+	logging.Logger("fish")
+	logging.Logger("lobster")
+
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		serveLogLevels(rec, httptest.NewRequest(method, adminLogPath, strings.NewReader(body)))
+		return rec
+	}
+	levels := func(rec *httptest.ResponseRecorder) map[string]string {
+		var got map[string]string
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		return got
+	}
+
+	rec := serve(http.MethodPut, `{"*": "warn", "fish": "debug"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	got := levels(rec)
+	require.Equal(t, "debug", got["fish"])
+	require.Equal(t, "warn", got["lobster"])
+	require.Equal(t, got, levels(serve(http.MethodGet, "")))
+
+	// Invalid requests change no level.
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, `{"fish": "info", "lobster": "loud"}`).Code)
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, `{"fish": "info", "undersea": "info"}`).Code)
+	require.Equal(t, "debug", levels(serve(http.MethodGet, ""))["fish"])
+
+	require.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodDelete, "").Code)
+}
+
+func TestLogConfig_Apply(t *testing.T) {
+	defer logging.SetupLogging(logging.GetConfig())
+	logging.Logger("fish")
+
+	require.NoError(t, (&LogConfig{Level: "warn", Levels: map[string]string{"fish": "debug"}}).Apply())
+	require.Equal(t, "debug", logLevels()["fish"])
+	require.Equal(t, "warn", logLevels()["indexstar/mux"])
+
+	require.ErrorContains(t, (&LogConfig{Format: "loud"}).Apply(), "unknown log format")
+	require.ErrorContains(t, (&LogConfig{Levels: map[string]string{"fish": "loud"}}).Apply(), "invalid log level")
+}
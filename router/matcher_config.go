@@ -0,0 +1,101 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MatcherConfig declares the requests a backend is queried for. All of the
+// specified conditions must hold for a request to match. An empty MatcherConfig
+// matches any request.
+type MatcherConfig struct {
+	// QueryParam matches requests with the given query parameter value.
+	QueryParam *KeyValue `json:",omitempty"`
+	// Header matches requests with the given header value.
+	Header *KeyValue `json:",omitempty"`
+	// PathPrefix matches requests whose path starts with the given prefix.
+	PathPrefix string `json:",omitempty"`
+	// PathRegexp matches requests whose path matches the given regular
+	// expression.
+	PathRegexp string `json:",omitempty"`
+	// Method matches requests with any of the given methods.
+	Method []string `json:",omitempty"`
+	// Not matches requests not matched by the given matcher.
+	Not *MatcherConfig `json:",omitempty"`
+	// AllOf matches requests matched by all of the given matchers.
+	AllOf []MatcherConfig `json:",omitempty"`
+	// AnyOf matches requests matched by any of the given matchers.
+	AnyOf []MatcherConfig `json:",omitempty"`
+}
+
+// KeyValue is a key and value pair, e.g. of a header or query parameter.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// matcher builds the HttpRequestMatcher declared by the config.
+func (mc *MatcherConfig) matcher() (HttpRequestMatcher, error) {
+	var ms []HttpRequestMatcher
+	if mc.QueryParam != nil {
+		ms = append(ms, Matchers.QueryParam(mc.QueryParam.Key, mc.QueryParam.Value))
+	}
+	if mc.Header != nil {
+		ms = append(ms, Matchers.Header(mc.Header.Key, mc.Header.Value))
+	}
+	if mc.PathPrefix != "" {
+		ms = append(ms, Matchers.PathPrefix(mc.PathPrefix))
+	}
+	if mc.PathRegexp != "" {
+		re, err := regexp.Compile(mc.PathRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regexp: %w", err)
+		}
+		ms = append(ms, Matchers.PathRegexp(re))
+	}
+	if len(mc.Method) > 0 {
+		ms = append(ms, Matchers.Method(mc.Method...))
+	}
+	if mc.Not != nil {
+		m, err := mc.Not.matcher()
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Matchers.Not(m))
+	}
+	if len(mc.AllOf) > 0 {
+		m, err := matchersOf(mc.AllOf)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Matchers.AllOf(m...))
+	}
+	if len(mc.AnyOf) > 0 {
+		m, err := matchersOf(mc.AnyOf)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Matchers.AnyOf(m...))
+	}
+
+	switch len(ms) {
+	case 0:
+		return Matchers.Any, nil
+	case 1:
+		return ms[0], nil
+	default:
+		return Matchers.AllOf(ms...), nil
+	}
+}
+
+func matchersOf(mcs []MatcherConfig) ([]HttpRequestMatcher, error) {
+	ms := make([]HttpRequestMatcher, 0, len(mcs))
+	for _, mc := range mcs {
+		m, err := mc.matcher()
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
@@ -0,0 +1,58 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcherConfig_Matcher(t *testing.T) {
+	var subject MatcherConfig
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"Method": ["GET"],
+		"Not": {"PathPrefix": "/encrypted/"},
+		"AnyOf": [
+			{"Header": {"Key": "X-Fish", "Value": "lobster"}},
+			{"QueryParam": {"Key": "cascade", "Value": "ipfs-dht"}},
+			{"PathRegexp": "^/cid/bafy"}
+		]
+	}`), &subject))
+	matcher, err := subject.matcher()
+	require.NoError(t, err)
+
+	withHeader := httptest.NewRequest(http.MethodGet, "/multihash/fish", nil)
+	withHeader.Header.Set("X-Fish", "lobster")
+	require.True(t, matcher(withHeader))
+	require.True(t, matcher(httptest.NewRequest(http.MethodGet, "/multihash/fish?cascade=ipfs-dht", nil)))
+	require.True(t, matcher(httptest.NewRequest(http.MethodGet, "/cid/bafyfish", nil)))
+
+	require.False(t, matcher(httptest.NewRequest(http.MethodGet, "/multihash/fish", nil)))
+	require.False(t, matcher(httptest.NewRequest(http.MethodPost, "/cid/bafyfish", nil)))
+	require.False(t, matcher(httptest.NewRequest(http.MethodGet, "/encrypted/multihash/fish?cascade=ipfs-dht", nil)))
+}
+
+func TestMatcherConfig_EmptyMatchesAny(t *testing.T) {
+	matcher, err := (&MatcherConfig{}).matcher()
+	require.NoError(t, err)
+	require.True(t, matcher(httptest.NewRequest(http.MethodPost, "/fish", nil)))
+}
+
+func TestMatcherConfig_InvalidRegexp(t *testing.T) {
+	_, err := (&MatcherConfig{PathRegexp: "("}).matcher()
+	require.ErrorContains(t, err, "invalid path regexp")
+}
+
+func TestMatchers_HeaderMatchesInboundRequest(t *testing.T) {
+	inbound := http.Header{}
+	inbound.Set("X-Fish", "lobster")
+	ctx := context.WithValue(context.Background(), inboundHeaderKey{}, inbound)
+	backendReq, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend.invalid/multihash/fish", nil)
+	require.NoError(t, err)
+
+	require.True(t, Matchers.Header("X-Fish", "lobster")(backendReq))
+	require.False(t, Matchers.Header("X-Fish", "crab")(backendReq))
+}
@@ -0,0 +1,69 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxWaitHeader overrides the backend deadline of a request, e.g. 15s, so
+// that batch consumers can opt into more complete results while interactive
+// clients keep the configured deadlines.
+const maxWaitHeader = "X-IPNI-Max-Wait"
+
+type maxWaitKey struct{}
+
+// maxWaitOverrider honours the max wait header of requests by trusted API
+// keys, bounded by the configured minimum and maximum. The header of other
+// requests is ignored.
+type maxWaitOverrider struct {
+	keys map[string]struct{}
+}
+
+// newMaxWaitOverrider instantiates a maxWaitOverrider, or returns nil if no
+// API key is trusted to override deadlines.
+func newMaxWaitOverrider() (*maxWaitOverrider, error) {
+	o := &maxWaitOverrider{keys: make(map[string]struct{})}
+	for _, key := range strings.Split(config.MaxWait.Keys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			o.keys[key] = struct{}{}
+		}
+	}
+	if len(o.keys) == 0 {
+		return nil, nil
+	}
+	if config.MaxWait.Max <= 0 || config.MaxWait.Min > config.MaxWait.Max {
+		return nil, fmt.Errorf("max wait bounds must satisfy 0 <= min <= max and max > 0, got [%s, %s]", config.MaxWait.Min, config.MaxWait.Max)
+	}
+	return o, nil
+}
+
+func (o *maxWaitOverrider) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(maxWaitHeader)
+		if v == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, trusted := o.keys[requestAPIKey(r)]; !trusted {
+			next.ServeHTTP(w, r)
+			return
+		}
+		maxWait, err := time.ParseDuration(v)
+		if err != nil || maxWait <= 0 {
+			http.Error(w, "invalid "+maxWaitHeader+" header", http.StatusBadRequest)
+			return
+		}
+		maxWait = min(max(maxWait, config.MaxWait.Min), config.MaxWait.Max)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), maxWaitKey{}, maxWait)))
+	})
+}
+
+// maxWaitOverrideFrom returns the backend deadline that the request with the
+// given context overrides, or zero if none.
+func maxWaitOverrideFrom(ctx context.Context) time.Duration {
+	maxWait, _ := ctx.Value(maxWaitKey{}).(time.Duration)
+	return maxWait
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxWaitOverrider_HonoursTrustedKeysWithinBounds(t *testing.T) {
+	defer func(old string) { config.MaxWait.Keys = old }(config.MaxWait.Keys)
+	defer func(old time.Duration) { config.MaxWait.Min = old }(config.MaxWait.Min)
+	defer func(old time.Duration) { config.MaxWait.Max = old }(config.MaxWait.Max)
+	config.MaxWait.Keys = "batch, crawler"
+	config.MaxWait.Min = time.Second
+	config.MaxWait.Max = 30 * time.Second
+
+	subject, err := newMaxWaitOverrider()
+	require.NoError(t, err)
+	var got time.Duration
+	handler := subject.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = maxWaitOverrideFrom(r.Context())
+	}))
+	serve := func(apiKey, maxWait string) int {
+		got = 0
+		r := httptest.NewRequest(http.MethodGet, "/cid/fish", nil)
+		if apiKey != "" {
+			r.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		if maxWait != "" {
+			r.Header.Set(maxWaitHeader, maxWait)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, serve("batch", "15s"))
+	require.Equal(t, 15*time.Second, got)
+	require.Equal(t, http.StatusOK, serve("crawler", "5m"))
+	require.Equal(t, 30*time.Second, got)
+	require.Equal(t, http.StatusOK, serve("batch", "10ms"))
+	require.Equal(t, time.Second, got)
+	require.Equal(t, http.StatusOK, serve("batch", ""))
+	require.Zero(t, got)
+	// The header of untrusted clients is ignored.
+	require.Equal(t, http.StatusOK, serve("fish", "15s"))
+	require.Zero(t, got)
+	require.Equal(t, http.StatusOK, serve("", "15s"))
+	require.Zero(t, got)
+	require.Equal(t, http.StatusBadRequest, serve("batch", "lobster"))
+	require.Equal(t, http.StatusBadRequest, serve("batch", "-1s"))
+	require.Zero(t, maxWaitOverrideFrom(context.Background()))
+}
+
+func TestNewMaxWaitOverrider(t *testing.T) {
+	defer func(old string) { config.MaxWait.Keys = old }(config.MaxWait.Keys)
+	defer func(old time.Duration) { config.MaxWait.Min = old }(config.MaxWait.Min)
+	defer func(old time.Duration) { config.MaxWait.Max = old }(config.MaxWait.Max)
+
+	config.MaxWait.Keys = " , "
+	subject, err := newMaxWaitOverrider()
+	require.NoError(t, err)
+	require.Nil(t, subject)
+
+	config.MaxWait.Keys = "batch"
+	config.MaxWait.Min = time.Minute
+	config.MaxWait.Max = time.Second
+	_, err = newMaxWaitOverrider()
+	require.ErrorContains(t, err, "max wait bounds")
+}
+
+func TestScatterGather_MaxWaitOverride(t *testing.T) {
+	sg := scatterGather[Backend, any]{maxWait: time.Second, cascadeMaxWait: 2 * time.Second}
+	regular, err := NewBackend("http://fish.invalid", nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	cascade := caskadeBackend{Backend: regular}
+	ctx := context.WithValue(context.Background(), maxWaitKey{}, 15*time.Second)
+
+	require.Equal(t, time.Second, sg.maxWaitFor(context.Background(), regular))
+	require.Equal(t, 2*time.Second, sg.maxWaitFor(context.Background(), Backend(cascade)))
+	require.Equal(t, 15*time.Second, sg.maxWaitFor(ctx, regular))
+	require.Equal(t, 15*time.Second, sg.maxWaitFor(ctx, Backend(cascade)))
+}
@@ -0,0 +1,173 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+)
+
+// Middleware hooks into the handling of requests, so that deployments can add
+// custom policy without forking handlers. Embed BaseMiddleware to implement
+// only the hooks needed.
+type Middleware interface {
+	// BeforeRequest is called before an inbound request is handled, and
+	// returns the request to handle, which may be a modified copy of r. A
+	// non-nil error denies the request, which is then responded to with the
+	// status of a StatusError or 403 Forbidden otherwise.
+	BeforeRequest(r *http.Request) (*http.Request, error)
+	// DecorateBackendRequest is called before a request is sent to a backend,
+	// and may modify it, e.g. to add headers.
+	DecorateBackendRequest(req *http.Request, b Backend)
+	// AfterAggregation is called with provider results aggregated across
+	// backends before they are written to the client, and returns the results
+	// to write; it may filter or annotate them. When results are streamed,
+	// it is called once per result. Encrypted results are not passed to
+	// middleware.
+	AfterAggregation(ctx context.Context, results []model.ProviderResult) []model.ProviderResult
+}
+
+// BaseMiddleware implements Middleware with hooks that change nothing.
+type BaseMiddleware struct{}
+
+func (BaseMiddleware) BeforeRequest(r *http.Request) (*http.Request, error) { return r, nil }
+
+func (BaseMiddleware) DecorateBackendRequest(*http.Request, Backend) {}
+
+func (BaseMiddleware) AfterAggregation(_ context.Context, results []model.ProviderResult) []model.ProviderResult {
+	return results
+}
+
+// StatusError is returned by Middleware.BeforeRequest to deny a request with a
+// specific HTTP status.
+type StatusError struct {
+	Status int
+	// Code is the code of the error responded to clients that accept JSON.
+	// Defaults to the code of the status if empty.
+	Code string
+	// RetryAfter is how long clients should wait before retrying the
+	// request, if set.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err == nil {
+		return http.StatusText(e.Status)
+	}
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error { return e.Err }
+
+var (
+	middlewareFactoriesMu sync.Mutex
+	middlewareFactories   = make(map[string]func() (Middleware, error))
+)
+
+// RegisterMiddleware makes a middleware available by name to the chain
+// configured via the SERVER_MIDDLEWARES env var. It is typically called from
+// the init function of the package implementing the middleware.
+func RegisterMiddleware(name string, factory func() (Middleware, error)) {
+	middlewareFactoriesMu.Lock()
+	defer middlewareFactoriesMu.Unlock()
+	middlewareFactories[name] = factory
+}
+
+// newConfiguredMiddlewares instantiates registered middlewares in the order
+// of the given comma-separated names.
+func newConfiguredMiddlewares(names string) ([]Middleware, error) {
+	if names == "" {
+		return nil, nil
+	}
+	middlewareFactoriesMu.Lock()
+	defer middlewareFactoriesMu.Unlock()
+	var mws []Middleware
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		factory, ok := middlewareFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware: %s", name)
+		}
+		mw, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate middleware %s: %w", name, err)
+		}
+		mws = append(mws, mw)
+	}
+	return mws, nil
+}
+
+// gatingMiddleware is implemented by built-in middlewares that only admit,
+// deny or rewrite inbound requests in BeforeRequest.
+type gatingMiddleware interface {
+	gatesOnly()
+}
+
+// middlewares is a chain of Middleware, with hooks called in order.
+type middlewares []Middleware
+
+// tailorsResults reports whether any middleware of the chain may decorate
+// backend requests or tailor aggregated results, so that find results must be
+// aggregated rather than proxied from a sole backend, and translated responses
+// must not be shared across clients.
+func (m middlewares) tailorsResults() bool {
+	for _, mw := range m {
+		if _, ok := mw.(gatingMiddleware); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m middlewares) handler(next http.Handler) http.Handler {
+	if len(m) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, mw := range m {
+			next, err := mw.BeforeRequest(r)
+			if err != nil {
+				status, code := http.StatusForbidden, ""
+				var se *StatusError
+				if errors.As(err, &se) {
+					status, code = se.Status, se.Code
+					if se.RetryAfter > 0 {
+						w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(se.RetryAfter.Seconds()))))
+					}
+				}
+				if code == "" {
+					code = errCodeOf(status)
+				}
+				log.Debugw("Request denied by middleware", "path", r.URL.Path, "err", err)
+				httpError(w, "", code, status)
+				return
+			}
+			r = next
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m middlewares) decorateBackendRequest(req *http.Request, b Backend) {
+	for _, mw := range m {
+		mw.DecorateBackendRequest(req, b)
+	}
+}
+
+func (m middlewares) afterAggregation(ctx context.Context, results []model.ProviderResult) []model.ProviderResult {
+	for _, mw := range m {
+		if len(results) == 0 {
+			break
+		}
+		results = mw.AfterAggregation(ctx, results)
+	}
+	return results
+}
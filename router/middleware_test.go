@@ -0,0 +1,122 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+type testMiddleware struct {
+	BaseMiddleware
+	deny       bool
+	dropPeerID string
+}
+
+func (m *testMiddleware) BeforeRequest(r *http.Request) (*http.Request, error) {
+	if m.deny {
+		return nil, &StatusError{Status: http.StatusTeapot, Err: errors.New("fish")}
+	}
+	return r, nil
+}
+
+func (m *testMiddleware) DecorateBackendRequest(req *http.Request, _ Backend) {
+	req.Header.Set("X-Test", "lobster")
+}
+
+func (m *testMiddleware) AfterAggregation(_ context.Context, results []model.ProviderResult) []model.ProviderResult {
+	var kept []model.ProviderResult
+	for _, r := range results {
+		if r.Provider.ID.String() != m.dropPeerID {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func TestMiddleware_AppliesHooks(t *testing.T) {
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test") != "lobster" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	mw := &testMiddleware{dropPeerID: mockbackend.SampleProviders[0]}
+	handler, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+		Middlewares: []Middleware{mw},
+	})
+	require.NoError(t, err)
+	subject := httptest.NewServer(handler)
+	defer subject.Close()
+
+	// The first sample CID is provided by both sample providers, one of which
+	// is filtered out.
+	resp, err := http.Get(subject.URL + "/cid/" + mockbackend.SampleCids[0])
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	found, err := model.UnmarshalFindResponse(data)
+	require.NoError(t, err)
+	require.Len(t, found.MultihashResults[0].ProviderResults, 1)
+	require.Equal(t, mockbackend.SampleProviders[1], found.MultihashResults[0].ProviderResults[0].Provider.ID.String())
+
+	// The second sample CID is provided by the filtered out provider only.
+	req, err := http.NewRequest(http.MethodGet, subject.URL+"/cid/"+mockbackend.SampleCids[1], nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", MediaTypeNDJson)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	mw.deny = true
+	resp, err = http.Get(subject.URL + "/cid/" + mockbackend.SampleCids[0])
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTeapot, resp.StatusCode)
+}
+
+func TestNewConfiguredMiddlewares(t *testing.T) {
+	RegisterMiddleware("test-fish", func() (Middleware, error) { return BaseMiddleware{}, nil })
+
+	mws, err := newConfiguredMiddlewares("test-fish, test-fish")
+	require.NoError(t, err)
+	require.Len(t, mws, 2)
+
+	_, err = newConfiguredMiddlewares("test-fish,test-lobster")
+	require.ErrorContains(t, err, "unknown middleware: test-lobster")
+}
+
+func TestNewServer_DoesNotAliasMiddlewares(t *testing.T) {
+	defer func(old string) { config.Server.Middlewares = old }(config.Server.Middlewares)
+	RegisterMiddleware("test-fish", func() (Middleware, error) { return BaseMiddleware{}, nil })
+	config.Server.Middlewares = "test-fish"
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+
+	// Spare capacity must not be appended to in place.
+	caller := make([]Middleware, 1, 2)
+	caller[0] = &testMiddleware{}
+	_, err := NewServer(Options{
+		Backends:    []BackendConfig{{URL: backend.URL}, {URL: backend.URL, Type: BackendTypeProviders}},
+		Middlewares: caller,
+	})
+	require.NoError(t, err)
+	require.Nil(t, caller[:2][1])
+}
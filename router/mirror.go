@@ -0,0 +1,119 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// mirror shadows a sample of requests to a target backend, e.g. to evaluate an
+// experimental backend against production traffic. Mirrored requests are sent
+// asynchronously and their responses discarded, so that mirroring never
+// affects the responses served to clients.
+type mirror struct {
+	target       *url.URL
+	client       *http.Client
+	pathPrefixes []string
+	methods      map[string]struct{}
+	limiter      *rate.Limiter
+}
+
+func newMirror(target string) (*mirror, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewBackendClient(BackendConfig{URL: target})
+	if err != nil {
+		return nil, err
+	}
+	m := &mirror{
+		target:       u,
+		client:       client,
+		pathPrefixes: capturePathPrefixes,
+		methods:      make(map[string]struct{}),
+		limiter:      rate.NewLimiter(0, 0),
+	}
+	if config.Mirror.Paths != "" {
+		m.pathPrefixes = nil
+		for _, prefix := range strings.Split(config.Mirror.Paths, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				m.pathPrefixes = append(m.pathPrefixes, prefix)
+			}
+		}
+	}
+	for _, method := range strings.Split(config.Mirror.Methods, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			m.methods[strings.ToUpper(method)] = struct{}{}
+		}
+	}
+	// Nothing is mirrored without a rate limit, since each mirrored request
+	// is sent on its own goroutine.
+	if config.Mirror.MaxQPS > 0 {
+		m.limiter = rate.NewLimiter(rate.Limit(config.Mirror.MaxQPS), max(1, int(config.Mirror.MaxQPS)))
+	}
+	return m, nil
+}
+
+// middleware mirrors the sampled requests handled by the given handler to the
+// mirror target.
+func (m *mirror) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.mirrors(r) {
+			var body []byte
+			if r.Body != nil && r.Body != http.NoBody {
+				var err error
+				if body, err = io.ReadAll(r.Body); err != nil {
+					http.Error(w, "", http.StatusBadRequest)
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			go m.send(r.Method, r.URL, r.Header.Get("Accept"), body)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mirrors checks whether the given request is sampled for mirroring, within
+// the configured rate limit, if any.
+func (m *mirror) mirrors(r *http.Request) bool {
+	if _, ok := m.methods[r.Method]; !ok {
+		return false
+	}
+	for _, prefix := range m.pathPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return rand.Float64() < config.Mirror.SampleRate && m.limiter.Allow()
+		}
+	}
+	return false
+}
+
+func (m *mirror) send(method string, reqURL *url.URL, accept string, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.ResultMaxWait)
+	defer cancel()
+	endpoint := *reqURL
+	endpoint.Scheme = m.target.Scheme
+	endpoint.Host = m.target.Host
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		log.Debugw("Failed to construct mirrored request", "err", err)
+		return
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Debugw("Failed to mirror request", "target", m.target.Host, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+}
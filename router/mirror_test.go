@@ -0,0 +1,62 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror_MirrorsSampledRequests(t *testing.T) {
+	defer func(old float64) { config.Mirror.SampleRate = old }(config.Mirror.SampleRate)
+	defer func(old float64) { config.Mirror.MaxQPS = old }(config.Mirror.MaxQPS)
+	defer func(old string) { config.Mirror.Paths = old }(config.Mirror.Paths)
+	config.Mirror.SampleRate = 1
+	config.Mirror.MaxQPS = 1
+	config.Mirror.Paths = "/multihash/"
+
+	mirrored := make(chan string, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("Accept")
+	}))
+	defer target.Close()
+
+	subject, err := newMirror(target.URL)
+	require.NoError(t, err)
+	var served int
+	handler := subject.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/cid/fish", nil),
+		httptest.NewRequest(http.MethodPost, "/multihash/fish", nil),
+		httptest.NewRequest(http.MethodGet, "/multihash/fish?cascade=ipfs-dht", nil),
+		// Exceeds the mirroring rate limit.
+		httptest.NewRequest(http.MethodGet, "/multihash/lobster", nil),
+	} {
+		req.Header.Set("Accept", MediaTypeNDJson)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	require.Equal(t, 4, served)
+
+	select {
+	case got := <-mirrored:
+		require.Equal(t, "GET /multihash/fish?cascade=ipfs-dht "+MediaTypeNDJson, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for mirrored request")
+	}
+	select {
+	case got := <-mirrored:
+		t.Fatalf("unexpected mirrored request: %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Nothing is mirrored without a rate limit.
+	config.Mirror.MaxQPS = 0
+	subject, err = newMirror(target.URL)
+	require.NoError(t, err)
+	require.False(t, subject.mirrors(httptest.NewRequest(http.MethodGet, "/multihash/fish", nil)))
+}
@@ -0,0 +1,166 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/metrics"
+	"github.com/mercari/go-circuitbreaker"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// Kinds of malformed backend responses to NDJSON find requests, which are
+// tolerated rather than failing the backend attempt.
+const (
+	// malformedJSONBody is a JSON find response in place of NDJSON, which is
+	// parsed as such.
+	malformedJSONBody = "json_body"
+	// malformedBody is a response that is neither NDJSON nor a JSON find
+	// response, such as an HTML error page, which is ignored.
+	malformedBody = "body"
+	// malformedLine is a line that is not a record, such as a truncated one,
+	// which is skipped.
+	malformedLine = "line"
+)
+
+func recordMalformedNDJson(ctx context.Context, host, kind string) {
+	_ = stats.RecordWithOptions(ctx,
+		stats.WithTags(tag.Insert(metrics.Backend, host), tag.Insert(metrics.ErrKind, kind)),
+		stats.WithMeasurements(metrics.NDJsonMalformed.M(1)))
+}
+
+// readNDJsonResults reads the records of the given successful response of a
+// backend to an NDJSON find request, and passes each to emit until it returns
+// false. Backends that respond with a JSON body, an error page or truncated
+// lines are tolerated: responses labelled as JSON are parsed as find responses,
+// HTML responses are ignored, and lines that are not records are skipped. Only
+// failures to read the response are returned.
+func readNDJsonResults(ctx context.Context, b Backend, resp *http.Response, emit func(*encryptedOrPlainResult) bool) error {
+	log := log.With("backend", b.URL().Host)
+	body := &readErrReader{r: resp.Body}
+	// Responses are scanned as NDJSON unless labelled otherwise, since NDJSON
+	// is often served unlabelled or sniffed as plain text.
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mediaType == MediaTypeJson || strings.HasSuffix(mediaType, "+json"):
+		parsed, err := readJSONResults(ctx, b, body, emit)
+		if parsed {
+			recordMalformedNDJson(ctx, b.URL().Host, malformedJSONBody)
+		}
+		return readFailure(ctx, b, err)
+	case mediaType == "text/html":
+		log.Warn("Ignored HTML backend response")
+		recordMalformedNDJson(ctx, b.URL().Host, malformedBody)
+		return nil
+	}
+
+	scanner, splitter, release := newNDJsonScanner(body)
+	defer release()
+	var malformed int
+	defer func() {
+		if splitter.skipped > 0 {
+			log.Warnw("Skipped oversized lines in backend response", "count", splitter.skipped, "maxLineSize", splitter.maxLineSize)
+		}
+		if malformed > 0 {
+			log.Warnw("Skipped malformed lines in backend response", "count", malformed)
+		}
+	}()
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return nil
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var result encryptedOrPlainResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			malformed++
+			recordMalformedNDJson(ctx, b.URL().Host, malformedLine)
+			continue
+		}
+		if !validNDJsonResult(&result) {
+			// Backends that do not respect the accept media type may respond
+			// with a JSON find response on a single line; see:
+			// https://github.com/ipni/storetheindex/issues/1209
+			if rsp, err := decodeFindResponse(bytes.NewReader(line)); err == nil && (len(rsp.MultihashResults) > 0 || len(rsp.EncryptedMultihashResults) > 0) {
+				recordMalformedNDJson(ctx, b.URL().Host, malformedJSONBody)
+				if !emitFindResponse(rsp, emit) {
+					return nil
+				}
+			}
+			continue
+		}
+		if !emit(&result) {
+			return nil
+		}
+	}
+	return readFailure(ctx, b, scanner.Err())
+}
+
+// readJSONResults reads the given backend response as a JSON find response,
+// and returns whether it was parsed along with failures to read it. Responses
+// that cannot be parsed are ignored.
+func readJSONResults(ctx context.Context, b Backend, body *readErrReader, emit func(*encryptedOrPlainResult) bool) (bool, error) {
+	rsp, err := decodeFindResponse(body)
+	if err != nil {
+		if body.err != nil {
+			return false, body.err
+		}
+		log.Warnw("Ignored backend response that is not JSON", "backend", b.URL().Host, "err", err)
+		recordMalformedNDJson(ctx, b.URL().Host, malformedBody)
+		return false, nil
+	}
+	emitFindResponse(rsp, emit)
+	return true, nil
+}
+
+// emitFindResponse passes the valid records of the given find response to emit
+// until it returns false, and returns whether it did not.
+func emitFindResponse(rsp *model.FindResponse, emit func(*encryptedOrPlainResult) bool) bool {
+	for _, mhr := range rsp.MultihashResults {
+		for _, pr := range mhr.ProviderResults {
+			result := &encryptedOrPlainResult{ProviderResult: pr}
+			if validNDJsonResult(result) && !emit(result) {
+				return false
+			}
+		}
+	}
+	for _, emr := range rsp.EncryptedMultihashResults {
+		for _, evk := range emr.EncryptedValueKeys {
+			if !emit(&encryptedOrPlainResult{EncryptedValueKey: evk}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validNDJsonResult checks whether the given record is an encrypted value key
+// or a provider record with addresses.
+func validNDJsonResult(r *encryptedOrPlainResult) bool {
+	return len(r.EncryptedValueKey) > 0 || (r.Provider != nil && r.Provider.ID != "" && len(r.Provider.Addrs) > 0)
+}
+
+// readFailure records and returns the given failure to read a backend
+// response, if any. Failures are not counted by the circuit breaker, since
+// the backend responded.
+func readFailure(ctx context.Context, b Backend, err error) error {
+	if err == nil {
+		return nil
+	}
+	recordBackendFailure(ctx, b.URL().Host, requestErrKind(err, true))
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		log.Debugw("Reading backend response ended", "backend", b.URL().Host, "err", err)
+	} else {
+		log.Warnw("Failed to read backend response", "backend", b.URL().Host, "err", err)
+	}
+	return circuitbreaker.MarkAsSuccess(err)
+}
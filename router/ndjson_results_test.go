@@ -0,0 +1,164 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+type failingReader struct{ io.Reader }
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestReadNDJsonResults_ToleratesMalformedResponses(t *testing.T) {
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	mh, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	record := model.ProviderResult{
+		ContextID: []byte("fish"),
+		Provider:  &peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}},
+	}
+	line, err := json.Marshal(record)
+	require.NoError(t, err)
+	findResponse, err := json.Marshal(model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: mh, ProviderResults: []model.ProviderResult{record}}}})
+	require.NoError(t, err)
+	b, err := NewBackend("http://localhost", nil, Matchers.Any, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        io.Reader
+		wantResults int
+		wantErr     bool
+	}{
+		{
+			name:        "ndjson",
+			contentType: MediaTypeNDJson,
+			body:        strings.NewReader(string(line) + "\n" + string(line) + "\n"),
+			wantResults: 2,
+		},
+		{
+			name:        "truncated line",
+			contentType: MediaTypeNDJson,
+			body:        strings.NewReader(string(line) + "\n" + string(line[:len(line)/2])),
+			wantResults: 1,
+		},
+		{
+			name:        "garbage line",
+			contentType: "text/plain; charset=utf-8",
+			body:        strings.NewReader("fish\n" + string(line) + "\n"),
+			wantResults: 1,
+		},
+		{
+			name:        "json body",
+			contentType: MediaTypeJson,
+			body:        strings.NewReader(string(findResponse)),
+			wantResults: 1,
+		},
+		{
+			name:        "json body labelled ndjson",
+			contentType: MediaTypeNDJson,
+			body:        strings.NewReader(string(findResponse)),
+			wantResults: 1,
+		},
+		{
+			name:        "html body",
+			contentType: "text/html; charset=utf-8",
+			body:        strings.NewReader("<html><body>Bad Gateway</body></html>"),
+		},
+		{
+			name:        "unparsable json body",
+			contentType: MediaTypeJson,
+			body:        strings.NewReader(`{"MultihashResults": [`),
+		},
+		{
+			name:        "read failure",
+			contentType: MediaTypeNDJson,
+			body:        failingReader{strings.NewReader(string(line) + "\n")},
+			wantResults: 1,
+			wantErr:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{"Content-Type": []string{test.contentType}},
+				Body:   io.NopCloser(test.body),
+			}
+			var got int
+			err := readNDJsonResults(context.Background(), b, resp, func(*encryptedOrPlainResult) bool {
+				got++
+				return true
+			})
+			if test.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.wantResults, got)
+		})
+	}
+}
+
+func TestFindNDJson_JSONBackendResponse(t *testing.T) {
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	mh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	jsonBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// Respond with JSON regardless of the accept media type.
+		w.Header().Set("Content-Type", MediaTypeJson)
+		_ = json.NewEncoder(w).Encode(model.FindResponse{MultihashResults: []model.MultihashResult{{
+			Multihash: mh,
+			ProviderResults: []model.ProviderResult{{
+				ContextID: []byte("fish"),
+				Provider:  &peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}},
+			}},
+		}}})
+	}))
+	defer jsonBackend.Close()
+	htmlBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>Bad Gateway</body></html>"))
+	}))
+	defer htmlBackend.Close()
+	providers := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer providers.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: jsonBackend.URL},
+			{URL: htmlBackend.URL},
+			{URL: providers.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/multihash/"+mh.B58String(), nil)
+	req.Header.Set("Accept", MediaTypeNDJson)
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var result model.ProviderResult
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(rec.Body.String())), &result))
+	require.Equal(t, pid, result.Provider.ID)
+}
@@ -0,0 +1,84 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+)
+
+// ndjsonSplitter splits NDJSON streams into lines, similar to bufio.ScanLines.
+// Unlike bufio.ScanLines lines longer than maxLineSize are skipped instead of
+// aborting the whole scan with bufio.ErrTooLong.
+type ndjsonSplitter struct {
+	maxLineSize int
+	skipping    bool
+	skipped     int
+}
+
+// newNDJsonScanner instantiates a scanner over the given reader that uses the
+// configured buffer size and skips lines longer than the configured max line
+// size. The returned splitter may be used to check the number of skipped lines
+// once scanning is finished. The returned function releases the buffer of the
+// scanner to the pool, and must be called once scanned lines are no longer
+// referenced.
+func newNDJsonScanner(r io.Reader) (*bufio.Scanner, *ndjsonSplitter, func()) {
+	maxLineSize := config.Server.NDJsonMaxLineSize
+	bufSize := min(config.Server.NDJsonScannerBufferSize, maxLineSize+1)
+	splitter := &ndjsonSplitter{maxLineSize: maxLineSize}
+	scanner := bufio.NewScanner(r)
+	// Allow the buffer to grow one byte past max line size so that the splitter
+	// gets a chance to detect oversized lines before the scanner gives up.
+	buf := getScanBuffer(bufSize)
+	scanner.Buffer((*buf)[:0:bufSize], maxLineSize+1)
+	scanner.Split(splitter.split)
+	return scanner, splitter, func() { releaseScanBuffer(buf) }
+}
+
+func (s *ndjsonSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	i := bytes.IndexByte(data, '\n')
+	if s.skipping {
+		// Discard everything up to and including the end of the oversized line.
+		if i >= 0 {
+			s.skipping = false
+			return i + 1, nil, nil
+		}
+		return len(data), nil, nil
+	}
+	switch {
+	case i > s.maxLineSize:
+		s.skip()
+		return i + 1, nil, nil
+	case i >= 0:
+		return i + 1, dropCR(data[:i]), nil
+	case len(data) > s.maxLineSize:
+		s.skip()
+		s.skipping = !atEOF
+		return len(data), nil, nil
+	case atEOF:
+		return len(data), dropCR(data), nil
+	default:
+		// Request more data.
+		return 0, nil, nil
+	}
+}
+
+func (s *ndjsonSplitter) skip() {
+	s.skipped++
+	_ = stats.RecordWithOptions(context.Background(),
+		stats.WithMeasurements(metrics.NDJsonSkippedLines.M(1)))
+}
+
+// dropCR drops a terminal \r from the data.
+func dropCR(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		return data[0 : len(data)-1]
+	}
+	return data
+}
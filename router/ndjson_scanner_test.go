@@ -0,0 +1,53 @@
+package router
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNDJsonScanner_SkipsOversizedLines(t *testing.T) {
+	defer func(old int) { config.Server.NDJsonMaxLineSize = old }(config.Server.NDJsonMaxLineSize)
+	config.Server.NDJsonMaxLineSize = 8
+
+	body := "fish\n" + strings.Repeat("x", 20) + "\r\nlobster\n\n" + strings.Repeat("y", 9) + "\ncrab"
+	scanner, splitter, release := newNDJsonScanner(strings.NewReader(body))
+	defer release()
+
+	var got []string
+	for scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, []string{"fish", "lobster", "", "crab"}, got)
+	require.Equal(t, 2, splitter.skipped)
+}
+
+func TestNDJsonScanner_SkipsOversizedTrailingLine(t *testing.T) {
+	defer func(old int) { config.Server.NDJsonMaxLineSize = old }(config.Server.NDJsonMaxLineSize)
+	config.Server.NDJsonMaxLineSize = 4
+
+	scanner, splitter, release := newNDJsonScanner(strings.NewReader("fish\nlobster"))
+	defer release()
+
+	var got []string
+	for scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, []string{"fish"}, got)
+	require.Equal(t, 1, splitter.skipped)
+}
+
+func BenchmarkNDJsonScanner(b *testing.B) {
+	body := strings.Repeat(`{"ContextID":"ZmlzaA==","Metadata":"gBI=","Provider":{"ID":"12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h","Addrs":["/ip4/127.0.0.1/tcp/4001"]}}`+"\n", 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scanner, _, release := newNDJsonScanner(strings.NewReader(body))
+		for scanner.Scan() {
+		}
+		release()
+	}
+}
@@ -0,0 +1,272 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// negativeFilterPath is the path on which instances serve their negative
+// lookup filter to peers.
+const negativeFilterPath = "/negative-filter"
+
+// negativeFilter is a bloom filter of find lookups that every backend recently
+// confirmed to have no results for, so that repeated lookups of absent
+// multihashes are answered without scattering them to backends.
+//
+// Entries expire by rotating between two generations of the filter every half
+// of the configured window: lookups are answered from either generation, while
+// new entries are only added to the current one. An entry is therefore retained
+// for between half and all of the window.
+//
+// When peers are configured, the current generation of each peer is
+// periodically merged into the current generation of this filter, so that
+// absence confirmed by one instance is shared across instances. Peers must be
+// configured with the same filter size.
+type negativeFilter struct {
+	window       time.Duration
+	hashes       int
+	syncInterval time.Duration
+	peers        []*url.URL
+	client       *http.Client
+
+	mu        sync.RWMutex
+	current   []uint64
+	previous  []uint64
+	rotatedAt time.Time
+}
+
+func newNegativeFilter() (*negativeFilter, error) {
+	if config.Negative.Bits < 64 {
+		return nil, fmt.Errorf("negative filter must have at least 64 bits, got %d", config.Negative.Bits)
+	}
+	if config.Negative.Hashes < 1 {
+		return nil, fmt.Errorf("negative filter must have at least one hash, got %d", config.Negative.Hashes)
+	}
+	words := (config.Negative.Bits + 63) / 64
+	f := &negativeFilter{
+		window:       config.Negative.Window,
+		hashes:       config.Negative.Hashes,
+		syncInterval: config.Negative.SyncInterval,
+		client:       &http.Client{Timeout: config.Server.HttpClientTimeout},
+		current:      make([]uint64, words),
+		previous:     make([]uint64, words),
+		rotatedAt:    time.Now(),
+	}
+	for _, peer := range strings.Split(config.Negative.Peers, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		u, err := url.Parse(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid negative filter peer %s: %w", peer, err)
+		}
+		f.peers = append(f.peers, u.JoinPath(negativeFilterPath))
+	}
+	return f, nil
+}
+
+// negativeKey returns the key under which the find request with the given URL
+// is tracked by the negative filter: its sharding key, qualified by whether
+// it is encrypted and by its cascade label.
+func negativeKey(reqURL *url.URL, encrypted bool) []byte {
+	key := extractShardingKey(reqURL)
+	// Never append to the multihash itself.
+	key = key[:len(key):len(key)]
+	if encrypted {
+		key = append(key, 'e')
+	}
+	// Results differ by cascade label.
+	if cascade := reqURL.Query().Get(cascadeQueryParam); cascade != "" {
+		key = append(key, 0)
+		key = append(key, cascade...)
+	}
+	return key
+}
+
+// positions calls fn with the bit position of each hash of the given key, by
+// combining two hashes of the key as described by Kirsch and Mitzenmacher.
+func (f *negativeFilter) positions(key []byte, fn func(word int, bit uint64)) {
+	h1 := xxhash.Sum64(key)
+	h2 := h1>>33 | h1<<31 | 1
+	bits := uint64(len(f.current) * 64)
+	for i := 0; i < f.hashes; i++ {
+		p := (h1 + uint64(i)*h2) % bits
+		fn(int(p/64), 1<<(p%64))
+	}
+}
+
+// add records that every backend confirmed the given key to be absent.
+func (f *negativeFilter) add(key []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rotateIfDue()
+	f.positions(key, func(word int, bit uint64) {
+		f.current[word] |= bit
+	})
+}
+
+// mayBeAbsent checks whether the given key was recently confirmed absent,
+// subject to false positives at a rate that depends on the filter size.
+func (f *negativeFilter) mayBeAbsent(key []byte) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	inCurrent, inPrevious := true, true
+	f.positions(key, func(word int, bit uint64) {
+		inCurrent = inCurrent && f.current[word]&bit != 0
+		inPrevious = inPrevious && f.previous[word]&bit != 0
+	})
+	if !inCurrent && !inPrevious {
+		return false
+	}
+	// Entries of a generation that would have been rotated out since no longer
+	// count.
+	age := time.Since(f.rotatedAt)
+	if age >= f.window {
+		return false
+	}
+	return inCurrent || age < f.window/2
+}
+
+// rotateIfDue starts a new generation if the current one is older than half
+// of the window. The caller must hold the write lock.
+func (f *negativeFilter) rotateIfDue() {
+	age := time.Since(f.rotatedAt)
+	if age < f.window/2 {
+		return
+	}
+	if age >= f.window {
+		clear(f.previous)
+	} else {
+		copy(f.previous, f.current)
+	}
+	clear(f.current)
+	f.rotatedAt = time.Now()
+}
+
+// run rotates the filter, and merges the filters of peers if any, until the
+// context is done.
+func (f *negativeFilter) run(ctx context.Context) {
+	interval := f.window / 2
+	if len(f.peers) > 0 && f.syncInterval > 0 {
+		interval = min(interval, f.syncInterval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		f.mu.Lock()
+		f.rotateIfDue()
+		f.mu.Unlock()
+		for _, peer := range f.peers {
+			if err := f.mergeFrom(ctx, peer); err != nil {
+				log.Warnw("Failed to merge negative filter of peer", "peer", peer, "err", err)
+			}
+		}
+	}
+}
+
+// mergeFrom fetches the current generation of the filter of the given peer
+// and merges it into the current generation of this filter.
+func (f *negativeFilter) mergeFrom(ctx context.Context, peer *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("status %d response from peer", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(len(f.current)*8+1)))
+	if err != nil {
+		return err
+	}
+	if len(data) != len(f.current)*8 {
+		return fmt.Errorf("peer filter has %d bits, expected %d", len(data)*8, len(f.current)*64)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rotateIfDue()
+	for i := range f.current {
+		f.current[i] |= binary.BigEndian.Uint64(data[i*8:])
+	}
+	return nil
+}
+
+// serveHTTP serves the current generation of the filter to peers.
+func (f *negativeFilter) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	f.mu.Lock()
+	f.rotateIfDue()
+	data := make([]byte, 0, len(f.current)*8)
+	for _, word := range f.current {
+		data = binary.BigEndian.AppendUint64(data, word)
+	}
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(data)
+}
+
+// knownAbsent checks whether the find request with the given URL was recently
+// confirmed absent by every backend, and records a hit if so. Requests pinned
+// to a backend or assigned an experiment variant are never answered from the
+// filter.
+func (s *Server) knownAbsent(ctx context.Context, method string, reqURL *url.URL, encrypted bool) bool {
+	if s.negative == nil {
+		return false
+	}
+	if narrowedBackends(ctx) {
+		return false
+	}
+	if !s.negative.mayBeAbsent(negativeKey(reqURL, encrypted)) {
+		return false
+	}
+	_ = stats.RecordWithOptions(ctx,
+		stats.WithTags(tag.Insert(metrics.Method, method)),
+		stats.WithMeasurements(metrics.NegativeFilterHits.M(1)))
+	return true
+}
+
+// noteAbsent records that every backend confirmed the find request with the
+// given URL to have no results. Absence confirmed by requests pinned to a
+// backend or assigned an experiment variant is not recorded, since other
+// backends may not have been consulted.
+func (s *Server) noteAbsent(ctx context.Context, reqURL *url.URL, encrypted bool) {
+	if s.negative == nil {
+		return
+	}
+	if narrowedBackends(ctx) {
+		return
+	}
+	// Backends not queried since the client went away do not confirm the
+	// absence.
+	if clientGone(ctx) {
+		return
+	}
+	s.negative.add(negativeKey(reqURL, encrypted))
+}
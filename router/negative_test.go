@@ -0,0 +1,196 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegativeKey(t *testing.T) {
+	c := cid.MustParse(mockbackend.SampleCids[0])
+	byCid := negativeKey(&url.URL{Path: "/cid/" + c.String()}, false)
+	require.Equal(t, byCid, negativeKey(&url.URL{Path: "/multihash/" + c.Hash().B58String()}, false))
+	require.Equal(t, byCid, negativeKey(&url.URL{Path: "/multihash/" + c.Hash().HexString()}, false))
+	require.NotEqual(t, byCid, negativeKey(&url.URL{Path: "/encrypted/cid/" + c.String()}, true))
+	require.NotEqual(t, byCid, negativeKey(&url.URL{Path: "/cid/" + c.String(), RawQuery: "cascade=ipfs-dht"}, false))
+}
+
+func TestNegativeFilter_ExpiresAndMerges(t *testing.T) {
+	defer func(old time.Duration) { config.Negative.Window = old }(config.Negative.Window)
+	config.Negative.Window = time.Hour
+
+	subject, err := newNegativeFilter()
+	require.NoError(t, err)
+	require.False(t, subject.mayBeAbsent([]byte("fish")))
+	subject.add([]byte("fish"))
+	require.True(t, subject.mayBeAbsent([]byte("fish")))
+	require.False(t, subject.mayBeAbsent([]byte("lobster")))
+
+	// Entries outlive a single rotation, but not two.
+	subject.rotatedAt = time.Now().Add(-40 * time.Minute)
+	subject.mu.Lock()
+	subject.rotateIfDue()
+	subject.mu.Unlock()
+	require.True(t, subject.mayBeAbsent([]byte("fish")))
+	subject.rotatedAt = time.Now().Add(-40 * time.Minute)
+	require.False(t, subject.mayBeAbsent([]byte("fish")))
+
+	peer, err := newNegativeFilter()
+	require.NoError(t, err)
+	peer.add([]byte("lobster"))
+	server := httptest.NewServer(http.HandlerFunc(peer.serveHTTP))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	require.NoError(t, subject.mergeFrom(context.Background(), u))
+	require.True(t, subject.mayBeAbsent([]byte("lobster")))
+
+	defer func(old int) { config.Negative.Bits = old }(config.Negative.Bits)
+	config.Negative.Bits = 128
+	small, err := newNegativeFilter()
+	require.NoError(t, err)
+	require.ErrorContains(t, small.mergeFrom(context.Background(), u), "expected 128")
+}
+
+func TestFind_AnswersConfirmedAbsentFromNegativeFilter(t *testing.T) {
+	defer func(old time.Duration) { config.Negative.Window = old }(config.Negative.Window)
+	config.Negative.Window = time.Hour
+
+	var failing atomic.Bool
+	var finds atomic.Int32
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/providers") {
+			finds.Add(1)
+			if failing.Load() {
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(p, accept string) int {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Absence is not recorded while backends fail.
+	failing.Store(true)
+	absent, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, find("/multihash/"+absent.B58String(), MediaTypeJson))
+	require.Equal(t, int32(2), finds.Load())
+	failing.Store(false)
+
+	require.Equal(t, http.StatusNotFound, find("/multihash/"+absent.B58String(), MediaTypeJson))
+	require.Equal(t, int32(4), finds.Load())
+	require.Equal(t, http.StatusNotFound, find("/multihash/"+absent.B58String(), MediaTypeJson))
+	require.Equal(t, http.StatusNotFound, find("/multihash/"+absent.B58String(), MediaTypeNDJson))
+	require.Equal(t, http.StatusNotFound, find("/routing/v1/providers/"+cid.NewCidV1(cid.Raw, absent).String(), MediaTypeJson))
+	require.Equal(t, int32(4), finds.Load())
+
+	require.Equal(t, http.StatusOK, find("/cid/"+mockbackend.SampleCids[0], MediaTypeJson))
+	require.Equal(t, int32(6), finds.Load())
+}
+
+func TestFind_RecordsAbsenceConfirmedBySingleBackend(t *testing.T) {
+	defer func(old time.Duration) { config.Negative.Window = old }(config.Negative.Window)
+	config.Negative.Window = time.Hour
+
+	var finds atomic.Int32
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/providers") {
+			finds.Add(1)
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	absent, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	for _, accept := range []string{MediaTypeJson, MediaTypeJson, MediaTypeNDJson} {
+		req := httptest.NewRequest(http.MethodGet, "/multihash/"+absent.B58String(), nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	}
+	require.Equal(t, int32(1), finds.Load())
+}
+
+func TestFind_DoesNotRecordAbsenceConfirmedByExperimentVariant(t *testing.T) {
+	defer func(old time.Duration) { config.Negative.Window = old }(config.Negative.Window)
+	defer func(old string) { config.Experiment.Path = old }(config.Experiment.Path)
+	config.Negative.Window = time.Hour
+
+	var finds atomic.Int32
+	empty := mockbackend.New()
+	fish := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/providers") {
+			finds.Add(1)
+		}
+		empty.ServeHTTP(w, r)
+	}))
+	defer fish.Close()
+	lobster := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer lobster.Close()
+	u, err := url.Parse(fish.URL)
+	require.NoError(t, err)
+	config.Experiment.Path = filepath.Join(t.TempDir(), "experiment.json")
+	require.NoError(t, os.WriteFile(config.Experiment.Path, []byte(`{"Name": "fish", "Variants": [{"Name": "fish-only", "Weight": 1, "Backends": ["`+u.Host+`"]}]}`), 0o644))
+	subject, err := NewServer(Options{
+		Backends: []BackendConfig{
+			{URL: fish.URL},
+			{URL: lobster.URL},
+			{URL: lobster.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	// The variant only queries one of the backends, which does not confirm
+	// absence from the others.
+	absent, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/multihash/"+absent.B58String(), nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	}
+	require.Equal(t, int32(2), finds.Load())
+	require.False(t, subject.negative.mayBeAbsent(negativeKey(&url.URL{Path: "/multihash/" + absent.B58String()}, false)))
+}
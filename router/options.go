@@ -0,0 +1,210 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mercari/go-circuitbreaker"
+)
+
+const (
+	// allowCascadeHeader advertises the cascade labels supported on find
+	// routes, as a comma-separated list.
+	allowCascadeHeader = "X-IPNI-Allow-Cascade"
+	// allowStreamingHeader advertises the media type of streaming responses,
+	// if any backend streams them.
+	allowStreamingHeader = "X-IPNI-Allow-Streaming"
+)
+
+// findMethods are the methods served on find routes, in the order advertised.
+var findMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// capabilities are the capabilities of find routes advertised in response to
+// OPTIONS requests.
+type capabilities struct {
+	methods   []string
+	cascade   []string
+	streaming bool
+}
+
+// staticCapabilities returns the capabilities advertised when backends are
+// not asked for theirs, given the supported cascade labels.
+func staticCapabilities(labels []string) *capabilities {
+	return &capabilities{methods: findMethods, cascade: labels}
+}
+
+// optionsCache caches the capabilities of backends merged from their
+// responses to OPTIONS requests, so that CORS preflight requests are not
+// fanned out to every backend.
+type optionsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	merged  *capabilities
+	expires time.Time
+}
+
+// newOptionsCache instantiates an optionsCache, or returns nil if backends
+// are not to be asked for their capabilities.
+func newOptionsCache(ttl time.Duration) *optionsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &optionsCache{ttl: ttl}
+}
+
+// get returns the cached capabilities, fetching them first if expired.
+// Concurrent callers wait for a single fetch.
+func (c *optionsCache) get(fetch func() *capabilities) *capabilities {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.merged == nil || time.Now().After(c.expires) {
+		c.merged = fetch()
+		c.expires = time.Now().Add(c.ttl)
+	}
+	return c.merged
+}
+
+// reset drops the cached capabilities, e.g. once backends change.
+func (c *optionsCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.merged = nil
+	c.mu.Unlock()
+}
+
+// handleIPNIOptions responds to OPTIONS requests on find routes with the
+// capabilities of backends.
+func (s *Server) handleIPNIOptions(w http.ResponseWriter, r *http.Request) {
+	caps := staticCapabilities(s.cascade)
+	if s.options != nil {
+		caps = s.options.get(func() *capabilities { return s.fetchCapabilities(r.URL) })
+	}
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Allow-Methods", strings.Join(caps.methods, ", "))
+	w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Accept")
+	if len(caps.cascade) > 0 {
+		w.Header().Add(allowCascadeHeader, strings.Join(caps.cascade, ","))
+	}
+	if caps.streaming {
+		w.Header().Add(allowStreamingHeader, MediaTypeNDJson)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// fetchCapabilities propagates an OPTIONS request for the given URL to the
+// backends and merges the capabilities they advertise. The static
+// capabilities are returned if no backend responds. The fan-out is detached
+// from the request that triggered it, since its result is shared.
+func (s *Server) fetchCapabilities(reqURL *url.URL) *capabilities {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sg := &scatterGather[Backend, capabilities]{
+		backends:    s.backendsFor(ctx),
+		maxWait:     config.Server.ResultMaxWait,
+		pool:        s.scatterPool,
+		concurrency: s.concurrency,
+	}
+	if err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*capabilities, error) {
+		if _, ok := b.(providersBackend); ok {
+			return nil, nil
+		}
+		endpoint := *reqURL
+		endpoint.Host = b.URL().Host
+		endpoint.Scheme = b.URL().Scheme
+		log := log.With("backend", endpoint.Host)
+
+		req, err := http.NewRequestWithContext(cctx, http.MethodOptions, endpoint.String(), nil)
+		if err != nil {
+			log.Warnw("Failed to construct OPTIONS backend query", "err", err)
+			return nil, err
+		}
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		s.middlewares.decorateBackendRequest(req, b)
+		if !b.Matches(req) {
+			return nil, nil
+		}
+		resp, err := b.Client().Do(req)
+		if err != nil {
+			recordBackendFailure(cctx, b.URL().Host, requestErrKind(err, false))
+			log.Warnw("Failed to query backend for OPTIONS", "err", err)
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err := fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
+			if resp.StatusCode < http.StatusInternalServerError {
+				// Backends that do not serve OPTIONS advertise nothing.
+				return nil, circuitbreaker.MarkAsSuccess(err)
+			}
+			recordBackendFailure(cctx, b.URL().Host, statusErrKind(resp.StatusCode))
+			return nil, err
+		}
+		return &capabilities{
+			methods:   splitHeaderList(resp.Header.Values("Access-Control-Allow-Methods")),
+			cascade:   splitHeaderList(resp.Header.Values(allowCascadeHeader)),
+			streaming: resp.Header.Get(allowStreamingHeader) != "" || s.streaming.supports(b),
+		}, nil
+	}); err != nil {
+		log.Errorw("Failed to scatter OPTIONS request", "err", err)
+		return staticCapabilities(s.cascade)
+	}
+
+	var responded bool
+	var methods, labels []string
+	var streaming bool
+	for caps := range sg.gather(ctx) {
+		responded = true
+		methods = append(methods, caps.methods...)
+		labels = append(labels, caps.cascade...)
+		streaming = streaming || caps.streaming
+	}
+	if !responded {
+		return staticCapabilities(s.cascade)
+	}
+	return mergeCapabilities(methods, labels, streaming, s.cascade)
+}
+
+// mergeCapabilities merges the given methods, cascade labels and streaming
+// support advertised by backends into the capabilities of find routes.
+// Methods are restricted to those served on find routes, where HEAD and
+// OPTIONS are always served regardless of backends. Cascade labels are
+// restricted to the supported ones if any, since others are rejected.
+func mergeCapabilities(methods, labels []string, streaming bool, supported []string) *capabilities {
+	caps := &capabilities{streaming: streaming}
+	for _, m := range findMethods {
+		if m == http.MethodHead || m == http.MethodOptions || slices.Contains(methods, m) {
+			caps.methods = append(caps.methods, m)
+		}
+	}
+	if len(supported) > 0 {
+		caps.cascade = supported
+	} else {
+		slices.Sort(labels)
+		caps.cascade = slices.Compact(labels)
+	}
+	return caps
+}
+
+// splitHeaderList splits the given values of a header that holds
+// comma-separated lists into their trimmed, non-empty elements.
+func splitHeaderList(values []string) []string {
+	var elems []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				elems = append(elems, e)
+			}
+		}
+	}
+	return elems
+}
@@ -0,0 +1,111 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_OptionsMergesBackendCapabilities(t *testing.T) {
+	var requests atomic.Int32
+	options := func(methods, cascade string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodOptions {
+				http.Error(w, "", http.StatusMethodNotAllowed)
+				return
+			}
+			requests.Add(1)
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			if cascade != "" {
+				w.Header().Set(allowCascadeHeader, cascade)
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}))
+	}
+	fish := options("GET, OPTIONS", "ipfs-dht")
+	defer fish.Close()
+	lobster := options("GET, POST, OPTIONS", "legacy, ipfs-dht")
+	defer lobster.Close()
+	unsupported := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}))
+	defer unsupported.Close()
+	providers := emptyProvidersBackend()
+	defer providers.Close()
+
+	subject, err := New(Options{Backends: []BackendConfig{
+		{URL: fish.URL},
+		{URL: lobster.URL},
+		{URL: unsupported.URL},
+		{URL: providers.URL, Type: BackendTypeProviders},
+	}})
+	require.NoError(t, err)
+	serve := func() http.Header {
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/multihash/QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH", nil))
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		return rec.Header()
+	}
+
+	got := serve()
+	require.Equal(t, "*", got.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, HEAD, OPTIONS", got.Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "ipfs-dht,legacy", got.Get(allowCascadeHeader))
+	require.Equal(t, MediaTypeNDJson, got.Get(allowStreamingHeader))
+	require.Equal(t, int32(2), requests.Load())
+
+	// Merged capabilities are cached until reset, e.g. on reload.
+	serve()
+	require.Equal(t, int32(2), requests.Load())
+	subject.(*Server).options.reset()
+	got = serve()
+	require.Equal(t, "ipfs-dht,legacy", got.Get(allowCascadeHeader))
+	require.Equal(t, int32(4), requests.Load())
+}
+
+func TestServer_OptionsWithoutBackendResponses(t *testing.T) {
+	defer func(old string) { config.Server.CascadeLabels = old }(config.Server.CascadeLabels)
+	config.Server.CascadeLabels = "ipfs-dht"
+	unsupported := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}))
+	defer unsupported.Close()
+	providers := emptyProvidersBackend()
+	defer providers.Close()
+
+	subject, err := New(Options{Backends: []BackendConfig{{URL: unsupported.URL}, {URL: providers.URL, Type: BackendTypeProviders}}})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/cid/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", nil))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Equal(t, "GET, HEAD, OPTIONS", rec.Header().Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "ipfs-dht", rec.Header().Get(allowCascadeHeader))
+	require.Empty(t, rec.Header().Get(allowStreamingHeader))
+}
+
+// emptyProvidersBackend serves no providers, and nothing else.
+func emptyProvidersBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/providers" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		_, _ = w.Write([]byte("[]"))
+	}))
+}
+
+func TestMergeCapabilities(t *testing.T) {
+	got := mergeCapabilities([]string{http.MethodPost}, []string{"legacy", "ipfs-dht", "legacy"}, false, nil)
+	require.Equal(t, []string{http.MethodHead, http.MethodOptions}, got.methods)
+	require.Equal(t, []string{"ipfs-dht", "legacy"}, got.cascade)
+	require.False(t, got.streaming)
+
+	// Only supported labels are advertised, since others are rejected.
+	got = mergeCapabilities([]string{http.MethodGet}, []string{"legacy"}, true, []string{"ipfs-dht"})
+	require.Equal(t, findMethods, got.methods)
+	require.Equal(t, []string{"ipfs-dht"}, got.cascade)
+	require.True(t, got.streaming)
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// payloadRoutes are the routes that payload sizes are recorded by, keyed by
+// path prefix. Paths matching none are recorded as routeOther, so that the
+// cardinality of the route tag is bounded.
+var payloadRoutes = []struct {
+	prefix string
+	route  string
+}{
+	{"/cid/", routeFind},
+	{"/multihash/", routeFind},
+	{"/encrypted/cid/", "find_encrypted"},
+	{"/encrypted/multihash/", "find_encrypted"},
+	{"/metadata/", routeMetadata},
+	{"/providers", "providers"},
+	{"/routing/v1/providers/", "delegated_providers"},
+	{"/routing/v1/encrypted/providers/", "delegated_encrypted"},
+	{"/routing/v1/peers/", "delegated_peers"},
+	{"/watch/", "watch"},
+}
+
+const routeOther = "other"
+
+// payloadRouteOf returns the route that the payload size of requests to the
+// given path are recorded by.
+func payloadRouteOf(p string) string {
+	p = strings.TrimPrefix(p, legacyFinderPrefix)
+	for _, pr := range payloadRoutes {
+		if strings.HasPrefix(p, pr.prefix) {
+			return pr.route
+		}
+	}
+	return routeOther
+}
+
+// payloadEncodingOf returns the encoding that the size of a response with the
+// given content type is recorded by.
+func payloadEncodingOf(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "":
+		return "none"
+	case MediaTypeJson:
+		return "json"
+	case MediaTypeNDJson:
+		return "ndjson"
+	case "text/html":
+		return "html"
+	default:
+		return "other"
+	}
+}
+
+// withResponseSizes records the size of the response bodies written by next,
+// by route and encoding.
+func withResponseSizes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		_ = stats.RecordWithOptions(r.Context(),
+			stats.WithTags(
+				tag.Insert(metrics.Route, payloadRouteOf(r.URL.Path)),
+				tag.Insert(metrics.Encoding, payloadEncodingOf(w.Header().Get("Content-Type")))),
+			stats.WithMeasurements(metrics.ResponseSize.M(rw.size)))
+	})
+}
+
+// sizedBody records the number of bytes read from a backend response body by
+// route once it is closed.
+type sizedBody struct {
+	io.ReadCloser
+	host  string
+	route string
+	size  atomic.Int64
+	once  sync.Once
+}
+
+func (b *sizedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size.Add(int64(n))
+	return n, err
+}
+
+func (b *sizedBody) Close() error {
+	b.once.Do(func() {
+		_ = stats.RecordWithOptions(context.Background(),
+			stats.WithTags(tag.Insert(metrics.Backend, b.host), tag.Insert(metrics.Route, b.route)),
+			stats.WithMeasurements(metrics.BackendResponseSize.M(b.size.Load())))
+	})
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,77 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestPayloadRouteOf(t *testing.T) {
+	require.Equal(t, routeFind, payloadRouteOf("/cid/fish"))
+	require.Equal(t, routeFind, payloadRouteOf(legacyFinderPrefix+"/multihash/fish"))
+	require.Equal(t, "find_encrypted", payloadRouteOf("/encrypted/multihash/fish"))
+	require.Equal(t, "providers", payloadRouteOf("/providers/fish"))
+	require.Equal(t, "delegated_providers", payloadRouteOf("/routing/v1/providers/fish"))
+	require.Equal(t, routeOther, payloadRouteOf("/ingest/announce"))
+}
+
+func TestFind_RecordsPayloadSizes(t *testing.T) {
+	responseView := &view.View{
+		Name:        "test/http/response_size",
+		Measure:     metrics.ResponseSize,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{metrics.Route, metrics.Encoding},
+	}
+	backendView := &view.View{
+		Name:        "test/backend/response_size",
+		Measure:     metrics.BackendResponseSize,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{metrics.Backend, metrics.Route},
+	}
+	require.NoError(t, view.Register(responseView, backendView))
+	defer view.Unregister(responseView, backendView)
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+	req.Header.Set("Accept", MediaTypeJson)
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	sumOf := func(name string, tags ...tag.Tag) float64 {
+		rows, err := view.RetrieveData(name)
+		require.NoError(t, err)
+		for _, row := range rows {
+			if slices.Equal(row.Tags, tags) {
+				return row.Data.(*view.SumData).Value
+			}
+		}
+		return 0
+	}
+	served := sumOf(responseView.Name,
+		tag.Tag{Key: metrics.Encoding, Value: "json"},
+		tag.Tag{Key: metrics.Route, Value: routeFind})
+	require.Equal(t, float64(rec.Body.Len()), served)
+	read := sumOf(backendView.Name,
+		tag.Tag{Key: metrics.Backend, Value: strings.TrimPrefix(backend.URL, "http://")},
+		tag.Tag{Key: metrics.Route, Value: routeFind})
+	require.Positive(t, read)
+}
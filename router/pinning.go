@@ -0,0 +1,94 @@
+package router
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	// backendPinningHeader restricts a request to the single backend with the
+	// given host, so that issues can be reproduced against a specific backend.
+	backendPinningHeader = "X-IPNI-Backend"
+	// backendPinningTokenHeader authenticates a pinned request.
+	backendPinningTokenHeader = "X-IPNI-Backend-Token"
+)
+
+type pinnedBackendKey struct{}
+
+// pinningHandler restricts requests that carry the backend pinning header to
+// the named backend. Pinned requests must carry the configured pinning token;
+// the header is ignored altogether when pinning is disabled.
+func (s *Server) pinningHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Header.Get(backendPinningHeader)
+		if host == "" || config.Server.BackendPinningToken == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get(backendPinningTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Server.BackendPinningToken)) != 1 {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		var known bool
+		for _, b := range s.backends() {
+			if pinnedTo(b, host) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			http.Error(w, "unknown backend", http.StatusBadRequest)
+			return
+		}
+		log.Infow("Serving request pinned to backend", "backend", host, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pinnedBackendKey{}, host)))
+	})
+}
+
+// backendsFor returns the backends to scatter the request with the given
+// context to: either the backend it is pinned to, or the backends of its
+// experiment variant short of any whose ingestion is lagging, but including
+// any that acknowledged a related recent write.
+func (s *Server) backendsFor(ctx context.Context) []Backend {
+	return s.backendsIn(ctx, s.backends())
+}
+
+// narrowedBackends reports whether the request with the given context is
+// scattered to backends chosen for it, i.e. it is pinned to a backend or
+// assigned an experiment variant, so that its results are not those of every
+// backend.
+func narrowedBackends(ctx context.Context) bool {
+	_, pinned := ctx.Value(pinnedBackendKey{}).(string)
+	return pinned || experimentVariantFrom(ctx) != nil
+}
+
+// backendsIn returns the backends among the given ones to scatter the request
+// with the given context to, as per backendsFor.
+func (s *Server) backendsIn(ctx context.Context, all []Backend) []Backend {
+	host, ok := ctx.Value(pinnedBackendKey{}).(string)
+	if !ok {
+		backends := all
+		if v := experimentVariantFrom(ctx); v != nil {
+			backends = v.backends(backends)
+		}
+		if s.ingest != nil {
+			backends = s.ingest.dropStale(backends)
+		}
+		return withRecentWrite(ctx, all, backends)
+	}
+	var pinned []Backend
+	for _, b := range all {
+		if pinnedTo(b, host) {
+			pinned = append(pinned, b)
+		}
+	}
+	return pinned
+}
+
+// pinnedTo checks whether the backend is named by the given host, with or
+// without port.
+func pinnedTo(b Backend, host string) bool {
+	return b.URL().Host == host || b.URL().Hostname() == host
+}
@@ -0,0 +1,63 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinningHandler(t *testing.T) {
+	defer func(token string) { config.Server.BackendPinningToken = token }(config.Server.BackendPinningToken)
+	config.Server.BackendPinningToken = "fish"
+
+	populated := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer populated.Close()
+	empty := httptest.NewServer(mockbackend.New())
+	defer empty.Close()
+
+	handler, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: populated.URL},
+			{URL: empty.URL},
+			{URL: populated.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+	subject := httptest.NewServer(handler)
+	defer subject.Close()
+
+	find := func(pinned, token string) int {
+		req, err := http.NewRequest(http.MethodGet, subject.URL+"/cid/"+mockbackend.SampleCids[0], nil)
+		require.NoError(t, err)
+		if pinned != "" {
+			req.Header.Set(backendPinningHeader, pinned)
+		}
+		if token != "" {
+			req.Header.Set(backendPinningTokenHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	hostOf := func(u string) string {
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		return parsed.Host
+	}
+
+	require.Equal(t, http.StatusOK, find("", ""))
+	require.Equal(t, http.StatusOK, find(hostOf(populated.URL), "fish"))
+	require.Equal(t, http.StatusNotFound, find(hostOf(empty.URL), "fish"))
+	require.Equal(t, http.StatusForbidden, find(hostOf(empty.URL), "lobster"))
+	require.Equal(t, http.StatusForbidden, find(hostOf(empty.URL), ""))
+	require.Equal(t, http.StatusBadRequest, find("crab.example.com", "fish"))
+
+	// The header is ignored when pinning is disabled.
+	config.Server.BackendPinningToken = ""
+	require.Equal(t, http.StatusOK, find(hostOf(empty.URL), ""))
+}
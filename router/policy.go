@@ -0,0 +1,238 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+const (
+	policyActionAllow   = "allow"
+	policyActionDeny    = "deny"
+	policyActionRewrite = "rewrite"
+)
+
+type (
+	// policy authorizes and rewrites requests according to an ordered list of
+	// rules, each matching requests via a CEL expression. The first matching
+	// allow or deny rule decides the request; matching rewrite rules modify
+	// the request and evaluation continues with the rewritten request. When no
+	// rule decides, the configured default action is taken.
+	//
+	// Rule expressions may refer to the following variables:
+	//   - path: the request URL path,
+	//   - method: the request method,
+	//   - ip: the client IP address,
+	//   - apiKey: the X-API-Key header, or bearer token of the Authorization
+	//     header,
+	//   - accept: the Accept header,
+	//   - query: the map of query parameters to their first value,
+	//
+	// as well as inCidr(ip, cidr) to check if an IP address is within a CIDR.
+	policy struct {
+		BaseMiddleware
+		rules []*policyRule
+		allow bool
+	}
+	policyRule struct {
+		// Match is a CEL expression that evaluates to true when the rule
+		// applies to a request.
+		Match string
+		// Action is one of allow, deny or rewrite.
+		Action string
+		// Status is the HTTP status of requests denied by the rule. Defaults
+		// to 403.
+		Status int `json:",omitempty"`
+		// Rewrite is the change made to requests matched by a rewrite rule.
+		Rewrite *policyRewrite `json:",omitempty"`
+
+		program cel.Program
+	}
+	policyRewrite struct {
+		// Path replaces the request path, if set.
+		Path string `json:",omitempty"`
+		// Query sets the given query parameters. Parameters set to an empty
+		// value are removed.
+		Query map[string]string `json:",omitempty"`
+	}
+)
+
+// newPolicy loads policy rules from the JSON file at the given path.
+func newPolicy(filePath string) (*policy, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*policyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid policy rules: %w", err)
+	}
+
+	var p policy
+	switch config.Policy.DefaultAction {
+	case policyActionAllow:
+		p.allow = true
+	case policyActionDeny:
+	default:
+		return nil, fmt.Errorf("invalid policy default action: %s", config.Policy.DefaultAction)
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("path", cel.StringType),
+		cel.Variable("method", cel.StringType),
+		cel.Variable("ip", cel.StringType),
+		cel.Variable("apiKey", cel.StringType),
+		cel.Variable("accept", cel.StringType),
+		cel.Variable("query", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Function("inCidr",
+			cel.Overload("inCidr_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(inCidr))),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		switch rule.Action {
+		case policyActionAllow, policyActionDeny:
+		case policyActionRewrite:
+			if rule.Rewrite == nil {
+				return nil, fmt.Errorf("policy rule %d: rewrite rule must specify rewrite", i)
+			}
+		default:
+			return nil, fmt.Errorf("policy rule %d: invalid action: %s", i, rule.Action)
+		}
+		ast, issues := env.Compile(rule.Match)
+		if issues.Err() != nil {
+			return nil, fmt.Errorf("policy rule %d: %w", i, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("policy rule %d: match must evaluate to bool", i)
+		}
+		if rule.program, err = env.Program(ast); err != nil {
+			return nil, fmt.Errorf("policy rule %d: %w", i, err)
+		}
+	}
+	p.rules = rules
+	return &p, nil
+}
+
+func (*policy) gatesOnly() {}
+
+func (p *policy) BeforeRequest(r *http.Request) (*http.Request, error) {
+	vars := policyVars(r)
+	for _, rule := range p.rules {
+		out, _, err := rule.program.Eval(vars)
+		if err != nil {
+			// Evaluation errors, e.g. a missing query parameter, do not match.
+			log.Debugw("Failed to evaluate policy rule", "match", rule.Match, "err", err)
+			continue
+		}
+		if matched, _ := out.Value().(bool); !matched {
+			continue
+		}
+		switch rule.Action {
+		case policyActionAllow:
+			return r, nil
+		case policyActionDeny:
+			return nil, &StatusError{Status: orDefault(rule.Status, http.StatusForbidden), Code: errCodeDeniedByPolicy, Err: fmt.Errorf("denied by policy rule: %s", rule.Match)}
+		case policyActionRewrite:
+			r = rule.Rewrite.apply(r)
+			vars = policyVars(r)
+		}
+	}
+	if !p.allow {
+		return nil, &StatusError{Status: http.StatusForbidden, Code: errCodeDeniedByPolicy, Err: fmt.Errorf("denied by default policy")}
+	}
+	return r, nil
+}
+
+func (rw *policyRewrite) apply(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	if rw.Path != "" {
+		r.URL.Path = rw.Path
+		r.URL.RawPath = ""
+	}
+	if len(rw.Query) > 0 {
+		q := r.URL.Query()
+		for k, v := range rw.Query {
+			if v == "" {
+				q.Del(k)
+			} else {
+				q.Set(k, v)
+			}
+		}
+		r.URL.RawQuery = q.Encode()
+	}
+	r.RequestURI = r.URL.RequestURI()
+	return r
+}
+
+func policyVars(r *http.Request) map[string]any {
+	query := make(map[string]string)
+	for k, vs := range r.URL.Query() {
+		if len(vs) > 0 {
+			query[k] = vs[0]
+		}
+	}
+	return map[string]any{
+		"path":   r.URL.Path,
+		"method": r.Method,
+		"ip":     clientIP(r),
+		"apiKey": requestAPIKey(r),
+		"accept": r.Header.Get("Accept"),
+		"query":  query,
+	}
+}
+
+// requestAPIKey returns the X-API-Key header of the request, or the bearer
+// token of its Authorization header otherwise.
+func requestAPIKey(r *http.Request) string {
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		return apiKey
+	}
+	apiKey, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return apiKey
+}
+
+// hashAPIKey returns the hash that identifies the given API key wherever it
+// is shared or exposed, so that the key itself never is.
+func hashAPIKey(apiKey string) string {
+	return strconv.FormatUint(xxhash.Sum64String(apiKey), 16)
+}
+
+// clientIP returns the IP address of the client that sent the request.
+func clientIP(r *http.Request) string {
+	if config.Policy.TrustForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func inCidr(ip, cidr ref.Val) ref.Val {
+	addr, err := netip.ParseAddr(fmt.Sprint(ip.Value()))
+	if err != nil {
+		return types.False
+	}
+	prefix, err := netip.ParsePrefix(fmt.Sprint(cidr.Value()))
+	if err != nil {
+		return types.NewErr("invalid cidr: %s", cidr.Value())
+	}
+	return types.Bool(prefix.Contains(addr.Unmap()))
+}
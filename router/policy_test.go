@@ -0,0 +1,85 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPolicy(t *testing.T, rules string) (*policy, error) {
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policyPath, []byte(rules), 0o644))
+	return newPolicy(policyPath)
+}
+
+func TestPolicy_BeforeRequest(t *testing.T) {
+	subject, err := newTestPolicy(t, `[
+		{"Match": "path.startsWith('/providers') && apiKey != 'fish'", "Action": "deny", "Status": 401},
+		{"Match": "inCidr(ip, '10.0.0.0/8')", "Action": "deny"},
+		{"Match": "accept == 'application/x-ndjson'", "Action": "rewrite", "Rewrite": {"Query": {"cascade": "ipfs-dht"}}},
+		{"Match": "query['cascade'] == 'ipfs-dht'", "Action": "deny", "Status": 429}
+	]`)
+	require.NoError(t, err)
+
+	deniedStatus := func(r *http.Request) int {
+		_, err := subject.BeforeRequest(r)
+		if err == nil {
+			return 0
+		}
+		return err.(*StatusError).Status
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/providers", nil)
+	require.Equal(t, http.StatusUnauthorized, deniedStatus(r))
+	r.Header.Set("Authorization", "Bearer fish")
+	require.Zero(t, deniedStatus(r))
+
+	r = httptest.NewRequest(http.MethodGet, "/multihash/lobster", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	require.Equal(t, http.StatusForbidden, deniedStatus(r))
+
+	// The rewritten query parameter is visible to subsequent rules.
+	r = httptest.NewRequest(http.MethodGet, "/multihash/lobster", nil)
+	r.Header.Set("Accept", MediaTypeNDJson)
+	require.Equal(t, http.StatusTooManyRequests, deniedStatus(r))
+
+	r = httptest.NewRequest(http.MethodGet, "/multihash/lobster", nil)
+	require.Zero(t, deniedStatus(r))
+}
+
+func TestPolicy_DefaultDeny(t *testing.T) {
+	defer func(action string) { config.Policy.DefaultAction = action }(config.Policy.DefaultAction)
+	config.Policy.DefaultAction = policyActionDeny
+
+	subject, err := newTestPolicy(t, `[{"Match": "method == 'GET'", "Action": "allow"}]`)
+	require.NoError(t, err)
+
+	_, err = subject.BeforeRequest(httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NoError(t, err)
+	_, err = subject.BeforeRequest(httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Error(t, err)
+}
+
+func TestPolicy_RewritesRequest(t *testing.T) {
+	subject, err := newTestPolicy(t, `[{"Match": "path == '/fish'", "Action": "rewrite", "Rewrite": {"Path": "/lobster", "Query": {"crab": ""}}}]`)
+	require.NoError(t, err)
+
+	got, err := subject.BeforeRequest(httptest.NewRequest(http.MethodGet, "/fish?crab=1&squid=2", nil))
+	require.NoError(t, err)
+	require.Equal(t, "/lobster?squid=2", got.URL.RequestURI())
+}
+
+func TestNewPolicy_RejectsInvalidRules(t *testing.T) {
+	_, err := newTestPolicy(t, `[{"Match": "path", "Action": "allow"}]`)
+	require.ErrorContains(t, err, "must evaluate to bool")
+	_, err = newTestPolicy(t, `[{"Match": "true", "Action": "fish"}]`)
+	require.ErrorContains(t, err, "invalid action")
+	_, err = newTestPolicy(t, `[{"Match": "true", "Action": "rewrite"}]`)
+	require.ErrorContains(t, err, "must specify rewrite")
+	_, err = newTestPolicy(t, `[{"Match": "unknown == 1", "Action": "allow"}]`)
+	require.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+)
+
+const (
+	// priorityHeader sets the priority class of a request, one of high or
+	// low.
+	priorityHeader = "X-IPNI-Priority"
+
+	priorityHigh = "high"
+	priorityLow  = "low"
+)
+
+type priorityKey struct{}
+
+// priorityClass is the priority of a request, as determined on arrival.
+type priorityClass struct {
+	low bool
+	// underLoad is whether the server was under load when the request
+	// arrived.
+	underLoad bool
+}
+
+// prioritizer classifies requests into high and low priority, so that
+// interactive clients do not compete equally with bulk clients such as
+// gateways during incidents. While more requests than the load threshold are
+// in flight, low priority requests get shorter backend deadlines and are
+// served from cache when possible. While more than the shed threshold are in
+// flight, low priority requests are rejected with 503 Service Unavailable.
+//
+// The class of a request is set by its API key, if configured, or else its
+// priority header, or else the configured default.
+type prioritizer struct {
+	defaultLow bool
+	keys       map[string]bool
+	inFlight   atomic.Int64
+}
+
+func newPrioritizer() (*prioritizer, error) {
+	p := &prioritizer{keys: make(map[string]bool)}
+	var err error
+	if p.defaultLow, err = parsePriority(config.Priority.Default); err != nil {
+		return nil, err
+	}
+	for _, kv := range strings.Split(config.Priority.Keys, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		key, class, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("priority key must be of the form key=class, got %s", kv)
+		}
+		if p.keys[key], err = parsePriority(class); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// parsePriority parses the given priority class, and returns whether it is
+// low.
+func parsePriority(class string) (bool, error) {
+	switch class {
+	case priorityHigh:
+		return false, nil
+	case priorityLow:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown priority class: %s", class)
+	}
+}
+
+func (p *prioritizer) classify(r *http.Request) priorityClass {
+	if low, ok := p.keys[requestAPIKey(r)]; ok {
+		return priorityClass{low: low}
+	}
+	if low, err := parsePriority(r.Header.Get(priorityHeader)); err == nil {
+		return priorityClass{low: low}
+	}
+	return priorityClass{low: p.defaultLow}
+}
+
+func (p *prioritizer) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight := p.inFlight.Add(1)
+		defer p.inFlight.Add(-1)
+
+		class := p.classify(r)
+		if class.low && config.Priority.ShedThreshold > 0 && inFlight > int64(config.Priority.ShedThreshold) {
+			_ = stats.RecordWithOptions(r.Context(), stats.WithMeasurements(metrics.PriorityShed.M(1)))
+			w.Header().Set("Retry-After", "1")
+			httpError(w, "", errCodeOverloaded, http.StatusServiceUnavailable)
+			return
+		}
+		class.underLoad = config.Priority.LoadThreshold > 0 && inFlight > int64(config.Priority.LoadThreshold)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), priorityKey{}, class)))
+	})
+}
+
+// lowPriorityUnderLoad checks whether the request with the given context is
+// of low priority and arrived while the server was under load.
+func lowPriorityUnderLoad(ctx context.Context) bool {
+	class, ok := ctx.Value(priorityKey{}).(priorityClass)
+	return ok && class.low && class.underLoad
+}
+
+// priorityMaxWait bounds the given backend deadline of the request with the
+// given context according to its priority.
+func priorityMaxWait(ctx context.Context, maxWait time.Duration) time.Duration {
+	if config.Priority.LowMaxWait > 0 && lowPriorityUnderLoad(ctx) {
+		return min(maxWait, config.Priority.LowMaxWait)
+	}
+	return maxWait
+}
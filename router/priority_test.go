@@ -0,0 +1,132 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrioritizer_ClassifiesAndShedsLowPriority(t *testing.T) {
+	defer func(old string) { config.Priority.Keys = old }(config.Priority.Keys)
+	defer func(old int) { config.Priority.LoadThreshold = old }(config.Priority.LoadThreshold)
+	defer func(old int) { config.Priority.ShedThreshold = old }(config.Priority.ShedThreshold)
+	defer func(old time.Duration) { config.Priority.LowMaxWait = old }(config.Priority.LowMaxWait)
+	config.Priority.Keys = "gateway=low,fish=high"
+	config.Priority.LoadThreshold = 1
+	config.Priority.ShedThreshold = 2
+	config.Priority.LowMaxWait = time.Second
+
+	subject, err := newPrioritizer()
+	require.NoError(t, err)
+	var got priorityClass
+	handler := subject.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = r.Context().Value(priorityKey{}).(priorityClass)
+		require.Equal(t, got.low && got.underLoad, lowPriorityUnderLoad(r.Context()))
+		if lowPriorityUnderLoad(r.Context()) {
+			require.Equal(t, time.Second, priorityMaxWait(r.Context(), time.Minute))
+		} else {
+			require.Equal(t, time.Minute, priorityMaxWait(r.Context(), time.Minute))
+		}
+	}))
+	serve := func(apiKey, priority string) int {
+		r := httptest.NewRequest(http.MethodGet, "/cid/fish", nil)
+		if apiKey != "" {
+			r.Header.Set("X-API-Key", apiKey)
+		}
+		if priority != "" {
+			r.Header.Set(priorityHeader, priority)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, serve("", ""))
+	require.Equal(t, priorityClass{}, got)
+	require.Equal(t, http.StatusOK, serve("gateway", ""))
+	require.Equal(t, priorityClass{low: true}, got)
+	// API keys take precedence over the priority header.
+	require.Equal(t, http.StatusOK, serve("fish", priorityLow))
+	require.Equal(t, priorityClass{}, got)
+	require.Equal(t, http.StatusOK, serve("", priorityLow))
+	require.Equal(t, priorityClass{low: true}, got)
+
+	subject.inFlight.Store(1)
+	require.Equal(t, http.StatusOK, serve("gateway", ""))
+	require.Equal(t, priorityClass{low: true, underLoad: true}, got)
+	require.Equal(t, http.StatusOK, serve("", ""))
+	require.Equal(t, priorityClass{underLoad: true}, got)
+
+	subject.inFlight.Store(2)
+	require.Equal(t, http.StatusServiceUnavailable, serve("gateway", ""))
+	require.Equal(t, http.StatusOK, serve("", ""))
+	require.False(t, lowPriorityUnderLoad(context.Background()))
+}
+
+func TestNewPrioritizer_RejectsInvalid(t *testing.T) {
+	defer func(old string) { config.Priority.Keys = old }(config.Priority.Keys)
+	defer func(old string) { config.Priority.Default = old }(config.Priority.Default)
+	for _, c := range []struct{ def, keys string }{
+		{def: "urgent"},
+		{def: priorityHigh, keys: "gateway"},
+		{def: priorityHigh, keys: "gateway=urgent"},
+	} {
+		config.Priority.Default = c.def
+		config.Priority.Keys = c.keys
+		_, err := newPrioritizer()
+		require.Error(t, err)
+	}
+}
+
+func TestFind_ServesLowPriorityFromCacheUnderLoad(t *testing.T) {
+	defer func(old time.Duration) { config.Cache.TTL = old }(config.Cache.TTL)
+	defer func(old time.Duration) { config.Cache.RevalidateWindow = old }(config.Cache.RevalidateWindow)
+	defer func(old int) { config.Priority.LoadThreshold = old }(config.Priority.LoadThreshold)
+	config.Cache.TTL = time.Nanosecond
+	config.Cache.RevalidateWindow = time.Hour
+	config.Priority.LoadThreshold = 1
+
+	var finds atomic.Int32
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/providers") {
+			finds.Add(1)
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := NewServer(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		req.Header.Set(priorityHeader, priorityLow)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+	require.Equal(t, http.StatusOK, find().Code)
+	require.Equal(t, int32(2), finds.Load())
+
+	// Under load, the cached result is served without being revalidated.
+	subject.priority.inFlight.Store(1)
+	cached := find()
+	require.Equal(t, http.StatusOK, cached.Code)
+	require.NotEmpty(t, cached.Header().Get("Age"))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(2), finds.Load())
+}
@@ -0,0 +1,104 @@
+package router
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+)
+
+// provenanceQueryParam opts find requests into annotating each provider
+// record with the backends that returned it and when, for debugging and
+// downstream trust decisions. Records follow the standard schema otherwise.
+const provenanceQueryParam = "provenance"
+
+type (
+	// provenance is a backend that returned a provider record, and when.
+	provenance struct {
+		Backend    string
+		ReceivedAt time.Time
+	}
+	// annotatedResult is a provider record annotated with its provenance.
+	annotatedResult struct {
+		model.ProviderResult
+		Provenance []provenance
+	}
+	// annotatedFindResponse is a find response of annotated provider
+	// records.
+	annotatedFindResponse struct {
+		MultihashResults []annotatedMultihashResult `json:"MultihashResults,omitempty"`
+	}
+	annotatedMultihashResult struct {
+		Multihash       multihash.Multihash
+		ProviderResults []annotatedResult
+	}
+)
+
+// provenanceRequested checks whether the given find request opts into
+// provenance annotations, and returns its URL without the opt-in, so that
+// backends are asked for the lookup as is.
+func provenanceRequested(r *http.Request) (bool, *url.URL) {
+	query := r.URL.Query()
+	if query.Get(provenanceQueryParam) != "true" {
+		return false, r.URL
+	}
+	reqURL := *r.URL
+	query.Del(provenanceQueryParam)
+	reqURL.RawQuery = query.Encode()
+	return true, &reqURL
+}
+
+func newProvenance(b Backend) provenance {
+	return provenance{Backend: b.URL().Host, ReceivedAt: time.Now().UTC()}
+}
+
+// provenanceTracker tracks the provenance of the provider records of a find
+// response as they are gathered, including the backends that returned records
+// already gathered.
+type provenanceTracker struct {
+	// records is the provenance of each record by its index in the response.
+	records [][]provenance
+	// derived holds the indices of the records derived from each result of
+	// backends via middleware, by the key of the result.
+	derived map[string][]int
+}
+
+func newProvenanceTracker() *provenanceTracker {
+	return &provenanceTracker{derived: make(map[string][]int)}
+}
+
+func provenanceKey(r *encryptedOrPlainResult) string {
+	var id string
+	if r.Provider != nil {
+		id = string(r.Provider.ID)
+	}
+	return id + "\x00" + string(r.ContextID) + "\x00" + string(r.Metadata)
+}
+
+// add tracks the next record of the response, derived from the given result
+// returned by the given backend.
+func (t *provenanceTracker) add(from *encryptedOrPlainResult, b Backend) {
+	key := provenanceKey(from)
+	t.derived[key] = append(t.derived[key], len(t.records))
+	t.records = append(t.records, []provenance{newProvenance(b)})
+}
+
+// returnedAgain tracks that the given backend returned the given result,
+// which was already gathered.
+func (t *provenanceTracker) returnedAgain(r *encryptedOrPlainResult, b Backend) {
+	p := newProvenance(b)
+	for _, i := range t.derived[provenanceKey(r)] {
+		t.records[i] = append(t.records[i], p)
+	}
+}
+
+// annotate annotates the given records of the response with their provenance.
+func (t *provenanceTracker) annotate(prs []model.ProviderResult) []annotatedResult {
+	annotated := make([]annotatedResult, 0, len(prs))
+	for i, pr := range prs {
+		annotated = append(annotated, annotatedResult{ProviderResult: pr, Provenance: t.records[i]})
+	}
+	return annotated
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind_AnnotatesProvenanceOnRequest(t *testing.T) {
+	first := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer first.Close()
+	second := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer second.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: first.URL},
+			{URL: second.URL},
+			{URL: first.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+	hosts := []string{strings.TrimPrefix(first.URL, "http://"), strings.TrimPrefix(second.URL, "http://")}
+	find := func(query, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0]+query, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	// Records returned by both backends list both of them.
+	var resp annotatedFindResponse
+	require.NoError(t, json.Unmarshal(find("?provenance=true", MediaTypeJson).Body.Bytes(), &resp))
+	require.Len(t, resp.MultihashResults, 1)
+	require.NotEmpty(t, resp.MultihashResults[0].ProviderResults)
+	for _, pr := range resp.MultihashResults[0].ProviderResults {
+		require.Len(t, pr.Provenance, 2)
+		require.ElementsMatch(t, hosts, []string{pr.Provenance[0].Backend, pr.Provenance[1].Backend})
+		require.False(t, pr.Provenance[0].ReceivedAt.IsZero())
+	}
+
+	// Streamed records carry the backend that returned them first.
+	scanner := bufio.NewScanner(find("?provenance=true", MediaTypeNDJson).Body)
+	var lines int
+	for scanner.Scan() {
+		var record annotatedResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		require.Len(t, record.Provenance, 1)
+		require.Contains(t, hosts, record.Provenance[0].Backend)
+		lines++
+	}
+	require.Equal(t, len(resp.MultihashResults[0].ProviderResults), lines)
+
+	// Records follow the standard schema otherwise.
+	require.NotContains(t, find("", MediaTypeJson).Body.String(), "Provenance")
+	require.NotContains(t, find("", MediaTypeNDJson).Body.String(), "Provenance")
+}
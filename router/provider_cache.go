@@ -0,0 +1,319 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipni/go-libipni/apierror"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/pcache"
+	"github.com/ipni/indexstar/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// providerCache caches the information on providers listed by providers
+// backends. Refreshes are driven by the server rather than by lookups, so that
+// they happen regardless of lookups and are observed.
+type providerCache struct {
+	*pcache.ProviderCache
+
+	mu sync.Mutex
+	// loaded holds the providers loaded by the ongoing refresh across sources,
+	// if the cache size is bounded. Providers beyond the bound are not loaded,
+	// and so expire from the cache once its TTL passes.
+	loaded map[peer.ID]struct{}
+}
+
+// providerSource is a source of the provider cache that records its errors,
+// and lists no more providers than the configured max size of the cache.
+type providerSource struct {
+	pcache.ProviderSource
+	host  string
+	cache *providerCache
+}
+
+// Policies by which the provider cache merges the information on a provider
+// listed by several providers backends.
+const (
+	providersMergeFreshest = "freshest"
+	providersMergeUnion    = "union"
+	providersMergePrefer   = "prefer"
+)
+
+func newProviderCache(backends []Backend) (*providerCache, error) {
+	switch config.Providers.MergePolicy {
+	case providersMergeFreshest, providersMergeUnion:
+	case providersMergePrefer:
+		if config.Providers.PreferredSource == "" {
+			return nil, fmt.Errorf("providers merge policy %s requires a preferred source", providersMergePrefer)
+		}
+	default:
+		return nil, fmt.Errorf("unknown providers merge policy %q", config.Providers.MergePolicy)
+	}
+
+	pc := &providerCache{}
+	var sources []*providerSource
+	for _, backend := range backends {
+		// do not send providers requests to not providers backends
+		if _, ok := backend.(providersBackend); !ok {
+			continue
+		}
+		// Provider lookups trip the providers circuit of the backend.
+		client := *backend.Client()
+		if cb := backend.CBFor(circuitProviders); cb != nil {
+			client.Transport = &circuitTransport{next: orDefault(client.Transport, http.DefaultTransport), cb: cb, probed: probePathOf(backend) != ""}
+		}
+		httpSrc, err := pcache.NewHTTPSource(backend.URL().String(), &client)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create http provider source: %w", err)
+		}
+		sources = append(sources, &providerSource{ProviderSource: httpSrc, host: backend.URL().Host, cache: pc})
+	}
+	// The information of several sources is merged as per the configured
+	// policy, rather than left to the cache, which takes the freshest.
+	var merged []pcache.ProviderSource
+	if len(sources) > 1 {
+		merged = append(merged, &mergedProviderSource{sources: sources})
+	} else {
+		for _, src := range sources {
+			merged = append(merged, src)
+		}
+	}
+	var err error
+	pc.ProviderCache, err = pcache.New(
+		pcache.WithSource(merged...),
+		pcache.WithTTL(config.Providers.CacheTTL),
+		pcache.WithPreload(false),
+		pcache.WithRefreshInterval(0))
+	if err != nil {
+		return nil, err
+	}
+	if config.Providers.CachePreload {
+		pc.refresh(context.Background())
+	}
+	return pc, nil
+}
+
+// run refreshes the cache at the configured interval until the context is
+// done.
+func (pc *providerCache) run(ctx context.Context) {
+	ticker := time.NewTicker(config.Providers.CacheRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pc.refresh(ctx)
+		}
+	}
+}
+
+// refresh refreshes the cache from its sources, and records how long it took
+// and the resulting size of the cache.
+func (pc *providerCache) refresh(ctx context.Context) {
+	pc.mu.Lock()
+	pc.loaded = make(map[peer.ID]struct{})
+	pc.mu.Unlock()
+	start := time.Now()
+	if err := pc.Refresh(ctx); err != nil {
+		log.Warnw("Failed to refresh provider cache", "err", err)
+		return
+	}
+	_ = stats.RecordWithOptions(ctx,
+		stats.WithMeasurements(
+			metrics.ProviderCacheRefresh.M(float64(time.Since(start).Milliseconds())),
+			metrics.ProviderCacheSize.M(int64(pc.Len()))))
+}
+
+func (s *providerSource) Fetch(ctx context.Context, pid peer.ID) (*model.ProviderInfo, error) {
+	pinfo, err := s.ProviderSource.Fetch(ctx, pid)
+	if err != nil {
+		s.recordError(ctx)
+	}
+	return pinfo, err
+}
+
+func (s *providerSource) FetchAll(ctx context.Context) ([]*model.ProviderInfo, error) {
+	pinfos, err := s.ProviderSource.FetchAll(ctx)
+	if err != nil {
+		s.recordError(ctx)
+		return nil, err
+	}
+	if config.Providers.CacheMaxSize > 0 {
+		pinfos = s.cache.admit(s.host, pinfos)
+	}
+	return pinfos, nil
+}
+
+// admit returns the given providers listed by the source of the given host
+// that fit in the cache, i.e. those already loaded by the ongoing refresh and
+// as many others as the configured max size allows.
+func (pc *providerCache) admit(host string, pinfos []*model.ProviderInfo) []*model.ProviderInfo {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	admitted := pinfos[:0:0]
+	for _, pinfo := range pinfos {
+		id := pinfo.AddrInfo.ID
+		if _, ok := pc.loaded[id]; !ok {
+			if len(pc.loaded) >= config.Providers.CacheMaxSize {
+				continue
+			}
+			pc.loaded[id] = struct{}{}
+		}
+		admitted = append(admitted, pinfo)
+	}
+	if dropped := len(pinfos) - len(admitted); dropped > 0 {
+		log.Warnw("Provider cache max size reached; dropping providers", "source", host, "dropped", dropped, "maxSize", config.Providers.CacheMaxSize)
+	}
+	return admitted
+}
+
+func (s *providerSource) recordError(ctx context.Context) {
+	_ = stats.RecordWithOptions(ctx,
+		stats.WithTags(tag.Insert(metrics.Backend, s.host)),
+		stats.WithMeasurements(metrics.ProviderCacheSourceErrors.M(1)))
+}
+
+// mergedProviderSource is a source of the provider cache that lists the
+// providers of several sources, merging the information on providers listed by
+// more than one as per the configured merge policy.
+type mergedProviderSource struct {
+	sources []*providerSource
+}
+
+// sourcedProviderInfo is the information on a provider listed by the source
+// of the given host.
+type sourcedProviderInfo struct {
+	host  string
+	pinfo *model.ProviderInfo
+}
+
+func (s *mergedProviderSource) Fetch(ctx context.Context, pid peer.ID) (*model.ProviderInfo, error) {
+	var listed []sourcedProviderInfo
+	var errs []error
+	for _, src := range s.sources {
+		pinfo, err := src.Fetch(ctx, pid)
+		if err != nil {
+			var apiErr *apierror.Error
+			if !errors.As(err, &apiErr) || apiErr.Status() != http.StatusNotFound {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if pinfo != nil {
+			listed = append(listed, sourcedProviderInfo{host: src.host, pinfo: pinfo})
+		}
+	}
+	if len(listed) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return mergeProviderInfos(ctx, listed), nil
+}
+
+func (s *mergedProviderSource) FetchAll(ctx context.Context) ([]*model.ProviderInfo, error) {
+	var order []peer.ID
+	listed := make(map[peer.ID][]sourcedProviderInfo)
+	var errs []error
+	for _, src := range s.sources {
+		pinfos, err := src.FetchAll(ctx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, pinfo := range pinfos {
+			id := pinfo.AddrInfo.ID
+			if _, ok := listed[id]; !ok {
+				order = append(order, id)
+			}
+			listed[id] = append(listed[id], sourcedProviderInfo{host: src.host, pinfo: pinfo})
+		}
+	}
+	if len(errs) == len(s.sources) {
+		return nil, errors.Join(errs...)
+	}
+	merged := make([]*model.ProviderInfo, 0, len(order))
+	for _, id := range order {
+		merged = append(merged, mergeProviderInfos(ctx, listed[id]))
+	}
+	return merged, nil
+}
+
+func (s *mergedProviderSource) String() string {
+	hosts := make([]string, 0, len(s.sources))
+	for _, src := range s.sources {
+		hosts = append(hosts, src.host)
+	}
+	return fmt.Sprintf("merged%v", hosts)
+}
+
+// mergeProviderInfos merges the given information on a provider listed by one
+// or more sources as per the configured merge policy, and records a conflict
+// if the sources list different addresses.
+func mergeProviderInfos(ctx context.Context, listed []sourcedProviderInfo) *model.ProviderInfo {
+	freshest := listed[0]
+	var freshestTime time.Time
+	for i, l := range listed {
+		// Ties go to the first source, as in the cache itself.
+		if t, _ := time.Parse(time.RFC3339, l.pinfo.LastAdvertisementTime); i == 0 || t.After(freshestTime) {
+			freshest, freshestTime = l, t
+		}
+	}
+
+	var conflict bool
+	for _, l := range listed[1:] {
+		if !sameAddrs(l.pinfo, listed[0].pinfo) {
+			conflict = true
+			break
+		}
+	}
+	if conflict {
+		log.Debugw("Providers backends list conflicting addresses of provider", "provider", freshest.pinfo.AddrInfo.ID, "policy", config.Providers.MergePolicy)
+		_ = stats.RecordWithOptions(ctx, stats.WithMeasurements(metrics.ProviderCacheConflicts.M(1)))
+	}
+
+	switch config.Providers.MergePolicy {
+	case providersMergeUnion:
+		if !conflict {
+			return freshest.pinfo
+		}
+		union := *freshest.pinfo
+		union.AddrInfo.Addrs = slices.Clone(freshest.pinfo.AddrInfo.Addrs)
+		for _, l := range listed {
+			for _, addr := range l.pinfo.AddrInfo.Addrs {
+				if !slices.ContainsFunc(union.AddrInfo.Addrs, addr.Equal) {
+					union.AddrInfo.Addrs = append(union.AddrInfo.Addrs, addr)
+				}
+			}
+		}
+		return &union
+	case providersMergePrefer:
+		for _, l := range listed {
+			if l.host == config.Providers.PreferredSource {
+				return l.pinfo
+			}
+		}
+	}
+	return freshest.pinfo
+}
+
+// sameAddrs checks whether the given providers have the same addresses,
+// regardless of order.
+func sameAddrs(a, b *model.ProviderInfo) bool {
+	if len(a.AddrInfo.Addrs) != len(b.AddrInfo.Addrs) {
+		return false
+	}
+	for _, addr := range a.AddrInfo.Addrs {
+		if !slices.ContainsFunc(b.AddrInfo.Addrs, addr.Equal) {
+			return false
+		}
+	}
+	return true
+}
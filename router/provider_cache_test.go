@@ -0,0 +1,158 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestProviderCache_BoundsSizeAndRecordsMetrics(t *testing.T) {
+	defer func(v int) { config.Providers.CacheMaxSize = v }(config.Providers.CacheMaxSize)
+	config.Providers.CacheMaxSize = 2
+	sizeView := &view.View{
+		Name:        "test/pcache/size",
+		Measure:     metrics.ProviderCacheSize,
+		Aggregation: view.LastValue(),
+	}
+	errorsView := &view.View{
+		Name:        "test/pcache/source_errors",
+		Measure:     metrics.ProviderCacheSourceErrors,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{metrics.Backend},
+	}
+	require.NoError(t, view.Register(sizeView, errorsView))
+	defer view.Unregister(sizeView, errorsView)
+
+	var ids []peer.ID
+	for _, s := range []string{
+		"12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h",
+		"12D3KooWD1XypSuBmhebQcvq7Sf1XJZ1hKSfYCED4w6eyxhzwqnV",
+		"12D3KooWBckWLKiYoUX4k3HTrbrSe4DD5SPNTKgP6vKTva1NaRkJ",
+	} {
+		id, err := peer.Decode(s)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	source := func(ids ...peer.ID) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			var pinfos []model.ProviderInfo
+			for _, id := range ids {
+				pinfos = append(pinfos, model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: id}})
+			}
+			_ = json.NewEncoder(w).Encode(pinfos)
+		}))
+	}
+	first := source(ids[0], ids[1])
+	defer first.Close()
+	// Providers already loaded from the first source fit in the cache.
+	second := source(ids[1], ids[2])
+	defer second.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	var backends []Backend
+	for _, u := range []string{first.URL, second.URL, failing.URL} {
+		b, err := NewBackend(u, nil, Matchers.Any, nil)
+		require.NoError(t, err)
+		backends = append(backends, providersBackend{b})
+	}
+
+	subject, err := newProviderCache(backends)
+	require.NoError(t, err)
+	require.Equal(t, 2, subject.Len())
+	for _, id := range ids[:2] {
+		pinfo, err := subject.Get(context.Background(), id)
+		require.NoError(t, err)
+		require.NotNil(t, pinfo)
+	}
+
+	rows, err := view.RetrieveData(sizeView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.Equal(t, 2.0, rows[0].Data.(*view.LastValueData).Value)
+	rows, err = view.RetrieveData(errorsView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.Equal(t, []tag.Tag{{Key: metrics.Backend, Value: strings.TrimPrefix(failing.URL, "http://")}}, rows[0].Tags)
+}
+
+func TestProviderCache_MergesConflictingSources(t *testing.T) {
+	defer func(v string) { config.Providers.MergePolicy = v }(config.Providers.MergePolicy)
+	defer func(v string) { config.Providers.PreferredSource = v }(config.Providers.PreferredSource)
+	conflictsView := &view.View{
+		Name:        "test/pcache/conflicts",
+		Measure:     metrics.ProviderCacheConflicts,
+		Aggregation: view.Count(),
+	}
+	require.NoError(t, view.Register(conflictsView))
+	defer view.Unregister(conflictsView)
+
+	id, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	source := func(addr, lastAdvertised string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pinfo := model.ProviderInfo{
+				AddrInfo:              peer.AddrInfo{ID: id, Addrs: []multiaddr.Multiaddr{multiaddr.StringCast(addr)}},
+				LastAdvertisementTime: lastAdvertised,
+			}
+			if strings.HasPrefix(r.URL.Path, "/providers/") {
+				_ = json.NewEncoder(w).Encode(pinfo)
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]model.ProviderInfo{pinfo})
+		}))
+	}
+	stale := source("/ip4/192.0.2.1/tcp/4001", "2024-01-01T00:00:00Z")
+	defer stale.Close()
+	fresh := source("/ip4/192.0.2.2/tcp/4001", "2024-06-01T00:00:00Z")
+	defer fresh.Close()
+	var backends []Backend
+	for _, u := range []string{stale.URL, fresh.URL} {
+		b, err := NewBackend(u, nil, Matchers.Any, nil)
+		require.NoError(t, err)
+		backends = append(backends, providersBackend{b})
+	}
+	addrsOf := func() []string {
+		subject, err := newProviderCache(backends)
+		require.NoError(t, err)
+		pinfo, err := subject.Get(context.Background(), id)
+		require.NoError(t, err)
+		var addrs []string
+		for _, addr := range pinfo.AddrInfo.Addrs {
+			addrs = append(addrs, addr.String())
+		}
+		return addrs
+	}
+
+	config.Providers.MergePolicy = providersMergeFreshest
+	require.Equal(t, []string{"/ip4/192.0.2.2/tcp/4001"}, addrsOf())
+	config.Providers.MergePolicy = providersMergeUnion
+	require.Equal(t, []string{"/ip4/192.0.2.2/tcp/4001", "/ip4/192.0.2.1/tcp/4001"}, addrsOf())
+	config.Providers.MergePolicy = providersMergePrefer
+	config.Providers.PreferredSource = backends[0].URL().Host
+	require.Equal(t, []string{"/ip4/192.0.2.1/tcp/4001"}, addrsOf())
+
+	rows, err := view.RetrieveData(conflictsView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.EqualValues(t, 3, rows[0].Data.(*view.CountData).Value)
+
+	config.Providers.PreferredSource = ""
+	_, err = newProviderCache(backends)
+	require.Error(t, err)
+	config.Providers.MergePolicy = "fish"
+	_, err = newProviderCache(backends)
+	require.Error(t, err)
+}
@@ -0,0 +1,249 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mercari/go-circuitbreaker"
+)
+
+func (s *Server) providers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pinfos, ok := s.scatterProviders(r.Context(), r.URL)
+	if !ok {
+		pinfos = s.pcache.List()
+	}
+
+	// Write out combined.
+	//
+	// Note that /providers never returns 404. Instead, when there are no
+	// providers, an empty JSON array is returned.
+	outData, err := json.Marshal(pinfos)
+	if err != nil {
+		log.Warnw("failed marshal response", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, outData)
+}
+
+// extendedPathSuffix is the suffix of provider lookups for the extended
+// providers of a provider only.
+const extendedPathSuffix = "/extended"
+
+// provider returns most recent state of a single provider, or of its extended
+// providers if looked up at /providers/{peerID}/extended.
+func (s *Server) provider(w http.ResponseWriter, r *http.Request) {
+	reqURL := *r.URL
+	var extended bool
+	reqURL.Path, extended = strings.CutSuffix(reqURL.Path, extendedPathSuffix)
+	pid, err := peer.Decode(path.Base(reqURL.Path))
+	if err != nil {
+		log.Warnw("bad provider ID", "err", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	var pinfo *model.ProviderInfo
+	if pinfos, ok := s.scatterProviders(r.Context(), &reqURL); ok {
+		if len(pinfos) > 0 {
+			pinfo = pinfos[0]
+		}
+	} else {
+		pinfo, err = s.pcache.Get(r.Context(), pid)
+		if err != nil {
+			log.Warnw("count not get provider information", "err", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if pinfo == nil || (extended && pinfo.ExtendedProviders == nil) {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	var out any = pinfo
+	if extended {
+		out = pinfo.ExtendedProviders
+	}
+	outData, err := json.Marshal(out)
+	if err != nil {
+		log.Warnw("failed marshal response", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, outData)
+}
+
+// expandExtended appends to the given provider records those of the extended
+// providers of their providers, as known to the provider cache, if enabled.
+// Records of extended providers that the given set deems duplicates, such as
+// those already expanded by backends, are skipped.
+func (s *Server) expandExtended(ctx context.Context, prs []model.ProviderResult, seen *resultSet) []model.ProviderResult {
+	if !config.Providers.ExpandExtended || s.pcache == nil {
+		return prs
+	}
+	// Records are appended to a copy, since the given ones may be cached.
+	expanded := slices.Clip(prs)
+	for _, pr := range prs {
+		if pr.Provider == nil {
+			continue
+		}
+		xprs, err := s.pcache.GetResults(ctx, pr.Provider.ID, pr.ContextID, pr.Metadata)
+		if err != nil {
+			log.Warnw("Failed to get extended providers", "provider", pr.Provider.ID, "err", err)
+			continue
+		}
+		// The first record is that of the provider itself.
+		for _, xpr := range xprs[min(1, len(xprs)):] {
+			if seen.putIfAbsent(&encryptedOrPlainResult{ProviderResult: xpr}) {
+				expanded = append(expanded, xpr)
+			}
+		}
+	}
+	return expanded
+}
+
+// withExtended returns the given aggregated provider records along with those
+// of extended providers, deduplicated by value key as aggregated records are.
+func (s *Server) withExtended(ctx context.Context, prs []model.ProviderResult) []model.ProviderResult {
+	if !config.Providers.ExpandExtended {
+		return prs
+	}
+	seen := newDedupSet(config.Server.MaxDedupEntries, byValueKey)
+	for _, pr := range prs {
+		seen.putIfAbsent(&encryptedOrPlainResult{ProviderResult: pr})
+	}
+	return s.expandExtended(ctx, prs, seen)
+}
+
+// scatterProviders looks up the providers at the given URL, i.e. /providers
+// or /providers/{peerID}, from every providers backend and merges the
+// information on each provider, if provider lookups are scattered. It returns
+// false if they are not, or if no backend responded, in which case lookups are
+// left to the provider cache. Lookups related to a recent write are scattered
+// regardless, including to the backend that acknowledged it, since the
+// provider cache may not reflect the write yet.
+func (s *Server) scatterProviders(ctx context.Context, reqURL *url.URL) ([]*model.ProviderInfo, bool) {
+	written, recent := recentWriteFrom(ctx)
+	if !config.Providers.Scatter && !recent {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sg := &scatterGather[Backend, []*model.ProviderInfo]{
+		backends:    s.backendsFor(ctx),
+		maxWait:     config.Server.ResultMaxWait,
+		pool:        s.scatterPool,
+		concurrency: s.concurrency,
+		circuit:     circuitProviders,
+	}
+	single := strings.HasPrefix(reqURL.Path, "/providers/")
+	if err := sg.scatter(ctx, func(cctx context.Context, b Backend) (*[]*model.ProviderInfo, error) {
+		if _, ok := b.(providersBackend); !ok && !(recent && pinnedTo(b, written)) {
+			return nil, nil
+		}
+		endpoint := *reqURL
+		endpoint.Host = b.URL().Host
+		endpoint.Scheme = b.URL().Scheme
+		log := log.With("backend", endpoint.Host)
+
+		req, err := http.NewRequestWithContext(cctx, http.MethodGet, endpoint.String(), nil)
+		if err != nil {
+			log.Warnw("Failed to construct providers backend query", "err", err)
+			return nil, err
+		}
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		req.Header.Set("Accept", MediaTypeJson)
+		s.middlewares.decorateBackendRequest(req, b)
+		if !b.Matches(req) {
+			return nil, nil
+		}
+		resp, err := b.Client().Do(req)
+		if err != nil {
+			recordBackendFailure(cctx, b.URL().Host, requestErrKind(err, false))
+			log.Warnw("Failed to query backend for providers", "err", err)
+			return nil, err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			recordBackendFailure(cctx, b.URL().Host, requestErrKind(err, true))
+			log.Warnw("Failed to read providers backend response", "err", err)
+			return nil, err
+		}
+
+		var pinfos []*model.ProviderInfo
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return &pinfos, nil
+		default:
+			recordBackendFailure(cctx, b.URL().Host, statusErrKind(resp.StatusCode))
+			log.Warnw("Request processing was not successful", "status", resp.StatusCode, "body", string(data))
+			err := fmt.Errorf("status %d response from backend %s", resp.StatusCode, b.URL().Host)
+			if resp.StatusCode < http.StatusInternalServerError {
+				err = circuitbreaker.MarkAsSuccess(err)
+			}
+			return nil, err
+		}
+		if single {
+			var pinfo model.ProviderInfo
+			err = json.Unmarshal(data, &pinfo)
+			pinfos = append(pinfos, &pinfo)
+		} else {
+			err = json.Unmarshal(data, &pinfos)
+		}
+		if err != nil {
+			recordBackendFailure(cctx, b.URL().Host, errKindDecode)
+			log.Warnw("Failed to decode providers backend response", "err", err)
+			return nil, circuitbreaker.MarkAsSuccess(err)
+		}
+		return &pinfos, nil
+	}); err != nil {
+		log.Errorw("Failed to scatter HTTP providers request", "err", err)
+		return nil, false
+	}
+
+	var responded bool
+	merged := make(map[peer.ID]*model.ProviderInfo)
+	for pinfos := range sg.gather(ctx) {
+		responded = true
+		for _, pinfo := range pinfos {
+			if pinfo == nil || pinfo.AddrInfo.ID == "" {
+				continue
+			}
+			if prev, ok := merged[pinfo.AddrInfo.ID]; ok {
+				pinfo = mergeProviderInfo(prev, pinfo)
+			}
+			merged[pinfo.AddrInfo.ID] = pinfo
+		}
+	}
+	if !responded {
+		return nil, false
+	}
+	pinfos := make([]*model.ProviderInfo, 0, len(merged))
+	for _, pinfo := range merged {
+		pinfos = append(pinfos, pinfo)
+	}
+	slices.SortFunc(pinfos, func(a, b *model.ProviderInfo) int {
+		return strings.Compare(string(a.AddrInfo.ID), string(b.AddrInfo.ID))
+	})
+	return pinfos, true
+}
@@ -0,0 +1,191 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviders_Scatter(t *testing.T) {
+	defer func(v bool) { config.Providers.Scatter = v }(config.Providers.Scatter)
+	config.Providers.Scatter = true
+
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	unknown, err := peer.Decode("12D3KooWD1XypSuBmhebQcvq7Sf1XJZ1hKSfYCED4w6eyxhzwqnV")
+	require.NoError(t, err)
+	providersBackend := func(pinfos ...model.ProviderInfo) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/providers" {
+				_ = json.NewEncoder(w).Encode(pinfos)
+				return
+			}
+			for _, pinfo := range pinfos {
+				if r.URL.Path == "/providers/"+pinfo.AddrInfo.ID.String() {
+					_ = json.NewEncoder(w).Encode(pinfo)
+					return
+				}
+			}
+			http.NotFound(w, r)
+		}))
+	}
+	stale := providersBackend(model.ProviderInfo{
+		AddrInfo:              peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1")}},
+		LastAdvertisementTime: "2024-01-01T00:00:00Z",
+		ExtendedProviders:     &model.ExtendedProviders{Providers: []peer.AddrInfo{{ID: unknown}}},
+	})
+	defer stale.Close()
+	freshAddrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/2")}
+	fresh := providersBackend(model.ProviderInfo{
+		AddrInfo:              peer.AddrInfo{ID: pid, Addrs: freshAddrs},
+		LastAdvertisementTime: "2024-01-02T00:00:00Z",
+	})
+	defer fresh.Close()
+	regular := httptest.NewServer(http.NotFoundHandler())
+	defer regular.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: regular.URL},
+			{URL: stale.URL, Type: BackendTypeProviders},
+			{URL: fresh.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	assertMerged := func(pinfo model.ProviderInfo) {
+		require.Equal(t, freshAddrs, pinfo.AddrInfo.Addrs)
+		require.Equal(t, "2024-01-02T00:00:00Z", pinfo.LastAdvertisementTime)
+		require.NotNil(t, pinfo.ExtendedProviders)
+		require.Len(t, pinfo.ExtendedProviders.Providers, 1)
+		require.Equal(t, unknown, pinfo.ExtendedProviders.Providers[0].ID)
+	}
+
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/providers", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var pinfos []model.ProviderInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &pinfos))
+	require.Len(t, pinfos, 1)
+	assertMerged(pinfos[0])
+
+	rec = httptest.NewRecorder()
+	subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/providers/"+pid.String(), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var pinfo model.ProviderInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &pinfo))
+	assertMerged(pinfo)
+
+	rec = httptest.NewRecorder()
+	subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/providers/"+unknown.String(), nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestProviders_Extended(t *testing.T) {
+	defer func(v bool) { config.Providers.ExpandExtended = v }(config.Providers.ExpandExtended)
+	config.Providers.ExpandExtended = true
+
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	xpid, err := peer.Decode("12D3KooWD1XypSuBmhebQcvq7Sf1XJZ1hKSfYCED4w6eyxhzwqnV")
+	require.NoError(t, err)
+	plain, err := peer.Decode("12D3KooWBckWLKiYoUX4k3HTrbrSe4DD5SPNTKgP6vKTva1NaRkJ")
+	require.NoError(t, err)
+	mh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	addrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}
+	xaddrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4002")}
+	extended := &model.ExtendedProviders{
+		Providers: []peer.AddrInfo{{ID: xpid, Addrs: xaddrs}},
+		Metadatas: [][]byte{[]byte("lobster")},
+	}
+
+	pinfos := []model.ProviderInfo{
+		{AddrInfo: peer.AddrInfo{ID: pid, Addrs: addrs}, ExtendedProviders: extended},
+		{AddrInfo: peer.AddrInfo{ID: plain, Addrs: addrs}},
+	}
+	providers := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/providers" {
+			_ = json.NewEncoder(w).Encode(pinfos)
+			return
+		}
+		for _, pinfo := range pinfos {
+			if r.URL.Path == "/providers/"+pinfo.AddrInfo.ID.String() {
+				_ = json.NewEncoder(w).Encode(pinfo)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	defer providers.Close()
+	regular := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := model.ProviderResult{ContextID: []byte("fish"), Metadata: []byte("crab"), Provider: &peer.AddrInfo{ID: pid, Addrs: addrs}}
+		if r.Header.Get("Accept") == MediaTypeNDJson {
+			w.Header().Set("Content-Type", MediaTypeNDJson)
+			_ = json.NewEncoder(w).Encode(record)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeJson)
+		_ = json.NewEncoder(w).Encode(model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: mh, ProviderResults: []model.ProviderResult{record}}}})
+	}))
+	defer regular.Close()
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: regular.URL},
+			{URL: other.URL},
+			{URL: providers.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("extended providers of provider", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/providers/"+pid.String()+"/extended", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var got model.ExtendedProviders
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		require.Len(t, got.Providers, 1)
+		require.Equal(t, xpid, got.Providers[0].ID)
+
+		rec = httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/providers/"+plain.String()+"/extended", nil))
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	for _, accept := range []string{MediaTypeJson, MediaTypeNDJson} {
+		t.Run("find expands extended providers as "+accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/multihash/"+mh.B58String(), nil)
+			req.Header.Set("Accept", accept)
+			rec := httptest.NewRecorder()
+			subject.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			var got []model.ProviderResult
+			if accept == MediaTypeJson {
+				var resp model.FindResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+				got = resp.MultihashResults[0].ProviderResults
+			} else {
+				for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+					var pr model.ProviderResult
+					require.NoError(t, json.Unmarshal([]byte(line), &pr))
+					got = append(got, pr)
+				}
+			}
+			require.Len(t, got, 2)
+			require.Equal(t, pid, got[0].Provider.ID)
+			require.Equal(t, xpid, got[1].Provider.ID)
+			require.Equal(t, []byte("fish"), got[1].ContextID)
+			require.Equal(t, []byte("lobster"), got[1].Metadata)
+		})
+	}
+}
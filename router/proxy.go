@@ -0,0 +1,60 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+)
+
+// newBackendProxy instantiates a reverse proxy that forwards requests to the
+// given backend as-is, streaming the response back to the client without
+// buffering. The outcome of proxied requests is reported to the backend's
+// circuit breaker.
+func newBackendProxy(b Backend) *httputil.ReverseProxy {
+	target := b.URL()
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = target.Scheme
+			pr.Out.URL.Host = target.Host
+			pr.Out.Host = target.Host
+			pr.SetXForwarded()
+		},
+		Transport: b.Client().Transport,
+		// Flush immediately so that streaming responses are passed through as
+		// they arrive.
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			var err error
+			if resp.StatusCode >= http.StatusInternalServerError {
+				err = fmt.Errorf("status %d response from backend %s", resp.StatusCode, target.Host)
+			}
+			if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode != http.StatusNotFound {
+				recordBackendFailure(resp.Request.Context(), target.Host, statusErrKind(resp.StatusCode))
+			}
+			if b.CB() != nil {
+				_ = b.CB().Done(resp.Request.Context(), err)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if b.CB() != nil {
+				_ = b.CB().Done(r.Context(), err)
+			}
+			recordBackendFailure(r.Context(), target.Host, requestErrKind(err, false))
+			status := http.StatusBadGateway
+			switch {
+			case errors.Is(err, context.Canceled):
+				log.Debugw("Proxied backend request canceled", "backend", target.Host)
+			case errors.Is(err, context.DeadlineExceeded):
+				log.Debugw("Proxied backend request timed out", "backend", target.Host)
+				status = http.StatusGatewayTimeout
+			default:
+				log.Warnw("Failed to proxy request to backend", "backend", target.Host, "err", err)
+			}
+			acc, err := getAccepts(r)
+			streamError(w, err == nil && acc.ndjson, status)
+		},
+	}
+}
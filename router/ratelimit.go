@@ -0,0 +1,195 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterRateLimitPath is the path on which instances serve their rate limit
+// counters to peers.
+const clusterRateLimitPath = "/cluster/ratelimit"
+
+// rateLimitCounts are the requests counted by an instance per rate limit key
+// within the window starting at WindowStart, as served to its peers.
+type rateLimitCounts struct {
+	WindowStart time.Time
+	Counts      map[string]int
+}
+
+// rateLimiter denies requests with 429 Too Many Requests once a client IP or
+// API key exceeds its configured number of requests within a fixed window.
+//
+// Windows are aligned to wall-clock time, so that clustered instances agree on
+// window boundaries. When cluster peers are configured, each instance
+// periodically fetches the counters of its peers for the current window and
+// enforces limits against the sum of its own and its peers' counters. Limits
+// are therefore enforced across the cluster to within the requests served
+// since the last sync. API keys are only shared with peers hashed.
+type rateLimiter struct {
+	BaseMiddleware
+	window       time.Duration
+	perIP        int
+	perKey       int
+	syncInterval time.Duration
+	peers        []*url.URL
+	client       *http.Client
+
+	mu          sync.Mutex
+	windowStart time.Time
+	local       map[string]int
+	remote      map[string]map[string]int
+}
+
+func newRateLimiter() (*rateLimiter, error) {
+	if config.RateLimit.Window <= 0 {
+		return nil, fmt.Errorf("rate limit window must be positive, got %s", config.RateLimit.Window)
+	}
+	peers, err := clusterPeers()
+	if err != nil {
+		return nil, err
+	}
+	l := &rateLimiter{
+		window:       config.RateLimit.Window,
+		perIP:        config.RateLimit.PerIP,
+		perKey:       config.RateLimit.PerKey,
+		syncInterval: config.RateLimit.SyncInterval,
+		client:       &http.Client{Timeout: config.Server.HttpClientTimeout},
+		local:        make(map[string]int),
+		remote:       make(map[string]map[string]int),
+	}
+	for _, peer := range peers {
+		l.peers = append(l.peers, peer.JoinPath(clusterRateLimitPath))
+	}
+	return l, nil
+}
+
+func (*rateLimiter) gatesOnly() {}
+
+// BeforeRequest counts the request against the limits of its client IP and
+// API key, and denies it if either is exceeded. Denied requests are not
+// counted. Requests of cluster peers are never limited.
+func (l *rateLimiter) BeforeRequest(r *http.Request) (*http.Request, error) {
+	if strings.HasPrefix(r.URL.Path, "/cluster/") || r.URL.Path == negativeFilterPath {
+		return r, nil
+	}
+	type limit struct {
+		key string
+		max int
+	}
+	var limits []limit
+	if l.perIP > 0 {
+		limits = append(limits, limit{key: "ip " + clientIP(r), max: l.perIP})
+	}
+	if apiKey := requestAPIKey(r); l.perKey > 0 && apiKey != "" {
+		limits = append(limits, limit{key: "key " + hashAPIKey(apiKey), max: l.perKey})
+	}
+	if len(limits) == 0 {
+		return r, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rolloverIfDue()
+	for _, lim := range limits {
+		count := l.local[lim.key]
+		for _, counts := range l.remote {
+			count += counts[lim.key]
+		}
+		if count >= lim.max {
+			return nil, &StatusError{Status: http.StatusTooManyRequests, Code: errCodeRateLimited, RetryAfter: time.Until(l.windowStart.Add(l.window))}
+		}
+	}
+	for _, lim := range limits {
+		l.local[lim.key]++
+	}
+	return r, nil
+}
+
+// rolloverIfDue resets counters once the current window has passed. The
+// caller must hold the lock.
+func (l *rateLimiter) rolloverIfDue() {
+	start := time.Now().Truncate(l.window)
+	if start.Equal(l.windowStart) {
+		return
+	}
+	l.windowStart = start
+	clear(l.local)
+	clear(l.remote)
+}
+
+// run fetches the counters of peers at the configured interval until the
+// context is done.
+func (l *rateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(l.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, peer := range l.peers {
+			if err := l.syncFrom(ctx, peer); err != nil {
+				log.Warnw("Failed to fetch rate limit counters of peer", "peer", peer, "err", err)
+			}
+		}
+	}
+}
+
+func (l *rateLimiter) syncFrom(ctx context.Context, peer *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d response from peer", resp.StatusCode)
+	}
+	var counts rateLimitCounts
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rolloverIfDue()
+	// Counters of another window, e.g. due to clock skew, are ignored.
+	if counts.WindowStart.Equal(l.windowStart) {
+		l.remote[peer.String()] = counts.Counts
+	}
+	return nil
+}
+
+// serveHTTP serves the counters of the current window to peers.
+func (l *rateLimiter) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	l.mu.Lock()
+	l.rolloverIfDue()
+	data, err := json.Marshal(rateLimitCounts{WindowStart: l.windowStart, Counts: l.local})
+	l.mu.Unlock()
+	if err != nil {
+		log.Errorw("Failed to marshal rate limit counters", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, data)
+}
@@ -0,0 +1,80 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRateLimiter(t *testing.T, perIP, perKey int, peer string) *rateLimiter {
+	defer func(old int) { config.RateLimit.PerIP = old }(config.RateLimit.PerIP)
+	defer func(old int) { config.RateLimit.PerKey = old }(config.RateLimit.PerKey)
+	defer func(old string) { config.Cluster.Peers = old }(config.Cluster.Peers)
+	config.RateLimit.PerIP = perIP
+	config.RateLimit.PerKey = perKey
+	config.Cluster.Peers = peer
+	// A long window keeps counters from being reset part way through tests.
+	defer func(old time.Duration) { config.RateLimit.Window = old }(config.RateLimit.Window)
+	config.RateLimit.Window = 24 * time.Hour
+	l, err := newRateLimiter()
+	require.NoError(t, err)
+	return l
+}
+
+func requireRateLimited(t *testing.T, l *rateLimiter, r *http.Request, limited bool) {
+	t.Helper()
+	_, err := l.BeforeRequest(r)
+	if !limited {
+		require.NoError(t, err)
+		return
+	}
+	var se *StatusError
+	require.True(t, errors.As(err, &se))
+	require.Equal(t, http.StatusTooManyRequests, se.Status)
+}
+
+func TestRateLimiter_LimitsPerIPAndKey(t *testing.T) {
+	subject := newTestRateLimiter(t, 2, 1, "")
+	fromIP := func(ip, apiKey string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/cid/fish", nil)
+		r.RemoteAddr = ip + ":1234"
+		if apiKey != "" {
+			r.Header.Set("X-API-Key", apiKey)
+		}
+		return r
+	}
+
+	requireRateLimited(t, subject, fromIP("192.0.2.1", ""), false)
+	requireRateLimited(t, subject, fromIP("192.0.2.1", ""), false)
+	requireRateLimited(t, subject, fromIP("192.0.2.1", ""), true)
+	requireRateLimited(t, subject, fromIP("192.0.2.2", "lobster"), false)
+	requireRateLimited(t, subject, fromIP("192.0.2.3", "lobster"), true)
+	requireRateLimited(t, subject, fromIP("192.0.2.3", ""), false)
+
+	// Counters reset with the window.
+	subject.windowStart = subject.windowStart.Add(-subject.window)
+	requireRateLimited(t, subject, fromIP("192.0.2.1", ""), false)
+}
+
+func TestRateLimiter_EnforcesAcrossPeers(t *testing.T) {
+	var a *rateLimiter
+	aServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { a.serveHTTP(w, r) }))
+	defer aServer.Close()
+	a = newTestRateLimiter(t, 3, 0, "")
+	b := newTestRateLimiter(t, 3, 0, aServer.URL)
+
+	r := httptest.NewRequest(http.MethodGet, "/cid/fish", nil)
+	requireRateLimited(t, a, r, false)
+	requireRateLimited(t, a, r, false)
+	requireRateLimited(t, b, r, false)
+	require.NoError(t, b.syncFrom(context.Background(), b.peers[0]))
+	requireRateLimited(t, b, r, true)
+
+	// Peer requests are not counted.
+	requireRateLimited(t, b, httptest.NewRequest(http.MethodGet, clusterRateLimitPath, nil), false)
+}
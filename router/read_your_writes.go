@@ -0,0 +1,200 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipni/go-libipni/announce/message"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// announcePathSuffix is the path suffix of announcements proxied to the
+// fallback backend, e.g. /ingest/announce.
+const announcePathSuffix = "/announce"
+
+type recentWriteKey struct{}
+
+// recentWrites remembers which backend acknowledged recent announcements, by
+// client and by announced provider, so that lookups by the publisher, and
+// provider lookups of the announced provider, include that backend. Otherwise
+// publishers verifying their own announcements may see inconsistent results
+// from backends that have yet to ingest them.
+type recentWrites struct {
+	ttl time.Duration
+
+	mu         sync.Mutex
+	byClient   map[string]recentWrite
+	byProvider map[peer.ID]recentWrite
+	lastPrune  time.Time
+}
+
+type recentWrite struct {
+	host    string
+	expires time.Time
+}
+
+// newRecentWrites instantiates recentWrites that remember writes for the given
+// TTL, or returns nil if the TTL is not positive.
+func newRecentWrites(ttl time.Duration) *recentWrites {
+	if ttl <= 0 {
+		return nil
+	}
+	return &recentWrites{
+		ttl:        ttl,
+		byClient:   make(map[string]recentWrite),
+		byProvider: make(map[peer.ID]recentWrite),
+	}
+}
+
+// track remembers announcements by the given proxied handler that are
+// acknowledged by the backend with the given host. A nil recentWrites
+// returns the handler as is.
+func (rw *recentWrites) track(next http.Handler, host string) http.Handler {
+	if rw == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodPut && r.Method != http.MethodPost) || !strings.HasSuffix(r.URL.Path, announcePathSuffix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The body is bounded by the request body limits.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sw := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status < 200 || sw.status >= 300 {
+			return
+		}
+		provider, _ := announcedProvider(body)
+		rw.record(writerOf(r), provider, host)
+	})
+}
+
+// record remembers that the given client's announcement of the given
+// provider, if known, was acknowledged by the backend with the given host.
+func (rw *recentWrites) record(client string, provider peer.ID, host string) {
+	now := time.Now()
+	w := recentWrite{host: host, expires: now.Add(rw.ttl)}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.byClient[client] = w
+	if provider != "" {
+		rw.byProvider[provider] = w
+	}
+	if now.Sub(rw.lastPrune) >= rw.ttl {
+		rw.lastPrune = now
+		for k, v := range rw.byClient {
+			if now.After(v.expires) {
+				delete(rw.byClient, k)
+			}
+		}
+		for k, v := range rw.byProvider {
+			if now.After(v.expires) {
+				delete(rw.byProvider, k)
+			}
+		}
+	}
+}
+
+// handler marks requests related to a recent write with the host of the
+// backend that acknowledged it: requests by the client that wrote, and
+// provider lookups of the announced provider.
+func (rw *recentWrites) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, ok := rw.lookup(r); ok {
+			r = r.WithContext(context.WithValue(r.Context(), recentWriteKey{}, host))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rw *recentWrites) lookup(r *http.Request) (string, bool) {
+	var provider peer.ID
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/providers/"); ok {
+		provider, _ = peer.Decode(path.Base(strings.TrimSuffix(rest, extendedPathSuffix)))
+	}
+	now := time.Now()
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if w, ok := rw.byProvider[provider]; ok && provider != "" && now.Before(w.expires) {
+		return w.host, true
+	}
+	if w, ok := rw.byClient[writerOf(r)]; ok && now.Before(w.expires) {
+		return w.host, true
+	}
+	return "", false
+}
+
+// writerOf identifies the client of the given request by its API key if any,
+// or else its IP.
+func writerOf(r *http.Request) string {
+	if apiKey := requestAPIKey(r); apiKey != "" {
+		return "key:" + hashAPIKey(apiKey)
+	}
+	return "ip:" + clientIP(r)
+}
+
+// announcedProvider returns the provider of the given announcement, encoded
+// as either JSON or CBOR, as named by the peer ID of its addresses.
+func announcedProvider(body []byte) (peer.ID, error) {
+	var msg message.Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		msg = message.Message{}
+		if err := msg.UnmarshalCBOR(bytes.NewReader(body)); err != nil {
+			return "", err
+		}
+	}
+	addrs, err := msg.GetAddrs()
+	if err != nil {
+		return "", err
+	}
+	infos, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil || len(infos) == 0 {
+		return "", err
+	}
+	return infos[0].ID, nil
+}
+
+// recentWriteFrom returns the host of the backend that acknowledged a write
+// related to the request with the given context, if any.
+func recentWriteFrom(ctx context.Context) (string, bool) {
+	host, ok := ctx.Value(recentWriteKey{}).(string)
+	return host, ok
+}
+
+// withRecentWrite adds to the given backends any of all backends that
+// acknowledged a write related to the request with the given context, so
+// that it is not routed away from by shard affinity or ingestion lag.
+func withRecentWrite(ctx context.Context, all, backends []Backend) []Backend {
+	host, ok := recentWriteFrom(ctx)
+	if !ok {
+		return backends
+	}
+	for _, b := range all {
+		if pinnedTo(b, host) && !containsBackend(backends, b) {
+			backends = append(backends, b)
+		}
+	}
+	return backends
+}
+
+func containsBackend(backends []Backend, b Backend) bool {
+	for _, other := range backends {
+		if other.URL().String() == b.URL().String() {
+			return true
+		}
+	}
+	return false
+}
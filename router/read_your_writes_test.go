@@ -0,0 +1,110 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/announce/message"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentWrites_ProviderLookupsReadAnnouncements(t *testing.T) {
+	defer func(old time.Duration) { config.ReadYourWrites.TTL = old }(config.ReadYourWrites.TTL)
+	config.ReadYourWrites.TTL = time.Minute
+
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	addr := multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")
+
+	// The indexer that ingests announcements knows of the provider, while
+	// the provider cache does not yet.
+	indexer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/ingest/announce":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Path == "/providers/"+pid.String():
+			_ = json.NewEncoder(w).Encode(model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{addr}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer indexer.Close()
+	providers := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/providers" {
+			_, _ = w.Write([]byte("[]"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer providers.Close()
+
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: indexer.URL},
+			{URL: providers.URL, Type: BackendTypeProviders},
+		},
+		FallbackBackend: indexer.URL,
+	})
+	require.NoError(t, err)
+	lookup := func(apiKey string) int {
+		req := httptest.NewRequest(http.MethodGet, "/providers/"+pid.String(), nil)
+		req.Header.Set("X-API-Key", apiKey)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(t, http.StatusNotFound, lookup("publisher"))
+
+	var msg message.Message
+	msg.Cid = cid.MustParse("bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	msg.SetAddrs([]multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001/p2p/" + pid.String())})
+	body, err := json.Marshal(&msg)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPut, "/ingest/announce", bytes.NewReader(body))
+	req.Header.Set("X-API-Key", "publisher")
+	rec := httptest.NewRecorder()
+	subject.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	// Provider lookups of the announced provider are answered by the indexer
+	// that acknowledged the announcement, whoever the client.
+	require.Equal(t, http.StatusOK, lookup("publisher"))
+	require.Equal(t, http.StatusOK, lookup("fish"))
+}
+
+func TestRecentWrites_IncludesAcknowledgingBackend(t *testing.T) {
+	subject := newRecentWrites(time.Minute)
+	var backends []Backend
+	for _, u := range []string{"http://fish.invalid", "http://lobster.invalid"} {
+		b, err := NewBackend(u, nil, Matchers.Any, nil)
+		require.NoError(t, err)
+		backends = append(backends, b)
+	}
+	subject.record("key:"+hashAPIKey("publisher"), "", "lobster.invalid")
+
+	var got []Backend
+	handler := subject.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = withRecentWrite(r.Context(), backends, backends[:1])
+	}))
+	for apiKey, want := range map[string][]Backend{
+		"publisher": backends,
+		"fish":      backends[:1],
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/multihash/QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		require.Equal(t, want, got, apiKey)
+	}
+}
+
+func TestNewRecentWrites_DisabledWithoutTTL(t *testing.T) {
+	require.Nil(t, newRecentWrites(0))
+}
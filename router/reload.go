@@ -0,0 +1,199 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// ReloadReport describes what changed by reloading the configuration.
+type ReloadReport struct {
+	// Backends is how the backends of requests addressed to no tenant
+	// changed.
+	Backends BackendsDiff
+	// Tenants is how the backends of each tenant changed, by tenant name.
+	Tenants map[string]BackendsDiff `json:",omitempty"`
+	// Settings are the names of the settings other than backends that
+	// changed, such as Log.
+	Settings []string `json:",omitempty"`
+	// Error is why reloading the configuration failed, if it did.
+	Error string `json:",omitempty"`
+	// DryRun is whether the configuration was only validated, in which case
+	// the report describes what reloading it would change.
+	DryRun bool `json:",omitempty"`
+	// Unreachable are the errors probing the backends that a dry run would
+	// add or reconfigure, by backend.
+	Unreachable map[string]string `json:",omitempty"`
+}
+
+// BackendsDiff lists the backends added, removed or reconfigured by a
+// reload. Backends are identified by their type and URL, e.g.
+// "regular https://example.com", so that secrets in their config are not
+// disclosed.
+type BackendsDiff struct {
+	Added   []string `json:",omitempty"`
+	Removed []string `json:",omitempty"`
+	Updated []string `json:",omitempty"`
+}
+
+// Empty returns whether no backends changed.
+func (d BackendsDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Updated) == 0
+}
+
+// BackendID identifies the backend of the given config by its type and URL,
+// as backends are identified in reload reports.
+func BackendID(cfg BackendConfig) string {
+	return normalizedBackendConfig(cfg).Type + " " + cfg.URL
+}
+
+func normalizedBackendConfig(cfg BackendConfig) BackendConfig {
+	if cfg.Type == "" {
+		cfg.Type = BackendTypeRegular
+	}
+	return cfg
+}
+
+// DiffBackends returns how the given backends after a reload differ from the
+// given backends before it.
+func DiffBackends(before, after []BackendConfig) BackendsDiff {
+	normalized, idOf := normalizedBackendConfig, BackendID
+	previous := make(map[string]BackendConfig, len(before))
+	for _, cfg := range before {
+		cfg = normalized(cfg)
+		previous[idOf(cfg)] = cfg
+	}
+	var d BackendsDiff
+	current := make(map[string]struct{}, len(after))
+	for _, cfg := range after {
+		cfg = normalized(cfg)
+		id := idOf(cfg)
+		current[id] = struct{}{}
+		prev, ok := previous[id]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, id)
+		case !reflect.DeepEqual(prev, cfg):
+			d.Updated = append(d.Updated, id)
+		}
+	}
+	for id := range previous {
+		if _, ok := current[id]; !ok {
+			d.Removed = append(d.Removed, id)
+		}
+	}
+	slices.Sort(d.Removed)
+	return d
+}
+
+// ValidateBackends checks that backends can be instantiated from the given
+// configs, as reloading them would, without routing requests to them.
+func ValidateBackends(cfgs []BackendConfig) error {
+	backends, err := loadBackends(cfgs, nil, false)
+	for _, b := range backends {
+		b.Client().CloseIdleConnections()
+	}
+	return err
+}
+
+// ProbeBackends probes the backends of the given configs with an OPTIONS
+// request, and returns the errors of those that are unreachable by backend ID.
+// Like circuit probes, backends that respond with a status below 500 are
+// deemed reachable, whether or not they advertise capabilities.
+func ProbeBackends(ctx context.Context, cfgs []BackendConfig) map[string]string {
+	ctx, cancel := context.WithTimeout(ctx, config.Server.ResultMaxWait)
+	defer cancel()
+	errs := make([]error, len(cfgs))
+	var wg sync.WaitGroup
+	for i, cfg := range cfgs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = probeBackend(ctx, cfg)
+		}()
+	}
+	wg.Wait()
+
+	var unreachable map[string]string
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if unreachable == nil {
+			unreachable = make(map[string]string)
+		}
+		unreachable[BackendID(cfgs[i])] = err.Error()
+	}
+	return unreachable
+}
+
+func probeBackend(ctx context.Context, cfg BackendConfig) error {
+	client, err := NewBackendClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d response", resp.StatusCode)
+	}
+	return nil
+}
+
+// serveReload reloads the configuration on POST via the reload function of
+// the server options, as an alternative to SIGHUP where signaling the process
+// is awkward, and responds with what changed. With the dry_run query
+// parameter set, the configuration is only validated via the validate reload
+// function, and the response describes what reloading it would change.
+func (s *Server) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	if dryRun && s.validateReload == nil {
+		http.Error(w, "dry runs of reloads are not supported", http.StatusNotImplemented)
+		return
+	}
+	status := http.StatusOK
+	var report ReloadReport
+	var err error
+	if dryRun {
+		report, err = s.validateReload()
+	} else {
+		report, err = s.reload()
+	}
+	switch {
+	case err != nil:
+		log.Warnw("Failed to reload config via admin endpoint", "dryRun", dryRun, "err", err)
+		status = http.StatusBadRequest
+		report = ReloadReport{Error: err.Error(), DryRun: dryRun}
+	case dryRun:
+		log.Infow("Validated config via admin endpoint", "report", report)
+	default:
+		log.Infow("Reloaded config via admin endpoint", "report", report)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Errorw("Failed to marshal reload report", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, status, data)
+}
@@ -0,0 +1,197 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBackends(t *testing.T) {
+	before := []BackendConfig{
+		{URL: "http://fish"},
+		{URL: "http://lobster", Type: BackendTypeCascade},
+		{URL: "http://crab", Type: BackendTypeProviders},
+	}
+	after := []BackendConfig{
+		{URL: "http://fish", Type: BackendTypeRegular},
+		{URL: "http://lobster", Type: BackendTypeCascade, MaxQPS: 10},
+		{URL: "http://crab", Type: BackendTypeRegular},
+	}
+	require.Equal(t, BackendsDiff{
+		Added:   []string{"regular http://crab"},
+		Removed: []string{"providers http://crab"},
+		Updated: []string{"cascade http://lobster"},
+	}, DiffBackends(before, after))
+	require.True(t, DiffBackends(before, before).Empty())
+}
+
+func TestAdmin_Reloads(t *testing.T) {
+	defer func(old string) { config.Server.AdminToken = old }(config.Server.AdminToken)
+	config.Server.AdminToken = "fish"
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	var reloadErr error
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+		Reload: func() (ReloadReport, error) {
+			return ReloadReport{Backends: BackendsDiff{Added: []string{"regular http://lobster"}}}, reloadErr
+		},
+	})
+	require.NoError(t, err)
+
+	reload := func(method, token string) (int, ReloadReport) {
+		req := httptest.NewRequest(method, adminReloadPath, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		var got ReloadReport
+		if rec.Header().Get("Content-Type") == "application/json; charset=utf-8" {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		}
+		return rec.Code, got
+	}
+
+	code, _ := reload(http.MethodPost, "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = reload(http.MethodGet, "fish")
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, got := reload(http.MethodPost, "fish")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"regular http://lobster"}, got.Backends.Added)
+
+	reloadErr = errors.New("invalid config")
+	code, got = reload(http.MethodPost, "fish")
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, "invalid config", got.Error)
+	require.Empty(t, got.Backends.Added)
+}
+
+// TestServer_ReloadsWhileFinding is meant to be run with -race.
+func TestServer_ReloadsWhileFinding(t *testing.T) {
+	defer func(old int) { config.Shard.Replicas = old }(config.Shard.Replicas)
+	config.Shard.Replicas = 1
+
+	fish := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer fish.Close()
+	lobster := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer lobster.Close()
+	configs := func(u string) []BackendConfig {
+		return []BackendConfig{
+			{URL: u, ReplicaGroup: "sea"},
+			{URL: u, Type: BackendTypeProviders},
+		}
+	}
+	subject, err := NewServer(Options{Backends: configs(fish.URL)})
+	require.NoError(t, err)
+
+	const mh = "QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH"
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				rec := httptest.NewRecorder()
+				subject.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/multihash/"+mh, nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		u := fish.URL
+		if i%2 == 0 {
+			u = lobster.URL
+		}
+		require.NoError(t, subject.Reload(configs(u)))
+	}
+	wg.Wait()
+}
+
+func TestProbeBackends(t *testing.T) {
+	reachable := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer reachable.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cfgs := []BackendConfig{
+		{URL: reachable.URL},
+		{URL: failing.URL, Type: BackendTypeCascade},
+		{URL: closed.URL},
+	}
+	require.NoError(t, ValidateBackends(cfgs))
+	got := ProbeBackends(context.Background(), cfgs)
+	require.Len(t, got, 2)
+	require.Equal(t, "status 502 response", got["cascade "+failing.URL])
+	require.Contains(t, got, "regular "+closed.URL)
+
+	require.Error(t, ValidateBackends(nil))
+}
+
+func TestAdmin_ValidatesReloads(t *testing.T) {
+	defer func(old string) { config.Server.AdminToken = old }(config.Server.AdminToken)
+	config.Server.AdminToken = "fish"
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	var reloaded, validated int
+	o := Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+		Reload: func() (ReloadReport, error) {
+			reloaded++
+			return ReloadReport{}, nil
+		},
+	}
+	withoutDryRuns, err := New(o)
+	require.NoError(t, err)
+	o.ValidateReload = func() (ReloadReport, error) {
+		validated++
+		return ReloadReport{DryRun: true, Unreachable: map[string]string{"regular http://lobster": "connection refused"}}, nil
+	}
+	subject, err := New(o)
+	require.NoError(t, err)
+
+	reload := func(s http.Handler, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req.Header.Set("Authorization", "Bearer fish")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusNotImplemented, reload(withoutDryRuns, adminReloadPath+"?dry_run=true").Code)
+	rec := reload(subject, adminReloadPath+"?dry_run=true")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got ReloadReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.True(t, got.DryRun)
+	require.Equal(t, "connection refused", got.Unreachable["regular http://lobster"])
+	require.Equal(t, 1, validated)
+	require.Zero(t, reloaded)
+
+	require.Equal(t, http.StatusOK, reload(subject, adminReloadPath).Code)
+	require.Equal(t, 1, validated)
+	require.Equal(t, 1, reloaded)
+}
@@ -0,0 +1,321 @@
+package router
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ReputationSource supplies the reliability scores of providers, such as the
+// retrieval success rates measured by an external prober.
+type ReputationSource interface {
+	// Scores returns the score of each provider known to the source, within
+	// [0, 1] where 1 is the most reliable.
+	Scores(ctx context.Context) (map[peer.ID]float64, error)
+}
+
+// feedReputationSource reads provider scores from a JSON object of scores
+// keyed by peer ID, served at an HTTP URL or stored in a file.
+type feedReputationSource struct {
+	location string
+	client   *http.Client
+}
+
+func newFeedReputationSource(location string) (*feedReputationSource, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		var err error
+		if location, err = expandHome(strings.TrimPrefix(location, "file://")); err != nil {
+			return nil, err
+		}
+	}
+	return &feedReputationSource{location: location, client: &http.Client{Timeout: time.Minute}}, nil
+}
+
+func (f *feedReputationSource) Scores(ctx context.Context) (map[peer.ID]float64, error) {
+	var body io.ReadCloser
+	if strings.HasPrefix(f.location, "http://") || strings.HasPrefix(f.location, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.location, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", MediaTypeJson)
+		resp, err := f.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("status %d response from reputation source", resp.StatusCode)
+		}
+		body = resp.Body
+	} else {
+		file, err := os.Open(f.location)
+		if err != nil {
+			return nil, err
+		}
+		body = file
+	}
+	defer body.Close()
+
+	var feed map[string]float64
+	if err := json.NewDecoder(body).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("invalid reputation feed: %w", err)
+	}
+	scores := make(map[peer.ID]float64, len(feed))
+	for id, score := range feed {
+		pid, err := peer.Decode(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provider %q in reputation feed: %w", id, err)
+		}
+		scores[pid] = clampScore(score)
+	}
+	return scores, nil
+}
+
+// clampScore bounds the given score to [0, 1].
+func clampScore(score float64) float64 {
+	return min(max(score, 0), 1)
+}
+
+// providerReputation is the reputation of a provider, as served by the admin
+// endpoint.
+type providerReputation struct {
+	// Score is the effective score of the provider: its override if any, or
+	// else its score from the source, or else the default score.
+	Score float64
+	// SourceScore is the score of the provider from the source, if any.
+	SourceScore *float64 `json:",omitempty"`
+	// Override is the score of the provider set via the admin endpoint, if
+	// any, which takes precedence over its score from the source.
+	Override *float64 `json:",omitempty"`
+}
+
+// reputationReport is the response to a reputation listing request.
+type reputationReport struct {
+	// Refreshed is when scores were last refreshed from the source.
+	Refreshed time.Time
+	// Error is why the last refresh failed, if it did. Scores of the last
+	// successful refresh are retained.
+	Error string `json:",omitempty"`
+	// Providers are the reputations of providers scored by the source or
+	// overridden, keyed by peer ID.
+	Providers map[string]providerReputation
+}
+
+// reputationOverride is the body of a request to override the score of a
+// provider.
+type reputationOverride struct {
+	Score float64
+}
+
+// reputation ranks provider results by the reliability score of their
+// provider, most reliable first, and filters out those of providers scored
+// below the configured minimum. Scores are refreshed from the source at the
+// configured interval, and may be overridden per provider via the admin
+// endpoint, e.g. to demote a provider ahead of the source noticing it. Unlike
+// source scores, overrides are not persisted across restarts.
+type reputation struct {
+	BaseMiddleware
+	source ReputationSource
+
+	mu        sync.RWMutex
+	scores    map[peer.ID]float64
+	overrides map[peer.ID]float64
+	refreshed time.Time
+	err       error
+}
+
+func newReputation(source ReputationSource) (*reputation, error) {
+	if config.Reputation.MinScore < 0 || config.Reputation.MinScore > 1 {
+		return nil, fmt.Errorf("reputation min score must be within [0, 1], got %f", config.Reputation.MinScore)
+	}
+	if config.Reputation.DefaultScore < 0 || config.Reputation.DefaultScore > 1 {
+		return nil, fmt.Errorf("reputation default score must be within [0, 1], got %f", config.Reputation.DefaultScore)
+	}
+	return &reputation{
+		source:    source,
+		scores:    make(map[peer.ID]float64),
+		overrides: make(map[peer.ID]float64),
+	}, nil
+}
+
+// scoreOf returns the effective score of the given provider.
+func (rp *reputation) scoreOf(id peer.ID) float64 {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+	if score, ok := rp.overrides[id]; ok {
+		return score
+	}
+	if score, ok := rp.scores[id]; ok {
+		return score
+	}
+	return config.Reputation.DefaultScore
+}
+
+// refresh replaces the scores with those of the source, retaining the current
+// ones if the source fails.
+func (rp *reputation) refresh(ctx context.Context) {
+	scores, err := rp.source.Scores(ctx)
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.err = err
+	if err != nil {
+		log.Warnw("Failed to refresh provider reputation", "err", err)
+		return
+	}
+	rp.scores = scores
+	rp.refreshed = time.Now()
+	log.Debugw("Refreshed provider reputation", "providers", len(scores))
+}
+
+// run refreshes scores at the configured interval until the context is done.
+func (rp *reputation) run(ctx context.Context) {
+	rp.refresh(ctx)
+	ticker := time.NewTicker(config.Reputation.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rp.refresh(ctx)
+		}
+	}
+}
+
+func (rp *reputation) AfterAggregation(_ context.Context, results []model.ProviderResult) []model.ProviderResult {
+	type scored struct {
+		result model.ProviderResult
+		score  float64
+	}
+	ranked := make([]scored, 0, len(results))
+	for _, pr := range results {
+		score := config.Reputation.DefaultScore
+		if pr.Provider != nil {
+			score = rp.scoreOf(pr.Provider.ID)
+		}
+		if score < config.Reputation.MinScore {
+			continue
+		}
+		ranked = append(ranked, scored{result: pr, score: score})
+	}
+	// Results of equally scored providers keep their aggregated order.
+	slices.SortStableFunc(ranked, func(a, b scored) int {
+		return cmp.Compare(b.score, a.score)
+	})
+	out := make([]model.ProviderResult, len(ranked))
+	for i, r := range ranked {
+		out[i] = r.result
+	}
+	return out
+}
+
+// serveHTTP serves the reputation of providers. GET /admin/reputation lists
+// every scored or overridden provider, and GET /admin/reputation/{peerID}
+// serves the reputation of a provider. PUT /admin/reputation/{peerID}
+// overrides the score of the provider with that of the request body, and
+// DELETE removes its override.
+func (rp *reputation) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	arg := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminReputationPath), "/")
+	if arg == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		rp.writeJson(w, rp.report())
+		return
+	}
+
+	id, err := peer.Decode(arg)
+	if err != nil {
+		http.Error(w, "invalid peer id: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var override reputationOverride
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&override); err != nil {
+			http.Error(w, "invalid override: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if override.Score < 0 || override.Score > 1 {
+			http.Error(w, "score must be within [0, 1]", http.StatusBadRequest)
+			return
+		}
+		rp.mu.Lock()
+		rp.overrides[id] = override.Score
+		rp.mu.Unlock()
+		log.Infow("Overrode provider reputation", "provider", id, "score", override.Score)
+	case http.MethodDelete:
+		rp.mu.Lock()
+		delete(rp.overrides, id)
+		rp.mu.Unlock()
+		log.Infow("Removed provider reputation override", "provider", id)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodPut)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	rp.writeJson(w, rp.reputationOf(id))
+}
+
+func (rp *reputation) writeJson(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorw("Failed to marshal provider reputation", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, data)
+}
+
+func (rp *reputation) reputationOf(id peer.ID) providerReputation {
+	rep := providerReputation{Score: rp.scoreOf(id)}
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+	if score, ok := rp.scores[id]; ok {
+		rep.SourceScore = &score
+	}
+	if score, ok := rp.overrides[id]; ok {
+		rep.Override = &score
+	}
+	return rep
+}
+
+func (rp *reputation) report() reputationReport {
+	rp.mu.RLock()
+	ids := slices.Collect(maps.Keys(rp.scores))
+	for id := range rp.overrides {
+		if _, ok := rp.scores[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	report := reputationReport{
+		Refreshed: rp.refreshed,
+		Providers: make(map[string]providerReputation, len(ids)),
+	}
+	if rp.err != nil {
+		report.Error = rp.err.Error()
+	}
+	rp.mu.RUnlock()
+	for _, id := range ids {
+		report.Providers[id.String()] = rp.reputationOf(id)
+	}
+	return report
+}
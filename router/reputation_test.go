@@ -0,0 +1,109 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeedReputationSource_ReadsScores(t *testing.T) {
+	feed := `{"` + mockbackend.SampleProviders[0] + `": 0.2, "` + mockbackend.SampleProviders[1] + `": 1.5}`
+	feedPath := filepath.Join(t.TempDir(), "scores.json")
+	require.NoError(t, os.WriteFile(feedPath, []byte(feed), 0o644))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJsonResponse(w, http.StatusOK, []byte(feed))
+	}))
+	defer server.Close()
+
+	bitswap, err := peer.Decode(mockbackend.SampleProviders[0])
+	require.NoError(t, err)
+	httpProvider, err := peer.Decode(mockbackend.SampleProviders[1])
+	require.NoError(t, err)
+	for _, location := range []string{feedPath, "file://" + feedPath, server.URL} {
+		subject, err := newFeedReputationSource(location)
+		require.NoError(t, err)
+		got, err := subject.Scores(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, map[peer.ID]float64{bitswap: 0.2, httpProvider: 1}, got)
+	}
+}
+
+func TestReputation_RanksAndFiltersResults(t *testing.T) {
+	defer func(old string) { config.Reputation.Source = old }(config.Reputation.Source)
+	defer func(old float64) { config.Reputation.MinScore = old }(config.Reputation.MinScore)
+	defer func(old string) { config.Server.AdminToken = old }(config.Server.AdminToken)
+	config.Reputation.MinScore = 0.1
+	config.Server.AdminToken = "fish"
+
+	feedPath := filepath.Join(t.TempDir(), "scores.json")
+	feed := `{"` + mockbackend.SampleProviders[0] + `": 0.2, "` + mockbackend.SampleProviders[1] + `": 0.9}`
+	require.NoError(t, os.WriteFile(feedPath, []byte(feed), 0o644))
+	config.Reputation.Source = feedPath
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subject, err := New(Options{
+		Context: ctx,
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Accept", MediaTypeJson)
+		if strings.HasPrefix(target, adminReputationPath) {
+			req.Header.Set("Authorization", "Bearer fish")
+		}
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+	find := func() []string {
+		rec := serve(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		resp, err := model.UnmarshalFindResponse(rec.Body.Bytes())
+		require.NoError(t, err)
+		var ids []string
+		for _, pr := range resp.MultihashResults[0].ProviderResults {
+			ids = append(ids, pr.Provider.ID.String())
+		}
+		return ids
+	}
+
+	require.Eventually(t, func() bool {
+		var report reputationReport
+		rec := serve(http.MethodGet, adminReputationPath, "")
+		return rec.Code == http.StatusOK &&
+			json.Unmarshal(rec.Body.Bytes(), &report) == nil &&
+			len(report.Providers) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{mockbackend.SampleProviders[1], mockbackend.SampleProviders[0]}, find())
+
+	rec := serve(http.MethodPut, adminReputationPath+"/"+mockbackend.SampleProviders[1], `{"Score": 0.05}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got providerReputation
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Equal(t, 0.05, got.Score)
+	require.Equal(t, 0.9, *got.SourceScore)
+	require.Equal(t, []string{mockbackend.SampleProviders[0]}, find())
+
+	require.Equal(t, http.StatusBadRequest, serve(http.MethodPut, adminReputationPath+"/"+mockbackend.SampleProviders[1], `{"Score": 2}`).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodDelete, adminReputationPath+"/"+mockbackend.SampleProviders[1], "").Code)
+	require.Equal(t, []string{mockbackend.SampleProviders[1], mockbackend.SampleProviders[0]}, find())
+}
@@ -0,0 +1,46 @@
+package router
+
+import "net/http"
+
+// recordingResponseWriter records the status and the number of body bytes of
+// a response, for middleware that acts upon them once the response is served.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	// status is the status of the response, or zero if none is written yet.
+	status int
+	size   int64
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying writer if it supports flushing, so that
+// streamed responses are not held back.
+func (w *recordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// FlushError flushes the underlying writer like Flush, and returns any error
+// flushing, so that stalled clients are noticed via http.ResponseController.
+func (w *recordingResponseWriter) FlushError() error {
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,29 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	subject := &recordingResponseWriter{ResponseWriter: rec}
+	_, err := subject.Write([]byte("fish"))
+	require.NoError(t, err)
+	subject.WriteHeader(http.StatusTeapot)
+	require.Equal(t, http.StatusOK, subject.status)
+	require.Equal(t, int64(4), subject.size)
+
+	// Flushes reach the underlying writer through nested writers, and their
+	// errors are returned.
+	nested := &errorResponseWriter{recordingResponseWriter: recordingResponseWriter{ResponseWriter: &recordingResponseWriter{ResponseWriter: rec}}}
+	rc := http.NewResponseController(&recordingResponseWriter{ResponseWriter: nested})
+	require.NoError(t, rc.Flush())
+	require.True(t, rec.Flushed)
+
+	var w http.ResponseWriter = &recordingResponseWriter{ResponseWriter: nested}
+	require.Same(t, nested, w.(interface{ Unwrap() http.ResponseWriter }).Unwrap())
+}
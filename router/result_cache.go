@@ -0,0 +1,284 @@
+package router
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// staleWarning is the Warning header value of responses served stale, as
+	// defined by RFC 7234.
+	staleWarning = `110 - "Response is Stale"`
+
+	// cacheStatusHeader tells clients, CDNs and support staff whether a
+	// response was served from the result cache, as one of the cache
+	// statuses below.
+	cacheStatusHeader = "X-Cache"
+	cacheHit          = "HIT"
+	cacheMiss         = "MISS"
+	cacheStale        = "STALE"
+)
+
+// cacheStatus describes how a response was served by the result cache.
+type cacheStatus struct {
+	// status is empty if the result cache is disabled.
+	status string
+	age    time.Duration
+}
+
+// newCacheStatus returns the status of a response served from cache with the
+// given age, which is stale once older than the cache TTL.
+func newCacheStatus(age time.Duration) cacheStatus {
+	if age > config.Cache.TTL {
+		return cacheStatus{status: cacheStale, age: age}
+	}
+	return cacheStatus{status: cacheHit, age: age}
+}
+
+// setHeaders sets the X-Cache header of the response along with its Age, and
+// warns that it is stale if so.
+func (c cacheStatus) setHeaders(w http.ResponseWriter) {
+	if c.status == "" {
+		return
+	}
+	w.Header().Set(cacheStatusHeader, c.status)
+	if c.status == cacheMiss {
+		return
+	}
+	w.Header().Set("Age", strconv.Itoa(int(c.age.Seconds())))
+	if c.status == cacheStale {
+		w.Header().Set("Warning", staleWarning)
+	}
+}
+
+// resultCache retains the most recent aggregated find results. Results are
+// served from the cache while fresh, served and revalidated in the background
+// once older than the fresh TTL but within the revalidate window, and served
+// stale when every backend fails to respond.
+//
+// Results are retained before middleware is applied, since middleware may
+// tailor responses to the requesting client. At most the configured number of
+// entries are retained, evicting the least recently used first.
+type resultCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+	stats      resultCacheStats
+}
+
+// resultCacheStats are the cumulative counts of responses by how they were
+// served by the result cache, as served on /admin/cache.
+type resultCacheStats struct {
+	Hits   int64
+	Stale  int64
+	Misses int64
+}
+
+type resultCacheEntry struct {
+	key          string
+	multihash    string
+	data         []byte
+	foundRegular bool
+	foundCaskade bool
+	storedAt     time.Time
+	revalidating bool
+	validators   map[string]backendValidator
+}
+
+func newResultCache(maxEntries int) *resultCache {
+	return &resultCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// put retains the given result under the given key.
+func (c *resultCache) put(key string, g *gatheredFind) {
+	data, err := model.MarshalFindResponse(&g.resp)
+	if err != nil {
+		log.Warnw("Failed to marshal response to cache", "err", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &resultCacheEntry{
+		key:          key,
+		multihash:    string(findResponseMultihash(&g.resp)),
+		data:         data,
+		foundRegular: g.foundRegular,
+		foundCaskade: g.foundCaskade,
+		storedAt:     time.Now(),
+		validators:   g.validators,
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+// get returns the result retained under the given key along with its age, as
+// long as it is no older than maxAge.
+func (c *resultCache) get(key string, maxAge time.Duration) (*gatheredFind, time.Duration, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*resultCacheEntry)
+	age := time.Since(entry.storedAt)
+	c.mu.Unlock()
+
+	if age > maxAge {
+		return nil, 0, false
+	}
+	resp, err := model.UnmarshalFindResponse(entry.data)
+	if err != nil {
+		log.Warnw("Failed to unmarshal cached response", "err", err)
+		return nil, 0, false
+	}
+	return &gatheredFind{
+		resp:         *resp,
+		foundRegular: entry.foundRegular,
+		foundCaskade: entry.foundCaskade,
+	}, age, true
+}
+
+// validators returns the backend responses retained for conditional
+// revalidation along with the result retained under the given key, however
+// old it is.
+func (c *resultCache) validators(key string) map[string]backendValidator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		return e.Value.(*resultCacheEntry).validators
+	}
+	return nil
+}
+
+// remove evicts the result retained under the given key, if any.
+func (c *resultCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// purge evicts every result of the given multihash, whichever request it was
+// retained under, and returns the number of results evicted.
+func (c *resultCache) purge(mh multihash.Multihash) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var purged int
+	for key, e := range c.entries {
+		if e.Value.(*resultCacheEntry).multihash == string(mh) {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// flush evicts every result and returns the number of results evicted.
+func (c *resultCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := c.lru.Len()
+	clear(c.entries)
+	c.lru.Init()
+	return purged
+}
+
+// findResponseMultihash returns the multihash that the given find response is
+// for, or nil if it has no results.
+func findResponseMultihash(resp *model.FindResponse) multihash.Multihash {
+	if len(resp.MultihashResults) > 0 {
+		return resp.MultihashResults[0].Multihash
+	}
+	if len(resp.EncryptedMultihashResults) > 0 {
+		return resp.EncryptedMultihashResults[0].Multihash
+	}
+	return nil
+}
+
+// startRevalidating marks the result retained under the given key as being
+// revalidated, and returns false if it is already being revalidated so that
+// concurrent requests trigger at most one revalidation.
+func (c *resultCache) startRevalidating(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	entry := e.Value.(*resultCacheEntry)
+	if entry.revalidating {
+		return false
+	}
+	entry.revalidating = true
+	return true
+}
+
+// stopRevalidating clears the revalidating mark of the result retained under
+// the given key, so that it can be revalidated again.
+func (c *resultCache) stopRevalidating(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*resultCacheEntry).revalidating = false
+	}
+}
+
+// served counts a response served with the given cache status towards the
+// cache statistics. A nil resultCache counts nothing.
+func (c *resultCache) served(cs cacheStatus) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch cs.status {
+	case cacheHit:
+		c.stats.Hits++
+	case cacheStale:
+		c.stats.Stale++
+	case cacheMiss:
+		c.stats.Misses++
+	}
+}
+
+// statistics returns the cumulative cache statistics.
+func (c *resultCache) statistics() resultCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// addStatistics adds the given statistics to the cumulative ones, e.g. as
+// restored from a snapshot.
+func (c *resultCache) addStatistics(stats resultCacheStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Hits += stats.Hits
+	c.stats.Stale += stats.Stale
+	c.stats.Misses += stats.Misses
+}
@@ -0,0 +1,303 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	subject := newResultCache(2)
+	g := &gatheredFind{
+		resp:         model.FindResponse{MultihashResults: []model.MultihashResult{{Multihash: cid.MustParse(mockbackend.SampleCids[0]).Hash()}}},
+		foundRegular: true,
+	}
+	subject.put("a", g)
+	subject.put("b", g)
+	_, _, ok := subject.get("a", time.Hour)
+	require.True(t, ok)
+	subject.put("c", g)
+
+	_, _, ok = subject.get("b", time.Hour)
+	require.False(t, ok)
+	got, age, ok := subject.get("a", time.Hour)
+	require.True(t, ok)
+	require.Equal(t, g.resp.MultihashResults[0].Multihash, got.resp.MultihashResults[0].Multihash)
+	require.True(t, got.foundRegular)
+	require.Less(t, age, time.Minute)
+
+	time.Sleep(time.Millisecond)
+	_, _, ok = subject.get("a", time.Nanosecond)
+	require.False(t, ok)
+
+	require.True(t, subject.startRevalidating("a"))
+	require.False(t, subject.startRevalidating("a"))
+	subject.stopRevalidating("a")
+	require.True(t, subject.startRevalidating("a"))
+	subject.remove("a")
+	_, _, ok = subject.get("a", time.Hour)
+	require.False(t, ok)
+}
+
+func TestFind_RevalidatesCachedResultInBackground(t *testing.T) {
+	defer func(old time.Duration) { config.Cache.TTL = old }(config.Cache.TTL)
+	defer func(old time.Duration) { config.Cache.RevalidateWindow = old }(config.Cache.RevalidateWindow)
+	config.Cache.TTL = time.Nanosecond
+	config.Cache.RevalidateWindow = time.Hour
+
+	var failing atomic.Bool
+	var finds atomic.Int32
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/providers") {
+			finds.Add(1)
+			if failing.Load() {
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(c string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+c, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+
+	fresh := find(mockbackend.SampleCids[0])
+	require.Equal(t, http.StatusOK, fresh.Code)
+	require.Equal(t, int32(2), finds.Load())
+
+	// Past its TTL, the cached result is served as is while it is refreshed,
+	// and is retained when the refresh fails.
+	failing.Store(true)
+	cached := find(mockbackend.SampleCids[0])
+	require.Equal(t, http.StatusOK, cached.Code)
+	require.JSONEq(t, fresh.Body.String(), cached.Body.String())
+	require.Equal(t, cacheStale, cached.Header().Get(cacheStatusHeader))
+	require.Equal(t, staleWarning, cached.Header().Get("Warning"))
+	require.Eventually(t, func() bool { return finds.Load() == 4 }, time.Second, time.Millisecond)
+
+	// Once the previous refresh completes, a later request refreshes it again.
+	failing.Store(false)
+	require.Eventually(t, func() bool {
+		return find(mockbackend.SampleCids[0]).Code == http.StatusOK && finds.Load() >= 6
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFind_ServesStaleWhenAllBackendsFail(t *testing.T) {
+	defer func(old time.Duration) { config.Cache.StaleWindow = old }(config.Cache.StaleWindow)
+	config.Cache.StaleWindow = time.Hour
+
+	var failing atomic.Bool
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && !strings.HasPrefix(r.URL.Path, "/providers") {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(c string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+c, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec
+	}
+
+	fresh := find(mockbackend.SampleCids[0])
+	require.Equal(t, http.StatusOK, fresh.Code)
+	require.Empty(t, fresh.Header().Get("Warning"))
+	require.Equal(t, cacheMiss, fresh.Header().Get(cacheStatusHeader))
+
+	failing.Store(true)
+	stale := find(mockbackend.SampleCids[0])
+	require.Equal(t, http.StatusOK, stale.Code)
+	require.Equal(t, staleWarning, stale.Header().Get("Warning"))
+	require.Equal(t, cacheStale, stale.Header().Get(cacheStatusHeader))
+	require.NotEmpty(t, stale.Header().Get("Age"))
+	require.JSONEq(t, fresh.Body.String(), stale.Body.String())
+
+	// Lookups that were never cached still fail.
+	require.Equal(t, http.StatusNotFound, find(mockbackend.SampleCids[1]).Code)
+}
+
+func TestFind_SetsCacheStatusHeaders(t *testing.T) {
+	defer func(old time.Duration) { config.Cache.TTL = old }(config.Cache.TTL)
+	config.Cache.TTL = time.Hour
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	miss := find("/cid/" + mockbackend.SampleCids[0])
+	require.Equal(t, cacheMiss, miss.Header().Get(cacheStatusHeader))
+	require.Empty(t, miss.Header().Get("Age"))
+
+	for _, target := range []string{
+		"/cid/" + mockbackend.SampleCids[0],
+		"/cid/" + mockbackend.SampleCids[0] + "/count",
+		"/cid/" + mockbackend.SampleCids[0] + "?exists=true",
+	} {
+		hit := find(target)
+		require.Equal(t, cacheHit, hit.Header().Get(cacheStatusHeader), target)
+		require.Equal(t, "0", hit.Header().Get("Age"), target)
+		require.Empty(t, hit.Header().Get("Warning"), target)
+	}
+}
+
+func TestFind_CachesResultsOfSingleBackend(t *testing.T) {
+	defer func(old time.Duration) { config.Cache.TTL = old }(config.Cache.TTL)
+	config.Cache.TTL = time.Hour
+
+	var finds atomic.Int32
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/providers") {
+			finds.Add(1)
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+	require.Equal(t, cacheMiss, find().Header().Get(cacheStatusHeader))
+	require.Equal(t, cacheHit, find().Header().Get(cacheStatusHeader))
+	require.Equal(t, int32(1), finds.Load())
+}
+
+func TestFind_DoesNotCacheResultsOfPinnedRequests(t *testing.T) {
+	defer func(old time.Duration) { config.Cache.TTL = old }(config.Cache.TTL)
+	defer func(token string) { config.Server.BackendPinningToken = token }(config.Server.BackendPinningToken)
+	config.Cache.TTL = time.Hour
+	config.Server.BackendPinningToken = "fish"
+
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	mh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	// Each backend names itself in the context ID of the record it returns.
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", MediaTypeJson)
+			_ = json.NewEncoder(w).Encode(model.FindResponse{MultihashResults: []model.MultihashResult{{
+				Multihash: mh,
+				ProviderResults: []model.ProviderResult{{
+					ContextID: []byte(name),
+					Provider:  &peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}},
+				}},
+			}}})
+		}))
+	}
+	fish := backend("fish")
+	defer fish.Close()
+	lobster := backend("lobster")
+	defer lobster.Close()
+	providers := emptyProvidersBackend()
+	defer providers.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: fish.URL},
+			{URL: lobster.URL},
+			{URL: providers.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(pinned string) (string, int) {
+		req := httptest.NewRequest(http.MethodGet, "/multihash/"+mh.B58String(), nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		if pinned != "" {
+			req.Header.Set(backendPinningHeader, strings.TrimPrefix(pinned, "http://"))
+			req.Header.Set(backendPinningTokenHeader, "fish")
+		}
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp model.FindResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return rec.Header().Get(cacheStatusHeader), len(resp.MultihashResults[0].ProviderResults)
+	}
+
+	status, records := find(fish.URL)
+	require.Empty(t, status)
+	require.Equal(t, 1, records)
+
+	// Unpinned requests are not answered with the results of one backend.
+	status, records = find("")
+	require.Equal(t, cacheMiss, status)
+	require.Equal(t, 2, records)
+	status, records = find("")
+	require.Equal(t, cacheHit, status)
+	require.Equal(t, 2, records)
+
+	// Nor are pinned requests answered with those of every backend.
+	status, records = find(lobster.URL)
+	require.Empty(t, status)
+	require.Equal(t, 1, records)
+}
@@ -0,0 +1,311 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type scatterGather[B Backend, R any] struct {
+	backends []B
+	start    time.Time
+	wg       sync.WaitGroup
+	out      chan R
+	maxWait  time.Duration
+	// cascadeMaxWait is the deadline for scattering to cascade backends, which
+	// may be longer than maxWait since cascading is typically slower. Defaults
+	// to maxWait if zero.
+	cascadeMaxWait time.Duration
+	// latency tunes maxWait to the latency observed from backends other than
+	// cascade backends, if non-nil.
+	latency *latencyTracker
+	// pool bounds the goroutines scattering to backends, if non-nil.
+	pool *scatterPool
+	// concurrency adaptively limits the requests scattered to each backend,
+	// if non-nil.
+	concurrency *adaptiveConcurrency
+	// circuit is the route class whose circuit breakers of backends are
+	// consulted and tripped. Defaults to find if empty.
+	circuit string
+	// circuitOpen holds the backends that were not scattered to because their
+	// circuit breaker was open. It is populated by scatter.
+	circuitOpen []B
+	// concurrencyLimited holds the backends that were not scattered to
+	// because they were at their concurrency limit. It is populated by
+	// scatter.
+	concurrencyLimited []B
+}
+
+// maxWaitFor returns the deadline for scattering the request with the given
+// context to the given backend. A deadline overridden by the request applies
+// to every backend.
+func (sg *scatterGather[B, R]) maxWaitFor(ctx context.Context, target B) time.Duration {
+	_, isCascade := any(target).(caskadeBackend)
+	maxWait := sg.maxWait
+	if override := maxWaitOverrideFrom(ctx); override > 0 {
+		maxWait = override
+	} else if isCascade {
+		if sg.cascadeMaxWait > 0 {
+			maxWait = sg.cascadeMaxWait
+		}
+	} else if v := experimentVariantFrom(ctx); v != nil && v.maxWait > 0 {
+		maxWait = v.maxWait
+	} else {
+		maxWait = sg.latency.maxWait(maxWait)
+	}
+	return priorityMaxWait(ctx, maxWait)
+}
+
+// observeLatency records the time the given backend took to respond to the
+// request with the given context, for tuning the deadline of subsequent
+// requests. Backends that failed are not observed, nor are backends that
+// timed out on a deadline overridden or shortened for the request.
+func (sg *scatterGather[B, R]) observeLatency(ctx context.Context, target B, elapsed time.Duration, err error) {
+	if sg.latency == nil || ctx.Err() != nil {
+		return
+	}
+	if _, isCascade := any(target).(caskadeBackend); isCascade {
+		return
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, context.DeadlineExceeded):
+		if deadlineShortened(ctx) {
+			return
+		}
+	default:
+		return
+	}
+	sg.latency.record(elapsed)
+}
+
+// deadlineShortened checks whether the backend deadline of the request with
+// the given context is overridden or shortened for the request, such that
+// timing out on it says nothing of the backend.
+func deadlineShortened(ctx context.Context) bool {
+	return experimentVariantFrom(ctx) != nil || lowPriorityUnderLoad(ctx) || maxWaitOverrideFrom(ctx) > 0
+}
+
+func (sg *scatterGather[B, R]) scatter(ctx context.Context, forEach func(context.Context, B) (*R, error)) error {
+	sg.start = time.Now()
+	sg.out = make(chan R, 1)
+	sg.circuitOpen = nil
+	sg.concurrencyLimited = nil
+	var ready []B
+	var limiters []*aimdLimiter
+	for _, backend := range sg.backends {
+		if !circuitReady(backend, sg.circuit) {
+			sg.circuitOpen = append(sg.circuitOpen, backend)
+			continue
+		}
+		limiter, ok := sg.concurrency.acquire(backend)
+		if !ok {
+			log.Debugw("Skipped scatter on target at its concurrency limit", "target", backend.URL().Host)
+			sg.concurrencyLimited = append(sg.concurrencyLimited, backend)
+			continue
+		}
+		ready = append(ready, backend)
+		limiters = append(limiters, limiter)
+	}
+
+	dispatch := func() {
+		for i, backend := range ready {
+			// Dispatching waits for a worker once the pool is saturated,
+			// which holds back requests to the remaining backends too.
+			release, err := sg.pool.acquire(ctx, backend)
+			if err != nil {
+				for _, limiter := range limiters[i:] {
+					limiter.release()
+				}
+				log.Errorw("context is done before completing scatter", "err", err)
+				return
+			}
+			sg.wg.Add(1)
+			go sg.scatterTo(ctx, backend, release, limiters[i], forEach)
+		}
+	}
+	if sg.pool == nil {
+		dispatch()
+	} else {
+		// Workers are dispatched in the background, since a saturated pool
+		// only frees up as results are gathered.
+		sg.wg.Add(1)
+		go func() {
+			defer sg.wg.Done()
+			dispatch()
+		}()
+	}
+	go func() {
+		defer close(sg.out)
+		sg.wg.Wait()
+	}()
+	return nil
+}
+
+// scatterTo sends the request to the given backend via forEach, and releases
+// its worker and concurrency limiter once done.
+func (sg *scatterGather[B, R]) scatterTo(ctx context.Context, target B, release func(), limiter *aimdLimiter, forEach func(context.Context, B) (*R, error)) {
+	defer sg.wg.Done()
+	defer release()
+	defer limiter.release()
+
+	select {
+	case <-ctx.Done():
+		if clientGone(ctx) {
+			log.Debugw("Client went away before completing scatter", "target", target.URL().Host)
+		} else {
+			log.Errorw("context is done before completing scatter", "err", ctx.Err())
+		}
+		return
+	default:
+	}
+
+	maxWait := sg.maxWaitFor(ctx, target)
+	cctx, cancel := context.WithTimeout(ctx, maxWait)
+	// Only backends that are actually sent a request are observed,
+	// rather than those that forEach skips.
+	var queried atomic.Bool
+	if sg.latency != nil || limiter != nil {
+		cctx = httptrace.WithClientTrace(cctx, &httptrace.ClientTrace{
+			GetConn: func(string) { queried.Store(true) },
+		})
+	}
+	start := time.Now()
+	sout, err := forEach(cctx, target)
+	cancel()
+	if queried.Load() {
+		elapsed := time.Since(start)
+		sg.observeLatency(ctx, target, elapsed, err)
+		sg.observeConcurrency(ctx, limiter, elapsed, err)
+	}
+	if cb := target.CBFor(sg.circuit); cb != nil {
+		err = cb.Done(cctx, err)
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Debugw("Scatter on target canceled", "target", target.URL().Host)
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			log.Debugw("failed to scatter on target because context deadline exceeded", "target", target.URL().Host, "maxWait", maxWait)
+		} else {
+			log.Errorw("failed to scatter on target", "target", target.URL().Host, "err", err, "maxWait", maxWait)
+		}
+		return
+	}
+	if sout != nil {
+		select {
+		case <-ctx.Done():
+		case sg.out <- *sout:
+		}
+	}
+}
+
+// settle waits for every backend scattered to with the given context to be
+// done if the client went away, which is prompt since their requests are
+// canceled, so that the backends cut short are tallied before gathering
+// completes.
+func (sg *scatterGather[_, _]) settle(ctx context.Context) {
+	if clientGone(ctx) {
+		sg.wg.Wait()
+	}
+}
+
+func (sg *scatterGather[_, R]) gather(ctx context.Context) <-chan R {
+	gout := make(chan R, 1)
+	go func() {
+		defer func() {
+			// Logged ahead of closing, after which sg may be scattered
+			// again.
+			log.Debugw("Completed scatter gather", "elapsed", time.Since(sg.start))
+			close(gout)
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case r, ok := <-sg.out:
+				if !ok {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case gout <- r:
+					continue
+				}
+			}
+		}
+	}()
+	return gout
+}
+
+// scatterPool bounds the number of goroutines scattering requests to backends,
+// across all backends and per backend, so that bursts of requests cannot
+// spawn an unbounded number of goroutines. A nil scatterPool is unbounded.
+type scatterPool struct {
+	// workers holds a token per goroutine scattering to any backend, if
+	// bounded.
+	workers        chan struct{}
+	backendWorkers int
+
+	mu                sync.Mutex
+	perBackendWorkers map[string]chan struct{}
+}
+
+// newScatterPool instantiates a scatterPool of the given number of workers in
+// total and per backend, either of which is unbounded if zero.
+func newScatterPool(workers, backendWorkers int) *scatterPool {
+	p := &scatterPool{
+		backendWorkers:    backendWorkers,
+		perBackendWorkers: make(map[string]chan struct{}),
+	}
+	if workers > 0 {
+		p.workers = make(chan struct{}, workers)
+	}
+	return p
+}
+
+// acquire blocks until a worker is available to scatter to the given backend
+// or the context is done, and returns the function that releases the worker.
+func (p *scatterPool) acquire(ctx context.Context, b Backend) (func(), error) {
+	if p == nil {
+		return func() {}, nil
+	}
+	var backendWorkers chan struct{}
+	if p.backendWorkers > 0 {
+		key := clusterKey(b)
+		p.mu.Lock()
+		backendWorkers = p.perBackendWorkers[key]
+		if backendWorkers == nil {
+			backendWorkers = make(chan struct{}, p.backendWorkers)
+			p.perBackendWorkers[key] = backendWorkers
+		}
+		p.mu.Unlock()
+	}
+	// Acquire the worker of the backend first, so that no worker in total is
+	// held while waiting on a saturated backend.
+	for _, tokens := range []chan struct{}{backendWorkers, p.workers} {
+		if tokens == nil {
+			continue
+		}
+		select {
+		case tokens <- struct{}{}:
+		case <-ctx.Done():
+			if tokens == p.workers && backendWorkers != nil {
+				<-backendWorkers
+			}
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		if p.workers != nil {
+			<-p.workers
+		}
+		if backendWorkers != nil {
+			<-backendWorkers
+		}
+	}, nil
+}
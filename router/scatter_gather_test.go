@@ -0,0 +1,294 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/stretchr/testify/require"
+)
+
+var _ (Backend) = (*testBackend)(nil)
+
+type testBackend int
+
+func (t testBackend) URL() *url.URL {
+	u, err := url.Parse("http://test.invalid")
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func (t testBackend) CB() *circuitbreaker.CircuitBreaker { return nil }
+
+func (t testBackend) CBFor(string) *circuitbreaker.CircuitBreaker { return nil }
+
+func (t testBackend) Matches(*http.Request) bool { return false }
+
+func (t testBackend) Client() *http.Client { return http.DefaultClient }
+
+func TestScatterGather_GathersExpectedResults(t *testing.T) {
+	subject := scatterGather[testBackend, string]{
+		backends: []testBackend{testBackend(1), testBackend(2), testBackend(3), testBackend(4), testBackend(5)},
+		maxWait:  2 * time.Second,
+	}
+
+	ctx := context.Background()
+	err := subject.scatter(ctx, func(cctx context.Context, i testBackend) (*string, error) {
+		if cctx.Err() == nil {
+			str := fmt.Sprintf("%d fish", i)
+			return &str, nil
+		}
+		return nil, cctx.Err()
+	})
+	require.NoError(t, err)
+
+	var gotResults []string
+	for got := range subject.gather(ctx) {
+		gotResults = append(gotResults, got)
+	}
+	require.Len(t, gotResults, 5)
+	require.Contains(t, gotResults, "1 fish")
+	require.Contains(t, gotResults, "2 fish")
+	require.Contains(t, gotResults, "3 fish")
+	require.Contains(t, gotResults, "4 fish")
+	require.Contains(t, gotResults, "5 fish")
+}
+
+func TestScatterGather_ExcludesScatterErrors(t *testing.T) {
+	subject := scatterGather[testBackend, string]{
+		backends: []testBackend{testBackend(1), testBackend(2), testBackend(3)},
+		maxWait:  2 * time.Second,
+	}
+	ctx := context.Background()
+	err := subject.scatter(ctx, func(cctx context.Context, i testBackend) (*string, error) {
+		if i == 2 {
+			return nil, errors.New("fish says no")
+		}
+		if cctx.Err() == nil {
+			str := fmt.Sprintf("%d fish", i)
+			return &str, nil
+		}
+		return nil, cctx.Err()
+	})
+	require.NoError(t, err)
+
+	var gotResults []string
+	for got := range subject.gather(ctx) {
+		gotResults = append(gotResults, got)
+	}
+	require.Len(t, gotResults, 2)
+	require.Contains(t, gotResults, "1 fish")
+	require.Contains(t, gotResults, "3 fish")
+	require.NotContains(t, gotResults, "2 fish")
+}
+
+func TestScatterGather_DoesNotWaitLongerThanExpected(t *testing.T) {
+	subject := scatterGather[testBackend, string]{
+		backends: []testBackend{testBackend(1)},
+		maxWait:  100 * time.Millisecond,
+	}
+	ctx := context.Background()
+	err := subject.scatter(ctx, func(cctx context.Context, i testBackend) (*string, error) {
+		time.Sleep(2 * time.Second)
+		if cctx.Err() == nil {
+			str := fmt.Sprintf("%d fish", i)
+			return &str, nil
+		}
+		return nil, cctx.Err()
+	})
+	require.NoError(t, err)
+
+	var gotResults []string
+	for got := range subject.gather(ctx) {
+		gotResults = append(gotResults, got)
+	}
+	require.Len(t, gotResults, 0)
+}
+
+func TestScatterGather_GathersNothingWhenContextIsCancelled(t *testing.T) {
+	subject := scatterGather[testBackend, string]{
+		backends: []testBackend{testBackend(1), testBackend(2), testBackend(3)},
+		maxWait:  2 * time.Second,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Millisecond)
+	cancel()
+
+	err := subject.scatter(ctx, func(cctx context.Context, i testBackend) (*string, error) {
+		if cctx.Err() == nil {
+			str := fmt.Sprintf("%d fish", i)
+			return &str, nil
+		}
+		return nil, cctx.Err()
+	})
+	require.NoError(t, err)
+
+	var gotResults []string
+	for got := range subject.gather(ctx) {
+		gotResults = append(gotResults, got)
+	}
+	require.Len(t, gotResults, 0)
+}
+
+func TestScatterGather_CascadeBackendsWaitLonger(t *testing.T) {
+	subject := scatterGather[Backend, string]{
+		backends:       []Backend{testBackend(1), caskadeBackend{Backend: testBackend(2)}},
+		maxWait:        50 * time.Millisecond,
+		cascadeMaxWait: 2 * time.Second,
+	}
+
+	ctx := context.Background()
+	err := subject.scatter(ctx, func(cctx context.Context, b Backend) (*string, error) {
+		// Both backends respond slower than maxWait.
+		select {
+		case <-cctx.Done():
+			return nil, cctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+		_, isCascade := b.(caskadeBackend)
+		str := fmt.Sprintf("cascade: %t", isCascade)
+		return &str, nil
+	})
+	require.NoError(t, err)
+
+	var gotResults []string
+	for got := range subject.gather(ctx) {
+		gotResults = append(gotResults, got)
+	}
+	require.Equal(t, []string{"cascade: true"}, gotResults)
+}
+
+type openCircuitBackend struct {
+	testBackend
+	cb *circuitbreaker.CircuitBreaker
+}
+
+func (o openCircuitBackend) CB() *circuitbreaker.CircuitBreaker { return o.cb }
+
+func (o openCircuitBackend) CBFor(string) *circuitbreaker.CircuitBreaker { return o.cb }
+
+func TestScatterGather_RecordsOpenCircuits(t *testing.T) {
+	cb := circuitbreaker.New()
+	cb.SetState(circuitbreaker.StateOpen)
+	open := openCircuitBackend{testBackend: testBackend(2), cb: cb}
+	subject := scatterGather[Backend, string]{
+		backends: []Backend{testBackend(1), open},
+		maxWait:  2 * time.Second,
+	}
+
+	ctx := context.Background()
+	err := subject.scatter(ctx, func(cctx context.Context, b Backend) (*string, error) {
+		str := "ok"
+		return &str, nil
+	})
+	require.NoError(t, err)
+
+	var gotResults []string
+	for got := range subject.gather(ctx) {
+		gotResults = append(gotResults, got)
+	}
+	require.Equal(t, []string{"ok"}, gotResults)
+	require.Equal(t, []Backend{open}, subject.circuitOpen)
+}
+
+func TestScatterGather_ConsultsCircuitOfRouteClass(t *testing.T) {
+	metadataCB := circuitbreaker.New()
+	metadataCB.SetState(circuitbreaker.StateOpen)
+	b, err := newBackend("http://test.invalid", circuitbreaker.New(), map[string]*circuitbreaker.CircuitBreaker{
+		circuitMetadata: metadataCB,
+	}, Matchers.Any, nil)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		circuit string
+		want    []string
+	}{
+		{circuit: "", want: []string{"ok"}},
+		{circuit: circuitMetadata},
+		{circuit: circuitProviders, want: []string{"ok"}},
+	} {
+		subject := scatterGather[Backend, string]{
+			backends: []Backend{b},
+			maxWait:  2 * time.Second,
+			circuit:  test.circuit,
+		}
+		ctx := context.Background()
+		require.NoError(t, subject.scatter(ctx, func(cctx context.Context, b Backend) (*string, error) {
+			str := "ok"
+			return &str, nil
+		}))
+		var gotResults []string
+		for got := range subject.gather(ctx) {
+			gotResults = append(gotResults, got)
+		}
+		require.Equal(t, test.want, gotResults, "circuit %q", test.circuit)
+	}
+}
+
+func TestScatterGather_BoundsWorkers(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		workers        int
+		backendWorkers int
+		wantMax        int32
+	}{
+		{name: "total", workers: 1, wantMax: 1},
+		// Test backends share a URL, so are bounded as a single backend.
+		{name: "per backend", backendWorkers: 2, wantMax: 2},
+		{name: "unbounded", wantMax: 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			subject := scatterGather[testBackend, string]{
+				backends: []testBackend{testBackend(1), testBackend(2), testBackend(3), testBackend(4), testBackend(5)},
+				maxWait:  2 * time.Second,
+				pool:     newScatterPool(test.workers, test.backendWorkers),
+			}
+			var inFlight, maxInFlight atomic.Int32
+			ctx := context.Background()
+			err := subject.scatter(ctx, func(cctx context.Context, i testBackend) (*string, error) {
+				n := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for {
+					m := maxInFlight.Load()
+					if n <= m || maxInFlight.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				str := fmt.Sprintf("%d fish", i)
+				return &str, nil
+			})
+			require.NoError(t, err)
+
+			var gotResults []string
+			for got := range subject.gather(ctx) {
+				gotResults = append(gotResults, got)
+			}
+			require.Len(t, gotResults, 5)
+			require.LessOrEqual(t, maxInFlight.Load(), test.wantMax)
+		})
+	}
+}
+
+func TestScatterPool_ReleasesBackendWorkerWhenContextIsDone(t *testing.T) {
+	subject := newScatterPool(1, 2)
+	release, err := subject.acquire(context.Background(), testBackend(1))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = subject.acquire(ctx, testBackend(2))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, subject.perBackendWorkers[clusterKey(testBackend(2))], 1)
+
+	release()
+	require.Empty(t, subject.workers)
+	require.Empty(t, subject.perBackendWorkers[clusterKey(testBackend(1))])
+}
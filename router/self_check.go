@@ -0,0 +1,94 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// selfCheckMultihash is the multihash looked up by self-check probes, which
+// backends are not expected to have records of.
+var selfCheckMultihash = func() string {
+	digest := sha256.Sum256([]byte("indexstar self-check"))
+	mh, _ := multihash.Encode(digest[:], multihash.SHA2_256)
+	return multihash.Multihash(mh).B58String()
+}()
+
+// selfCheckRoutes are the routes that backends are probed on by self-check,
+// by backend type.
+var selfCheckRoutes = map[string][]string{
+	BackendTypeRegular:   {"/health", "/multihash/" + selfCheckMultihash, "/providers"},
+	BackendTypeCascade:   {"/health", "/multihash/" + selfCheckMultihash},
+	BackendTypeDH:        {"/health", "/encrypted/multihash/" + selfCheckMultihash},
+	BackendTypeProviders: {"/health", "/providers"},
+}
+
+// SelfCheckResult is how a backend responded to self-check probes.
+type SelfCheckResult struct {
+	URL  string
+	Type string
+	// Routes are the status of the response to the probe of each route, or
+	// the error probing it.
+	Routes map[string]string
+	// Usable is whether the backend responded on at least one route without
+	// a 5xx status.
+	Usable bool
+}
+
+// SelfCheck probes every backend on the routes it is expected to serve, so
+// that misconfigured or unreachable backends are noticed on startup rather
+// than by clients. Probes are bounded by SERVER_RESULT_MAX_WAIT.
+func (s *Server) SelfCheck(ctx context.Context) []SelfCheckResult {
+	backends := s.backends()
+	results := make([]SelfCheckResult, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		typ := backendType(b)
+		results[i] = SelfCheckResult{
+			URL:    b.URL().String(),
+			Type:   typ,
+			Routes: make(map[string]string),
+		}
+		wg.Add(1)
+		go func(r *SelfCheckResult) {
+			defer wg.Done()
+			for _, route := range selfCheckRoutes[typ] {
+				status, err := selfCheckProbe(ctx, b, route)
+				if err != nil {
+					r.Routes[route] = err.Error()
+					continue
+				}
+				r.Routes[route] = strconv.Itoa(status)
+				if status < http.StatusInternalServerError {
+					r.Usable = true
+				}
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// selfCheckProbe sends a GET request to the given route of the given backend,
+// bypassing its circuit breakers, and returns the response status.
+func selfCheckProbe(ctx context.Context, b Backend, route string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Server.ResultMaxWait)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL().JoinPath(route).String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", MediaTypeJson)
+	resp, err := b.Client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,45 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_SelfCheck(t *testing.T) {
+	healthy := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	subject, err := NewServer(Options{
+		Backends: []BackendConfig{
+			{URL: healthy.URL},
+			{URL: failing.URL, Type: BackendTypeCascade},
+			{URL: healthy.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	got := subject.SelfCheck(context.Background())
+	require.Len(t, got, 3)
+
+	require.Equal(t, BackendTypeRegular, got[0].Type)
+	require.True(t, got[0].Usable)
+	require.Equal(t, "404", got[0].Routes["/multihash/"+selfCheckMultihash])
+	require.Equal(t, "200", got[0].Routes["/providers"])
+
+	require.Equal(t, BackendTypeCascade, got[1].Type)
+	require.False(t, got[1].Usable)
+	require.Len(t, got[1].Routes, 2)
+	require.Equal(t, "503", got[1].Routes["/health"])
+
+	require.Equal(t, BackendTypeProviders, got[2].Type)
+	require.True(t, got[2].Usable)
+	require.NotContains(t, got[2].Routes, "/multihash/"+selfCheckMultihash)
+}
@@ -0,0 +1,861 @@
+// Package router implements the indexstar aggregation core: it routes IPNI and
+// delegated routing requests across a set of backends and merges their
+// responses. See New for embedding it into other Go services.
+package router
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/mercari/go-circuitbreaker"
+	"golang.org/x/time/rate"
+)
+
+var (
+	log = logging.Logger("indexstar/mux")
+
+	//go:embed *.html
+	webUI embed.FS
+)
+
+// legacyFinderPrefix is the path prefix of finder routes in the legacy
+// storetheindex api/v0.
+const legacyFinderPrefix = "/api/v0/finder"
+
+// Options configures a Server.
+type Options struct {
+	// Context bounds the lifetime of background work started by the Server,
+	// such as webhook subscriptions, auditing and canary probes. Defaults to
+	// context.Background.
+	Context context.Context
+	// Backends are the backends to route requests to. At least one backend
+	// must be specified.
+	Backends []BackendConfig
+	// FallbackBackend is the URL of a backend to reverse proxy requests to for
+	// any path not handled by indexstar, e.g. /ingest/*. Optional.
+	FallbackBackend string
+	// TranslateNonStreaming sets whether to translate non-streaming JSON
+	// requests to streaming NDJSON requests before scattering to backends.
+	TranslateNonStreaming bool
+	// HomepageURL is the webUI rendered via iframe on the embedded index
+	// page.
+	HomepageURL string
+	// Chaos enables test-only fault injection toward backends as configured
+	// by CHAOS_* env vars. Never enable in production.
+	Chaos bool
+	// Middlewares are applied to requests in order, ahead of any middlewares
+	// configured via the SERVER_MIDDLEWARES env var. Since middlewares may
+	// tailor results, any middleware disables proxying find requests to a
+	// sole backend as well as caching translated delegated routing responses,
+	// as do the built-in reputation, usage and analytics middlewares.
+	Middlewares []Middleware
+	// CascadeLabels overrides the comma-separated cascade labels configured
+	// via the SERVER_CASCADE_LABELS env var, if non-empty.
+	CascadeLabels string
+	// MaxStreams overrides the limit of open streaming responses configured
+	// via the SERVER_MAX_STREAMS env var, if non-zero.
+	MaxStreams int
+	// SnapshotPath overrides the path of the counters snapshot configured
+	// via the SNAPSHOT_PATH env var, if non-empty.
+	SnapshotPath string
+	// SubscriptionsStorePath overrides the path of the subscriptions store
+	// configured via the SUBSCRIPTIONS_STORE_PATH env var, if non-empty.
+	SubscriptionsStorePath string
+	// CapturePath overrides the path of the capture file configured via the
+	// CAPTURE_PATH env var, if non-empty.
+	CapturePath string
+	// LeaderLease overrides the namespace/name of the leader lease
+	// configured via the LEADER_LEASE env var, if non-empty.
+	LeaderLease string
+	// DisablePeerSync disables synchronizing circuit state, rate limit
+	// counters and the negative lookup filter with the configured peers,
+	// whose endpoints are those of their default Server.
+	DisablePeerSync bool
+	// Reload reloads the configuration when requested via POST /admin/reload,
+	// and returns what changed. The endpoint is disabled if nil.
+	Reload func() (ReloadReport, error)
+	// ValidateReload validates the configuration without reloading it when
+	// requested via POST /admin/reload?dry_run=true, and returns what
+	// reloading it would change. Dry runs are not supported if nil.
+	ValidateReload func() (ReloadReport, error)
+	// ReputationSource overrides the source of provider scores configured
+	// via the REPUTATION_SOURCE env var, if non-nil.
+	ReputationSource ReputationSource
+}
+
+// Server routes IPNI find, metadata and providers requests, as well as
+// delegated routing requests, across a set of backends and aggregates their
+// responses.
+type Server struct {
+	ctx     context.Context
+	handler http.Handler
+	// routing is the set of backends requests are routed to, swapped as a
+	// whole on reload.
+	routing atomic.Pointer[backendSet]
+	// cascade are the supported cascade labels, if restricted.
+	cascade               []string
+	fallback              http.Handler
+	translateNonStreaming bool
+	// chaos enables fault injection toward targeted backends.
+	chaos bool
+
+	index          *indexRenderer
+	pcache         *providerCache
+	subscriptions  *subscriptions
+	auditor        *auditor
+	canary         *canary
+	ingest         *ingestMonitor
+	certs          *certMonitor
+	mirror         *mirror
+	cache          *resultCache
+	delegatedCache *delegatedCache
+	negative       *negativeFilter
+	cluster        *cluster
+	prober         *circuitProber
+	rateLimiter    *rateLimiter
+	inflight       *inflightLimiter
+	usage          *usageAccounter
+	leader         *leaderElector
+	priority       *prioritizer
+	maxWait        *maxWaitOverrider
+	// deadlines tunes backend deadlines per route, if non-nil.
+	deadlines   map[string]*latencyTracker
+	scatterPool *scatterPool
+	// concurrency adaptively limits requests scattered to each backend, if
+	// non-nil.
+	concurrency *adaptiveConcurrency
+	streams     *streamLimiter
+	streaming   *streamingSupport
+	options     *optionsCache
+	writes      *recentWrites
+	capturer    *capturer
+	analytics   *analytics
+	reputation  *reputation
+	snapshots   *snapshotter
+	middlewares middlewares
+	// reload reloads the configuration, and validateReload validates it
+	// without reloading it, if supported.
+	reload         func() (ReloadReport, error)
+	validateReload func() (ReloadReport, error)
+}
+
+// caskadeBackend is a marker for caskade backends
+type caskadeBackend struct {
+	Backend
+	// limiter bounds the rate of lookups cascaded to the backend, if non-nil.
+	limiter *rate.Limiter
+}
+
+type dhBackend struct {
+	Backend
+}
+
+type providersBackend struct {
+	Backend
+}
+
+// New instantiates an http.Handler that serves the indexstar API by routing
+// requests across the backends specified in the given options. See NewServer.
+func New(o Options) (http.Handler, error) {
+	return NewServer(o)
+}
+
+// NewServer instantiates a Server with the given options. Background work
+// started by the server runs until the options context is done.
+func NewServer(o Options) (*Server, error) {
+	if o.Context == nil {
+		o.Context = context.Background()
+	}
+	labels := cascadeLabels()
+	if o.CascadeLabels != "" {
+		labels = parseCascadeLabels(o.CascadeLabels)
+	}
+	backends, err := loadBackends(o.Backends, labels, o.Chaos)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := newProviderCache(backends)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create provider cache: %w", err)
+	}
+
+	writes := newRecentWrites(config.ReadYourWrites.TTL)
+	var fallback http.Handler
+	if fb := o.FallbackBackend; fb != "" {
+		client, err := newBackendClient(BackendConfig{URL: fb}, o.Chaos)
+		if err != nil {
+			return nil, fmt.Errorf("failed to instantiate fallback backend client: %w", err)
+		}
+		b, err := NewBackend(fb, nil, Matchers.Any, client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to instantiate fallback backend: %w", err)
+		}
+		fallback = writes.track(newBackendProxy(b), b.URL().Host)
+	}
+
+	configured, err := newConfiguredMiddlewares(config.Server.Middlewares)
+	if err != nil {
+		return nil, err
+	}
+	mws := append(append([]Middleware(nil), o.Middlewares...), configured...)
+	if config.Experiment.Path != "" {
+		experimentPath, err := expandHome(config.Experiment.Path)
+		if err != nil {
+			return nil, err
+		}
+		e, err := newExperiment(experimentPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load experiment: %w", err)
+		}
+		mws = append([]Middleware{e}, mws...)
+	}
+	// Rate limits only count requests authorized by policy.
+	var limiter *rateLimiter
+	if config.RateLimit.PerIP > 0 || config.RateLimit.PerKey > 0 {
+		limiter, err = newRateLimiter()
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate rate limiter: %w", err)
+		}
+		if o.DisablePeerSync {
+			limiter.peers = nil
+		}
+		mws = append([]Middleware{limiter}, mws...)
+	}
+	var inflight *inflightLimiter
+	if config.InflightLimit.PerIP > 0 || config.InflightLimit.PerKey > 0 {
+		inflight = newInflightLimiter(config.InflightLimit.PerIP, config.InflightLimit.PerKey)
+	}
+	// Policy is evaluated ahead of any other middleware, since it authorizes
+	// requests.
+	if config.Policy.Path != "" {
+		policyPath, err := expandHome(config.Policy.Path)
+		if err != nil {
+			return nil, err
+		}
+		p, err := newPolicy(policyPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load policy: %w", err)
+		}
+		mws = append([]Middleware{p}, mws...)
+	}
+	// Results are ranked by reputation once filtered by any middleware
+	// configured to, and ahead of accounting them below.
+	var rep *reputation
+	if source := o.ReputationSource; source != nil || config.Reputation.Source != "" {
+		if source == nil {
+			source, err = newFeedReputationSource(config.Reputation.Source)
+			if err != nil {
+				return nil, fmt.Errorf("cannot instantiate reputation source: %w", err)
+			}
+		}
+		rep, err = newReputation(source)
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate reputation: %w", err)
+		}
+		mws = append(mws, rep)
+	}
+	// Usage is accounted after any other middleware, so that only results
+	// served to clients are counted.
+	var usage *usageAccounter
+	if config.Usage.Retention > 0 {
+		usage, err = newUsageAccounter()
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate usage accounting: %w", err)
+		}
+		mws = append(mws, usage)
+	}
+	// Likewise, analytics observes the transports of results served to
+	// clients.
+	var qa *analytics
+	if config.Analytics.Sink != "" {
+		qa, err = newAnalytics(o.Context, config.Analytics.Sink)
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate query analytics: %w", err)
+		}
+		mws = append(mws, qa)
+	}
+
+	s := &Server{
+		ctx:                   o.Context,
+		cascade:               labels,
+		chaos:                 o.Chaos,
+		fallback:              fallback,
+		translateNonStreaming: o.TranslateNonStreaming,
+		pcache:                pc,
+		rateLimiter:           limiter,
+		inflight:              inflight,
+		usage:                 usage,
+		analytics:             qa,
+		reputation:            rep,
+		scatterPool:           newScatterPool(config.Server.ScatterWorkers, config.Server.ScatterBackendWorkers),
+		streams:               newStreamLimiter(orDefault(o.MaxStreams, config.Server.MaxStreams)),
+		streaming:             newStreamingSupport(),
+		options:               newOptionsCache(config.Server.OptionsCacheTTL),
+		writes:                writes,
+		middlewares:           mws,
+		reload:                o.Reload,
+		validateReload:        o.ValidateReload,
+	}
+	routing := &backendSet{backends: backends}
+	if config.Shard.Replicas > 0 {
+		routing.shards = newShardRouter(config.Shard.Replicas, o.Backends)
+	}
+	s.routing.Store(routing)
+
+	if config.Audit.Interval > 0 {
+		s.auditor = newAuditor(s.backends)
+	}
+
+	if config.Cache.TTL > 0 || config.Cache.StaleWindow > 0 {
+		s.cache = newResultCache(config.Cache.MaxEntries)
+	}
+
+	// Translated responses are tailored by middleware to the requesting
+	// client, so are only cached without middleware other than that gating
+	// requests.
+	if config.Delegated.CacheTTL > 0 && !s.middlewares.tailorsResults() {
+		s.delegatedCache = newDelegatedCache(config.Delegated.CacheMaxEntries)
+	}
+
+	if config.Negative.Window > 0 {
+		s.negative, err = newNegativeFilter()
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate negative filter: %w", err)
+		}
+		if o.DisablePeerSync {
+			s.negative.peers = nil
+		}
+	}
+
+	if config.Priority.LoadThreshold > 0 || config.Priority.ShedThreshold > 0 {
+		s.priority, err = newPrioritizer()
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate prioritizer: %w", err)
+		}
+	}
+
+	s.maxWait, err = newMaxWaitOverrider()
+	if err != nil {
+		return nil, fmt.Errorf("cannot instantiate max wait override: %w", err)
+	}
+
+	if config.Deadline.Percentile > 0 {
+		s.deadlines, err = newLatencyTrackers()
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate deadline tuning: %w", err)
+		}
+	}
+
+	if lease := orDefault(o.LeaderLease, config.Leader.Lease); lease != "" {
+		s.leader, err = newLeaderElector(lease)
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate leader election: %w", err)
+		}
+	}
+
+	if config.Cluster.Peers != "" && !o.DisablePeerSync {
+		s.cluster, err = newCluster(s.backends)
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate cluster: %w", err)
+		}
+	}
+
+	if config.Circuit.ProbePath != "" || config.CascadeCircuit.ProbePath != "" {
+		s.prober, err = newCircuitProber(s.backends)
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate circuit prober: %w", err)
+		}
+	}
+
+	if config.Concurrency.InitialLimit > 0 {
+		s.concurrency = newAdaptiveConcurrency()
+	}
+
+	if config.Ingest.Interval > 0 {
+		s.ingest = newIngestMonitor(s.backends)
+	}
+
+	if config.CertExpiry.Interval > 0 {
+		s.certs = newCertMonitor(s.backends)
+	}
+
+	if config.Canary.Probes != "" {
+		s.canary, err = newCanary(config.Canary.Probes, s.doFind)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Mirror.Target != "" {
+		s.mirror, err = newMirror(config.Mirror.Target)
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate mirror: %w", err)
+		}
+	}
+
+	if capturePath := orDefault(o.CapturePath, config.Capture.Path); capturePath != "" {
+		capturePath, err := expandHome(capturePath)
+		if err != nil {
+			return nil, err
+		}
+		s.capturer, err = newCapturer(s.ctx, capturePath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open capture file: %w", err)
+		}
+	}
+
+	// Webhook subscriptions are only enabled when a store path is configured.
+	if storePath := orDefault(o.SubscriptionsStorePath, config.Subscriptions.StorePath); storePath != "" {
+		storePath, err := expandHome(storePath)
+		if err != nil {
+			return nil, err
+		}
+		s.subscriptions, err = newSubscriptions(storePath, s.doFind)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load subscriptions: %w", err)
+		}
+	}
+
+	// Counters are only snapshotted when a snapshot path is configured.
+	if snapshotPath := orDefault(o.SnapshotPath, config.Snapshot.Path); snapshotPath != "" {
+		snapshotPath, err := expandHome(snapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		s.snapshots, err = newSnapshotter(snapshotPath, s.usage, s.cache)
+		if err != nil {
+			return nil, fmt.Errorf("cannot restore counters snapshot: %w", err)
+		}
+	}
+
+	s.index, err = newIndexRenderer(s, o.HomepageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	s.handler, err = s.newHandler()
+	if err != nil {
+		return nil, err
+	}
+	s.start()
+	return s, nil
+}
+
+// loadBackends instantiates the backends of the given configs, where cascade
+// backends only match lookups cascaded to any of the given labels, if any, and
+// faults are injected toward targeted backends if chaos is enabled.
+func loadBackends(cfgs []BackendConfig, labels []string, chaos bool) ([]Backend, error) {
+	newBackendFunc := func(cfg BackendConfig, matcher HttpRequestMatcher) (Backend, error) {
+		s := cfg.URL
+		client, err := newBackendClient(cfg, chaos)
+		if err != nil {
+			return nil, err
+		}
+		newCB := func(class string) *circuitbreaker.CircuitBreaker {
+			return circuitbreaker.New(
+				circuitbreaker.WithFailOnContextCancel(false),
+				circuitbreaker.WithHalfOpenMaxSuccesses(int64(config.Circuit.HalfOpenSuccesses)),
+				circuitbreaker.WithOpenTimeout(config.Circuit.OpenTimeout),
+				circuitbreaker.WithCounterResetInterval(config.Circuit.CounterReset),
+				circuitbreaker.WithOnStateChangeHookFn(func(from, to circuitbreaker.State) {
+					log.Infof("%s circuit state for %s changed from %s to %s", class, s, from, to)
+				}))
+		}
+		return newBackend(s, newCB(circuitFind), map[string]*circuitbreaker.CircuitBreaker{
+			circuitMetadata:  newCB(circuitMetadata),
+			circuitProviders: newCB(circuitProviders),
+		}, matcher, client)
+	}
+
+	backends := make([]Backend, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		matcher := Matchers.Any
+		if cfg.Match != nil {
+			var err error
+			if matcher, err = cfg.Match.matcher(); err != nil {
+				return nil, fmt.Errorf("invalid matcher for backend %s: %w", cfg.URL, err)
+			}
+		}
+		switch cfg.Type {
+		case BackendTypeDH:
+			b, err := newBackendFunc(cfg, matcher)
+			if err != nil {
+				return nil, fmt.Errorf("failed to instantiate dh backend: %w", err)
+			}
+			backends = append(backends, dhBackend{Backend: b})
+		case BackendTypeProviders:
+			b, err := newBackendFunc(cfg, matcher)
+			if err != nil {
+				return nil, fmt.Errorf("failed to instantiate provider backend: %w", err)
+			}
+			backends = append(backends, providersBackend{Backend: b})
+		case BackendTypeCascade:
+			cs := cfg.URL
+			if len(labels) > 0 {
+				labelMatchers := make([]HttpRequestMatcher, 0, len(labels))
+				for _, label := range labels {
+					labelMatchers = append(labelMatchers, Matchers.QueryParam(cascadeQueryParam, label))
+				}
+				matcher = Matchers.AllOf(matcher, Matchers.AnyOf(labelMatchers...))
+			}
+			client, err := newBackendClient(cfg, chaos)
+			if err != nil {
+				return nil, fmt.Errorf("failed to instantiate cascade backend: %w", err)
+			}
+			b, err := NewBackend(cs, circuitbreaker.New(
+				circuitbreaker.WithFailOnContextCancel(false),
+				circuitbreaker.WithHalfOpenMaxSuccesses(int64(config.CascadeCircuit.HalfOpenSuccesses)),
+				circuitbreaker.WithOpenTimeout(config.CascadeCircuit.OpenTimeout),
+				circuitbreaker.WithCounterResetInterval(config.CascadeCircuit.CounterReset),
+				circuitbreaker.WithOnStateChangeHookFn(func(from, to circuitbreaker.State) {
+					log.Infof("cascade circuit state for %s changed from %s to %s", cs, from, to)
+				})), matcher, client)
+			if err != nil {
+				return nil, fmt.Errorf("failed to instantiate cascade backend: %w", err)
+			}
+			maxQPS := config.CascadeRateLimit.MaxQPS
+			if cfg.MaxQPS != 0 {
+				maxQPS = cfg.MaxQPS
+			}
+			var limiter *rate.Limiter
+			if maxQPS > 0 {
+				limiter = rate.NewLimiter(rate.Limit(maxQPS), max(1, int(maxQPS)))
+			}
+			backends = append(backends, caskadeBackend{Backend: b, limiter: limiter})
+		default:
+			b, err := newBackendFunc(cfg, matcher)
+			if err != nil {
+				return nil, fmt.Errorf("failed to instantiate backend: %w", err)
+			}
+			backends = append(backends, b)
+		}
+	}
+
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends specified")
+	}
+	return backends, nil
+}
+
+// backendSet is the set of backends requests are routed to, along with the
+// replica groups they are sharded by, if any.
+type backendSet struct {
+	backends []Backend
+	shards   *shardRouter
+}
+
+// backends returns the backends requests are currently routed to.
+func (s *Server) backends() []Backend {
+	return s.routing.Load().backends
+}
+
+// Reload replaces the backends requests are routed to with the given ones.
+// Requests in flight keep the backends they started with.
+func (s *Server) Reload(cfgs []BackendConfig) error {
+	b, err := loadBackends(cfgs, s.cascade, s.chaos)
+	if err != nil {
+		return err
+	}
+	routing := &backendSet{backends: b}
+	if config.Shard.Replicas > 0 {
+		routing.shards = newShardRouter(config.Shard.Replicas, cfgs)
+	}
+	old := s.routing.Swap(routing)
+	s.options.reset()
+	// Release idle connections held by the replaced backends' transports.
+	for _, ob := range old.backends {
+		ob.Client().CloseIdleConnections()
+	}
+
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// start runs the enabled background components until the server context is
+// done.
+func (s *Server) start() {
+	// Singleton jobs run on the elected leader only, if leader election is
+	// enabled.
+	var singletons []func(context.Context)
+	if s.subscriptions != nil {
+		singletons = append(singletons, s.subscriptions.run)
+	}
+	if s.auditor != nil {
+		singletons = append(singletons, s.auditor.run)
+	}
+	if s.leader != nil {
+		go s.leader.run(s.ctx, singletons...)
+	} else {
+		for _, job := range singletons {
+			go job(s.ctx)
+		}
+	}
+	if s.canary != nil {
+		go s.canary.run(s.ctx)
+	}
+	if s.ingest != nil {
+		go s.ingest.run(s.ctx)
+	}
+	if s.certs != nil {
+		go s.certs.run(s.ctx)
+	}
+	if config.Providers.CacheRefreshInterval > 0 {
+		go s.pcache.run(s.ctx)
+	}
+	if s.negative != nil {
+		go s.negative.run(s.ctx)
+	}
+	if s.cluster != nil {
+		go s.cluster.run(s.ctx)
+	}
+	if s.rateLimiter != nil && len(s.rateLimiter.peers) > 0 {
+		go s.rateLimiter.run(s.ctx)
+	}
+	if s.prober != nil {
+		go s.prober.run(s.ctx)
+	}
+	if s.snapshots != nil && config.Snapshot.Interval > 0 {
+		go s.snapshots.run(s.ctx)
+	}
+	if s.reputation != nil {
+		go s.reputation.run(s.ctx)
+	}
+}
+
+func (s *Server) newHandler() (http.Handler, error) {
+	mux := http.NewServeMux()
+	s.handleFinderRoutes(mux)
+	mux.HandleFunc("/health", s.health)
+	mux.HandleFunc("/watch/cid/", s.watchCid)
+	mux.HandleFunc("/watch/multihash/", s.watchMultihash)
+	if s.subscriptions != nil {
+		mux.HandleFunc("/subscriptions", s.subscriptions.handleSubscriptions)
+		mux.HandleFunc("/subscriptions/", s.subscriptions.handleSubscription)
+	}
+	if s.negative != nil {
+		mux.HandleFunc(negativeFilterPath, s.negative.serveHTTP)
+	}
+	if s.cluster != nil {
+		mux.HandleFunc(clusterStatePath, s.cluster.serveHTTP)
+	}
+	if s.rateLimiter != nil {
+		mux.HandleFunc(clusterRateLimitPath, s.rateLimiter.serveHTTP)
+	}
+	if config.Server.AdminToken != "" {
+		mux.HandleFunc(adminCachePath, adminHandler(s.purgeCache))
+		mux.HandleFunc(adminCachePath+"/", adminHandler(s.purgeCache))
+		if s.usage != nil {
+			mux.HandleFunc(adminUsagePath, adminHandler(s.usage.serveHTTP))
+		}
+		mux.HandleFunc(adminLogPath, adminHandler(serveLogLevels))
+		if s.reload != nil {
+			mux.HandleFunc(adminReloadPath, adminHandler(s.serveReload))
+		}
+		if s.reputation != nil {
+			mux.HandleFunc(adminReputationPath, adminHandler(s.reputation.serveHTTP))
+			mux.HandleFunc(adminReputationPath+"/", adminHandler(s.reputation.serveHTTP))
+		}
+	}
+
+	// Serve legacy storetheindex api/v0 finder routes by translating them to
+	// the current ones, for clients pinned to old storetheindex client libraries.
+	legacyMux := http.NewServeMux()
+	s.handleFinderRoutes(legacyMux)
+	mux.Handle(legacyFinderPrefix+"/", http.StripPrefix(legacyFinderPrefix, legacyMux))
+
+	delegated := newDelegatedTranslator(s.doFind, s.doFindStreaming, s.delegatedCache)
+	// Strip prefix URI since DelegatedTranslator uses a nested mux.
+	mux.Handle("/routing/v1/", http.StripPrefix("/routing/v1", delegated))
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Do not fall back on web-ui on unknown paths. Instead, strictly check the path and
+		// return 404 on anything but "/" and "index.html". Otherwise, paths that are supported by
+		// some backends and not others, like "/metadata" will return text/html.
+		switch r.URL.Path {
+		case "/", "/index.html":
+			if r.Method == http.MethodGet {
+				s.index.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		default:
+			// Pass through paths that are not handled by indexstar, like /ingest/*, to the
+			// fallback backend if there is one.
+			if s.fallback != nil {
+				s.fallback.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+	})
+
+	handler := s.streams.handler(s.pinningHandler(withInboundHeader(validateCascade(s.cascade, mux))))
+	if s.writes != nil {
+		handler = s.writes.handler(handler)
+	}
+	if s.mirror != nil {
+		// Mirror requests once allowed by middlewares such as policy.
+		handler = s.mirror.middleware(handler)
+	}
+	if s.inflight != nil {
+		// Only count requests in flight once allowed by middlewares such as
+		// policy and rate limits.
+		handler = s.inflight.handler(handler)
+	}
+	handler = s.middlewares.handler(handler)
+	if s.maxWait != nil {
+		handler = s.maxWait.handler(handler)
+	}
+	if s.priority != nil {
+		handler = s.priority.handler(handler)
+	}
+	if s.capturer != nil {
+		handler = s.capturer.middleware(handler)
+	}
+	if s.analytics != nil {
+		handler = s.analytics.handler(handler)
+	}
+	if s.usage != nil {
+		handler = s.usage.handler(handler)
+	}
+	limits, err := parseBodyLimits(config.Server.MaxRequestBodySizes, config.Server.MaxRequestBodySize)
+	if err != nil {
+		return nil, err
+	}
+	return withErrorResponses(withClientGone(withResponseSizes(withSurfaceMetrics(limits.handler(handler))))), nil
+}
+
+func (s *Server) handleFinderRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/cid/", func(w http.ResponseWriter, r *http.Request) { s.findCid(w, r, false) })
+	mux.HandleFunc("/encrypted/cid/", func(w http.ResponseWriter, r *http.Request) { s.findCid(w, r, true) })
+	mux.HandleFunc("/multihash/", func(w http.ResponseWriter, r *http.Request) { s.findMultihashSubtree(w, r, false) })
+	mux.HandleFunc("/encrypted/multihash/", func(w http.ResponseWriter, r *http.Request) { s.findMultihashSubtree(w, r, true) })
+	mux.HandleFunc("/metadata/", s.findMetadataSubtree)
+	mux.HandleFunc("/providers", s.providers)
+	mux.HandleFunc("/providers/", s.provider)
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.URL.Query().Has("detail") {
+		writeJsonResponse(w, http.StatusOK, []byte("ready"))
+		return
+	}
+
+	type ingestHealth struct {
+		LastAdvertisement     string `json:",omitempty"`
+		LastAdvertisementTime string `json:",omitempty"`
+		Lag                   string `json:",omitempty"`
+		SyncLag               int
+		Stale                 bool
+		CheckedAt             string
+		Error                 string `json:",omitempty"`
+	}
+	type backendHealth struct {
+		URL     string
+		Type    string
+		Circuit string `json:",omitempty"`
+		// Circuits are the circuit states of the route classes other than
+		// find, if they have circuits of their own.
+		Circuits map[string]string `json:",omitempty"`
+		Ingest   *ingestHealth     `json:",omitempty"`
+		// CertExpiry is when the TLS certificate of HTTPS backends expires,
+		// if checked.
+		CertExpiry string `json:",omitempty"`
+	}
+	backends := s.backends()
+	detail := make([]backendHealth, 0, len(backends))
+	for _, b := range backends {
+		bh := backendHealth{URL: b.URL().String(), Type: backendType(b)}
+		if b.CB() != nil {
+			bh.Circuit = string(b.CB().State())
+		}
+		for _, class := range []string{circuitMetadata, circuitProviders} {
+			if cb := b.CBFor(class); cb != nil && cb != b.CB() {
+				if bh.Circuits == nil {
+					bh.Circuits = make(map[string]string)
+				}
+				bh.Circuits[class] = string(cb.State())
+			}
+		}
+		if s.ingest != nil {
+			if st, ok := s.ingest.statusOf(b); ok {
+				bh.Ingest = &ingestHealth{
+					SyncLag:   st.SyncLag,
+					Stale:     st.Stale,
+					CheckedAt: st.CheckedAt.Format(time.RFC3339),
+					Error:     st.Error,
+				}
+				if st.LastAdvertisement.Defined() {
+					bh.Ingest.LastAdvertisement = st.LastAdvertisement.String()
+				}
+				if !st.LastAdvertisementTime.IsZero() {
+					bh.Ingest.LastAdvertisementTime = st.LastAdvertisementTime.Format(time.RFC3339)
+					bh.Ingest.Lag = st.Lag.Round(time.Second).String()
+				}
+			}
+		}
+		if s.certs != nil {
+			if expiry, ok := s.certs.expiryOf(b); ok {
+				bh.CertExpiry = expiry.Format(time.RFC3339)
+			}
+		}
+		detail = append(detail, bh)
+	}
+	var leader *bool
+	if s.leader != nil {
+		leader = new(bool)
+		*leader = s.leader.leader.Load()
+	}
+	body, err := json.Marshal(struct {
+		Backends []backendHealth
+		// Leader is whether this replica holds the leader lease, if leader
+		// election is enabled.
+		Leader *bool `json:",omitempty"`
+	}{Backends: detail, Leader: leader})
+	if err != nil {
+		log.Errorw("Failed to marshal health detail", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, body)
+}
+
+// backendType returns the configured type of the given backend.
+func backendType(b Backend) string {
+	switch b.(type) {
+	case caskadeBackend:
+		return BackendTypeCascade
+	case dhBackend:
+		return BackendTypeDH
+	case providersBackend:
+		return BackendTypeProviders
+	default:
+		return BackendTypeRegular
+	}
+}
+
+func writeJsonResponse(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	if _, err := w.Write(body); err != nil {
+		log.Errorw("cannot write response", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,49 @@
+package router_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/ipni/indexstar/router"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_RoutesToBackends(t *testing.T) {
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+
+	handler, err := router.New(router.Options{
+		Backends: []router.BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: router.BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+	subject := httptest.NewServer(handler)
+	defer subject.Close()
+
+	resp, err := http.Get(subject.URL + "/cid/" + mockbackend.SampleCids[0])
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	found, err := model.UnmarshalFindResponse(data)
+	require.NoError(t, err)
+	require.Len(t, found.MultihashResults, 1)
+	require.Len(t, found.MultihashResults[0].ProviderResults, 2)
+
+	resp, err = http.Get(subject.URL + "/routing/v1/providers/" + mockbackend.SampleCids[1])
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestNew_RequiresBackends(t *testing.T) {
+	_, err := router.New(router.Options{})
+	require.Error(t, err)
+}
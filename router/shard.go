@@ -0,0 +1,116 @@
+package router
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/ipfs/go-cid"
+)
+
+// extractShardingKey returns the multihash looked up by the find request with
+// the given URL, or the last element of its path if it cannot be parsed. CID
+// lookups are keyed by their multihash, so that they share a key with lookups
+// of the same multihash.
+func extractShardingKey(reqURL *url.URL) []byte {
+	key := path.Base(reqURL.Path)
+	if strings.Contains(reqURL.Path, "/cid/") {
+		if c, err := cid.Decode(key); err == nil {
+			return c.Hash()
+		}
+	} else if mh, err := parseMultihash(key); err == nil {
+		return mh
+	}
+	return []byte(key)
+}
+
+// shardRouter sends each find request to only a subset of the replicas in
+// each replica group, so that lookups of the same multihash consistently land
+// on the same replicas and benefit from their caches.
+//
+// Replicas are chosen by rendezvous hashing of the sharding key against each
+// replica, skipping replicas whose circuit is open. Adding or removing a
+// replica therefore only moves the keys it gains or loses, and keys move away
+// from a failing replica until it recovers. Backends that are not in any
+// replica group are always queried.
+type shardRouter struct {
+	replicas int
+	groups   map[string]string
+}
+
+func newShardRouter(replicas int, cfgs []BackendConfig) *shardRouter {
+	r := &shardRouter{
+		replicas: replicas,
+		groups:   make(map[string]string),
+	}
+	for _, cfg := range cfgs {
+		if cfg.ReplicaGroup == "" {
+			continue
+		}
+		typ := cfg.Type
+		if typ == "" {
+			typ = BackendTypeRegular
+		}
+		r.groups[typ+" "+cfg.URL] = cfg.ReplicaGroup
+	}
+	return r
+}
+
+// route returns the backends to query for the given sharding key.
+func (r *shardRouter) route(backends []Backend, key []byte) []Backend {
+	type scored struct {
+		backend Backend
+		score   uint64
+	}
+	routed := make([]Backend, 0, len(backends))
+	groups := make(map[string][]scored)
+	for _, b := range backends {
+		group, ok := r.groups[backendType(b)+" "+b.URL().String()]
+		if !ok {
+			routed = append(routed, b)
+			continue
+		}
+		if !circuitReady(b, circuitFind) {
+			continue
+		}
+		d := xxhash.New()
+		_, _ = d.Write(key)
+		_, _ = d.WriteString(b.URL().String())
+		groups[group] = append(groups[group], scored{backend: b, score: d.Sum64()})
+	}
+	for _, replicas := range groups {
+		slices.SortFunc(replicas, func(a, b scored) int {
+			switch {
+			case a.score > b.score:
+				return -1
+			case a.score < b.score:
+				return 1
+			default:
+				return 0
+			}
+		})
+		for _, s := range replicas[:min(r.replicas, len(replicas))] {
+			routed = append(routed, s.backend)
+		}
+	}
+	return routed
+}
+
+// findBackendsFor returns the backends to scatter the find request with the
+// given context and URL to.
+func (s *Server) findBackendsFor(ctx context.Context, reqURL *url.URL) []Backend {
+	// Backends are routed by the replica groups of the same set.
+	routing := s.routing.Load()
+	backends := s.backendsIn(ctx, routing.backends)
+	if routing.shards == nil {
+		return backends
+	}
+	// Pinned requests go to the backend they are pinned to regardless.
+	if _, pinned := ctx.Value(pinnedBackendKey{}).(string); pinned {
+		return backends
+	}
+	return withRecentWrite(ctx, backends, routing.shards.route(backends, extractShardingKey(reqURL)))
+}
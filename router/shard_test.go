@@ -0,0 +1,116 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractShardingKey(t *testing.T) {
+	c := cid.MustParse(mockbackend.SampleCids[0])
+	require.Equal(t, []byte(c.Hash()), extractShardingKey(&url.URL{Path: "/cid/" + c.String()}))
+	require.Equal(t, []byte(c.Hash()), extractShardingKey(&url.URL{Path: "/encrypted/multihash/" + c.Hash().B58String()}))
+	require.Equal(t, []byte("fish"), extractShardingKey(&url.URL{Path: "/multihash/fish"}))
+}
+
+func TestShardRouter_RoutesConsistentlyWithinGroups(t *testing.T) {
+	var cfgs []BackendConfig
+	var backends []Backend
+	for _, u := range []string{"http://a.invalid", "http://b.invalid", "http://c.invalid", "http://d.invalid", "http://solo.invalid"} {
+		cfg := BackendConfig{URL: u}
+		if u != "http://solo.invalid" {
+			cfg.ReplicaGroup = "abcd"
+		}
+		cfgs = append(cfgs, cfg)
+		b, err := NewBackend(u, circuitbreaker.New(), Matchers.Any, nil)
+		require.NoError(t, err)
+		backends = append(backends, b)
+	}
+	subject := newShardRouter(2, cfgs)
+
+	hosts := func(bs []Backend) []string {
+		var hs []string
+		for _, b := range bs {
+			hs = append(hs, b.URL().Host)
+		}
+		return hs
+	}
+	counts := make(map[string]int)
+	for i := range 100 {
+		key, err := multihash.Sum([]byte{byte(i)}, multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		routed := subject.route(backends, key)
+		require.Len(t, routed, 3)
+		require.Contains(t, hosts(routed), "solo.invalid")
+		require.Equal(t, routed, subject.route(backends, key))
+		for _, h := range hosts(routed) {
+			counts[h]++
+		}
+
+		// Removing a replica only moves the keys it served.
+		without := subject.route(backends[1:], key)
+		if !slices.Contains(hosts(routed), "a.invalid") {
+			require.ElementsMatch(t, hosts(routed), hosts(without))
+		}
+	}
+	for _, h := range []string{"a.invalid", "b.invalid", "c.invalid", "d.invalid"} {
+		require.Greater(t, counts[h], 20, h)
+	}
+
+	// Replicas with an open circuit are skipped.
+	backends[0].CB().SetState(circuitbreaker.StateOpen)
+	for i := range 20 {
+		key, err := multihash.Sum([]byte{byte(i)}, multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		routed := subject.route(backends, key)
+		require.Len(t, routed, 3)
+		require.NotContains(t, hosts(routed), "a.invalid")
+	}
+}
+
+func TestFind_SendsLookupsToShardReplicas(t *testing.T) {
+	defer func(old int) { config.Shard.Replicas = old }(config.Shard.Replicas)
+	config.Shard.Replicas = 1
+
+	var finds [3]atomic.Int32
+	var cfgs []BackendConfig
+	mock := mockbackend.NewWithSampleData()
+	for i := range finds {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/providers") {
+				finds[i].Add(1)
+			}
+			mock.ServeHTTP(w, r)
+		}))
+		defer backend.Close()
+		cfgs = append(cfgs, BackendConfig{URL: backend.URL, ReplicaGroup: "sample"})
+	}
+	cfgs = append(cfgs, BackendConfig{URL: cfgs[0].URL, Type: BackendTypeProviders})
+	subject, err := New(Options{Backends: cfgs})
+	require.NoError(t, err)
+
+	for range 3 {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	var total int32
+	for i := range finds {
+		n := finds[i].Load()
+		require.True(t, n == 0 || n == 3, "lookups of a multihash must land on the same replica")
+		total += n
+	}
+	require.Equal(t, int32(3), total)
+}
@@ -0,0 +1,37 @@
+package router
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignRequest(t *testing.T) {
+	secret := []byte("fish")
+	now := time.Unix(1700000000, 0)
+
+	req, err := http.NewRequest(http.MethodPost, "https://lobster.invalid/multihash?cascade=ipfs-dht", strings.NewReader("undersea"))
+	require.NoError(t, err)
+	require.NoError(t, signRequest(req, secret, now))
+
+	// The body must remain readable after signing.
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, "undersea", string(body))
+
+	require.Equal(t, "1700000000", req.Header.Get(signatureTimestampHeader))
+	got, err := hex.DecodeString(req.Header.Get(signatureHeader))
+	require.NoError(t, err)
+	want := requestSignature(secret, "1700000000", "/multihash?cascade=ipfs-dht", []byte("undersea"))
+	require.True(t, hmac.Equal(want, got))
+
+	// Signatures must differ for different secrets and paths.
+	require.False(t, hmac.Equal(want, requestSignature([]byte("crab"), "1700000000", "/multihash?cascade=ipfs-dht", []byte("undersea"))))
+	require.False(t, hmac.Equal(want, requestSignature(secret, "1700000000", "/multihash", []byte("undersea"))))
+}
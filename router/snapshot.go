@@ -0,0 +1,125 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// countersSnapshot is the snapshot of cumulative counters persisted across
+// restarts.
+type countersSnapshot struct {
+	// TakenAt is when the snapshot was taken.
+	TakenAt time.Time
+	// Usage are the retained usage buckets, if usage is accounted.
+	Usage map[int64]map[string]usageCounts `json:",omitempty"`
+	// Cache are the result cache statistics, if results are cached.
+	Cache *resultCacheStats `json:",omitempty"`
+}
+
+// snapshotter periodically snapshots cumulative counters to a JSON file, and
+// restores them from it on startup, so that routine deploys do not zero
+// long-horizon operational data. Counters are restored by adding to them, so
+// anything counted before restoring is kept.
+type snapshotter struct {
+	path  string
+	usage *usageAccounter
+	cache *resultCache
+
+	// mu serializes snapshots, which may be taken both periodically and on
+	// shutdown.
+	mu sync.Mutex
+}
+
+// newSnapshotter instantiates a snapshotter of the given counters, either of
+// which may be nil, and restores them from the snapshot at the given path if
+// any.
+func newSnapshotter(path string, usage *usageAccounter, cache *resultCache) (*snapshotter, error) {
+	s := &snapshotter{
+		path:  path,
+		usage: usage,
+		cache: cache,
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	var snap countersSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("cannot decode snapshot: %w", err)
+	}
+	if s.usage != nil && snap.Usage != nil {
+		s.usage.restore(snap.Usage)
+	}
+	if s.cache != nil && snap.Cache != nil {
+		s.cache.addStatistics(*snap.Cache)
+	}
+	log.Infow("Restored counters from snapshot", "path", path, "taken_at", snap.TakenAt)
+	return s, nil
+}
+
+// persist writes a snapshot of the counters to the snapshot file.
+func (s *snapshotter) persist() error {
+	snap := countersSnapshot{TakenAt: time.Now()}
+	if s.usage != nil {
+		snap.Usage = s.usage.snapshot()
+	}
+	if s.cache != nil {
+		stats := s.cache.statistics()
+		snap.Cache = &stats
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Write to a temporary file first and rename it, so that the snapshot is
+	// never left partially written.
+	tmp := s.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// run snapshots the counters at the configured interval, and once more when
+// the context is done.
+func (s *snapshotter) run(ctx context.Context) {
+	ticker := time.NewTicker(config.Snapshot.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.persist(); err != nil {
+				log.Warnw("Failed to snapshot counters", "err", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.persist(); err != nil {
+				log.Warnw("Failed to snapshot counters", "err", err)
+			}
+		}
+	}
+}
+
+// Snapshot snapshots the cumulative counters of the Server to the configured
+// snapshot file, if any, e.g. ahead of a restart.
+func (s *Server) Snapshot() error {
+	if s.snapshots == nil {
+		return nil
+	}
+	return s.snapshots.persist()
+}
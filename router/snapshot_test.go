@@ -0,0 +1,70 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot_RestoresCountersAcrossRestarts(t *testing.T) {
+	defer func(old time.Duration) { config.Usage.Retention = old }(config.Usage.Retention)
+	defer func(old time.Duration) { config.Cache.TTL = old }(config.Cache.TTL)
+	defer func(old string) { config.Server.AdminToken = old }(config.Server.AdminToken)
+	config.Usage.Retention = 24 * time.Hour
+	config.Cache.TTL = time.Minute
+	config.Server.AdminToken = "fish"
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	o := Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+		SnapshotPath: filepath.Join(t.TempDir(), "snapshots", "counters.json"),
+	}
+	start := func() *Server {
+		s, err := NewServer(o)
+		require.NoError(t, err)
+		return s
+	}
+	find := func(s *Server) {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		req.Header.Set("X-API-Key", "lobster")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	admin := func(s *Server, path string, v any) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer fish")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+
+	// Starting without a snapshot is not an error.
+	subject := start()
+	find(subject)
+	find(subject)
+	require.NoError(t, subject.Snapshot())
+
+	// Counters are restored on startup and keep accumulating, while cached
+	// results themselves are not.
+	subject = start()
+	find(subject)
+	var usage usageReport
+	admin(subject, adminUsagePath, &usage)
+	require.Equal(t, int64(3), usage.Clients["key:"+hashAPIKey("lobster")].Requests)
+	var stats resultCacheStats
+	admin(subject, adminCachePath, &stats)
+	require.Equal(t, resultCacheStats{Hits: 1, Misses: 2}, stats)
+}
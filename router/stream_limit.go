@@ -0,0 +1,79 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+)
+
+// streamPathPrefixes are the path prefixes of requests that may be responded
+// to with a stream.
+var streamPathPrefixes = []string{
+	"/cid/",
+	"/multihash/",
+	"/encrypted/cid/",
+	"/encrypted/multihash/",
+	"/routing/v1/providers/",
+	"/routing/v1/encrypted/providers/",
+}
+
+// streamLimiter caps the number of streaming responses open at once. Each
+// stream pins backend connections and goroutines for up to the configured
+// stream max wait, or max watch duration for watches, so that streams could
+// otherwise exhaust the server silently.
+type streamLimiter struct {
+	max  int64
+	open atomic.Int64
+}
+
+func newStreamLimiter(max int) *streamLimiter {
+	return &streamLimiter{max: int64(max)}
+}
+
+// isStreamRequest checks whether the given request is responded to with a
+// stream, i.e. is a watch or a lookup that accepts NDJSON.
+func isStreamRequest(r *http.Request) bool {
+	path := strings.TrimPrefix(r.URL.Path, legacyFinderPrefix)
+	if strings.HasPrefix(path, "/watch/") {
+		return true
+	}
+	streamable := false
+	for _, prefix := range streamPathPrefixes {
+		streamable = streamable || strings.HasPrefix(path, prefix)
+	}
+	if !streamable || isExistsRequest(r) || isCountRequest(r) {
+		return false
+	}
+	acc, err := getAccepts(r)
+	return err == nil && acc.ndjson
+}
+
+// handler rejects streaming requests to next with 503 Service Unavailable
+// while the configured max number of streams are open.
+func (l *streamLimiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isStreamRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		open := l.open.Add(1)
+		defer func() { l.record(r.Context(), l.open.Add(-1)) }()
+		if l.max > 0 && open > l.max {
+			log.Debugw("Rejected streaming request since too many streams are open", "path", r.URL.Path, "max", l.max)
+			_ = stats.RecordWithOptions(r.Context(), stats.WithMeasurements(metrics.StreamsRejected.M(1)))
+			w.Header().Set("Retry-After", "1")
+			httpError(w, "", errCodeTooManyStreams, http.StatusServiceUnavailable)
+			return
+		}
+		l.record(r.Context(), open)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *streamLimiter) record(ctx context.Context, open int64) {
+	_ = stats.RecordWithOptions(ctx, stats.WithMeasurements(metrics.OpenStreams.M(open)))
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsStreamRequest(t *testing.T) {
+	for _, test := range []struct {
+		method string
+		target string
+		accept string
+		want   bool
+	}{
+		{method: http.MethodGet, target: "/cid/fish", accept: MediaTypeNDJson, want: true},
+		{method: http.MethodGet, target: legacyFinderPrefix + "/multihash/fish", accept: MediaTypeNDJson, want: true},
+		{method: http.MethodGet, target: "/routing/v1/providers/fish", accept: MediaTypeNDJson, want: true},
+		{method: http.MethodGet, target: "/watch/cid/fish", want: true},
+		{method: http.MethodGet, target: "/cid/fish", accept: MediaTypeJson},
+		{method: http.MethodGet, target: "/cid/fish?exists=true", accept: MediaTypeNDJson},
+		{method: http.MethodHead, target: "/cid/fish", accept: MediaTypeNDJson},
+		{method: http.MethodGet, target: "/cid/fish/count", accept: MediaTypeNDJson},
+		{method: http.MethodGet, target: "/providers", accept: MediaTypeNDJson},
+	} {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		require.Equal(t, test.want, isStreamRequest(req), "%s %s", test.method, test.target)
+	}
+}
+
+func TestStreamLimiter_RejectsStreamsBeyondMax(t *testing.T) {
+	defer func(old int) { config.Server.MaxStreams = old }(config.Server.MaxStreams)
+	config.Server.MaxStreams = 1
+
+	unblock := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	mock := mockbackend.NewWithSampleData()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cid/") && r.Header.Get("Accept") == MediaTypeNDJson {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+			<-unblock
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func(accept string) int {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+mockbackend.SampleCids[0], nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	streamed := make(chan int)
+	go func() { streamed <- find(MediaTypeNDJson) }()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("stream never reached the backend")
+	}
+
+	require.Equal(t, http.StatusServiceUnavailable, find(MediaTypeNDJson))
+	require.Equal(t, http.StatusOK, find(MediaTypeJson))
+
+	close(unblock)
+	require.Equal(t, http.StatusOK, <-streamed)
+	require.Equal(t, http.StatusOK, find(MediaTypeNDJson))
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ndjsonWriter writes records to streaming NDJSON responses. Each record is
+// flushed to the client within the configured stream write timeout, so that a
+// stalled client cannot hold the handler and its backend connections until the
+// stream max wait. Write errors mean the client is stalled or gone, upon which
+// the stream must be aborted.
+type ndjsonWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newNDJsonWriter(w http.ResponseWriter) *ndjsonWriter {
+	return &ndjsonWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+// write writes the given record as a line and flushes it. Records that cannot
+// be marshalled are skipped, and only write errors are returned.
+func (nw *ndjsonWriter) write(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		log.Errorw("Failed to encode streaming record", "record", v, "err", err)
+		return nil
+	}
+	if config.Server.StreamWriteTimeout > 0 {
+		if err := nw.rc.SetWriteDeadline(time.Now().Add(config.Server.StreamWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+	if _, err := nw.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := nw.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// close lifts the write deadline once the stream is done, so that it does not
+// carry over to subsequent requests on the same connection.
+func (nw *ndjsonWriter) close() {
+	if config.Server.StreamWriteTimeout > 0 {
+		_ = nw.rc.SetWriteDeadline(time.Time{})
+	}
+}
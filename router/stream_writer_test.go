@@ -0,0 +1,75 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindNDJson_AbortsScatterOnStalledClient(t *testing.T) {
+	defer func(old time.Duration) { config.Server.StreamWriteTimeout = old }(config.Server.StreamWriteTimeout)
+	defer func(old time.Duration) { config.Server.ResultStreamMaxWait = old }(config.Server.ResultStreamMaxWait)
+	config.Server.StreamWriteTimeout = 100 * time.Millisecond
+	config.Server.ResultStreamMaxWait = time.Minute
+
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	addrs := []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}
+	// Backends stream distinct results until their request is canceled.
+	ended := make(chan struct{}, 2)
+	endless := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { ended <- struct{}{} }()
+		w.Header().Set("Content-Type", MediaTypeNDJson)
+		metadata := bytes.Repeat([]byte("fish"), 256)
+		for i := 0; r.Context().Err() == nil; i++ {
+			line, _ := json.Marshal(model.ProviderResult{
+				ContextID: []byte(strconv.Itoa(i)),
+				Metadata:  metadata,
+				Provider:  &peer.AddrInfo{ID: pid, Addrs: addrs},
+			})
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return
+			}
+		}
+	}))
+	defer endless.Close()
+	providers := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer providers.Close()
+	handler, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: endless.URL},
+			{URL: endless.URL},
+			{URL: providers.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// The client sends a lookup and never reads the response.
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.(*net.TCPConn).SetReadBuffer(4096))
+	_, err = conn.Write([]byte("GET /cid/" + mockbackend.SampleCids[0] + " HTTP/1.1\r\nHost: indexstar\r\nAccept: " + MediaTypeNDJson + "\r\n\r\n"))
+	require.NoError(t, err)
+
+	for range 2 {
+		select {
+		case <-ended:
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "backend requests were not canceled once the client stalled")
+		}
+	}
+}
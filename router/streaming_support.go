@@ -0,0 +1,58 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// streamingSupport tracks the backends that rejected streaming find requests,
+// so that they are asked for JSON responses straight away rather than having
+// every request rejected first. Streaming is tried again once the configured
+// recheck interval has passed, in case backends have since been upgraded.
+type streamingSupport struct {
+	mu sync.RWMutex
+	// rejected is when each backend last rejected a streaming request, by URL.
+	rejected map[string]time.Time
+}
+
+func newStreamingSupport() *streamingSupport {
+	return &streamingSupport{rejected: make(map[string]time.Time)}
+}
+
+// supports checks whether the given backend is to be sent streaming requests.
+// Every backend is if support is not tracked.
+func (s *streamingSupport) supports(b Backend) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	at, ok := s.rejected[b.URL().String()]
+	return !ok || time.Since(at) >= config.Server.StreamingRecheck
+}
+
+// reject tracks that the given backend rejected a streaming request.
+func (s *streamingSupport) reject(b Backend) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected[b.URL().String()] = time.Now()
+}
+
+// accept tracks that the given backend accepted a streaming request.
+func (s *streamingSupport) accept(b Backend) {
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	_, ok := s.rejected[b.URL().String()]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rejected, b.URL().String())
+}
@@ -0,0 +1,95 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindNDJson_RetriesRejectedStreamingAsJSON(t *testing.T) {
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	mh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var accepts []string
+	nonStreaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		accepts = append(accepts, r.Header.Get("Accept"))
+		mu.Unlock()
+		if r.Header.Get("Accept") == MediaTypeNDJson {
+			http.Error(w, "", http.StatusNotAcceptable)
+			return
+		}
+		// Respond unlabelled, so that the response is parsed as JSON since
+		// JSON was asked for.
+		_ = json.NewEncoder(w).Encode(model.FindResponse{MultihashResults: []model.MultihashResult{{
+			Multihash: mh,
+			ProviderResults: []model.ProviderResult{{
+				ContextID: []byte("fish"),
+				Provider:  &peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}},
+			}},
+		}}})
+	}))
+	defer nonStreaming.Close()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	providers := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer providers.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: nonStreaming.URL},
+			{URL: notFound.URL},
+			{URL: providers.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	find := func() {
+		req := httptest.NewRequest(http.MethodGet, "/multihash/"+mh.B58String(), nil)
+		req.Header.Set("Accept", MediaTypeNDJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var result model.ProviderResult
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(rec.Body.String())), &result))
+		require.Equal(t, pid, result.Provider.ID)
+	}
+
+	find()
+	require.Equal(t, []string{MediaTypeNDJson, MediaTypeJson}, accepts)
+	// Subsequent requests ask for JSON straight away.
+	find()
+	require.Equal(t, []string{MediaTypeNDJson, MediaTypeJson, MediaTypeJson}, accepts)
+}
+
+func TestStreamingSupport_Rechecks(t *testing.T) {
+	defer func(d time.Duration) { config.Server.StreamingRecheck = d }(config.Server.StreamingRecheck)
+	config.Server.StreamingRecheck = time.Hour
+
+	b, err := NewBackend("http://localhost", nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	subject := newStreamingSupport()
+
+	require.True(t, subject.supports(b))
+	subject.reject(b)
+	require.False(t, subject.supports(b))
+	subject.accept(b)
+	require.True(t, subject.supports(b))
+
+	subject.reject(b)
+	config.Server.StreamingRecheck = 0
+	require.True(t, subject.supports(b))
+}
@@ -0,0 +1,337 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const findMethodSubscription = "subscription-v0"
+
+type (
+	// subscription is a request to be notified via webhook once a multihash
+	// becomes resolvable.
+	subscription struct {
+		ID        string
+		Multihash multihash.Multihash
+		Callback  string
+		Expires   time.Time
+	}
+
+	subscriptionRequest struct {
+		Multihash string `json:",omitempty"`
+		Cid       string `json:",omitempty"`
+		Callback  string
+	}
+
+	// subscriptionNotification is the payload posted to subscription callbacks.
+	subscriptionNotification struct {
+		ID           string
+		Multihash    multihash.Multihash
+		FindResponse json.RawMessage
+	}
+
+	// subscriptions keeps track of webhook subscriptions, persisting them to a
+	// JSON file, and periodically re-checks whether subscribed multihashes have
+	// become resolvable using a bounded pool of workers.
+	subscriptions struct {
+		storePath string
+		find      findFunc
+		client    *http.Client
+
+		mu   sync.Mutex
+		subs map[string]*subscription
+	}
+)
+
+func newSubscriptions(storePath string, find findFunc) (*subscriptions, error) {
+	s := &subscriptions{
+		storePath: storePath,
+		find:      find,
+		client:    &http.Client{Timeout: config.Subscriptions.CallbackTimeout},
+		subs:      make(map[string]*subscription),
+	}
+	data, err := os.ReadFile(storePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		var subs []*subscription
+		if err := json.Unmarshal(data, &subs); err != nil {
+			return nil, fmt.Errorf("cannot load subscriptions: %w", err)
+		}
+		for _, sub := range subs {
+			s.subs[sub.ID] = sub
+		}
+	}
+	return s, nil
+}
+
+// persist writes all subscriptions to the store file. The caller must hold
+// the lock.
+func (s *subscriptions) persist() error {
+	subs := make([]*subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	data, err := json.Marshal(subs)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first and rename it, so that the store is
+	// never left partially written.
+	tmp := s.storePath + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.storePath), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.storePath)
+}
+
+func (s *subscriptions) add(sub *subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subs) >= config.Subscriptions.MaxSubscriptions {
+		return errTooManySubscriptions
+	}
+	s.subs[sub.ID] = sub
+	return s.persist()
+}
+
+func (s *subscriptions) get(id string) *subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subs[id]
+}
+
+func (s *subscriptions) remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[id]; !ok {
+		return false, nil
+	}
+	delete(s.subs, id)
+	return true, s.persist()
+}
+
+var errTooManySubscriptions = errors.New("too many subscriptions")
+
+// run periodically re-checks all subscriptions until the context is done.
+func (s *subscriptions) run(ctx context.Context) {
+	ticker := time.NewTicker(config.Subscriptions.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkAll(ctx)
+		}
+	}
+}
+
+// checkAll checks every subscription using a bounded pool of workers, and
+// waits for all checks to complete.
+func (s *subscriptions) checkAll(ctx context.Context) {
+	s.mu.Lock()
+	pending := make([]*subscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		pending = append(pending, sub)
+	}
+	s.mu.Unlock()
+
+	work := make(chan *subscription)
+	var wg sync.WaitGroup
+	for range max(config.Subscriptions.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sub := range work {
+				s.check(ctx, sub)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(work)
+	for _, sub := range pending {
+		select {
+		case <-ctx.Done():
+			return
+		case work <- sub:
+		}
+	}
+}
+
+// check looks up the multihash of the given subscription and notifies its
+// callback if found. Subscriptions are removed once notified or expired.
+// Failed notifications are retried on the next check.
+func (s *subscriptions) check(ctx context.Context, sub *subscription) {
+	log := log.With("subscription", sub.ID)
+	if time.Now().After(sub.Expires) {
+		log.Debug("Subscription expired")
+		if _, err := s.remove(sub.ID); err != nil {
+			log.Errorw("Failed to remove expired subscription", "err", err)
+		}
+		return
+	}
+
+	reqURL := &url.URL{Path: path.Join("/multihash", sub.Multihash.B58String())}
+	rcode, data := s.find(ctx, http.MethodGet, findMethodSubscription, reqURL, nil, false)
+	if rcode != http.StatusOK {
+		return
+	}
+
+	body, err := json.Marshal(subscriptionNotification{
+		ID:           sub.ID,
+		Multihash:    sub.Multihash,
+		FindResponse: data,
+	})
+	if err != nil {
+		log.Errorw("Failed to marshal subscription notification", "err", err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Callback, bytes.NewReader(body))
+	if err != nil {
+		log.Errorw("Failed to construct subscription notification", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", MediaTypeJson)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Warnw("Failed to notify subscription callback", "err", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		log.Warnw("Subscription callback was not successful", "status", resp.StatusCode)
+		return
+	}
+	if _, err := s.remove(sub.ID); err != nil {
+		log.Errorw("Failed to remove notified subscription", "err", err)
+	}
+}
+
+func (s *subscriptions) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	var sr subscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&sr); err != nil {
+		http.Error(w, "invalid subscription request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var mh multihash.Multihash
+	var err error
+	switch {
+	case sr.Multihash != "" && sr.Cid != "":
+		http.Error(w, "only one of multihash or cid may be specified", http.StatusBadRequest)
+		return
+	case sr.Multihash != "":
+		mh, err = parseMultihash(sr.Multihash)
+		if err != nil {
+			http.Error(w, "invalid multihash: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case sr.Cid != "":
+		c, err := cid.Decode(sr.Cid)
+		if err != nil {
+			http.Error(w, "invalid cid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		mh = c.Hash()
+	default:
+		http.Error(w, "multihash or cid must be specified", http.StatusBadRequest)
+		return
+	}
+
+	callback, err := url.Parse(sr.Callback)
+	if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || callback.Host == "" {
+		http.Error(w, "invalid callback URL", http.StatusBadRequest)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Errorw("Failed to generate subscription ID", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	sub := &subscription{
+		ID:        hex.EncodeToString(id),
+		Multihash: mh,
+		Callback:  callback.String(),
+		Expires:   time.Now().Add(config.Subscriptions.TTL),
+	}
+	if err := s.add(sub); err != nil {
+		if errors.Is(err, errTooManySubscriptions) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		log.Errorw("Failed to store subscription", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	outData, err := json.Marshal(sub)
+	if err != nil {
+		log.Warnw("failed marshal response", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusCreated, outData)
+}
+
+func (s *subscriptions) handleSubscription(w http.ResponseWriter, r *http.Request) {
+	id := path.Base(r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		sub := s.get(id)
+		if sub == nil {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		outData, err := json.Marshal(sub)
+		if err != nil {
+			log.Warnw("failed marshal response", "err", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		writeJsonResponse(w, http.StatusOK, outData)
+	case http.MethodDelete:
+		removed, err := s.remove(id)
+		if err != nil {
+			log.Errorw("Failed to remove subscription", "err", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodDelete)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,83 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptions_NotifiesOnceResolvable(t *testing.T) {
+	const mh = "QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH"
+	var found bool
+	find := func(_ context.Context, _, _ string, req *url.URL, _ []byte, _ bool) (int, []byte) {
+		require.Equal(t, "/multihash/"+mh, req.Path)
+		if !found {
+			return http.StatusNotFound, nil
+		}
+		return http.StatusOK, []byte(`{"MultihashResults":[]}`)
+	}
+
+	notified := make(chan subscriptionNotification, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n subscriptionNotification
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		notified <- n
+	}))
+	defer callback.Close()
+
+	storePath := filepath.Join(t.TempDir(), "subscriptions.json")
+	subject, err := newSubscriptions(storePath, find)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	body := `{"Multihash":"` + mh + `","Callback":"` + callback.URL + `"}`
+	subject.handleSubscriptions(rec, httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var sub subscription
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sub))
+	require.Equal(t, mh, sub.Multihash.B58String())
+
+	// Subscriptions must survive restarts.
+	reloaded, err := newSubscriptions(storePath, find)
+	require.NoError(t, err)
+	require.NotNil(t, reloaded.get(sub.ID))
+
+	// Nothing is notified while the multihash is not resolvable.
+	subject.checkAll(context.Background())
+	require.Len(t, notified, 0)
+	require.NotNil(t, subject.get(sub.ID))
+
+	found = true
+	subject.checkAll(context.Background())
+	got := <-notified
+	require.Equal(t, sub.ID, got.ID)
+	require.JSONEq(t, `{"MultihashResults":[]}`, string(got.FindResponse))
+	require.Nil(t, subject.get(sub.ID))
+
+	reloaded, err = newSubscriptions(storePath, find)
+	require.NoError(t, err)
+	require.Nil(t, reloaded.get(sub.ID))
+}
+
+func TestSubscriptions_RejectsInvalidRequests(t *testing.T) {
+	subject, err := newSubscriptions(filepath.Join(t.TempDir(), "subscriptions.json"), nil)
+	require.NoError(t, err)
+
+	for _, body := range []string{
+		`{"Callback":"https://fish.invalid"}`,
+		`{"Multihash":"fish","Callback":"https://fish.invalid"}`,
+		`{"Multihash":"QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH","Callback":"ftp://fish.invalid"}`,
+		`not json`,
+	} {
+		rec := httptest.NewRecorder()
+		subject.handleSubscriptions(rec, httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body)))
+		require.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// Public API surfaces that lookups are served on, by which find metrics are
+// tagged so that the migration of clients to delegated routing can be
+// tracked.
+const (
+	// surfaceNative is the IPNI find API, e.g. /cid/{cid}.
+	surfaceNative = "native"
+	// surfaceLegacy is the IPNI find API under the storetheindex
+	// /api/v0/finder prefix.
+	surfaceLegacy = "native_legacy"
+	// surfaceDelegated is the delegated routing API under /routing/v1.
+	surfaceDelegated = "delegated"
+)
+
+// nativeLookupPrefixes are the path prefixes of the lookups of the native
+// surface.
+var nativeLookupPrefixes = []string{"/cid/", "/multihash/", "/encrypted/cid/", "/encrypted/multihash/", "/metadata/", "/providers"}
+
+// surfaceOf returns the public API surface of lookups to the given path, or
+// empty if the path is not a lookup.
+func surfaceOf(p string) string {
+	if strings.HasPrefix(p, "/routing/v1/") {
+		return surfaceDelegated
+	}
+	surface := surfaceNative
+	if trimmed, ok := strings.CutPrefix(p, legacyFinderPrefix); ok {
+		p, surface = trimmed, surfaceLegacy
+	}
+	for _, prefix := range nativeLookupPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return surface
+		}
+	}
+	return ""
+}
+
+// statusClassOf returns the class of the given response status that requests
+// are counted by, telling not found lookups apart from failed ones.
+func statusClassOf(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	case status >= http.StatusBadRequest:
+		return "client_error"
+	default:
+		return "ok"
+	}
+}
+
+// withSurfaceMetrics tags the metrics recorded while handling lookups with
+// their public API surface, and records the number, latency and status of
+// lookups per surface.
+func withSurfaceMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		surface := surfaceOf(r.URL.Path)
+		if surface == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, err := tag.New(r.Context(), tag.Upsert(metrics.Surface, surface))
+		if err != nil {
+			log.Errorw("Failed to tag request with API surface", "err", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		_ = stats.RecordWithOptions(ctx,
+			stats.WithTags(tag.Insert(metrics.Status, statusClassOf(status))),
+			stats.WithMeasurements(metrics.APILatency.M(float64(time.Since(start).Milliseconds()))))
+	})
+}
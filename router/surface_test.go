@@ -0,0 +1,89 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestSurfaceOf(t *testing.T) {
+	require.Equal(t, surfaceNative, surfaceOf("/cid/fish"))
+	require.Equal(t, surfaceNative, surfaceOf("/encrypted/multihash/fish"))
+	require.Equal(t, surfaceNative, surfaceOf("/providers"))
+	require.Equal(t, surfaceLegacy, surfaceOf(legacyFinderPrefix+"/multihash/fish"))
+	require.Equal(t, surfaceDelegated, surfaceOf("/routing/v1/providers/fish"))
+	require.Empty(t, surfaceOf("/health"))
+	require.Empty(t, surfaceOf(legacyFinderPrefix+"/health"))
+}
+
+func TestFind_RecordsMetricsBySurface(t *testing.T) {
+	requestsView := &view.View{
+		Name:        "test/api/requests",
+		Measure:     metrics.APILatency,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{metrics.Surface, metrics.Status},
+	}
+	loadView := &view.View{
+		Name:        "test/find/load",
+		Measure:     metrics.FindLoad,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{metrics.Method, metrics.Surface},
+	}
+	require.NoError(t, view.Register(requestsView, loadView))
+	defer view.Unregister(requestsView, loadView)
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, p := range []string{
+		"/cid/" + mockbackend.SampleCids[0],
+		legacyFinderPrefix + "/cid/" + mockbackend.SampleCids[0],
+		"/routing/v1/providers/" + mockbackend.SampleCids[0],
+		"/cid/fish",
+		"/health",
+	} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		subject.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	countOf := func(name string, tags ...tag.Tag) int64 {
+		rows, err := view.RetrieveData(name)
+		require.NoError(t, err)
+		for _, row := range rows {
+			if slices.Equal(row.Tags, tags) {
+				return row.Data.(*view.CountData).Value
+			}
+		}
+		return 0
+	}
+	for _, surface := range []string{surfaceNative, surfaceLegacy, surfaceDelegated} {
+		require.Equal(t, int64(1), countOf(requestsView.Name,
+			tag.Tag{Key: metrics.Status, Value: "ok"},
+			tag.Tag{Key: metrics.Surface, Value: surface}), surface)
+	}
+	require.Equal(t, int64(1), countOf(requestsView.Name,
+		tag.Tag{Key: metrics.Status, Value: "client_error"},
+		tag.Tag{Key: metrics.Surface, Value: surfaceNative}))
+	require.Equal(t, int64(1), countOf(loadView.Name,
+		tag.Tag{Key: metrics.Method, Value: findMethodOrig},
+		tag.Tag{Key: metrics.Surface, Value: surfaceLegacy}))
+	require.Equal(t, int64(1), countOf(loadView.Name,
+		tag.Tag{Key: metrics.Method, Value: findMethodDelegated},
+		tag.Tag{Key: metrics.Surface, Value: surfaceDelegated}))
+}
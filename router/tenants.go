@@ -0,0 +1,198 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// TenantConfig configures a tenant: a named routing profile with its own
+// backends, cascade labels and limits, so that a single process can serve
+// several networks. Requests are addressed to a tenant by Host header or by
+// path prefix.
+type TenantConfig struct {
+	Name string
+	// Hosts are the hosts, with or without port, of requests addressed to
+	// the tenant.
+	Hosts []string `json:",omitempty"`
+	// PathPrefix addresses requests whose path starts with it to the tenant,
+	// e.g. /testnet. The prefix is stripped from the path of such requests.
+	PathPrefix string `json:",omitempty"`
+	Backends   []BackendConfig
+	// FallbackBackend is the backend that paths not handled by indexstar
+	// are proxied to. See Options.FallbackBackend.
+	FallbackBackend string `json:",omitempty"`
+	// CascadeLabels and MaxStreams override the corresponding server
+	// settings for the tenant, if set.
+	CascadeLabels string `json:",omitempty"`
+	MaxStreams    int    `json:",omitempty"`
+}
+
+// validate checks that the tenant has a name, is addressable and has
+// backends of known types, defaulting their type to regular.
+func (tc *TenantConfig) validate() error {
+	if tc.Name == "" {
+		return errors.New("tenant must have a name")
+	}
+	if len(tc.Hosts) == 0 && tc.PathPrefix == "" {
+		return fmt.Errorf("tenant %s must have hosts or a path prefix", tc.Name)
+	}
+	if tc.PathPrefix != "" && (!strings.HasPrefix(tc.PathPrefix, "/") || strings.HasSuffix(tc.PathPrefix, "/")) {
+		return fmt.Errorf("path prefix of tenant %s must start and not end with /, got %q", tc.Name, tc.PathPrefix)
+	}
+	if len(tc.Backends) == 0 {
+		return fmt.Errorf("tenant %s must have backends", tc.Name)
+	}
+	return defaultBackendTypes(tc.Backends)
+}
+
+// Tenants routes requests addressed to a tenant to the Server of the tenant,
+// and any other request to the default Server.
+type Tenants struct {
+	def     *Server
+	tenants []*tenant
+}
+
+type tenant struct {
+	TenantConfig
+	server *Server
+}
+
+// NewTenants instantiates a Server per tenant with the given options, save
+// for the settings of each tenant. Requests addressed to no tenant are routed
+// to the given default Server.
+func NewTenants(def *Server, o Options, cfgs []TenantConfig) (*Tenants, error) {
+	t := &Tenants{def: def}
+	hosts := make(map[string]string)
+	prefixes := make(map[string]string)
+	for _, tc := range cfgs {
+		if err := tc.validate(); err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(t.tenants, func(other *tenant) bool { return other.Name == tc.Name }) {
+			return nil, fmt.Errorf("duplicate tenant %s", tc.Name)
+		}
+		for _, host := range tc.Hosts {
+			if other, ok := hosts[host]; ok {
+				return nil, fmt.Errorf("host %s of tenant %s is already that of tenant %s", host, tc.Name, other)
+			}
+			hosts[host] = tc.Name
+		}
+		if other, ok := prefixes[tc.PathPrefix]; ok && tc.PathPrefix != "" {
+			return nil, fmt.Errorf("path prefix %s of tenant %s is already that of tenant %s", tc.PathPrefix, tc.Name, other)
+		}
+		prefixes[tc.PathPrefix] = tc.Name
+
+		to := o
+		to.Backends = tc.Backends
+		to.FallbackBackend = tc.FallbackBackend
+		to.CascadeLabels = tc.CascadeLabels
+		to.MaxStreams = tc.MaxStreams
+		// Each tenant snapshots its counters, stores its subscriptions and
+		// captures requests to its own files, and elects its own leader.
+		if snapshotPath := orDefault(o.SnapshotPath, config.Snapshot.Path); snapshotPath != "" {
+			to.SnapshotPath = snapshotPath + "." + tc.Name
+		}
+		if storePath := orDefault(o.SubscriptionsStorePath, config.Subscriptions.StorePath); storePath != "" {
+			to.SubscriptionsStorePath = storePath + "." + tc.Name
+		}
+		if capturePath := orDefault(o.CapturePath, config.Capture.Path); capturePath != "" {
+			to.CapturePath = capturePath + "." + tc.Name
+		}
+		if lease := orDefault(o.LeaderLease, config.Leader.Lease); lease != "" {
+			to.LeaderLease = lease + "-" + tc.Name
+		}
+		// Peers serve the state of their default Server only.
+		to.DisablePeerSync = true
+		s, err := NewServer(to)
+		if err != nil {
+			return nil, fmt.Errorf("cannot instantiate tenant %s: %w", tc.Name, err)
+		}
+		t.tenants = append(t.tenants, &tenant{TenantConfig: tc, server: s})
+		log.Infow("Serving tenant", "name", tc.Name, "hosts", tc.Hosts, "path_prefix", tc.PathPrefix)
+	}
+	return t, nil
+}
+
+func (t *Tenants) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	for _, tn := range t.tenants {
+		if slices.Contains(tn.Hosts, host) || slices.Contains(tn.Hosts, hostnameOf(host)) {
+			tn.server.ServeHTTP(w, r)
+			return
+		}
+	}
+	for _, tn := range t.tenants {
+		if tn.PathPrefix == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(r.URL.Path, tn.PathPrefix); ok && (rest == "" || rest[0] == '/') {
+			http.StripPrefix(tn.PathPrefix, tn.server).ServeHTTP(w, r)
+			return
+		}
+	}
+	t.def.ServeHTTP(w, r)
+}
+
+// Reload reloads the backends of each tenant from the given configs. Tenants
+// cannot be added, removed or addressed differently without a restart.
+func (t *Tenants) Reload(cfgs []TenantConfig) error {
+	backends, err := t.backendsOf(cfgs)
+	if err != nil {
+		return err
+	}
+	for i, tn := range t.tenants {
+		if err := tn.server.Reload(backends[i]); err != nil {
+			return fmt.Errorf("cannot reload tenant %s: %w", tn.Name, err)
+		}
+	}
+	return nil
+}
+
+// ValidateReload checks that the backends of each tenant could be reloaded
+// from the given configs, without reloading them.
+func (t *Tenants) ValidateReload(cfgs []TenantConfig) error {
+	backends, err := t.backendsOf(cfgs)
+	if err != nil {
+		return err
+	}
+	for i, tn := range t.tenants {
+		if err := ValidateBackends(backends[i]); err != nil {
+			return fmt.Errorf("cannot reload tenant %s: %w", tn.Name, err)
+		}
+	}
+	return nil
+}
+
+// backendsOf returns the backend configs of each tenant in the given configs.
+func (t *Tenants) backendsOf(cfgs []TenantConfig) ([][]BackendConfig, error) {
+	if len(cfgs) != len(t.tenants) {
+		return nil, errors.New("tenants cannot be added or removed without a restart")
+	}
+	backends := make([][]BackendConfig, len(t.tenants))
+	for i, tn := range t.tenants {
+		j := slices.IndexFunc(cfgs, func(tc TenantConfig) bool { return tc.Name == tn.Name })
+		if j < 0 {
+			return nil, fmt.Errorf("tenant %s cannot be removed without a restart", tn.Name)
+		}
+		if err := cfgs[j].validate(); err != nil {
+			return nil, err
+		}
+		backends[i] = cfgs[j].Backends
+	}
+	return backends, nil
+}
+
+// Snapshot snapshots the cumulative counters of the default Server and of
+// each tenant. See Server.Snapshot.
+func (t *Tenants) Snapshot() error {
+	errs := []error{t.def.Snapshot()}
+	for _, tn := range t.tenants {
+		if err := tn.server.Snapshot(); err != nil {
+			errs = append(errs, fmt.Errorf("cannot snapshot tenant %s: %w", tn.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
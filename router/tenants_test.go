@@ -0,0 +1,159 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenants_RouteByHostAndPathPrefix(t *testing.T) {
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	mh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	// Each backend names itself in the context ID of the record it returns.
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", MediaTypeJson)
+			_ = json.NewEncoder(w).Encode(model.FindResponse{MultihashResults: []model.MultihashResult{{
+				Multihash: mh,
+				ProviderResults: []model.ProviderResult{{
+					ContextID: []byte(name),
+					Provider:  &peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")}},
+				}},
+			}}})
+		}))
+	}
+	mainnet := backend("mainnet")
+	defer mainnet.Close()
+	testnet := backend("testnet")
+	defer testnet.Close()
+	private := backend("private")
+	defer private.Close()
+	providers := emptyProvidersBackend()
+	defer providers.Close()
+	backends := func(u string) []BackendConfig {
+		return []BackendConfig{{URL: u}, {URL: providers.URL, Type: BackendTypeProviders}}
+	}
+
+	def, err := NewServer(Options{Backends: backends(mainnet.URL)})
+	require.NoError(t, err)
+	subject, err := NewTenants(def, Options{}, []TenantConfig{
+		{Name: "testnet", Hosts: []string{"testnet.fish.invalid"}, PathPrefix: "/testnet", Backends: backends(testnet.URL)},
+		{Name: "private", PathPrefix: "/private", Backends: backends(private.URL), CascadeLabels: "ipfs-dht"},
+	})
+	require.NoError(t, err)
+
+	find := func(host, target string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Host = host
+		req.Header.Set("Accept", MediaTypeJson)
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			return rec.Code, ""
+		}
+		var resp model.FindResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return rec.Code, string(resp.MultihashResults[0].ProviderResults[0].ContextID)
+	}
+	for _, c := range []struct{ host, target, want string }{
+		{host: "fish.invalid", target: "/multihash/" + mh.B58String(), want: "mainnet"},
+		{host: "testnet.fish.invalid", target: "/multihash/" + mh.B58String(), want: "testnet"},
+		{host: "testnet.fish.invalid:8080", target: "/multihash/" + mh.B58String(), want: "testnet"},
+		{host: "fish.invalid", target: "/testnet/multihash/" + mh.B58String(), want: "testnet"},
+		{host: "fish.invalid", target: "/private/multihash/" + mh.B58String(), want: "private"},
+	} {
+		code, got := find(c.host, c.target)
+		require.Equal(t, http.StatusOK, code, c.target)
+		require.Equal(t, c.want, got, c.target)
+	}
+
+	// Cascade labels are validated per tenant.
+	code, _ := find("fish.invalid", "/private/multihash/"+mh.B58String()+"?cascade=legacy")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, got := find("fish.invalid", "/multihash/"+mh.B58String()+"?cascade=legacy")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "mainnet", got)
+}
+
+func TestTenants_PersistSubscriptionsSeparately(t *testing.T) {
+	defer func(old string) { config.Subscriptions.StorePath = old }(config.Subscriptions.StorePath)
+	storePath := filepath.Join(t.TempDir(), "subscriptions.json")
+	config.Subscriptions.StorePath = storePath
+	providers := emptyProvidersBackend()
+	defer providers.Close()
+	backends := []BackendConfig{{URL: providers.URL, Type: BackendTypeProviders}}
+
+	def, err := NewServer(Options{Backends: backends})
+	require.NoError(t, err)
+	subject, err := NewTenants(def, Options{}, []TenantConfig{
+		{Name: "testnet", PathPrefix: "/testnet", Backends: backends},
+		{Name: "private", PathPrefix: "/private", Backends: backends},
+	})
+	require.NoError(t, err)
+
+	subscribe := func(prefix string) string {
+		body := `{"Multihash":"QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH","Callback":"http://fish.invalid"}`
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, prefix+"/subscriptions", strings.NewReader(body)))
+		require.Equal(t, http.StatusCreated, rec.Code, prefix)
+		var sub subscription
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sub))
+		return sub.ID
+	}
+	ids := map[string]string{
+		storePath:              subscribe(""),
+		storePath + ".testnet": subscribe("/testnet"),
+		storePath + ".private": subscribe("/private"),
+	}
+
+	// Each tenant's subscriptions must survive restarts in its own store.
+	for path, id := range ids {
+		reloaded, err := newSubscriptions(path, nil)
+		require.NoError(t, err)
+		require.Len(t, reloaded.subs, 1, path)
+		require.NotNil(t, reloaded.get(id), path)
+	}
+}
+
+func TestNewTenants_RejectsInvalid(t *testing.T) {
+	providers := emptyProvidersBackend()
+	defer providers.Close()
+	backends := []BackendConfig{{URL: providers.URL, Type: BackendTypeProviders}}
+	for _, c := range []struct {
+		cfgs []TenantConfig
+		want string
+	}{
+		{cfgs: []TenantConfig{{Hosts: []string{"fish.invalid"}, Backends: backends}}, want: "must have a name"},
+		{cfgs: []TenantConfig{{Name: "fish", Backends: backends}}, want: "must have hosts or a path prefix"},
+		{cfgs: []TenantConfig{{Name: "fish", PathPrefix: "fish", Backends: backends}}, want: "must start and not end with /"},
+		{cfgs: []TenantConfig{{Name: "fish", PathPrefix: "/fish/", Backends: backends}}, want: "must start and not end with /"},
+		{cfgs: []TenantConfig{{Name: "fish", PathPrefix: "/fish"}}, want: "must have backends"},
+		{cfgs: []TenantConfig{{Name: "fish", PathPrefix: "/fish", Backends: []BackendConfig{{URL: "http://fish.invalid", Type: "undersea"}}}}, want: "unknown type"},
+		{cfgs: []TenantConfig{
+			{Name: "fish", PathPrefix: "/fish", Backends: backends},
+			{Name: "fish", PathPrefix: "/lobster", Backends: backends},
+		}, want: "duplicate tenant"},
+		{cfgs: []TenantConfig{
+			{Name: "fish", Hosts: []string{"fish.invalid"}, Backends: backends},
+			{Name: "lobster", Hosts: []string{"fish.invalid"}, Backends: backends},
+		}, want: "is already that of tenant fish"},
+		{cfgs: []TenantConfig{
+			{Name: "fish", PathPrefix: "/fish", Backends: backends},
+			{Name: "lobster", PathPrefix: "/fish", Backends: backends},
+		}, want: "is already that of tenant fish"},
+	} {
+		_, err := NewTenants(nil, Options{}, c.cfgs)
+		require.ErrorContains(t, err, c.want)
+	}
+}
@@ -0,0 +1,464 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/mercari/go-circuitbreaker"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// instrumentedTransport is an http.RoundTripper dedicated to a single backend
+// that records connection pool statistics of its underlying transport.
+type instrumentedTransport struct {
+	*http.Transport
+	host     string
+	dialer   *net.Dialer
+	resolver *hostResolver
+	// prefer is the address family the backend is dialed over first, if
+	// any.
+	prefer string
+	// egress is the egress allowlist enforced on dials, if any.
+	egress *egressAllowlist
+	// budget is the budget of outbound connections dials take a slot of.
+	budget *connBudget
+	secret []byte
+	open   atomic.Int64
+	inUse  atomic.Int64
+}
+
+// NewBackendClient instantiates an HTTP client with its own transport for the
+// backend with the given config, so that a misbehaving backend cannot starve
+// connections of others.
+func NewBackendClient(cfg BackendConfig) (*http.Client, error) {
+	return newBackendClient(cfg, false)
+}
+
+// newBackendClient instantiates a backend client as NewBackendClient does,
+// which injects faults toward the backend if chaos is enabled and the backend
+// is targeted.
+func newBackendClient(cfg BackendConfig, chaos bool) (*http.Client, error) {
+	var host string
+	if u, err := url.Parse(cfg.URL); err == nil {
+		host = u.Host
+	}
+	t := &instrumentedTransport{
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		host:      host,
+		dialer: &net.Dialer{
+			Timeout:   orDefault(time.Duration(cfg.DialerTimeout), config.Server.DialerTimeout),
+			KeepAlive: orDefault(time.Duration(cfg.DialerKeepAlive), config.Server.DialerKeepAlive),
+			// Also used by the dialer itself to race the address families
+			// of hosts dialed by name without a preferred family.
+			FallbackDelay: orDefault(time.Duration(cfg.DialerFallbackDelay), config.Server.DialerFallbackDelay),
+		},
+		prefer: orDefault(cfg.DialerPreferredFamily, config.Server.DialerPreferredFamily),
+		budget: outboundConns(),
+	}
+	switch t.prefer {
+	case "", addressFamilyIPv4, addressFamilyIPv6:
+	default:
+		return nil, fmt.Errorf("unsupported preferred address family %q for backend %s", t.prefer, cfg.URL)
+	}
+	var err error
+	if t.egress, err = newEgressAllowlist(config.Server.EgressAllowlist); err != nil {
+		return nil, err
+	}
+	t.egress.guard(t.dialer)
+	if cfg.SigningSecret != "" {
+		t.secret = []byte(cfg.SigningSecret)
+	}
+	t.MaxIdleConns = orDefault(cfg.MaxIdleConns, config.Server.MaxIdleConns)
+	t.MaxConnsPerHost = orDefault(cfg.MaxConnsPerHost, config.Server.MaxConnsPerHost)
+	t.MaxIdleConnsPerHost = orDefault(cfg.MaxIdleConnsPerHost, config.Server.MaxIdleConnsPerHost)
+	t.DialContext = t.dialContext
+	// Unless overridden per backend, the proxy is determined by the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	switch cfg.Proxy {
+	case "":
+	case proxyDirect:
+		t.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy for backend %s: %w", cfg.URL, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q for backend %s", proxyURL.Scheme, cfg.URL)
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+	// Caching resolved addresses is opt-in, since lookups by the cache are
+	// not traced by requests, whose DNS latency is then no longer recorded.
+	if hostname := hostnameOf(host); config.Server.DNSRefreshInterval > 0 && hostname != "" && net.ParseIP(hostname) == nil {
+		t.resolver = newHostResolver(hostname, config.Server.DNSRefreshInterval)
+	}
+
+	var rt http.RoundTripper = t
+	if chaos && chaosTargets(host) {
+		log.Warnw("Injecting faults toward backend", "backend", host)
+		rt = &chaosTransport{next: t}
+	}
+	return &http.Client{
+		Timeout:   orDefault(time.Duration(cfg.HttpClientTimeout), config.Server.HttpClientTimeout),
+		Transport: rt,
+	}, nil
+}
+
+func (t *instrumentedTransport) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := t.budget.acquire(ctx); err != nil {
+		if errors.Is(err, errOutboundConnBudget) {
+			log.Debugw("Rejected dial to backend since the outbound connection budget is exhausted", "backend", t.host)
+			t.record(metrics.OutboundConnsRejected.M(1))
+		}
+		return nil, err
+	}
+	conn, err := t.dial(t.egress.withHost(ctx, addr), network, addr)
+	if err != nil {
+		t.budget.release()
+		if errors.Is(err, errEgressDenied) {
+			log.Warnw("Refused to dial backend not on egress allowlist", "backend", t.host, "addr", addr, "err", err)
+			t.record(metrics.EgressDenied.M(1))
+		}
+		// Do not count dials abandoned because the request is no longer needed.
+		if ctx.Err() == nil {
+			t.record(metrics.BackendDialErrors.M(1))
+		}
+		return nil, err
+	}
+	_ = stats.RecordWithOptions(context.Background(),
+		stats.WithTags(tag.Insert(metrics.Backend, t.host), tag.Insert(metrics.Family, addressFamilyOf(conn.RemoteAddr()))),
+		stats.WithMeasurements(metrics.BackendDials.M(1)))
+	t.record(metrics.BackendConnsOpen.M(t.open.Add(1)))
+	t.recordIdle()
+	return &trackedConn{Conn: conn, t: t}, nil
+}
+
+// dial dials the given address, rotating among the cached addresses of the
+// backend host if DNS caching is enabled. Addresses of the preferred family
+// are dialed first, racing those of the other family after the fallback
+// delay.
+func (t *instrumentedTransport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || network != "tcp" {
+		return t.dialer.DialContext(ctx, network, addr)
+	}
+	if t.resolver == nil || host != t.resolver.host {
+		if t.prefer == "" || net.ParseIP(host) != nil {
+			return t.dialer.DialContext(ctx, network, addr)
+		}
+		// Restricting each dial to a single family leaves the dialer to
+		// resolve and race only the addresses of that family.
+		return t.dialFamilies(ctx,
+			func(ctx context.Context) (net.Conn, error) {
+				return t.dialer.DialContext(ctx, networkOf(t.prefer), addr)
+			},
+			func(ctx context.Context) (net.Conn, error) {
+				return t.dialer.DialContext(ctx, networkOf(otherAddressFamily(t.prefer)), addr)
+			})
+	}
+	ips, err := t.resolver.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks := partitionByFamily(ips, t.prefer)
+	return t.dialFamilies(ctx, t.dialSerial(host, primaries, port), t.dialSerial(host, fallbacks, port))
+}
+
+// dialSerial returns a dial of the given addresses of the given host one after
+// another until one succeeds, or nil if there are none.
+func (t *instrumentedTransport) dialSerial(host string, ips []string, port string) func(context.Context) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		var err error
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = t.dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			log.Debugw("Failed to dial backend address", "host", host, "addr", ip, "err", err)
+		}
+		return nil, err
+	}
+}
+
+// dialFamilies dials via primary, racing fallback against it once the
+// fallback delay elapses or as soon as primary fails, and returns the first
+// connection established. The connection of the dial that loses the race is
+// closed. If the fallback delay is negative, fallback is only dialed after
+// primary fails. The error of primary is returned if both fail.
+func (t *instrumentedTransport) dialFamilies(ctx context.Context, primary, fallback func(context.Context) (net.Conn, error)) (net.Conn, error) {
+	switch {
+	case primary == nil:
+		return fallback(ctx)
+	case fallback == nil:
+		return primary(ctx)
+	case t.dialer.FallbackDelay < 0:
+		conn, err := primary(ctx)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		if conn, fallbackErr := fallback(ctx); fallbackErr == nil {
+			return conn, nil
+		}
+		return nil, err
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, 2)
+	start := func(dial func(context.Context) (net.Conn, error), primary bool) {
+		go func() {
+			conn, err := dial(ctx)
+			results <- dialResult{conn: conn, err: err, primary: primary}
+		}()
+	}
+	start(primary, true)
+	delay := time.NewTimer(orDefault(t.dialer.FallbackDelay, defaultServerDialerFallbackDelay))
+	defer delay.Stop()
+
+	pending, fellBack := 1, false
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-delay.C:
+			if !fellBack {
+				fellBack = true
+				pending++
+				start(fallback, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// Close the connection of the other dial should it
+					// succeed before noticing it was cancelled.
+					go func() {
+						if res := <-results; res.conn != nil {
+							_ = res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			if !fellBack && ctx.Err() == nil {
+				fellBack = true
+				pending++
+				start(fallback, false)
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.resolver != nil {
+		// Drop idle connections when addresses change so that subsequent
+		// requests are not sent to addresses that are no longer valid.
+		t.resolver.maybeRefresh(t.CloseIdleConnections)
+	}
+
+	var dnsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.record(metrics.BackendDNSLatency.M(float64(time.Since(dnsStart).Milliseconds())))
+		},
+	}
+	req = req.Clone(httptrace.WithClientTrace(req.Context(), trace))
+	if t.secret != nil {
+		if err := signRequest(req, t.secret, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	t.record(metrics.BackendConnsInUse.M(t.inUse.Add(1)))
+	t.recordIdle()
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		t.release()
+		return nil, err
+	}
+	body := &sizedBody{ReadCloser: resp.Body, host: t.host, route: payloadRouteOf(req.URL.Path)}
+	resp.Body = &trackedBody{ReadCloser: body, release: t.release}
+	return resp, nil
+}
+
+// release marks a connection as no longer in use.
+func (t *instrumentedTransport) release() {
+	t.record(metrics.BackendConnsInUse.M(t.inUse.Add(-1)))
+	t.recordIdle()
+}
+
+func (t *instrumentedTransport) recordIdle() {
+	t.record(metrics.BackendConnsIdle.M(max(t.open.Load()-t.inUse.Load(), 0)))
+}
+
+func (t *instrumentedTransport) record(ms ...stats.Measurement) {
+	_ = stats.RecordWithOptions(context.Background(),
+		stats.WithTags(tag.Insert(metrics.Backend, t.host)),
+		stats.WithMeasurements(ms...))
+}
+
+// trackedConn decrements the open connection count of its transport, and
+// releases its slot of the outbound connection budget, on close.
+type trackedConn struct {
+	net.Conn
+	t    *instrumentedTransport
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.t.budget.release()
+		c.t.record(metrics.BackendConnsOpen.M(c.t.open.Add(-1)))
+		c.t.recordIdle()
+	})
+	return c.Conn.Close()
+}
+
+// trackedBody releases the in-use connection of its transport on close.
+type trackedBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// circuitTransport sends requests via the wrapped transport while the given
+// circuit breaker is ready, tripping it on failures and 5xx responses.
+type circuitTransport struct {
+	next http.RoundTripper
+	cb   *circuitbreaker.CircuitBreaker
+	// probed is whether the circuit is probed while half-open. See cbReady.
+	probed bool
+}
+
+func (t *circuitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cbReady(t.cb, t.probed) {
+		return nil, circuitbreaker.ErrOpen
+	}
+	resp, err := t.next.RoundTrip(req)
+	failure := err
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		failure = fmt.Errorf("status %d response from backend %s", resp.StatusCode, req.URL.Host)
+	}
+	_ = t.cb.Done(req.Context(), failure)
+	return resp, err
+}
+
+// Address families that backends may be preferred to be dialed over.
+const (
+	addressFamilyIPv4 = "ipv4"
+	addressFamilyIPv6 = "ipv6"
+)
+
+// networkOf returns the network that dials only over the given address family.
+func networkOf(family string) string {
+	if family == addressFamilyIPv6 {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
+func otherAddressFamily(family string) string {
+	if family == addressFamilyIPv6 {
+		return addressFamilyIPv4
+	}
+	return addressFamilyIPv6
+}
+
+// addressFamilyOfIP returns the address family of the given IP address.
+func addressFamilyOfIP(ip net.IP) string {
+	if ip.To4() != nil {
+		return addressFamilyIPv4
+	}
+	return addressFamilyIPv6
+}
+
+// addressFamilyOf returns the address family of the given address of a dialed
+// connection, or unknown if it is not a TCP address.
+func addressFamilyOf(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return addressFamilyOfIP(tcp.IP)
+	}
+	return "unknown"
+}
+
+// partitionByFamily partitions the given IP addresses into those of the
+// given preferred family, or of the family of the first address if none is
+// preferred, and those of the other, keeping their order.
+func partitionByFamily(ips []string, prefer string) (primaries, fallbacks []string) {
+	for _, ip := range ips {
+		family := addressFamilyIPv6
+		if parsed := net.ParseIP(ip); parsed != nil {
+			family = addressFamilyOfIP(parsed)
+		}
+		if prefer == "" {
+			prefer = family
+		}
+		if family == prefer {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// hostnameOf returns the host of the given host:port, or the given value as-is
+// if it has no port.
+func hostnameOf(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+func orDefault[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
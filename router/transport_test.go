@@ -0,0 +1,156 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBackendClient_Proxy(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://fish.invalid/multihash/lobster", nil)
+	require.NoError(t, err)
+
+	client, err := NewBackendClient(BackendConfig{URL: "https://fish.invalid", Proxy: "socks5h://127.0.0.1:9050"})
+	require.NoError(t, err)
+	proxyURL, err := client.Transport.(*instrumentedTransport).Proxy(req)
+	require.NoError(t, err)
+	require.Equal(t, "socks5h://127.0.0.1:9050", proxyURL.String())
+
+	client, err = NewBackendClient(BackendConfig{URL: "https://fish.invalid", Proxy: proxyDirect})
+	require.NoError(t, err)
+	require.Nil(t, client.Transport.(*instrumentedTransport).Proxy)
+
+	_, err = NewBackendClient(BackendConfig{URL: "https://fish.invalid", Proxy: "ftp://127.0.0.1"})
+	require.ErrorContains(t, err, "unsupported proxy scheme")
+}
+
+func TestNewBackendClient_Timeouts(t *testing.T) {
+	client, err := NewBackendClient(BackendConfig{URL: "https://fish.invalid"})
+	require.NoError(t, err)
+	require.Equal(t, config.Server.HttpClientTimeout, client.Timeout)
+	require.Equal(t, config.Server.DialerTimeout, client.Transport.(*instrumentedTransport).dialer.Timeout)
+	require.Equal(t, config.Server.DialerKeepAlive, client.Transport.(*instrumentedTransport).dialer.KeepAlive)
+
+	client, err = NewBackendClient(BackendConfig{
+		URL:               "https://fish.invalid",
+		HttpClientTimeout: Duration(2 * time.Minute),
+		DialerTimeout:     Duration(20 * time.Second),
+		DialerKeepAlive:   Duration(time.Minute),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Minute, client.Timeout)
+	require.Equal(t, 20*time.Second, client.Transport.(*instrumentedTransport).dialer.Timeout)
+	require.Equal(t, time.Minute, client.Transport.(*instrumentedTransport).dialer.KeepAlive)
+}
+
+func TestCircuitTransport_TripsOnServerErrors(t *testing.T) {
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		http.Error(w, "", http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	cb := circuitbreaker.New(circuitbreaker.WithTripFunc(circuitbreaker.NewTripFuncConsecutiveFailures(1)))
+	client := &http.Client{Transport: &circuitTransport{next: http.DefaultTransport, cb: cb}}
+
+	resp, err := client.Get(backend.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, circuitbreaker.StateOpen, cb.State())
+
+	_, err = client.Get(backend.URL)
+	require.ErrorIs(t, err, circuitbreaker.ErrOpen)
+	require.Equal(t, int32(1), requests.Load())
+}
+
+func TestNewBackendClient_DualStack(t *testing.T) {
+	client, err := NewBackendClient(BackendConfig{URL: "https://fish.invalid"})
+	require.NoError(t, err)
+	require.Equal(t, config.Server.DialerFallbackDelay, client.Transport.(*instrumentedTransport).dialer.FallbackDelay)
+	require.Equal(t, config.Server.DialerPreferredFamily, client.Transport.(*instrumentedTransport).prefer)
+
+	client, err = NewBackendClient(BackendConfig{
+		URL:                   "https://fish.invalid",
+		DialerFallbackDelay:   Duration(50 * time.Millisecond),
+		DialerPreferredFamily: addressFamilyIPv4,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 50*time.Millisecond, client.Transport.(*instrumentedTransport).dialer.FallbackDelay)
+	require.Equal(t, addressFamilyIPv4, client.Transport.(*instrumentedTransport).prefer)
+
+	_, err = NewBackendClient(BackendConfig{URL: "https://fish.invalid", DialerPreferredFamily: "ipx"})
+	require.ErrorContains(t, err, "unsupported preferred address family")
+}
+
+func TestPartitionByFamily(t *testing.T) {
+	ips := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}
+	primaries, fallbacks := partitionByFamily(ips, "")
+	require.Equal(t, []string{"2001:db8::1", "2001:db8::2"}, primaries)
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, fallbacks)
+
+	primaries, fallbacks = partitionByFamily(ips, addressFamilyIPv4)
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, primaries)
+	require.Equal(t, []string{"2001:db8::1", "2001:db8::2"}, fallbacks)
+}
+
+func TestDialFamilies_FallsBackWithoutWaitingForDialTimeout(t *testing.T) {
+	tr := &instrumentedTransport{dialer: &net.Dialer{FallbackDelay: 20 * time.Millisecond}}
+	// The primary family is broken such that its dials hang until cancelled.
+	hang := func(ctx context.Context) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	connect := func(context.Context) (net.Conn, error) {
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+	refuse := func(context.Context) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	start := time.Now()
+	conn, err := tr.dialFamilies(context.Background(), hang, connect)
+	require.NoError(t, err)
+	require.NotNil(t, conn)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	require.Less(t, time.Since(start), time.Second)
+
+	// Failed primaries fall back immediately.
+	tr.dialer.FallbackDelay = time.Hour
+	conn, err = tr.dialFamilies(context.Background(), refuse, connect)
+	require.NoError(t, err)
+	require.NotNil(t, conn)
+
+	_, err = tr.dialFamilies(context.Background(), refuse, refuse)
+	require.ErrorContains(t, err, "connection refused")
+
+	// Without fast fallback, fallbacks are dialed only once primaries fail.
+	tr.dialer.FallbackDelay = -1
+	conn, err = tr.dialFamilies(context.Background(), refuse, connect)
+	require.NoError(t, err)
+	require.NotNil(t, conn)
+}
+
+func TestInstrumentedTransport_DialsPreferredFamily(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer backend.Close()
+	_, port, err := net.SplitHostPort(backend.Listener.Addr().String())
+	require.NoError(t, err)
+
+	// The backend only listens on IPv4, so dials over IPv6 are refused.
+	client, err := NewBackendClient(BackendConfig{URL: "http://localhost:" + port, DialerPreferredFamily: addressFamilyIPv6})
+	require.NoError(t, err)
+	resp, err := client.Get("http://localhost:" + port)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
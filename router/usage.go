@@ -0,0 +1,263 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+)
+
+// usageCounts is the usage of a client within a period.
+type usageCounts struct {
+	// Requests is the number of requests made.
+	Requests int64
+	// Bytes is the number of response body bytes served.
+	Bytes int64
+	// Results is the number of provider results served, including those only
+	// counted by provider count and existence-only lookups.
+	Results int64
+}
+
+// usageReport is the response to a usage request.
+type usageReport struct {
+	// From and To bound the period that usage is reported for, rounded out to
+	// the configured bucket.
+	From time.Time
+	To   time.Time
+	// Clients is the usage by client, identified by key:<hash of API key> for
+	// requests with an API key and ip:<client IP prefix> otherwise.
+	Clients map[string]usageCounts
+}
+
+type usageRequestKey struct{}
+
+// usageRequest accumulates the usage of a request while it is handled.
+type usageRequest struct {
+	bytes   atomic.Int64
+	results atomic.Int64
+}
+
+// usageAccounter accounts the requests, bytes and results served per API key,
+// or per client IP prefix for requests without one, in buckets of wall-clock
+// time, for fair-use enforcement and billing. Usage is accounted per
+// instance.
+//
+// Results are counted as middleware, so it must be last in the chain to count
+// the results actually served.
+type usageAccounter struct {
+	BaseMiddleware
+	retention  time.Duration
+	bucket     time.Duration
+	ipv4Prefix int
+	ipv6Prefix int
+
+	mu sync.Mutex
+	// buckets are the usage by client keyed by the unix nanos of the start
+	// of their bucket.
+	buckets map[int64]map[string]usageCounts
+}
+
+func newUsageAccounter() (*usageAccounter, error) {
+	if config.Usage.Bucket <= 0 || config.Usage.Bucket > config.Usage.Retention {
+		return nil, fmt.Errorf("usage bucket must be positive and at most the retention, got %s", config.Usage.Bucket)
+	}
+	if config.Usage.IPv4Prefix < 0 || config.Usage.IPv4Prefix > 32 {
+		return nil, fmt.Errorf("usage IPv4 prefix must be within [0, 32], got %d", config.Usage.IPv4Prefix)
+	}
+	if config.Usage.IPv6Prefix < 0 || config.Usage.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("usage IPv6 prefix must be within [0, 128], got %d", config.Usage.IPv6Prefix)
+	}
+	return &usageAccounter{
+		retention:  config.Usage.Retention,
+		bucket:     config.Usage.Bucket,
+		ipv4Prefix: config.Usage.IPv4Prefix,
+		ipv6Prefix: config.Usage.IPv6Prefix,
+		buckets:    make(map[int64]map[string]usageCounts),
+	}, nil
+}
+
+// handler accounts the usage of requests to next. Requests of admins and
+// cluster peers are not accounted.
+func (u *usageAccounter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, adminPathPrefix) || strings.HasPrefix(r.URL.Path, "/cluster/") || r.URL.Path == negativeFilterPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ur := &usageRequest{}
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), usageRequestKey{}, ur)))
+		ur.bytes.Store(rw.size)
+		u.account(u.client(r), ur)
+	})
+}
+
+// AfterAggregation counts the given results towards the usage of the request.
+func (u *usageAccounter) AfterAggregation(ctx context.Context, results []model.ProviderResult) []model.ProviderResult {
+	if ur, ok := ctx.Value(usageRequestKey{}).(*usageRequest); ok {
+		ur.results.Add(int64(len(results)))
+	}
+	return results
+}
+
+// client returns the client that the usage of the given request is accounted
+// to.
+func (u *usageAccounter) client(r *http.Request) string {
+	if apiKey := requestAPIKey(r); apiKey != "" {
+		return "key:" + hashAPIKey(apiKey)
+	}
+	ip := clientIP(r)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "ip:" + ip
+	}
+	bits := u.ipv6Prefix
+	if addr.Is4() || addr.Is4In6() {
+		addr, bits = addr.Unmap(), u.ipv4Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "ip:" + addr.String()
+	}
+	return "ip:" + prefix.String()
+}
+
+func (u *usageAccounter) account(client string, ur *usageRequest) {
+	now := time.Now()
+	start := now.Truncate(u.bucket).UnixNano()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	clients, ok := u.buckets[start]
+	if !ok {
+		clients = make(map[string]usageCounts)
+		u.buckets[start] = clients
+		// Buckets past retention are evicted whenever a new one starts.
+		oldest := now.Add(-u.retention).Truncate(u.bucket).UnixNano()
+		for s := range u.buckets {
+			if s < oldest {
+				delete(u.buckets, s)
+			}
+		}
+	}
+	c := clients[client]
+	c.Requests++
+	c.Bytes += ur.bytes.Load()
+	c.Results += ur.results.Load()
+	clients[client] = c
+}
+
+// snapshot returns a copy of the retained usage buckets.
+func (u *usageAccounter) snapshot() map[int64]map[string]usageCounts {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buckets := make(map[int64]map[string]usageCounts, len(u.buckets))
+	for start, clients := range u.buckets {
+		buckets[start] = maps.Clone(clients)
+	}
+	return buckets
+}
+
+// restore adds the given usage buckets, e.g. as restored from a snapshot, to
+// the retained ones, save for buckets past retention.
+func (u *usageAccounter) restore(buckets map[int64]map[string]usageCounts) {
+	oldest := time.Now().Add(-u.retention).Truncate(u.bucket).UnixNano()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for start, clients := range buckets {
+		if start < oldest {
+			continue
+		}
+		retained, ok := u.buckets[start]
+		if !ok {
+			retained = make(map[string]usageCounts, len(clients))
+			u.buckets[start] = retained
+		}
+		for name, c := range clients {
+			total := retained[name]
+			total.Requests += c.Requests
+			total.Bytes += c.Bytes
+			total.Results += c.Results
+			retained[name] = total
+		}
+	}
+}
+
+// report sums the usage within the buckets that overlap the given period,
+// of the given client or of every client if empty.
+func (u *usageAccounter) report(from, to time.Time, client string) usageReport {
+	rep := usageReport{
+		From:    from.Truncate(u.bucket),
+		To:      to.Truncate(u.bucket),
+		Clients: make(map[string]usageCounts),
+	}
+	if rep.To.Before(to) {
+		rep.To = rep.To.Add(u.bucket)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for start, clients := range u.buckets {
+		if start < rep.From.UnixNano() || start >= rep.To.UnixNano() {
+			continue
+		}
+		for name, c := range clients {
+			if client != "" && name != client {
+				continue
+			}
+			total := rep.Clients[name]
+			total.Requests += c.Requests
+			total.Bytes += c.Bytes
+			total.Results += c.Results
+			rep.Clients[name] = total
+		}
+	}
+	return rep
+}
+
+// serveHTTP serves the usage within the period given by the from and to
+// query parameters in RFC 3339 format, which default to the configured
+// retention up to now. The client parameter restricts the usage to that of
+// one client.
+func (u *usageAccounter) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	to := time.Now()
+	if arg := query.Get("to"); arg != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, arg); err != nil {
+			http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-u.retention)
+	if arg := query.Get("from"); arg != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, arg); err != nil {
+			http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(u.report(from, to, query.Get("client")))
+	if err != nil {
+		log.Errorw("Failed to marshal usage report", "err", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, data)
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipni/indexstar/mockbackend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsage_AccountsPerClient(t *testing.T) {
+	defer func(old time.Duration) { config.Usage.Retention = old }(config.Usage.Retention)
+	defer func(old string) { config.Server.AdminToken = old }(config.Server.AdminToken)
+	config.Usage.Retention = 24 * time.Hour
+	config.Server.AdminToken = "fish"
+
+	backend := httptest.NewServer(mockbackend.NewWithSampleData())
+	defer backend.Close()
+	subject, err := New(Options{
+		Backends: []BackendConfig{
+			{URL: backend.URL},
+			{URL: backend.URL},
+			{URL: backend.URL, Type: BackendTypeProviders},
+		},
+	})
+	require.NoError(t, err)
+
+	var served int64
+	find := func(c, apiKey, remoteAddr string) {
+		req := httptest.NewRequest(http.MethodGet, "/cid/"+c, nil)
+		req.Header.Set("Accept", MediaTypeJson)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		served += int64(rec.Body.Len())
+	}
+	usage := func(query string) (int, usageReport) {
+		req := httptest.NewRequest(http.MethodGet, adminUsagePath+query, nil)
+		req.Header.Set("Authorization", "Bearer fish")
+		rec := httptest.NewRecorder()
+		subject.ServeHTTP(rec, req)
+		var got usageReport
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		}
+		return rec.Code, got
+	}
+
+	find(mockbackend.SampleCids[0], "lobster", "192.0.2.1:1234")
+	find(mockbackend.SampleCids[1], "lobster", "192.0.2.1:1234")
+	keyBytes := served
+	find(mockbackend.SampleCids[0], "", "192.0.2.1:1234")
+	find(mockbackend.SampleCids[0], "", "192.0.2.200:1234")
+	find(mockbackend.SampleCids[0], "", "[2001:db8::1]:1234")
+
+	code, got := usage("")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, map[string]usageCounts{
+		"key:" + hashAPIKey("lobster"): {Requests: 2, Bytes: keyBytes, Results: 3},
+		"ip:192.0.2.0/24":              {Requests: 2, Bytes: 2 * (served - keyBytes) / 3, Results: 4},
+		"ip:2001:db8::/48":             {Requests: 1, Bytes: (served - keyBytes) / 3, Results: 2},
+	}, got.Clients)
+
+	code, got = usage("?client=ip:2001:db8::/48")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, got.Clients, 1)
+
+	// Periods are rounded out to whole buckets.
+	code, got = usage("?to=" + time.Now().Add(-2*time.Hour).Format(time.RFC3339))
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, got.Clients)
+	require.Zero(t, got.To.Sub(got.From)%config.Usage.Bucket)
+
+	code, _ = usage("?from=yesterday")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestNewUsageAccounter_RejectsInvalidConfig(t *testing.T) {
+	defer func(old time.Duration) { config.Usage.Retention = old }(config.Usage.Retention)
+	defer func(old time.Duration) { config.Usage.Bucket = old }(config.Usage.Bucket)
+	defer func(old int) { config.Usage.IPv4Prefix = old }(config.Usage.IPv4Prefix)
+	config.Usage.Retention = time.Hour
+
+	config.Usage.Bucket = 2 * time.Hour
+	_, err := newUsageAccounter()
+	require.Error(t, err)
+
+	config.Usage.Bucket = time.Minute
+	config.Usage.IPv4Prefix = 33
+	_, err = newUsageAccounter()
+	require.Error(t, err)
+
+	config.Usage.IPv4Prefix = 16
+	_, err = newUsageAccounter()
+	require.NoError(t, err)
+}
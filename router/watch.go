@@ -0,0 +1,104 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const findMethodWatch = "watch-v0"
+
+func (s *Server) watchCid(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	c, err := cid.Decode(path.Base(r.URL.Path))
+	if err != nil {
+		httpError(w, "invalid cid: "+err.Error(), errCodeInvalidCid, http.StatusBadRequest)
+		return
+	}
+	s.watch(w, r, c.Hash())
+}
+
+func (s *Server) watchMultihash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	mh, err := parseMultihash(path.Base(r.URL.Path))
+	if err != nil {
+		httpError(w, "invalid multihash: "+err.Error(), errCodeInvalidMultihash, http.StatusBadRequest)
+		return
+	}
+	s.watch(w, r, mh)
+}
+
+// watch re-queries backends for the given multihash at the configured watch
+// interval and streams provider records to the client as NDJSON as they
+// appear. Each provider record is sent at most once. The response is closed
+// after the configured max watch duration.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request, mh multihash.Multihash) {
+	decoded, err := multihash.Decode(mh)
+	if err != nil {
+		httpError(w, "bad multihash: "+err.Error(), errCodeInvalidMultihash, http.StatusBadRequest)
+		return
+	}
+	if len(decoded.Digest) == 0 {
+		httpError(w, "bad multihash: zero-length digest", errCodeInvalidMultihash, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.Server.WatchMaxDuration)
+	defer cancel()
+
+	w.Header().Set("Content-Type", MediaTypeNDJson)
+	w.Header().Set("Connection", "Keep-Alive")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	flusher, flushable := w.(http.Flusher)
+	if flushable {
+		flusher.Flush()
+	}
+
+	// Query backends as if the multihash was looked up directly.
+	reqURL := url.URL{
+		Path:     "/multihash/" + mh.B58String(),
+		RawQuery: r.URL.RawQuery,
+	}
+	stream := newNDJsonWriter(w)
+	defer stream.close()
+	seen := newResultSet(config.Server.MaxDedupEntries)
+	ticker := time.NewTicker(config.Server.WatchInterval)
+	defer ticker.Stop()
+	for {
+		rcode, results := s.doFindStreaming(ctx, findMethodWatch, &reqURL, false)
+		if rcode == http.StatusOK {
+			for result := range results {
+				if !seen.putIfAbsent(result) {
+					continue
+				}
+				if err := stream.write(result.ProviderResult); err != nil {
+					log.Debugw("Failed to write watch result", "err", err)
+					return
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if r.Context().Err() == nil {
+				// The watch ran for its max duration.
+				setStreamStatus(w, streamStatusOK)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package router
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch_StreamsNewProvidersOnce(t *testing.T) {
+	defer func(interval, maxDuration time.Duration) {
+		config.Server.WatchInterval = interval
+		config.Server.WatchMaxDuration = maxDuration
+	}(config.Server.WatchInterval, config.Server.WatchMaxDuration)
+	config.Server.WatchInterval = 20 * time.Millisecond
+	config.Server.WatchMaxDuration = 300 * time.Millisecond
+
+	pid, err := peer.Decode("12D3KooWHf7cahZvAVB36SGaVXc7fiVDoJdRJq42zDRcN2s2512h")
+	require.NoError(t, err)
+	addr := multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")
+
+	var queries atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only start returning a provider after the first query.
+		if queries.Add(1) == 1 {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeNDJson)
+		require.NoError(t, json.NewEncoder(w).Encode(model.ProviderResult{
+			ContextID: []byte("fish"),
+			Provider:  &peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{addr}},
+		}))
+	}))
+	defer backend.Close()
+
+	b, err := NewBackend(backend.URL, nil, Matchers.Any, nil)
+	require.NoError(t, err)
+	subject := serverWith(b)
+
+	req := httptest.NewRequest(http.MethodGet, "/watch/multihash/QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH", nil)
+	rec := httptest.NewRecorder()
+	subject.watchMultihash(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, MediaTypeNDJson, rec.Header().Get("Content-Type"))
+	require.Greater(t, queries.Load(), int32(2))
+
+	var lines int
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var got model.ProviderResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &got))
+		require.Equal(t, pid, got.Provider.ID)
+		lines++
+	}
+	require.Equal(t, 1, lines)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipni/indexstar/metrics"
+	"github.com/ipni/indexstar/router"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	backendsArg          = "backends"
+	cascadeBackendsArg   = "cascadeBackends"
+	dhBackendsArg        = "dhBackends"
+	providersBackendsArg = "providersBackends"
+	fallbackBackendArg   = "fallbackBackend"
+	chaosArg             = "chaos"
+	devArg               = "dev"
+	metricsBasicAuthArg  = "metricsBasicAuth"
+	metricsAllowArg      = "metricsAllow"
+	selfCheckArg         = "selfCheck"
+	selfCheckMinArg      = "selfCheckMinBackends"
+
+	metricsOTLPEndpointArg = "metricsOTLPEndpoint"
+	metricsOTLPHeadersArg  = "metricsOTLPHeaders"
+	metricsStatsDArg       = "metricsStatsD"
+	metricsStatsDTagsArg   = "metricsStatsDTags"
+	metricsPushIntervalArg = "metricsPushInterval"
+
+	// metricsMaxRequestBodySize bounds request bodies on the metrics server,
+	// which only serves GET requests.
+	metricsMaxRequestBodySize = 8 << 10 // 8KiB
+)
+
+// server serves the indexstar router and metrics on their respective
+// listeners.
+type server struct {
+	context.Context
+	net.Listener
+	metricsListener net.Listener
+	metricsAccess   *metrics.AccessControl
+	metricsPush     metrics.PushOptions
+	cfgBase         string
+	router          *router.Server
+	// tenants routes requests addressed to tenants, if any are configured.
+	tenants *router.Tenants
+	// servers are the HTTP servers started by Serve.
+	servers []*http.Server
+
+	// reloadMu serializes reloads, which are triggered by SIGHUP, config
+	// file changes and the admin endpoint. The config as of the latest
+	// reload is kept to report what each reload changes.
+	reloadMu      sync.Mutex
+	backends      []router.BackendConfig
+	logConfig     *router.LogConfig
+	tenantConfigs []router.TenantConfig
+}
+
+func NewServer(c *cli.Context) (*server, error) {
+	metricsAccess, err := metrics.NewAccessControl(c.String(metricsBasicAuthArg), c.StringSlice(metricsAllowArg))
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics access control: %w", err)
+	}
+	metricsPush, err := metricsPushOptions(c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics push options: %w", err)
+	}
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	servers := backendConfigs(router.BackendTypeRegular, c.StringSlice(backendsArg))
+	var tenants []router.TenantConfig
+	var logConfig *router.LogConfig
+	if c.Bool(devArg) {
+		devURL, err := startDevBackend(c.Context)
+		if err != nil {
+			return nil, fmt.Errorf("could not start dev backend: %w", err)
+		}
+		servers = []router.BackendConfig{
+			{URL: devURL, Type: router.BackendTypeRegular},
+			{URL: devURL, Type: router.BackendTypeProviders},
+		}
+	} else if len(servers) == 0 {
+		if !c.IsSet("config") {
+			return nil, fmt.Errorf("no backends specified")
+		}
+		fc, err := router.LoadFile(c.String("config"))
+		if err != nil {
+			return nil, fmt.Errorf("could not load backends from config: %w", err)
+		}
+		if fc.Log != nil {
+			if err := fc.Log.Apply(); err != nil {
+				return nil, fmt.Errorf("could not configure logging: %w", err)
+			}
+		}
+		servers = fc.Backends
+		tenants = fc.Tenants
+		logConfig = fc.Log
+	}
+
+	s := &server{
+		Context:       c.Context,
+		metricsAccess: metricsAccess,
+		metricsPush:   metricsPush,
+		cfgBase:       c.String("config"),
+		logConfig:     logConfig,
+		tenantConfigs: tenants,
+	}
+
+	o := router.Options{
+		Context:               c.Context,
+		Backends:              append(servers, flagBackendConfigs(c)...),
+		FallbackBackend:       c.String(fallbackBackendArg),
+		TranslateNonStreaming: c.Bool("translateNonStreaming"),
+		HomepageURL:           c.String("homepageURL"),
+		Chaos:                 c.Bool(chaosArg),
+		Reload:                func() (router.ReloadReport, error) { return s.Reload(c) },
+		ValidateReload:        func() (router.ReloadReport, error) { return s.ValidateReload(c) },
+	}
+	s.backends = o.Backends
+	s.router, err = router.NewServer(o)
+	if err != nil {
+		return nil, err
+	}
+	if len(tenants) > 0 {
+		if s.tenants, err = router.NewTenants(s.router, o, tenants); err != nil {
+			return nil, err
+		}
+	}
+
+	// Backends are checked before binding listeners, so that a replica whose
+	// backends are unusable is never sent traffic.
+	if c.Bool(selfCheckArg) {
+		if err := selfCheck(c.Context, s.router, c.Int(selfCheckMinArg)); err != nil {
+			return nil, err
+		}
+	}
+	if s.Listener, err = listen(inherited, listenName, c.String("listen")); err != nil {
+		return nil, err
+	}
+	if s.metricsListener, err = listen(inherited, metricsListenName, c.String("metrics")); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// selfCheck probes the backends of the given router and logs which routes each
+// responded on. Unless minUsable is zero, an error is returned if fewer than
+// minUsable backends are usable.
+func selfCheck(ctx context.Context, r *router.Server, minUsable int) error {
+	results := r.SelfCheck(ctx)
+	var usable int
+	for _, res := range results {
+		if res.Usable {
+			usable++
+			log.Infow("Self-check passed", "backend", res.URL, "type", res.Type, "routes", res.Routes)
+		} else {
+			log.Warnw("Self-check failed", "backend", res.URL, "type", res.Type, "routes", res.Routes)
+		}
+	}
+	log.Infow("Self-check completed", "usable", usable, "backends", len(results))
+	if usable < minUsable {
+		return fmt.Errorf("self-check found %d usable backends, fewer than the required %d", usable, minUsable)
+	}
+	return nil
+}
+
+// metricsPushOptions returns the options of pushing metrics over OTLP or
+// StatsD as set by the given flags.
+func metricsPushOptions(c *cli.Context) (metrics.PushOptions, error) {
+	o := metrics.PushOptions{
+		OTLPEndpoint: c.String(metricsOTLPEndpointArg),
+		StatsDAddr:   c.String(metricsStatsDArg),
+		StatsDTags:   c.Bool(metricsStatsDTagsArg),
+		Interval:     c.Duration(metricsPushIntervalArg),
+	}
+	if o.OTLPEndpoint != "" {
+		if _, err := url.ParseRequestURI(o.OTLPEndpoint); err != nil {
+			return o, fmt.Errorf("invalid OTLP endpoint: %w", err)
+		}
+	}
+	for _, h := range c.StringSlice(metricsOTLPHeadersArg) {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok || k == "" {
+			return o, fmt.Errorf("OTLP header must be formatted as key=value, got %q", h)
+		}
+		if o.OTLPHeaders == nil {
+			o.OTLPHeaders = make(map[string]string)
+		}
+		o.OTLPHeaders[k] = v
+	}
+	if o.Interval < time.Second {
+		return o, fmt.Errorf("push interval must be at least 1s, got %s", o.Interval)
+	}
+	return o, nil
+}
+
+// backendConfigs instantiates configs of the given backend type for each of
+// the given URLs.
+func backendConfigs(typ string, urls []string) []router.BackendConfig {
+	cfgs := make([]router.BackendConfig, 0, len(urls))
+	for _, u := range urls {
+		cfgs = append(cfgs, router.BackendConfig{URL: u, Type: typ})
+	}
+	return cfgs
+}
+
+// flagBackendConfigs returns the configs of dh, providers and cascade backends
+// specified via CLI flags.
+func flagBackendConfigs(cctx *cli.Context) []router.BackendConfig {
+	var cfgs []router.BackendConfig
+	cfgs = append(cfgs, backendConfigs(router.BackendTypeDH, cctx.StringSlice(dhBackendsArg))...)
+	cfgs = append(cfgs, backendConfigs(router.BackendTypeProviders, cctx.StringSlice(providersBackendsArg))...)
+	cfgs = append(cfgs, backendConfigs(router.BackendTypeCascade, cctx.StringSlice(cascadeBackendsArg))...)
+	return cfgs
+}
+
+// Reload reloads the backends, tenants and logging from the config file, and
+// returns what changed.
+func (s *server) Reload(cctx *cli.Context) (router.ReloadReport, error) {
+	return s.reload(cctx, false)
+}
+
+// ValidateReload validates the config file without reloading it, and returns
+// what reloading it would change. Backends are instantiated as they would be
+// on reload, and those that would be added or reconfigured are probed, so that
+// unreachable ones are reported before any request is routed to them.
+func (s *server) ValidateReload(cctx *cli.Context) (router.ReloadReport, error) {
+	return s.reload(cctx, true)
+}
+
+func (s *server) reload(cctx *cli.Context, dryRun bool) (router.ReloadReport, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	report := router.ReloadReport{DryRun: dryRun}
+	fc, err := router.LoadFile(s.cfgBase)
+	if err != nil {
+		return report, err
+	}
+	if fc.Log != nil {
+		apply := fc.Log.Apply
+		if dryRun {
+			apply = fc.Log.Validate
+		}
+		if err := apply(); err != nil {
+			return report, err
+		}
+	}
+	if !reflect.DeepEqual(fc.Log, s.logConfig) {
+		report.Settings = append(report.Settings, "Log")
+	}
+	if !dryRun {
+		s.logConfig = fc.Log
+	}
+
+	backends := append(fc.Backends, flagBackendConfigs(cctx)...)
+	report.Backends = router.DiffBackends(s.backends, backends)
+	var probed []router.BackendConfig
+	if dryRun {
+		if err := router.ValidateBackends(backends); err != nil {
+			return report, err
+		}
+		probed = changedBackends(backends, report.Backends)
+	} else {
+		if err := s.router.Reload(backends); err != nil {
+			return report, err
+		}
+		s.backends = backends
+	}
+
+	if s.tenants != nil {
+		if dryRun {
+			err = s.tenants.ValidateReload(fc.Tenants)
+		} else {
+			err = s.tenants.Reload(fc.Tenants)
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, tc := range fc.Tenants {
+			var old []router.BackendConfig
+			if i := slices.IndexFunc(s.tenantConfigs, func(o router.TenantConfig) bool { return o.Name == tc.Name }); i >= 0 {
+				old = s.tenantConfigs[i].Backends
+			}
+			if diff := router.DiffBackends(old, tc.Backends); !diff.Empty() {
+				if report.Tenants == nil {
+					report.Tenants = make(map[string]router.BackendsDiff)
+				}
+				report.Tenants[tc.Name] = diff
+				probed = append(probed, changedBackends(tc.Backends, diff)...)
+			}
+		}
+	}
+
+	if dryRun {
+		report.Unreachable = router.ProbeBackends(s.Context, probed)
+	} else if s.tenants != nil {
+		s.tenantConfigs = fc.Tenants
+	}
+	return report, nil
+}
+
+// changedBackends returns the configs of the given backends that the given
+// diff adds or updates.
+func changedBackends(cfgs []router.BackendConfig, diff router.BackendsDiff) []router.BackendConfig {
+	var changed []router.BackendConfig
+	for _, cfg := range cfgs {
+		id := router.BackendID(cfg)
+		if slices.Contains(diff.Added, id) || slices.Contains(diff.Updated, id) {
+			changed = append(changed, cfg)
+		}
+	}
+	return changed
+}
+
+func (s *server) Serve() chan error {
+	ec := make(chan error)
+	var handler http.Handler = s.router
+	if s.tenants != nil {
+		handler = s.tenants
+	}
+	serv := &http.Server{
+		Handler: handler,
+	}
+	go func() {
+		log.Infow("finder http server listening", "listen_addr", s.Listener.Addr())
+		e := serv.Serve(s.Listener)
+		if s.Context.Err() == nil {
+			ec <- e
+		}
+	}()
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", metrics.Start(nil))
+	metricsMux.Handle("/pprof", metrics.WithProfile())
+	metricsServ := &http.Server{
+		Handler: http.MaxBytesHandler(s.metricsAccess.Handler(metricsMux), metricsMaxRequestBodySize),
+	}
+	s.servers = []*http.Server{serv, metricsServ}
+	stopPush, err := metrics.StartPush(s.metricsPush)
+	if err != nil {
+		log.Errorw("failed to start pushing metrics", "err", err)
+	} else {
+		go func() {
+			<-s.Context.Done()
+			stopPush()
+		}()
+	}
+	go func() {
+		log.Infow("metrics server listening", "listen_addr", s.metricsListener.Addr())
+		e := metricsServ.Serve(s.metricsListener)
+		if s.Context.Err() == nil {
+			ec <- e
+		}
+	}()
+
+	go func() {
+		defer close(ec)
+
+		<-s.Context.Done()
+		err := serv.Shutdown(s.Context)
+		if err != nil {
+			log.Warnw("failed shutdown", "err", err)
+			ec <- err
+		}
+	}()
+	return ec
+}
+
+// snapshot snapshots the cumulative counters of the router and of any
+// tenants, if enabled, so that they survive a restart.
+func (s *server) snapshot() {
+	var err error
+	if s.tenants != nil {
+		err = s.tenants.Snapshot()
+	} else {
+		err = s.router.Snapshot()
+	}
+	if err != nil {
+		log.Warnw("Failed to snapshot counters", "err", err)
+	}
+}
+
+// drain stops the servers started by Serve from accepting connections, and
+// waits for in-flight requests to complete until the context is done.
+func (s *server) drain(ctx context.Context) error {
+	var errs []error
+	for _, serv := range s.servers {
+		errs = append(errs, serv.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
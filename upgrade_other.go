@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyUpgrade does nothing, since upgrades are requested via SIGUSR2 which
+// is specific to unix.
+func notifyUpgrade(chan<- os.Signal) {}